@@ -3,6 +3,8 @@ package api
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -12,7 +14,7 @@ import (
 	"github.com/martini-contrib/render"
 )
 
-func createMartini(dbh *db.DBHandle) *martini.Martini {
+func createMartini(store db.Store) *martini.Martini {
 	m := martini.New()
 	m.Use(martini.Logger())
 	m.Use(
@@ -27,39 +29,122 @@ func createMartini(dbh *db.DBHandle) *martini.Martini {
 		if origin := req.Header.Get("Origin"); origin != "" {
 			w.Header().Add("Access-Control-Allow-Origin", origin)
 		}
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept, Accept-Encoding, X-CSRF-Token, Authorization, If-Match, If-None-Match, "+workspaceHeader)
+		w.Header().Add("Access-Control-Expose-Headers", "ETag")
 		w.Header().Add("Access-Control-Allow-Credentials", "true")
 	})
-	m.Map(dbh)
+	m.Use(selectSerializer)
+	m.MapTo(hookedStore{Store: store}, (*db.Store)(nil))
+	m.Action(createRouter().Handle)
 
+	return m
+}
+
+// createRouter sets up the api's routes.  Keep openAPISpec up to date with
+// any changes.
+func createRouter() martini.Router {
 	r := martini.NewRouter()
+	r.Get("/api/1/openapi.json", getOpenAPI)
+
 	r.Options("/api/1/people", send200)
-	r.Get("/api/1/people", getPeople)
-	r.Get("/api/1/people/:id", getPerson)
-	r.Post("/api/1/people", createPerson)
+	r.Get("/api/1/people", authenticate, withWorkspace, getPeople)
+	r.Get("/api/1/people/:id", authenticate, withWorkspace, getPerson)
+	r.Post("/api/1/people", authenticate, withWorkspace, createPerson)
+	r.Delete("/api/1/people/:id", authenticate, withWorkspace, deletePerson)
+	r.Options("/api/1/people/:id", send200)
 
-	r.Get("/api/1/notes", getNotes)
+	r.Get("/api/1/notes", authenticate, withWorkspace, getNotes)
 	r.Options("/api/1/notes", send200)
-	r.Post("/api/1/notes", createNote)
-	r.Delete("/api/1/notes/:id", deleteNote)
+	r.Post("/api/1/notes", authenticate, withWorkspace, createNote)
+	r.Delete("/api/1/notes/:id", authenticate, withWorkspace, deleteNote)
 	r.Options("/api/1/notes/:id", send200)
 
-	r.Get("/api/1/notes/:id", getNote)
-	r.Options("/api/1/notes/:id", send200)
-	r.Put("/api/1/notes/:id", updateNote)
+	r.Get("/api/1/notes/:id", authenticate, withWorkspace, getNote)
+	r.Put("/api/1/notes/:id", authenticate, withWorkspace, updateNote)
+	r.Patch("/api/1/notes/:id", authenticate, withWorkspace, patchNote)
+	r.Post("/api/1/notes/bulk", authenticate, withWorkspace, bulkNotes)
+	r.Options("/api/1/notes/bulk", send200)
+
+	r.Get("/api/1/people/:id/attachments", authenticate, withWorkspace, getPersonAttachments)
+	r.Post("/api/1/people/:id/attachments", authenticate, withWorkspace, uploadPersonAttachments)
+	r.Options("/api/1/people/:id/attachments", send200)
+	r.Get("/api/1/notes/:id/attachments", authenticate, withWorkspace, getNoteAttachments)
+	r.Post("/api/1/notes/:id/attachments", authenticate, withWorkspace, uploadNoteAttachments)
+	r.Options("/api/1/notes/:id/attachments", send200)
+	r.Get("/api/1/attachments/:id", authenticate, withWorkspace, getAttachment)
+	r.Delete("/api/1/attachments/:id", authenticate, withWorkspace, deleteAttachment)
+	r.Options("/api/1/attachments/:id", send200)
+	r.Get("/api/1/attachments/:id/content", authenticate, withWorkspace, getAttachmentContent)
+	r.Options("/api/1/attachments/:id/content", send200)
 
-	r.Get("/api/1/todos", getTodos)
-	r.Get("/api/1/todos/:id", getTodo)
+	r.Get("/api/1/templates", authenticate, withWorkspace, getTemplates)
+	r.Post("/api/1/templates", authenticate, withWorkspace, createTemplate)
+	r.Options("/api/1/templates", send200)
+	r.Get("/api/1/templates/:id", authenticate, withWorkspace, getTemplate)
+	r.Put("/api/1/templates/:id", authenticate, withWorkspace, updateTemplate)
+	r.Delete("/api/1/templates/:id", authenticate, withWorkspace, deleteTemplate)
+	r.Options("/api/1/templates/:id", send200)
 
-	r.Post("/api/1/todos", createTodo)
+	r.Get("/api/1/todos", authenticate, withWorkspace, getTodos)
+	r.Get("/api/1/todos/:id", authenticate, withWorkspace, getTodo)
+
+	r.Post("/api/1/todos", authenticate, withWorkspace, createTodo)
 	r.Options("/api/1/todos", send200)
-	r.Put("/api/1/todos/:id", updateTodo)
+	r.Put("/api/1/todos/:id", authenticate, withWorkspace, updateTodo)
+	r.Patch("/api/1/todos/:id", authenticate, withWorkspace, patchTodo)
 	r.Options("/api/1/todos/:id", send200)
-	r.Delete("/api/1/todos/:id", deleteTodo)
+	r.Delete("/api/1/todos/:id", authenticate, withWorkspace, deleteTodo)
+	r.Post("/api/1/todos/bulk", authenticate, withWorkspace, bulkTodos)
+	r.Options("/api/1/todos/bulk", send200)
+
+	r.Post("/api/1/import/ics", authenticate, withWorkspace, importCalendar)
+	r.Options("/api/1/import/ics", send200)
 
-	m.Action(r.Handle)
+	r.Get("/api/1/webhooks", authenticate, withWorkspace, getWebhooks)
+	r.Post("/api/1/webhooks", authenticate, withWorkspace, createWebhook)
+	r.Options("/api/1/webhooks", send200)
+	r.Delete("/api/1/webhooks/:id", authenticate, withWorkspace, deleteWebhook)
+	r.Options("/api/1/webhooks/:id", send200)
+	r.Get("/api/1/webhooks/:id/deliveries", authenticate, withWorkspace, getDeliveries)
+	r.Options("/api/1/webhooks/:id/deliveries", send200)
+
+	// The feed is read with its own token instead of the API token.
+	r.Get("/api/1/calendar.ics", getCalendarFeed)
+	r.Post("/api/1/calendar", authenticate, enableCalendar)
+	r.Delete("/api/1/calendar", authenticate, disableCalendar)
+	r.Options("/api/1/calendar", send200)
+
+	r.Get("/api/1/digest", authenticate, getDigest)
+	r.Put("/api/1/digest", authenticate, setDigest)
+	r.Options("/api/1/digest", send200)
+
+	r.Post("/api/1/inbox", authenticate, enableInbox)
+	r.Delete("/api/1/inbox", authenticate, disableInbox)
+	r.Options("/api/1/inbox", send200)
+
+	// Workspace management isn't done in a workspace.
+	r.Get("/api/1/workspaces", authenticate, getWorkspaces)
+	r.Post("/api/1/workspaces", authenticate, createWorkspace)
+	r.Options("/api/1/workspaces", send200)
+	r.Post("/api/1/workspaces/:id/members", authenticate, setMember)
+	r.Options("/api/1/workspaces/:id/members", send200)
+	r.Delete("/api/1/workspaces/:id/members/:user", authenticate, removeMember)
+	r.Options("/api/1/workspaces/:id/members/:user", send200)
+
+	return r
+}
+
+// NewHandler returns the api as an http.Handler.
+func NewHandler(store db.Store) http.Handler {
+	return createMartini(store)
+}
 
+// NewQuietHandler is NewHandler without the request log, for running the
+// api in process.
+func NewQuietHandler(store db.Store) http.Handler {
+	m := createMartini(store)
+	m.Map(log.New(ioutil.Discard, "", 0))
 	return m
 }
 
@@ -67,9 +152,10 @@ func send200() int {
 	return http.StatusOK
 }
 
-func RunWebUi(dbh *db.DBHandle) {
-	m := createMartini(dbh)
-	glog.Fatal(http.ListenAndServe(":3001", m))
+func RunWebUi(store db.Store) {
+	go newWebhookDispatcher(store).run(deliveryPollInterval)
+	go sweepBlobs(store)
+	glog.Fatal(http.ListenAndServe(":3001", NewHandler(store)))
 }
 
 func parseParamIds(str_ids []string) ([]int64, error) {
@@ -2,82 +2,107 @@ package api
 
 import (
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
 	"runtime/debug"
 	"testing"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
 
 	"github.com/codegangsta/martini"
 )
 
+// testToken is the API token of the user all test requests are made as.
+const testToken = "testtoken"
+
+// setupTest returns a handle limited to the test user's workspace.
 func setupTest(t *testing.T) (*db.DBHandle, *martini.Martini) {
 	dbh, err := db.NewMemoryDBHandle("testing", false)
 	if err != nil {
 		panic("Couldn't set up the test database")
 	}
 	m := createMartini(dbh)
-	return dbh, m
+	ws := setupTestWorkspace(t, dbh, "tester", testToken)
+	return dbh.InWorkspace(ws).(*db.DBHandle), m
+}
+
+// setupFakeTest returns a server backed by an in-memory dbtest.FakeStore loaded
+// with the same people, notes and todos as loadFixtures.  The returned store
+// is limited to the test user's workspace.
+func setupFakeTest(t *testing.T) (*dbtest.FakeStore, *martini.Martini) {
+	store := dbtest.NewFakeStore()
+	ws := setupTestWorkspace(t, store, "tester", testToken)
+	scoped := store.InWorkspace(ws).(*dbtest.FakeStore)
+	loadFixtures(t, scoped)
+	m := createMartini(store)
+	return scoped, m
+}
+
+// setupTestWorkspace creates a user with the given name and API token who
+// owns a workspace of their own.
+func setupTestWorkspace(t testing.TB, store db.Store, name string, token string) *db.Workspace {
+	u := db.User{Name: name, Token: token}
+	err := store.CreateUser(&u)
+	failOnError(t, err)
+	ws := db.Workspace{Name: name + "'s workspace"}
+	err = store.CreateWorkspace(&ws, &u)
+	failOnError(t, err)
+	return &ws
 }
 
-func failOnError(t *testing.T, err error) {
+// newTestRequest is http.NewRequest for requests made as the test user.
+func newTestRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req, nil
+}
+
+// serverTimes matches the times the server keeps, which differ from run to
+// run.
+var serverTimes = regexp.MustCompile(`"(created_at|updated_at)": "[^"]*"`)
+
+// goldenBody returns the body of response with the times the server keeps
+// blanked out, to compare with a golden response.
+func goldenBody(response *httptest.ResponseRecorder) string {
+	return serverTimes.ReplaceAllString(response.Body.String(), `"$1": ""`)
+}
+
+func failOnError(t testing.TB, err error) {
 	if err != nil {
 		fmt.Println(string(debug.Stack()))
 		t.Fatalf("Error: %s", err.Error())
 	}
 }
 
-func loadFixtures(dbh *db.DBHandle) {
-	people := map[string]db.Person{
-		"test1": db.Person{Name: "test1"},
-		"test2": db.Person{Name: "test2"},
-		"test3": db.Person{Name: "test3"},
-	}
-	notes := map[string]db.Note{
-		"test_feed1": db.Note{Text: "http://testfeed1/feed.atom"},
-		"test_feed2": db.Note{Text: "http://testfeed2/feed.atom"},
-		"test_feed3": db.Note{Text: "http://testfeed3/feed.atom"},
-	}
-	todos := map[string]db.Todo{
-		"todo1": db.Todo{
-			Subject: "test todo1",
-			Notes:   "test todo1 notes",
-		},
-		"todo2": db.Todo{
-			Subject: "test todo2",
-			Notes:   "test todo2 notes",
-		},
-		"todo3": db.Todo{
-			Subject: "test todo3",
-			Notes:   "test todo3 notes",
-		},
+// fixtureDate is the date of every note and todo loadFixtures creates.
+var fixtureDate = time.Date(2014, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+// loadFixtures creates three people, three notes about the last of them and
+// a todo for each of them.
+func loadFixtures(t testing.TB, dbh db.Store) {
+	people := []*db.Person{
+		{Name: "test1"},
+		{Name: "test2"},
+		{Name: "test3"},
 	}
-	db_people := make([]*db.Person, len(people))
-	i := 0
 	for _, p := range people {
-		err := dbh.CreatePerson(&p)
-		if err != nil {
-			glog.Fatal(err.Error())
-		}
-		db_people[i] = &p
-		i++
+		failOnError(t, dbh.CreatePerson(p))
 	}
 
-	for _, n := range notes {
-		n.Person = db_people[0]
-		err := dbh.CreateNote(&n)
-		if err != nil {
-			glog.Fatal(err.Error())
-		}
+	for _, text := range []string{"http://testfeed1/feed.atom", "http://testfeed2/feed.atom", "http://testfeed3/feed.atom"} {
+		n := &db.Note{Text: text, Date: fixtureDate, Person: people[2]}
+		failOnError(t, dbh.CreateNote(n))
 	}
 
-	i = 0
-	for _, t := range todos {
-		t.Person = db_people[i]
-		err := dbh.CreateTodo(&t)
-		if err != nil {
-			glog.Fatal(err.Error())
-		}
-		i++
+	for i, p := range people {
+		todo := &db.Todo{Text: fmt.Sprintf("test todo%d", i+1), Date: fixtureDate, Person: p}
+		failOnError(t, dbh.CreateTodo(todo))
 	}
 }
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codegangsta/martini"
+	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Files are attached to a note with POST /notes/:id/attachments, or to a
+// person directly with POST /people/:id/attachments, as the "file" fields
+// of a multipart form.  Their content type is sniffed from their content
+// rather than taken from the client, and they're downloaded from
+// /attachments/:id/content as attachments, never inline, so an uploaded
+// page can't run in the api's origin.
+//
+// Removing an attachment, or its note or person, only removes its row.  The
+// content is removed by sweepBlobs once nothing refers to it.
+const (
+	attachmentFileField = "file"
+	maxAttachmentSize   = 10 << 20
+	// Of a whole upload, which may have several files
+	maxUploadSize = 50 << 20
+	// Parts of uploads bigger than this are spooled to temporary files
+	maxUploadMemory   = 1 << 20
+	maxFilenameLength = 255
+	// How often sweepBlobs looks for orphaned content
+	blobSweepInterval = 10 * time.Minute
+	// Content is only orphaned once it's been stored this long without an
+	// attachment referring to it
+	orphanGrace = time.Hour
+)
+
+func attachmentResource(a *db.Attachment) resource {
+	rels := []relationship{toOne("person", personType, a.Person.Id)}
+	if a.Note != nil {
+		rels = append(rels, toOne("note", noteType, a.Note.Id))
+	}
+	return newResource(attachmentType, a.Id, a, rels...)
+}
+
+func attachmentResources(as []*db.Attachment) []resource {
+	rs := make([]resource, len(as))
+	for i, a := range as {
+		rs[i] = attachmentResource(a)
+	}
+	return rs
+}
+
+// sniffContentType returns the content type of data.  Office documents and
+// other formats the sniffer only knows as zip files or binary are named
+// by the extension of filename instead, unless that would make them text.
+func sniffContentType(filename string, data []byte) string {
+	sniffed := http.DetectContentType(data)
+	if sniffed != "application/octet-stream" && sniffed != "application/zip" {
+		return sniffed
+	}
+	by_ext := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if by_ext == "" || strings.HasPrefix(by_ext, "text/") || strings.Contains(by_ext, "html") ||
+		strings.Contains(by_ext, "javascript") || strings.Contains(by_ext, "xml") {
+		return sniffed
+	}
+	return by_ext
+}
+
+// cleanFilename returns the base name of an uploaded file, cut short if it's
+// too long.
+func cleanFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = strings.TrimSpace(name[strings.LastIndex(name, "/")+1:])
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if utf8.RuneCountInString(name) > maxFilenameLength {
+		name = string([]rune(name)[:maxFilenameLength])
+	}
+	if name == "" {
+		name = "attachment"
+	}
+	return name
+}
+
+// attachmentNote returns the note a is on, or nil if it's on a person.
+func attachmentNote(a *db.Attachment, store db.NoteStore) (*db.Note, error) {
+	if a.Note == nil {
+		return nil, nil
+	}
+	return store.GetNoteById(a.Note.Id)
+}
+
+// readableAttachment returns the attachment with id params["id"] and its
+// note if the policy lets the user see it.  Otherwise it writes a 404 and
+// returns nil.
+func readableAttachment(rend render.Render, params martini.Params, store db.Store, policy *Policy) (*db.Attachment, *db.Note) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, "Invalid id: "+err.Error())
+		return nil, nil
+	}
+	a, err := store.GetAttachmentById(id)
+	if err == nil {
+		var n *db.Note
+		n, err = attachmentNote(a, store)
+		if err == nil && policy.CanReadAttachment(n) {
+			return a, n
+		}
+	}
+	if err == nil || err == db.ErrNotFound {
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No Attachment with id %d found.", id))
+	} else {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return nil, nil
+}
+
+// uploadAttachments creates an attachment for each file uploaded with req
+// and writes them out.
+func uploadAttachments(w http.ResponseWriter, rend render.Render, req *http.Request, store db.Store, u *db.User, s Serializer, p *db.Person, n *db.Note) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	if err := req.ParseMultipartForm(maxUploadMemory); err != nil {
+		if strings.Contains(err.Error(), "too large") {
+			rend.JSON(http.StatusRequestEntityTooLarge, fmt.Sprintf("Uploads can't be bigger than %d bytes", maxUploadSize))
+		} else {
+			rend.JSON(http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	defer req.MultipartForm.RemoveAll()
+	files := req.MultipartForm.File[attachmentFileField]
+	if len(files) == 0 {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("No %s given", attachmentFileField))
+		return
+	}
+	for _, fh := range files {
+		if fh.Size > maxAttachmentSize {
+			rend.JSON(http.StatusRequestEntityTooLarge, fmt.Sprintf("%s is bigger than %d bytes", fh.Filename, maxAttachmentSize))
+			return
+		}
+	}
+
+	created := []*db.Attachment{}
+	err := store.InTx(func(tx db.Store) error {
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			filename := cleanFilename(fh.Filename)
+			a := &db.Attachment{
+				Person:      p,
+				Note:        n,
+				Uploader:    u,
+				Filename:    filename,
+				ContentType: sniffContentType(filename, data),
+			}
+			if err := tx.CreateAttachment(a, data); err != nil {
+				return err
+			}
+			created = append(created, a)
+		}
+		return nil
+	})
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.Many(attachmentType, attachmentResources(created), nil))
+}
+
+// attachmentPerson returns the person with id params["id"], or writes a
+// 404 and returns nil.
+func attachmentPerson(rend render.Render, params martini.Params, store db.PeopleStore) *db.Person {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, "Invalid id: "+err.Error())
+		return nil
+	}
+	p, err := store.GetPersonById(id)
+	if err == db.ErrNotFound {
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No Person with id %d found.", id))
+		return nil
+	}
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	return p
+}
+
+// getPersonAttachments lists the attachments on a person and on the notes
+// about them that the user can read.  Like other listings it leaves out
+// confidential notes' unless asked for them.
+func getPersonAttachments(rend render.Render, req *http.Request, params martini.Params, store db.Store, policy *Policy, s Serializer) {
+	if err := req.ParseForm(); err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	p := attachmentPerson(rend, params, store)
+	if p == nil {
+		return
+	}
+	as, err := store.GetAttachments(p)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var note_ids []int64
+	for _, a := range as {
+		if a.Note != nil {
+			note_ids = append(note_ids, a.Note.Id)
+		}
+	}
+	listed := map[int64]bool{}
+	if len(note_ids) > 0 {
+		notes, err := store.GetNotesById(note_ids)
+		if err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, n := range policy.FilterListed(notes, includeConfidential(req)) {
+			listed[n.Id] = true
+		}
+	}
+	visible := []*db.Attachment{}
+	for _, a := range as {
+		if a.Note == nil || listed[a.Note.Id] {
+			visible = append(visible, a)
+		}
+	}
+	rend.JSON(http.StatusOK, s.Many(attachmentType, attachmentResources(visible), nil))
+}
+
+func uploadPersonAttachments(w http.ResponseWriter, rend render.Render, req *http.Request, params martini.Params, store db.Store, u *db.User, policy *Policy, s Serializer) {
+	p := attachmentPerson(rend, params, store)
+	if p == nil {
+		return
+	}
+	if !policy.CanWriteAttachment(nil) {
+		rend.JSON(http.StatusForbidden, "Viewers can't attach files")
+		return
+	}
+	uploadAttachments(w, rend, req, store, u, s, p, nil)
+}
+
+// getNoteAttachments lists the attachments on a note.  Like other listings
+// it leaves out a confidential note's unless asked for them.
+func getNoteAttachments(rend render.Render, req *http.Request, params martini.Params, store db.Store, policy *Policy, s Serializer) {
+	if err := req.ParseForm(); err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, "Invalid id: "+err.Error())
+		return
+	}
+	n := readableNote(rend, id, store, policy)
+	if n == nil {
+		return
+	}
+	if len(policy.FilterListed([]*db.Note{n}, includeConfidential(req))) == 0 {
+		rend.JSON(http.StatusOK, s.Many(attachmentType, []resource{}, nil))
+		return
+	}
+	as, err := store.GetNoteAttachments(n)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.Many(attachmentType, attachmentResources(as), nil))
+}
+
+func uploadNoteAttachments(w http.ResponseWriter, rend render.Render, req *http.Request, params martini.Params, store db.Store, u *db.User, policy *Policy, s Serializer) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, "Invalid id: "+err.Error())
+		return
+	}
+	n := readableNote(rend, id, store, policy)
+	if n == nil {
+		return
+	}
+	if !policy.CanWriteAttachment(n) {
+		rend.JSON(http.StatusForbidden, "Only the author can attach files to a note")
+		return
+	}
+	uploadAttachments(w, rend, req, store, u, s, n.Person, n)
+}
+
+func getAttachment(rend render.Render, params martini.Params, store db.Store, policy *Policy, s Serializer) {
+	a, _ := readableAttachment(rend, params, store, policy)
+	if a == nil {
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(attachmentResource(a), nil))
+}
+
+// getAttachmentContent sends the attachment's content as a download.
+func getAttachmentContent(w http.ResponseWriter, rend render.Render, params martini.Params, store db.Store, policy *Policy) {
+	a, _ := readableAttachment(rend, params, store, policy)
+	if a == nil {
+		return
+	}
+	data, err := store.GetAttachmentData(a)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func deleteAttachment(rend render.Render, params martini.Params, store db.Store, policy *Policy) {
+	a, n := readableAttachment(rend, params, store, policy)
+	if a == nil {
+		return
+	}
+	if !policy.CanWriteAttachment(n) {
+		rend.JSON(http.StatusForbidden, "Only the note's author can remove its attachments")
+		return
+	}
+	if err := store.RemoveAttachment(a); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
+
+// sweepBlobs removes the content of removed attachments, forever.
+func sweepBlobs(store db.Store) {
+	for {
+		removed, err := store.RemoveOrphanedBlobs(time.Now().Add(-orphanGrace))
+		if err != nil {
+			glog.Errorf("Error removing orphaned attachment content: %s", err)
+		} else if removed > 0 {
+			glog.Infof("Removed the content of %d removed attachments", removed)
+		}
+		time.Sleep(blobSweepInterval)
+	}
+}
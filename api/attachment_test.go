@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+type upload struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// multipartBody returns a form with files as its "file" fields, and its
+// content type.
+func multipartBody(t *testing.T, files ...upload) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, f := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, f.filename))
+		h.Set("Content-Type", f.contentType)
+		part, err := w.CreatePart(h)
+		failOnError(t, err)
+		part.Write(f.data)
+	}
+	failOnError(t, w.Close())
+	return body, w.FormDataContentType()
+}
+
+type attachmentsDoc struct {
+	Attachments []struct {
+		Id          int64  `json:"id"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		Note        *int64 `json:"note"`
+	} `json:"attachments"`
+}
+
+func TestAttachments(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			tester, err := store.GetUserByName("tester")
+			failOnError(t, err)
+			for _, u := range []struct{ name, role string }{{"editor", db.RoleEditor}, {"viewer", db.RoleViewer}} {
+				user := &db.User{Name: u.name, Token: u.name + "-token"}
+				failOnError(t, store.CreateUser(user))
+				failOnError(t, store.SetMember(ws, user, u.role))
+			}
+			scoped := store.InWorkspace(ws)
+			bob := &db.Person{Name: "Bob"}
+			failOnError(t, scoped.CreatePerson(bob))
+			note := &db.Note{Person: bob, Author: tester, Text: "Offer"}
+			private := &db.Note{Person: bob, Author: tester, Text: "Mine", Visibility: db.VisibilityPrivate}
+			failOnError(t, scoped.CreateNote(note))
+			failOnError(t, scoped.CreateNote(private))
+			m := createMartini(store)
+			note_url := fmt.Sprintf("/api/1/notes/%d/attachments", note.Id)
+			person_url := fmt.Sprintf("/api/1/people/%d/attachments", bob.Id)
+
+			pdf := []byte("%PDF-1.4\nan offer")
+			body, content_type := multipartBody(t,
+				upload{"C:\\Users\\me\\offer.pdf", "text/html", pdf},
+				upload{"notes.txt", "application/octet-stream", []byte("hello")})
+			response := serveAs(m, testToken, "POST", note_url, body, "Content-Type", content_type)
+			doc := attachmentsDoc{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+			if response.Code != http.StatusOK || len(doc.Attachments) != 2 {
+				t.Fatalf("Expected 2 attachments, got %d: %s", response.Code, response.Body)
+			}
+			offer := doc.Attachments[0]
+			if offer.Filename != "offer.pdf" || offer.ContentType != "application/pdf" || offer.Size != int64(len(pdf)) ||
+				offer.Note == nil || *offer.Note != note.Id {
+				t.Errorf("Expected the pdf with a sniffed content type, got %+v", offer)
+			}
+			if doc.Attachments[1].ContentType != "text/plain; charset=utf-8" {
+				t.Errorf("Expected text to be sniffed, got %+v", doc.Attachments[1])
+			}
+
+			body, content_type = multipartBody(t, upload{"big.bin", "", make([]byte, maxAttachmentSize+1)})
+			if response := serveAs(m, testToken, "POST", person_url, body, "Content-Type", content_type); response.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected 413 for a file that's too big, got %d", response.Code)
+			}
+			body, content_type = multipartBody(t, upload{"x.txt", "", []byte("x")})
+			if response := serveAs(m, "editor-token", "POST", note_url, body, "Content-Type", content_type); response.Code != http.StatusForbidden {
+				t.Errorf("Expected only the author to attach files to a note, got %d", response.Code)
+			}
+			body, content_type = multipartBody(t, upload{"photo.png", "", []byte("\x89PNG\r\n\x1a\n")})
+			if response := serveAs(m, "editor-token", "POST", person_url, body, "Content-Type", content_type); response.Code != http.StatusOK {
+				t.Errorf("Expected editors to attach files to people, got %d: %s", response.Code, response.Body)
+			}
+			body, content_type = multipartBody(t, upload{"secret.txt", "", []byte("secret")})
+			response = serveAs(m, testToken, "POST", fmt.Sprintf("/api/1/notes/%d/attachments", private.Id), body, "Content-Type", content_type)
+			secret := attachmentsDoc{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &secret))
+
+			response = serveAs(m, "editor-token", "GET", person_url, nil)
+			doc = attachmentsDoc{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+			if response.Code != http.StatusOK || len(doc.Attachments) != 3 {
+				t.Errorf("Expected the person's and readable notes' attachments, got %d: %s", response.Code, response.Body)
+			}
+			if response := serveAs(m, "editor-token", "GET", fmt.Sprintf("/api/1/attachments/%d/content", secret.Attachments[0].Id), nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected private notes' attachments to be hidden, got %d", response.Code)
+			}
+
+			content_url := fmt.Sprintf("/api/1/attachments/%d/content", offer.Id)
+			response = serveAs(m, "viewer-token", "GET", content_url, nil)
+			if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), pdf) ||
+				response.Header().Get("Content-Type") != "application/pdf" ||
+				response.Header().Get("Content-Disposition") != `attachment; filename=offer.pdf` ||
+				response.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("Expected the pdf as a download, got %d %v: %q", response.Code, response.Header(), response.Body)
+			}
+			if response := serveAs(m, "viewer-token", "DELETE", fmt.Sprintf("/api/1/attachments/%d", offer.Id), nil); response.Code != http.StatusForbidden {
+				t.Errorf("Expected viewers not to remove attachments, got %d", response.Code)
+			}
+
+			// Confidential notes' attachments can't be redacted, so they're
+			// only seen by those who can list the note.
+			confidential := &db.Note{Person: bob, Author: tester, Text: "Salary", Confidential: true}
+			failOnError(t, scoped.CreateNote(confidential))
+			confidential_url := fmt.Sprintf("/api/1/notes/%d/attachments", confidential.Id)
+			body, content_type = multipartBody(t, upload{"salary.txt", "", []byte("salary")})
+			response = serveAs(m, testToken, "POST", confidential_url, body, "Content-Type", content_type)
+			salary := attachmentsDoc{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &salary))
+			if response.Code != http.StatusOK || len(salary.Attachments) != 1 {
+				t.Fatalf("Expected the confidential note's attachment, got %d: %s", response.Code, response.Body)
+			}
+			salary_url := fmt.Sprintf("/api/1/attachments/%d/content", salary.Attachments[0].Id)
+			if response := serveAs(m, "editor-token", "GET", salary_url, nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected confidential notes' attachments to be hidden, got %d", response.Code)
+			}
+			if response := serveAs(m, testToken, "GET", salary_url, nil); response.Code != http.StatusOK {
+				t.Errorf("Expected the author to see a confidential note's attachment, got %d", response.Code)
+			}
+			listings := []struct {
+				token, url string
+				expected   int
+			}{
+				{"editor-token", confidential_url + "?include_confidential=true", 0},
+				{"editor-token", person_url + "?include_confidential=true", 3},
+				{testToken, confidential_url, 0},
+				{testToken, confidential_url + "?include_confidential=true", 1},
+				{testToken, person_url, 4},
+				{testToken, person_url + "?include_confidential=true", 5},
+			}
+			for _, l := range listings {
+				response := serveAs(m, l.token, "GET", l.url, nil)
+				doc := attachmentsDoc{}
+				failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+				if response.Code != http.StatusOK || len(doc.Attachments) != l.expected {
+					t.Errorf("Expected %d attachments listed at %s for %s, got %d: %s", l.expected, l.url, l.token, response.Code, response.Body)
+				}
+			}
+
+			// Moving a note to someone else moves its attachments too.
+			alice := &db.Person{Name: "Alice"}
+			failOnError(t, scoped.CreatePerson(alice))
+			alice_url := fmt.Sprintf("/api/1/people/%d/attachments", alice.Id)
+			patch := fmt.Sprintf(`{"person": %d}`, alice.Id)
+			if response := serveAs(m, testToken, "PATCH", fmt.Sprintf("/api/1/notes/%d", private.Id), strings.NewReader(patch)); response.Code != http.StatusOK {
+				t.Fatalf("Expected the private note to be moved, got %d: %s", response.Code, response.Body)
+			}
+			code, statuses := serveBulk(t, m, "/api/1/notes/bulk", fmt.Sprintf(`{"op": "patch", "id": %d, "body": %s}`, note.Id, patch))
+			if code != http.StatusOK || fmt.Sprint(statuses) != "[200]" {
+				t.Fatalf("Expected the note to be moved in bulk, got %d %v", code, statuses)
+			}
+			for url, expected := range map[string]int{alice_url: 3, person_url: 1} {
+				response := serveAs(m, testToken, "GET", url, nil)
+				doc := attachmentsDoc{}
+				failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+				if len(doc.Attachments) != expected {
+					t.Errorf("Expected %d attachments listed at %s after moving the notes, got %s", expected, url, response.Body)
+				}
+			}
+
+			// Removing the note orphans its attachments' content.
+			if response := serveAs(m, testToken, "DELETE", fmt.Sprintf("/api/1/notes/%d", note.Id), nil); response.Code != http.StatusNoContent {
+				t.Fatalf("Expected the note to be removed, got %d", response.Code)
+			}
+			if response := serveAs(m, testToken, "GET", content_url, nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected the note's attachments to go with it, got %d", response.Code)
+			}
+			if removed, err := store.RemoveOrphanedBlobs(time.Now().Add(time.Second)); err != nil || removed != 2 {
+				t.Errorf("Expected the note's 2 attachments' content to be removed, got %d, %v", removed, err)
+			}
+		})
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		expected string
+	}{
+		{"page.pdf", "<html><script>alert(1)</script>", "text/html; charset=utf-8"},
+		{"offer.pdf", "%PDF-1.4", "application/pdf"},
+		{"evil.html", "\x00\x01binary", "application/octet-stream"},
+		{"data.json", "\x00\x01binary", "application/json"},
+	}
+	for _, test := range tests {
+		if got := sniffContentType(test.filename, []byte(test.data)); got != test.expected {
+			t.Errorf("Expected %s to be %s, got %s", test.filename, test.expected, got)
+		}
+	}
+	if got := cleanFilename("../../etc/" + strings.Repeat("x", 300)); len(got) != maxFilenameLength || strings.Contains(got, "/") {
+		t.Errorf("Expected the base name cut short, got %q", got)
+	}
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// POST /notes/bulk and /todos/bulk apply a list of operations in one
+// transaction:
+//
+//	{"operations": [
+//	  {"op": "create", "body": {"todo": {"text": "Book a room", "person": 1}}},
+//	  {"op": "update", "id": 3, "body": {"todo": {"text": "..."}}, "if_match": "\"...\""},
+//	  {"op": "patch", "id": 4, "body": {"category": null}},
+//	  {"op": "delete", "id": 5},
+//	  {"op": "complete", "id": 6},
+//	  {"op": "reassign", "from": 1, "to": 2}
+//	]}
+//
+// Bodies are what POST, PUT and PATCH of a single note or todo take, and
+// each operation's result has the status and body that request would have
+// got.  complete and reassign are only for todos: complete marks a todo
+// done and reassign moves all of a person's todos to someone else, e.g.
+// when they leave.
+//
+// Either every operation is applied or none are.  If any fails the
+// response is a 422 (or a 500 if the database failed) and the operations
+// that didn't fail get a 424.
+const maxBulkOperations = 1000
+
+var errBulkFailed = errors.New("bulk operation failed")
+
+type bulkOperation struct {
+	Op      string          `json:"op"`
+	Id      int64           `json:"id,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	IfMatch string          `json:"if_match,omitempty"`
+	From    int64           `json:"from,omitempty"`
+	To      int64           `json:"to,omitempty"`
+}
+
+type bulkRequest struct {
+	Operations []bulkOperation `json:"operations"`
+}
+
+type bulkResult struct {
+	Op     string      `json:"op"`
+	Id     int64       `json:"id,omitempty"`
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+type BulkResultsJSON struct {
+	Results []bulkResult `json:"results"`
+}
+
+// resultRender records the response a handler gives an operation instead
+// of writing it.
+type resultRender struct {
+	render.Render
+	s      Serializer
+	status int
+	body   interface{}
+}
+
+func (r *resultRender) JSON(status int, v interface{}) {
+	r.status = status
+	if status == http.StatusNoContent {
+		return
+	}
+	r.body = errorBody(r.s, status, v)
+}
+
+// request returns the request a handler is given for op, as if it had
+// been made on its own.
+func (op bulkOperation) request(method string, url string) *http.Request {
+	req, err := http.NewRequest(method, url, bytes.NewReader(op.Body))
+	if err != nil {
+		// Only ever given the api's own urls.
+		panic(err)
+	}
+	if op.IfMatch != "" {
+		req.Header.Set("If-Match", op.IfMatch)
+	}
+	return req
+}
+
+func (op bulkOperation) params() martini.Params {
+	return martini.Params{"id": strconv.FormatInt(op.Id, 10)}
+}
+
+// decodeBulk reads the operations of a bulk request, writing a 400 and
+// returning false if it can't.
+func decodeBulk(rend render.Render, req *http.Request) ([]bulkOperation, bool) {
+	b := bulkRequest{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid bulk request: %s", err))
+		return nil, false
+	}
+	if len(b.Operations) > maxBulkOperations {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("At most %d operations can be sent at once", maxBulkOperations))
+		return nil, false
+	}
+	return b.Operations, true
+}
+
+// runBulk runs each operation in ops with run, all in one transaction in
+// the workspace, and writes their results.  run gets a copy of policy that
+// looks things up inside the transaction.  It stops at the first 5xx, as
+// the transaction may not be usable after one.
+func runBulk(rend render.Render, store db.Store, m *db.Membership, policy *Policy, s Serializer, ops []bulkOperation,
+	run func(tx db.Store, policy *Policy, op bulkOperation, r render.Render)) {
+	results := make([]bulkResult, len(ops))
+	status := http.StatusOK
+	err := store.InWorkspace(m.Workspace).InTx(func(tx db.Store) error {
+		tx_policy := policy.inTx(tx)
+		for i, op := range ops {
+			r := &resultRender{Render: rend, s: s}
+			run(tx, tx_policy, op, r)
+			results[i] = bulkResult{Op: op.Op, Id: op.Id, Status: r.status, Body: r.body}
+			if r.status >= 500 {
+				status = http.StatusInternalServerError
+				break
+			}
+			if r.status >= 400 {
+				status = http.StatusUnprocessableEntity
+			}
+		}
+		if status != http.StatusOK {
+			return errBulkFailed
+		}
+		return nil
+	})
+	if err != nil && err != errBulkFailed {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if status != http.StatusOK {
+		for i, op := range ops {
+			if results[i].Status < 400 {
+				results[i] = bulkResult{
+					Op:     op.Op,
+					Id:     op.Id,
+					Status: http.StatusFailedDependency,
+					Body:   s.Error(http.StatusFailedDependency, "Not applied as another operation failed"),
+				}
+			}
+		}
+	}
+	rend.JSON(status, BulkResultsJSON{results})
+}
+
+func unknownOperation(r render.Render, op bulkOperation, kind resourceType) {
+	r.JSON(http.StatusUnprocessableEntity, fieldErrors{{"op", fmt.Sprintf("can't %q %s", op.Op, kind.Plural)}})
+}
+
+func bulkNotes(rend render.Render, req *http.Request, store db.Store, m *db.Membership, policy *Policy, s Serializer) {
+	ops, ok := decodeBulk(rend, req)
+	if !ok {
+		return
+	}
+	runBulk(rend, store, m, policy, s, ops, func(tx db.Store, policy *Policy, op bulkOperation, r render.Render) {
+		url := fmt.Sprintf("/api/1/notes/%d", op.Id)
+		switch op.Op {
+		case "create":
+			createNote(r, op.request("POST", "/api/1/notes"), nil, tx, tx, tx, policy, s)
+		case "update":
+			updateNote(r, op.request("PUT", url), op.params(), tx, policy, s)
+		case "patch":
+			patchNote(r, op.request("PATCH", url), op.params(), tx, tx, policy, s)
+		case "delete":
+			deleteNote(r, op.request("DELETE", url), op.params(), tx, policy, s)
+		default:
+			unknownOperation(r, op, noteType)
+		}
+	})
+}
+
+func bulkTodos(rend render.Render, req *http.Request, store db.Store, m *db.Membership, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
+	ops, ok := decodeBulk(rend, req)
+	if !ok {
+		return
+	}
+	runBulk(rend, store, m, policy, s, ops, func(tx db.Store, policy *Policy, op bulkOperation, r render.Render) {
+		url := fmt.Sprintf("/api/1/todos/%d", op.Id)
+		switch op.Op {
+		case "create":
+			createTodo(r, op.request("POST", "/api/1/todos"), nil, tx, tx, policy, s)
+		case "update":
+			updateTodo(r, op.request("PUT", url), op.params(), tx, policy, s)
+		case "patch":
+			patchTodo(r, op.request("PATCH", url), op.params(), tx, tx, policy, s)
+		case "delete":
+			deleteTodo(r, op.request("DELETE", url), op.params(), tx, policy, s)
+		case "complete":
+			completeTodo(r, op.request("POST", url), op.params(), tx, s)
+		case "reassign":
+			reassignTodos(r, op, tx, tx, s)
+		default:
+			unknownOperation(r, op, todoType)
+		}
+	})
+}
+
+// completeTodo marks a todo done.
+func completeTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, s Serializer) {
+	todo_id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	dbtodo, err := store.GetTodoById(todo_id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(404, fmt.Sprintf("No Todo with id %d found.", todo_id))
+		} else {
+			rend.JSON(500, err.Error())
+		}
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(todoResource(dbtodo), nil)) {
+		return
+	}
+	dbtodo.Done = true
+	if err := store.UpdateTodo(dbtodo); err != nil {
+		writeUpdateError(rend, err)
+		return
+	}
+	rend.JSON(200, s.One(todoResource(dbtodo), nil))
+}
+
+// reassignTodos moves all of the todos of the person op is from to the
+// person it's to, returning the todos moved.
+func reassignTodos(rend render.Render, op bulkOperation, store db.TodoStore, people db.PeopleStore, s Serializer) {
+	var errs fieldErrors
+	find := func(field string, id int64) *db.Person {
+		if id == 0 {
+			errs.add(field, "is required")
+			return nil
+		}
+		p, err := people.GetPersonById(id)
+		if err != nil {
+			errs.add(field, "no person with id %d", id)
+			return nil
+		}
+		return p
+	}
+	from, to := find("from", op.From), find("to", op.To)
+	if len(errs) > 0 {
+		rend.JSON(http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if err := people.LoadPeopleRelations([]*db.Person{from}, false, true); err != nil {
+		rend.JSON(500, err.Error())
+		return
+	}
+	moved := make([]resource, len(from.Todos))
+	for i, t := range from.Todos {
+		t.Person = to
+		if err := store.UpdateTodo(t); err != nil {
+			writeUpdateError(rend, err)
+			return
+		}
+		moved[i] = todoResource(t)
+	}
+	rend.JSON(200, s.Many(todoType, moved, nil))
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+)
+
+// serveBulk sends operations to url and returns the response's status and
+// the status of each operation.
+func serveBulk(t *testing.T, m *martini.Martini, url string, operations string) (int, []int) {
+	response := serveAs(m, testToken, "POST", url, strings.NewReader(`{"operations": [`+operations+`]}`))
+	results := BulkResultsJSON{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &results))
+	statuses := []int{}
+	for _, r := range results.Results {
+		statuses = append(statuses, r.Status)
+	}
+	return response.Code, statuses
+}
+
+func TestBulkOperations(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			scoped := store.InWorkspace(ws)
+			alice, bob := &db.Person{Name: "Alice"}, &db.Person{Name: "Bob"}
+			failOnError(t, scoped.CreatePerson(alice))
+			failOnError(t, scoped.CreatePerson(bob))
+			first := &db.Todo{Person: alice, Text: "first", Date: time.Now()}
+			second := &db.Todo{Person: alice, Text: "second", Date: time.Now()}
+			failOnError(t, scoped.CreateTodo(first))
+			failOnError(t, scoped.CreateTodo(second))
+			m := createMartini(store)
+
+			code, statuses := serveBulk(t, m, "/api/1/todos/bulk", fmt.Sprintf(`
+				{"op": "create", "body": {"todo": {"text": "third", "person": %d}}},
+				{"op": "update", "id": %d, "body": {"todo": {"text": "first, changed"}}},
+				{"op": "complete", "id": %d}`, bob.Id, first.Id, second.Id))
+			if code != http.StatusOK || fmt.Sprint(statuses) != "[200 200 200]" {
+				t.Fatalf("Expected every operation to work, got %d %v", code, statuses)
+			}
+			done, err := scoped.GetTodoById(second.Id)
+			failOnError(t, err)
+			if !done.Done {
+				t.Errorf("Expected todo %d to be done", second.Id)
+			}
+
+			// Nothing is applied if anything fails.
+			code, statuses = serveBulk(t, m, "/api/1/todos/bulk", fmt.Sprintf(`
+				{"op": "create", "body": {"todo": {"text": "fourth", "person": %d}}},
+				{"op": "delete", "id": %d},
+				{"op": "delete", "id": 999},
+				{"op": "patch", "id": %d, "body": {"colour": "red"}},
+				{"op": "update", "id": %d, "body": {"todo": {"text": "stale"}}, "if_match": "\"stale\""},
+				{"op": "archive", "id": %d}`, bob.Id, first.Id, second.Id, second.Id, second.Id))
+			expected := []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound,
+				http.StatusUnprocessableEntity, http.StatusPreconditionFailed, http.StatusUnprocessableEntity}
+			if code != http.StatusUnprocessableEntity || fmt.Sprint(statuses) != fmt.Sprint(expected) {
+				t.Errorf("Expected 422 with %v, got %d %v", expected, code, statuses)
+			}
+			todos, err := scoped.GetTodos()
+			failOnError(t, err)
+			if len(todos) != 3 {
+				t.Errorf("Expected a failed bulk request to change nothing, got %d todos", len(todos))
+			}
+
+			code, statuses = serveBulk(t, m, "/api/1/todos/bulk", fmt.Sprintf(`
+				{"op": "reassign", "from": %d, "to": %d}`, alice.Id, bob.Id))
+			if code != http.StatusOK || fmt.Sprint(statuses) != "[200]" {
+				t.Fatalf("Expected todos to be reassigned, got %d %v", code, statuses)
+			}
+			todos, err = scoped.GetTodos()
+			failOnError(t, err)
+			for _, todo := range todos {
+				if todo.Person.Id != bob.Id {
+					t.Errorf("Expected todo %d to be reassigned to %d, got %d", todo.Id, bob.Id, todo.Person.Id)
+				}
+			}
+			code, statuses = serveBulk(t, m, "/api/1/todos/bulk", `{"op": "reassign", "from": 999}`)
+			if code != http.StatusUnprocessableEntity || fmt.Sprint(statuses) != "[422]" {
+				t.Errorf("Expected reassigning to nobody to fail, got %d %v", code, statuses)
+			}
+
+			code, statuses = serveBulk(t, m, "/api/1/notes/bulk", fmt.Sprintf(`
+				{"op": "create", "body": {"note": {"text": "note", "person": %d}}},
+				{"op": "complete", "id": 1}`, alice.Id))
+			if code != http.StatusUnprocessableEntity || fmt.Sprint(statuses) != "[424 422]" {
+				t.Errorf("Expected notes not to be completable, got %d %v", code, statuses)
+			}
+
+			response := serveAs(m, testToken, "POST", "/api/1/notes/bulk", strings.NewReader(`{"ops": []}`))
+			if response.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for a malformed bulk request, got %d", response.Code)
+			}
+		})
+	}
+}
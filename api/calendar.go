@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/ical"
+	"github.com/martini-contrib/render"
+)
+
+// Every user can have an iCalendar feed of the todos and 1:1s in all of
+// their workspaces at /calendar.ics.  Calendar apps can't send an
+// Authorization header, so the feed is read with a token of its own in the
+// url, which only gives access to the feed.  POST /calendar turns the feed
+// on and returns its url and DELETE /calendar turns it off, so a leaked
+// url can be revoked by turning it off and on again.
+//
+// Todos are VTODOs due on their date and 1:1s (notes in
+// db.CategoryOneOnOne) are VEVENTs starting at theirs.
+const calendarTokenParam = "token"
+
+const (
+	calendarContentType = "text/calendar; charset=utf-8"
+	calendarProductId   = "-//pointyhair//calendar//EN"
+	// 1:1s don't have an end so they're all this long
+	oneOnOneLength = "PT30M"
+)
+
+type calendarJSON struct {
+	Id  int64  `json:"id"`
+	URL string `json:"url"`
+}
+
+// calendarURL returns the absolute url of u's feed, as requested through
+// the same host as req.
+func calendarURL(req *http.Request, u *db.User) string {
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/api/1/calendar.ics?%s=%s", scheme, req.Host, calendarTokenParam, u.CalendarToken)
+}
+
+func enableCalendar(rend render.Render, req *http.Request, u *db.User, store db.Store, s Serializer) {
+	if u.CalendarToken == "" {
+		token, err := db.NewToken()
+		if err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		u.CalendarToken = token
+		if err := store.SetCalendarToken(u); err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	rend.JSON(http.StatusOK, s.One(newResource(calendarType, u.Id, calendarJSON{u.Id, calendarURL(req, u)}), nil))
+}
+
+func disableCalendar(rend render.Render, u *db.User, store db.Store) {
+	u.CalendarToken = ""
+	if err := store.SetCalendarToken(u); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
+
+// stamp adds the properties every todo and event has.
+func stamp(c *ical.Component, uid string, created time.Time, updated time.Time, version int64) {
+	c.AddText("UID", uid)
+	c.AddTime("DTSTAMP", updated)
+	c.AddTime("CREATED", created)
+	c.AddTime("LAST-MODIFIED", updated)
+	c.Add("SEQUENCE", fmt.Sprint(version))
+}
+
+func todoComponent(t *db.Todo, person string, ws *db.Workspace) *ical.Component {
+	c := ical.NewComponent("VTODO")
+	stamp(c, fmt.Sprintf("todo-%d@pointyhair", t.Id), t.CreatedAt, t.UpdatedAt, t.Version)
+	c.AddText("SUMMARY", t.Text)
+	c.AddText("DESCRIPTION", fmt.Sprintf("For %s in %s", person, ws.Name))
+	c.AddTime("DUE", t.Date)
+	if t.Category != "" {
+		c.AddText("CATEGORIES", t.Category)
+	}
+	if t.Done {
+		c.Add("STATUS", "COMPLETED")
+	} else {
+		c.Add("STATUS", "NEEDS-ACTION")
+	}
+	return c
+}
+
+// oneOnOneComponent leaves out the note's text, as calendars get shared
+// and synced to places notes shouldn't go.
+func oneOnOneComponent(n *db.Note, person string, ws *db.Workspace) *ical.Component {
+	c := ical.NewComponent("VEVENT")
+	stamp(c, fmt.Sprintf("note-%d@pointyhair", n.Id), n.CreatedAt, n.UpdatedAt, n.Version)
+	c.AddText("SUMMARY", "1:1 with "+person)
+	c.AddText("DESCRIPTION", "In "+ws.Name)
+	c.AddTime("DTSTART", n.Date)
+	c.Add("DURATION", oneOnOneLength)
+	return c
+}
+
+// addWorkspace adds the todos and 1:1s u can see in m's workspace to cal.
+func addWorkspace(cal *ical.Component, u *db.User, m *db.Membership, store db.Store) error {
+	scoped := store.InWorkspace(m.Workspace)
+	policy := newPolicy(u, m, store)
+	people, err := scoped.GetPeopleById(nil)
+	if err != nil {
+		return err
+	}
+	names := map[int64]string{}
+	for _, p := range people {
+		names[p.Id] = p.Name
+	}
+
+	if policy.CanReadTodos() {
+		todos, err := scoped.GetTodos()
+		if err != nil {
+			return err
+		}
+		for _, t := range todos {
+			cal.AddComponent(todoComponent(t, names[t.Person.Id], m.Workspace))
+		}
+	}
+
+	notes, err := scoped.GetNotesById(nil)
+	if err != nil {
+		return err
+	}
+	// Confidential 1:1s are still listed as none of their text is.
+	for _, n := range policy.FilterListed(notes, true) {
+		if n.Category == db.CategoryOneOnOne {
+			cal.AddComponent(oneOnOneComponent(n, names[n.Person.Id], m.Workspace))
+		}
+	}
+	return nil
+}
+
+// getCalendarFeed writes the feed of the user whose calendar token is in
+// the url.
+func getCalendarFeed(w http.ResponseWriter, rend render.Render, req *http.Request, store db.Store) {
+	u, err := store.GetUserByCalendarToken(req.URL.Query().Get(calendarTokenParam))
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(http.StatusUnauthorized, "Missing or unknown calendar token")
+		} else {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	ms, err := store.GetMemberships(u)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	cal := ical.NewComponent("VCALENDAR")
+	cal.Add("VERSION", "2.0")
+	cal.AddText("PRODID", calendarProductId)
+	cal.Add("CALSCALE", "GREGORIAN")
+	cal.AddText("X-WR-CALNAME", "pointyhair")
+	for _, m := range ms {
+		if err := addWorkspace(cal, u, m, store); err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	var b bytes.Buffer
+	if err := cal.Encode(&b); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", calendarContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
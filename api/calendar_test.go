@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/ical"
+)
+
+// enableTestCalendar turns on the calendar of the user with token and returns
+// the path and query of its url.
+func enableTestCalendar(t *testing.T, m *martini.Martini, token string) string {
+	response := serveAs(m, token, "POST", "/api/1/calendar", nil)
+	doc := struct {
+		Calendar calendarJSON `json:"calendar"`
+	}{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+	u, err := url.Parse(doc.Calendar.URL)
+	failOnError(t, err)
+	return u.RequestURI()
+}
+
+func TestCalendarFeed(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			hr := &db.User{Name: "hr", Token: "hr-token"}
+			failOnError(t, store.CreateUser(hr))
+			failOnError(t, store.SetMember(ws, hr, db.RoleHR))
+			scoped := store.InWorkspace(ws)
+			p := &db.Person{Name: "Bob"}
+			failOnError(t, scoped.CreatePerson(p))
+			due := time.Date(2030, 1, 2, 15, 0, 0, 0, time.UTC)
+			todo := &db.Todo{Person: p, Text: "Review, then; sign off", Date: due, Done: true}
+			failOnError(t, scoped.CreateTodo(todo))
+			failOnError(t, scoped.CreateNote(&db.Note{Person: p, Text: "Agenda", Date: due, Category: db.CategoryOneOnOne}))
+			failOnError(t, scoped.CreateNote(&db.Note{Person: p, Text: "Not a 1:1", Date: due}))
+			m := createMartini(store)
+
+			feed := enableTestCalendar(t, m, testToken)
+			if again := enableTestCalendar(t, m, testToken); again != feed {
+				t.Errorf("Expected the feed's url to stay the same, got %s and %s", feed, again)
+			}
+			response := serveAs(m, "", "GET", feed, nil)
+			if response.Code != http.StatusOK || response.Header().Get("Content-Type") != calendarContentType {
+				t.Fatalf("Expected the feed, got %d %s: %s", response.Code, response.Header().Get("Content-Type"), response.Body)
+			}
+			cal, err := ical.Parse(response.Body)
+			failOnError(t, err)
+			todos, events := cal.All("VTODO"), cal.All("VEVENT")
+			if len(todos) != 1 || len(events) != 1 {
+				t.Fatalf("Expected a todo and a 1:1, got %d and %d", len(todos), len(events))
+			}
+			if todos[0].Text("SUMMARY") != todo.Text || todos[0].Text("STATUS") != "COMPLETED" {
+				t.Errorf("Expected the done todo, got %+v", todos[0])
+			}
+			if got, err := todos[0].Time("DUE"); err != nil || !got.Equal(due) {
+				t.Errorf("Expected the todo due %s, got %s, %v", due, got, err)
+			}
+			if events[0].Text("SUMMARY") != "1:1 with Bob" || events[0].Text("DESCRIPTION") != "In "+ws.Name {
+				t.Errorf("Expected a 1:1 with Bob without the note's text, got %+v", events[0])
+			}
+			if got, err := events[0].Time("DTSTART"); err != nil || !got.Equal(due) {
+				t.Errorf("Expected the 1:1 at %s, got %s, %v", due, got, err)
+			}
+
+			// HR partners can't see todos or anyone's 1:1s.
+			response = serveAs(m, "", "GET", enableTestCalendar(t, m, hr.Token), nil)
+			cal, err = ical.Parse(response.Body)
+			failOnError(t, err)
+			if len(cal.Components) != 0 {
+				t.Errorf("Expected an empty calendar for HR, got %+v", cal.Components)
+			}
+
+			for _, path := range []string{"/api/1/calendar.ics", "/api/1/calendar.ics?token=" + testToken} {
+				if response := serveAs(m, "", "GET", path, nil); response.Code != http.StatusUnauthorized {
+					t.Errorf("Expected 401 for %s, got %d", path, response.Code)
+				}
+			}
+			if response := serveAs(m, testToken, "DELETE", "/api/1/calendar", nil); response.Code != http.StatusNoContent {
+				t.Fatalf("Expected the feed to be turned off, got %d", response.Code)
+			}
+			if response := serveAs(m, "", "GET", feed, nil); response.Code != http.StatusUnauthorized {
+				t.Errorf("Expected 401 for a turned off feed, got %d", response.Code)
+			}
+		})
+	}
+}
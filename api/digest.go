@@ -0,0 +1,419 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Users with an email address are sent a digest of what needs doing in
+// all of their workspaces: todos that are overdue or due in the next week,
+// people they haven't had a 1:1 with for a while and the 1:1s coming up
+// (today's for a daily digest, the week's for a weekly one).  Like
+// everything else it only has what the user can see.  Digests go out once
+// DigestOptions.Hour has passed, every day or on DigestOptions.Weekday,
+// and users pick which, or turn them off, with PUT /digest.
+const (
+	upcomingTodoDays = 7
+	// People without a 1:1 for this long are due one
+	checkInDays = 14
+	// How often Run looks for digests that are due
+	digestPollInterval = 10 * time.Minute
+)
+
+// DigestOptions says how and when digests are sent.
+type DigestOptions struct {
+	// host:port of the SMTP server
+	SMTPAddr string
+	// Only authenticate if set
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+	// Hour of the day, in Location, digests are sent from
+	Hour int
+	// Day weekly digests are sent on
+	Weekday  time.Weekday
+	Location *time.Location
+}
+
+type digestJSON struct {
+	Id       int64  `json:"id"`
+	Email    string `json:"email"`
+	Schedule string `json:"schedule"`
+	// When the last digest was sent, if one has been
+	SentAt *time.Time `json:"sent_at"`
+}
+
+func newDigestJSON(u *db.User) digestJSON {
+	d := digestJSON{Id: u.Id, Email: u.Email, Schedule: u.Digest()}
+	if !u.DigestSentAt.IsZero() {
+		d.SentAt = &u.DigestSentAt
+	}
+	return d
+}
+
+type unmarshalDigestJSON struct {
+	Id int64 `json:"id"`
+	// Empty to stop digests being sent anywhere
+	Email    string `json:"email" validate:"max=255,email"`
+	Schedule string `json:"schedule" validate:"required,digest"`
+}
+
+func getDigest(rend render.Render, u *db.User, s Serializer) {
+	rend.JSON(http.StatusOK, s.One(newResource(digestType, u.Id, newDigestJSON(u)), nil))
+}
+
+func setDigest(rend render.Render, req *http.Request, u *db.User, store db.Store, s Serializer) {
+	ud := unmarshalDigestJSON{}
+	if !decodeValid(rend, req, s, digestType, &ud, true) {
+		return
+	}
+	u.Email = ud.Email
+	u.DigestSchedule = ud.Schedule
+	if err := store.SetDigest(u); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(newResource(digestType, u.Id, newDigestJSON(u)), nil))
+}
+
+type digestItem struct {
+	When   time.Time
+	Person string
+	Text   string
+}
+
+type digestCheckIn struct {
+	Person string
+	// Zero if they've never had one
+	Last time.Time
+}
+
+type digestWorkspace struct {
+	Name     string
+	Meetings []digestItem
+	Overdue  []digestItem
+	Upcoming []digestItem
+	CheckIns []digestCheckIn
+}
+
+func (w digestWorkspace) empty() bool {
+	return len(w.Meetings) == 0 && len(w.Overdue) == 0 && len(w.Upcoming) == 0 && len(w.CheckIns) == 0
+}
+
+// digest is what goes in one user's email.
+type digest struct {
+	User       string
+	Schedule   string
+	Date       time.Time
+	Workspaces []digestWorkspace
+	// Template constants
+	UpcomingDays int
+	CheckInDays  int
+}
+
+var digestFuncs = map[string]interface{}{
+	"day":   func(t time.Time) string { return t.Format("Mon 2 Jan") },
+	"clock": func(t time.Time) string { return t.Format("15:04") },
+}
+
+var digestText = template.Must(template.New("digest").Funcs(digestFuncs).Parse(
+	`Your pointyhair {{.Schedule}} digest for {{.Date.Format "Monday 2 January 2006"}}
+{{range .Workspaces}}
+== {{.Name}} ==
+{{if .Meetings}}
+1:1s
+{{range .Meetings}}  {{day .When}} {{clock .When}}  {{.Person}}
+{{end}}{{end}}{{if .Overdue}}
+Overdue todos
+{{range .Overdue}}  {{day .When}}  {{.Person}}: {{.Text}}
+{{end}}{{end}}{{if .Upcoming}}
+Due in the next {{$.UpcomingDays}} days
+{{range .Upcoming}}  {{day .When}}  {{.Person}}: {{.Text}}
+{{end}}{{end}}{{if .CheckIns}}
+No 1:1 for {{$.CheckInDays}} days
+{{range .CheckIns}}  {{.Person}}{{if .Last.IsZero}} (never){{else}} (last {{day .Last}}){{end}}
+{{end}}{{end}}{{end}}
+--
+You get this {{.Schedule}}.  Change that, or turn it off, with PUT /api/1/digest.
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Funcs(digestFuncs).Parse(
+	`<!DOCTYPE html>
+<html><body>
+<h1>Your pointyhair {{.Schedule}} digest for {{.Date.Format "Monday 2 January 2006"}}</h1>
+{{range .Workspaces}}
+<h2>{{.Name}}</h2>
+{{if .Meetings}}<h3>1:1s</h3><ul>
+{{range .Meetings}}<li>{{day .When}} {{clock .When}} <b>{{.Person}}</b></li>
+{{end}}</ul>{{end}}
+{{if .Overdue}}<h3>Overdue todos</h3><ul>
+{{range .Overdue}}<li>{{day .When}} <b>{{.Person}}</b>: {{.Text}}</li>
+{{end}}</ul>{{end}}
+{{if .Upcoming}}<h3>Due in the next {{$.UpcomingDays}} days</h3><ul>
+{{range .Upcoming}}<li>{{day .When}} <b>{{.Person}}</b>: {{.Text}}</li>
+{{end}}</ul>{{end}}
+{{if .CheckIns}}<h3>No 1:1 for {{$.CheckInDays}} days</h3><ul>
+{{range .CheckIns}}<li><b>{{.Person}}</b>{{if .Last.IsZero}} (never){{else}} (last {{day .Last}}){{end}}</li>
+{{end}}</ul>{{end}}
+{{end}}
+<p><small>You get this {{.Schedule}}.  Change that, or turn it off, with PUT /api/1/digest.</small></p>
+</body></html>
+`))
+
+// Digester sends digests to the users they're due for.
+type Digester struct {
+	store db.Store
+	opts  DigestOptions
+	now   func() time.Time
+	// smtp.SendMail, unless testing
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewDigester(store db.Store, opts DigestOptions) *Digester {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	return &Digester{store: store, opts: opts, now: time.Now, send: smtp.SendMail}
+}
+
+// Run sends digests as they become due, forever.
+func (d *Digester) Run() {
+	for {
+		if _, err := d.SendDue(); err != nil {
+			glog.Errorf("Error sending digests: %s", err)
+		}
+		time.Sleep(digestPollInterval)
+	}
+}
+
+// due returns true if u should be sent a digest at now.
+func (d *Digester) due(u *db.User, now time.Time) bool {
+	if u.Email == "" || u.Digest() == db.DigestOff {
+		return false
+	}
+	send_at := time.Date(now.Year(), now.Month(), now.Day(), d.opts.Hour, 0, 0, 0, now.Location())
+	if now.Before(send_at) {
+		return false
+	}
+	if u.Digest() == db.DigestWeekly && now.Weekday() != d.opts.Weekday {
+		return false
+	}
+	return u.DigestSentAt.Before(send_at)
+}
+
+// SendDue sends every digest that's due and returns how many were sent.
+// Users with nothing to be told about aren't sent anything but count as
+// having had their digest.  A failure to send to one user doesn't stop the
+// others being sent theirs, and is tried again next time.
+func (d *Digester) SendDue() (int, error) {
+	users, err := d.store.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+	now := d.now().In(d.opts.Location)
+	sent := 0
+	var last_err error
+	for _, u := range users {
+		if !d.due(u, now) {
+			continue
+		}
+		dg, err := d.build(u, now)
+		if err == nil && len(dg.Workspaces) > 0 {
+			err = d.sendDigest(u, dg)
+			if err == nil {
+				sent++
+			}
+		}
+		if err != nil {
+			glog.Errorf("Error sending digest to user %d: %s", u.Id, err)
+			last_err = err
+			continue
+		}
+		u.DigestSentAt = now
+		if err := d.store.SetDigest(u); err != nil {
+			return sent, err
+		}
+	}
+	return sent, last_err
+}
+
+// build gathers u's digest from all of their workspaces.
+func (d *Digester) build(u *db.User, now time.Time) (digest, error) {
+	dg := digest{
+		User:         u.Name,
+		Schedule:     u.Digest(),
+		Date:         now,
+		UpcomingDays: upcomingTodoDays,
+		CheckInDays:  checkInDays,
+	}
+	ms, err := d.store.GetMemberships(u)
+	if err != nil {
+		return dg, err
+	}
+	for _, m := range ms {
+		w, err := d.buildWorkspace(u, m, now)
+		if err != nil {
+			return dg, err
+		}
+		if !w.empty() {
+			dg.Workspaces = append(dg.Workspaces, w)
+		}
+	}
+	return dg, nil
+}
+
+func (d *Digester) buildWorkspace(u *db.User, m *db.Membership, now time.Time) (digestWorkspace, error) {
+	w := digestWorkspace{Name: m.Workspace.Name}
+	scoped := d.store.InWorkspace(m.Workspace)
+	policy := newPolicy(u, m, d.store)
+	loc := d.opts.Location
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	meetings_end := today.AddDate(0, 0, 1)
+	if u.Digest() == db.DigestWeekly {
+		meetings_end = today.AddDate(0, 0, 7)
+	}
+
+	people, err := scoped.GetPeopleById(nil)
+	if err != nil {
+		return w, err
+	}
+	names := map[int64]string{}
+	for _, p := range people {
+		names[p.Id] = p.Name
+	}
+
+	if policy.CanReadTodos() {
+		todos, err := scoped.GetTodos()
+		if err != nil {
+			return w, err
+		}
+		upcoming_end := today.AddDate(0, 0, upcomingTodoDays)
+		for _, t := range todos {
+			item := digestItem{t.Date.In(loc), names[t.Person.Id], t.Text}
+			switch {
+			case t.Done:
+			case t.Date.Before(today):
+				w.Overdue = append(w.Overdue, item)
+			case t.Date.Before(upcoming_end):
+				w.Upcoming = append(w.Upcoming, item)
+			}
+		}
+	}
+
+	notes, err := scoped.GetNotesById(nil)
+	if err != nil {
+		return w, err
+	}
+	last := map[int64]time.Time{}
+	// Like the calendar, confidential 1:1s are listed as none of their
+	// text is.
+	for _, n := range policy.FilterListed(notes, true) {
+		if n.Category != db.CategoryOneOnOne {
+			continue
+		}
+		if !n.Date.Before(today) && n.Date.Before(meetings_end) {
+			w.Meetings = append(w.Meetings, digestItem{n.Date.In(loc), names[n.Person.Id], ""})
+		}
+		if !n.Date.After(now) && n.Date.After(last[n.Person.Id]) {
+			last[n.Person.Id] = n.Date
+		}
+	}
+	// HR partners don't have 1:1s with people.
+	if m.Role != db.RoleHR {
+		due := now.AddDate(0, 0, -checkInDays)
+		for _, p := range people {
+			if l := last[p.Id]; l.Before(due) {
+				w.CheckIns = append(w.CheckIns, digestCheckIn{p.Name, l.In(loc)})
+			}
+		}
+	}
+
+	for _, items := range [][]digestItem{w.Meetings, w.Overdue, w.Upcoming} {
+		sort.SliceStable(items, func(i, j int) bool { return items[i].When.Before(items[j].When) })
+	}
+	return w, nil
+}
+
+// sendDigest emails dg to u as plain text and HTML.
+func (d *Digester) sendDigest(u *db.User, dg digest) error {
+	var text, html bytes.Buffer
+	if err := digestText.Execute(&text, dg); err != nil {
+		return err
+	}
+	if err := digestHTML.Execute(&html, dg); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Your pointyhair digest for %s", dg.Date.Format("Mon 2 Jan"))
+	msg, err := digestMessage(d.opts.From, u.Email, subject, dg.Date, text.Bytes(), html.Bytes())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if d.opts.SMTPUsername != "" {
+		host := strings.SplitN(d.opts.SMTPAddr, ":", 2)[0]
+		auth = smtp.PlainAuth("", d.opts.SMTPUsername, d.opts.SMTPPassword, host)
+	}
+	return d.send(d.opts.SMTPAddr, auth, d.opts.From, []string{u.Email}, msg)
+}
+
+// digestMessage returns a multipart/alternative email with text and html
+// versions of the same body.
+func digestMessage(from string, to string, subject string, date time.Time, text []byte, html []byte) ([]byte, error) {
+	if strings.ContainsAny(from+to, "\r\n") {
+		return nil, errors.New("Invalid email address")
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	parts := []struct {
+		content_type string
+		content      []byte
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	}
+	for _, part := range parts {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.content_type},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", w.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
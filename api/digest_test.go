@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// smtpStandIn is just enough of an SMTP server for net/smtp to send mail
+// to.  It keeps the messages it's sent.
+type smtpStandIn struct {
+	l        net.Listener
+	mu       sync.Mutex
+	messages []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnError(t, err)
+	s := &smtpStandIn{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpStandIn) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+// digestParts returns the text and html parts of a digest.
+func digestParts(t *testing.T, raw string) (*mail.Message, string, string) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	failOnError(t, err)
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	failOnError(t, err)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// Quoted-printable parts are decoded by NextPart.
+		b, err := ioutil.ReadAll(p)
+		failOnError(t, err)
+		parts = append(parts, string(b))
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected a text and an html part, got %d", len(parts))
+	}
+	return msg, parts[0], parts[1]
+}
+
+func TestDigest(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			smtp_server := newSMTPStandIn(t)
+			defer smtp_server.l.Close()
+
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			weekly := &db.User{Name: "weekly", Token: "weekly-token", Email: "weekly@example.com", DigestSchedule: db.DigestWeekly}
+			failOnError(t, store.CreateUser(weekly))
+			failOnError(t, store.SetMember(ws, weekly, db.RoleEditor))
+			scoped := store.InWorkspace(ws)
+			// Wednesday morning
+			now := time.Date(2030, 1, 2, 9, 30, 0, 0, time.UTC)
+			bob := &db.Person{Name: "Bob"}
+			carol := &db.Person{Name: "Carol <3"}
+			failOnError(t, scoped.CreatePerson(bob))
+			failOnError(t, scoped.CreatePerson(carol))
+			todos := []*db.Todo{
+				{Person: bob, Text: "Overdue review", Date: now.AddDate(0, 0, -3)},
+				{Person: bob, Text: "Done already", Date: now.AddDate(0, 0, -3), Done: true},
+				{Person: carol, Text: "Promotion packet", Date: now.AddDate(0, 0, 2)},
+				{Person: carol, Text: "Far off", Date: now.AddDate(0, 1, 0)},
+			}
+			for _, todo := range todos {
+				failOnError(t, scoped.CreateTodo(todo))
+			}
+			for _, n := range []*db.Note{
+				{Person: bob, Text: "Last week", Date: now.AddDate(0, 0, -7), Category: db.CategoryOneOnOne},
+				{Person: bob, Text: "Today", Date: now.Add(5 * time.Hour), Category: db.CategoryOneOnOne},
+				{Person: carol, Text: "Long ago", Date: now.AddDate(0, -2, 0), Category: db.CategoryOneOnOne},
+			} {
+				failOnError(t, scoped.CreateNote(n))
+			}
+			m := createMartini(store)
+
+			response := serveAs(m, testToken, "PUT", "/api/1/digest", strings.NewReader(`{"digest": {"email": "nope", "schedule": "hourly"}}`))
+			if response.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Expected 422 for a bad email and schedule, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "PUT", "/api/1/digest", strings.NewReader(`{"digest": {"email": "tester@example.com", "schedule": "daily"}}`))
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"sent_at": null`) {
+				t.Fatalf("Expected digests to be turned on, got %d: %s", response.Code, response.Body)
+			}
+
+			d := NewDigester(store, DigestOptions{SMTPAddr: smtp_server.l.Addr().String(), From: "pointyhair@example.com",
+				Hour: 7, Weekday: time.Monday, Location: time.UTC})
+			d.now = func() time.Time { return now.Add(-3 * time.Hour) }
+			if sent, err := d.SendDue(); err != nil || sent != 0 {
+				t.Errorf("Expected nothing to be sent before %d, got %d, %v", d.opts.Hour, sent, err)
+			}
+			d.now = func() time.Time { return now }
+			if sent, err := d.SendDue(); err != nil || sent != 1 {
+				t.Fatalf("Expected only the daily digest to be sent, got %d, %v", sent, err)
+			}
+			if sent, err := d.SendDue(); err != nil || sent != 0 {
+				t.Errorf("Expected one digest a day, got %d more, %v", sent, err)
+			}
+
+			msgs := smtp_server.sent()
+			if len(msgs) != 1 {
+				t.Fatalf("Expected 1 email, got %d", len(msgs))
+			}
+			msg, text, html := digestParts(t, msgs[0])
+			if msg.Header.Get("To") != "tester@example.com" || msg.Header.Get("From") != "pointyhair@example.com" {
+				t.Errorf("Expected an email to the tester, got %+v", msg.Header)
+			}
+			for _, expected := range []string{
+				"== tester's workspace ==",
+				"Wed 2 Jan 14:30  Bob",
+				"Sun 30 Dec  Bob: Overdue review",
+				"Fri 4 Jan  Carol <3: Promotion packet",
+				"Carol <3 (last Fri 2 Nov)",
+			} {
+				if !strings.Contains(text, expected) {
+					t.Errorf("Expected %q in the text digest:\n%s", expected, text)
+				}
+			}
+			for _, unexpected := range []string{"Done already", "Far off", "Bob (last"} {
+				if strings.Contains(text, unexpected) {
+					t.Errorf("Expected no %q in the text digest:\n%s", unexpected, text)
+				}
+			}
+			if !strings.Contains(html, "<b>Carol &lt;3</b>: Promotion packet") {
+				t.Errorf("Expected the html digest to be escaped:\n%s", html)
+			}
+
+			// Weekly digests go out on their day.
+			d.now = func() time.Time { return time.Date(2030, 1, 7, 8, 0, 0, 0, time.UTC) }
+			if sent, err := d.SendDue(); err != nil || sent != 2 {
+				t.Errorf("Expected the daily and weekly digests on Monday, got %d, %v", sent, err)
+			}
+
+			serveAs(m, testToken, "PUT", "/api/1/digest", strings.NewReader(`{"digest": {"email": "tester@example.com", "schedule": "off"}}`))
+			d.now = func() time.Time { return time.Date(2030, 1, 8, 8, 0, 0, 0, time.UTC) }
+			if sent, err := d.SendDue(); err != nil || sent != 0 {
+				t.Errorf("Expected nothing for users who opted out, got %d, %v", sent, err)
+			}
+		})
+	}
+}
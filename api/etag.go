@@ -0,0 +1,99 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// document is a response body made from resources.  formatRender writes it
+// with an ETag and answers If-None-Match with a 304 for GETs.  Handlers
+// that change things check If-Match against the document of what they're
+// about to change with checkIfMatch.
+type document struct {
+	Body interface{}
+	// type/id/version of every resource in Body
+	versions []string
+}
+
+func newDocument(body interface{}, rs []resource, included []resource) document {
+	d := document{Body: body}
+	for _, r := range append(append([]resource{}, rs...), included...) {
+		d.versions = append(d.versions, fmt.Sprintf("%s/%d/%d", r.Type.Plural, r.Id, r.Version))
+	}
+	return d
+}
+
+func (d document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Body)
+}
+
+// marshal returns the response body and its ETag.  The ETag is a hash of
+// the body and the versions of the resources in it, so it differs between
+// formats and fieldsets and changes with every update, even ones that put
+// back what was there before.
+func (d document) marshal() ([]byte, string, error) {
+	b, err := json.MarshalIndent(d.Body, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha1.New()
+	h.Write(b)
+	for _, v := range d.versions {
+		io.WriteString(h, v+"\n")
+	}
+	return b, `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// etagMatches returns true if the If-Match or If-None-Match header given
+// lists etag.  Weak ETags only match when weak is set, as If-None-Match
+// allows.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch writes a 412 and returns false if the request has an
+// If-Match header that doesn't match current, the document for the resource
+// as it is now.
+func checkIfMatch(rend render.Render, req *http.Request, current document) bool {
+	if_match := req.Header.Get("If-Match")
+	if if_match == "" {
+		return true
+	}
+	_, etag, err := current.marshal()
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if !etagMatches(if_match, etag, false) {
+		rend.JSON(http.StatusPreconditionFailed, "Changed since it was read, reload and try again")
+		return false
+	}
+	return true
+}
+
+// writeUpdateError writes the response for err from updating something in
+// the store.
+func writeUpdateError(rend render.Render, err error) {
+	if err == db.ErrConflict {
+		rend.JSON(http.StatusConflict, "Changed by someone else at the same time, reload and try again")
+		return
+	}
+	rend.JSON(http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+func TestETags(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadWorkspaceFixture(t, store, "tester", testToken, "text")
+			m := createMartini(store)
+			note_url := fmt.Sprintf("/api/1/notes/%d", f.Note.Id)
+
+			response := serveAs(m, testToken, "GET", note_url, nil)
+			etag := response.Header().Get("ETag")
+			if response.Code != http.StatusOK || etag == "" {
+				t.Fatalf("Expected 200 with an ETag getting the note, got %d: %v", response.Code, response.Header())
+			}
+			response = serveAs(m, testToken, "GET", note_url, nil, "If-None-Match", "W/"+etag)
+			if response.Code != http.StatusNotModified || response.Body.Len() != 0 {
+				t.Errorf("Expected an empty 304 for a matching If-None-Match, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "GET", note_url, nil, "Accept", contentTypeJSONAPI, "If-None-Match", etag)
+			if response.Code != http.StatusOK || response.Header().Get("ETag") == etag {
+				t.Errorf("Expected JSON:API to have a different ETag, got %d: %v", response.Code, response.Header())
+			}
+
+			list := serveAs(m, testToken, "GET", "/api/1/notes", nil)
+			list_etag := list.Header().Get("ETag")
+			response = serveAs(m, testToken, "GET", "/api/1/notes", nil, "If-None-Match", `"other", `+list_etag)
+			if response.Code != http.StatusNotModified {
+				t.Errorf("Expected 304 listing notes, got %d", response.Code)
+			}
+
+			// The first writer wins, the second has to reload.
+			body := `{"note": {"text": "first"}}`
+			response = serveAs(m, testToken, "PUT", note_url, strings.NewReader(body), "If-Match", etag)
+			if response.Code != http.StatusOK {
+				t.Fatalf("Expected 200 updating with the current ETag, got %d: %s", response.Code, response.Body)
+			}
+			new_etag := response.Header().Get("ETag")
+			if new_etag == etag {
+				t.Errorf("Expected the update to change the ETag")
+			}
+			body = `{"note": {"text": "second"}}`
+			response = serveAs(m, testToken, "PUT", note_url, strings.NewReader(body), "If-Match", etag)
+			if response.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 updating with a stale ETag, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "PATCH", note_url, strings.NewReader(`{"text": "second"}`),
+				"Content-Type", contentTypeMergePatch, "If-Match", "W/"+new_etag)
+			if response.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 patching with a weak ETag, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "GET", "/api/1/notes", nil, "If-None-Match", list_etag)
+			if response.Code != http.StatusOK {
+				t.Errorf("Expected the update to change the list's ETag, got %d", response.Code)
+			}
+			n, err := store.InWorkspace(f.Workspace).GetNoteById(f.Note.Id)
+			failOnError(t, err)
+			if n.Text != "first" {
+				t.Errorf("Expected the first update to stick, got %s", n.Text)
+			}
+
+			todo_url := fmt.Sprintf("/api/1/todos/%d", f.Todo.Id)
+			todo_etag := serveAs(m, testToken, "GET", todo_url, nil).Header().Get("ETag")
+			response = serveAs(m, testToken, "PATCH", todo_url, strings.NewReader(`{"text": "done"}`),
+				"Content-Type", contentTypeMergePatch, "If-Match", todo_etag)
+			if response.Code != http.StatusOK {
+				t.Fatalf("Expected 200 patching the todo, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "DELETE", todo_url, nil, "If-Match", todo_etag)
+			if response.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 deleting with a stale ETag, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "DELETE", todo_url, nil, "If-Match", "*")
+			if response.Code != http.StatusNoContent {
+				t.Errorf("Expected 204 deleting with If-Match: *, got %d: %s", response.Code, response.Body)
+			}
+
+			person_url := fmt.Sprintf("/api/1/people/%d", f.Person.Id)
+			person_etag := serveAs(m, testToken, "GET", person_url, nil).Header().Get("ETag")
+			response = serveAs(m, testToken, "DELETE", person_url, nil, "If-Match", etag)
+			if response.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 deleting a person with the wrong ETag, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, testToken, "DELETE", person_url, nil, "If-Match", person_etag)
+			if response.Code != http.StatusNoContent {
+				t.Errorf("Expected 204 deleting a person with their ETag, got %d: %s", response.Code, response.Body)
+			}
+		})
+	}
+}
+
+// The ETag of a redacted view has to match when it's sent back in If-Match.
+func TestETagsOfRedactedViews(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadWorkspaceFixture(t, store, "tester", testToken, "text")
+			editor := &db.User{Name: "editor", Token: "editortoken"}
+			failOnError(t, store.CreateUser(editor))
+			failOnError(t, store.SetMember(f.Workspace, editor, db.RoleEditor))
+			f.Note.Confidential = true
+			failOnError(t, store.InWorkspace(f.Workspace).UpdateNote(f.Note))
+			m := createMartini(store)
+
+			// The note has no author, so the editor can change it but only
+			// sees it redacted.
+			note_url := fmt.Sprintf("/api/1/notes/%d", f.Note.Id)
+			response := serveAs(m, "editortoken", "GET", note_url, nil)
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), redactedText) {
+				t.Fatalf("Expected the redacted note, got %d: %s", response.Code, response.Body)
+			}
+			etag := response.Header().Get("ETag")
+			response = serveAs(m, "editortoken", "PUT", note_url, strings.NewReader(`{"note": {"category": "x"}}`), "If-Match", etag)
+			if response.Code != http.StatusOK {
+				t.Errorf("Expected 200 updating the redacted note with its ETag, got %d: %s", response.Code, response.Body)
+			}
+
+			person_url := fmt.Sprintf("/api/1/people/%d?redact=true", f.Person.Id)
+			etag = serveAs(m, testToken, "GET", person_url, nil).Header().Get("ETag")
+			response = serveAs(m, testToken, "DELETE", person_url, nil, "If-Match", etag)
+			if response.Code != http.StatusNoContent {
+				t.Errorf("Expected 204 deleting a person with the ETag of their redacted view, got %d: %s", response.Code, response.Body)
+			}
+		})
+	}
+}
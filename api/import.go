@@ -0,0 +1,246 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/ical"
+	"github.com/martini-contrib/render"
+)
+
+// POST /import/ics reads an iCalendar file, sent as the body or as the
+// "file" field of a multipart form, and records every event that people in
+// the workspace attend as a 1:1 with each of them: a note by the user in
+// db.CategoryOneOnOne, dated when the event starts.  Attendees are matched
+// to people by email address or, failing that, by name.  With
+// ?prep_todos=true each new 1:1 also gets a todo to prepare for it, due
+// when it starts.
+//
+// Notes remember the UID of their event, so importing the same file again
+// changes nothing and importing a newer one moves rescheduled 1:1s.
+// Cancelled events and changes to single occurrences of recurring ones
+// are skipped.
+const (
+	prepTodosParam  = "prep_todos"
+	importFileField = "file"
+	maxImportSize   = 10 << 20
+)
+
+type importResult struct {
+	UID     string     `json:"uid"`
+	Summary string     `json:"summary"`
+	Start   *time.Time `json:"start,omitempty"`
+	// created, updated, unchanged, unmatched or skipped
+	Status string `json:"status"`
+	// Why the event was skipped
+	Reason string  `json:"reason,omitempty"`
+	Notes  []int64 `json:"notes,omitempty"`
+	Todos  []int64 `json:"todos,omitempty"`
+}
+
+type ImportResultsJSON struct {
+	Results []importResult `json:"results"`
+}
+
+// importFile returns the iCalendar file sent with req.
+func importFile(req *http.Request) (io.Reader, error) {
+	req.Body = http.MaxBytesReader(nil, req.Body, maxImportSize)
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := req.FormFile(importFileField)
+		return f, err
+	}
+	return req.Body, nil
+}
+
+// attendeeMatcher finds the people attending an event.
+type attendeeMatcher struct {
+	byEmail map[string]*db.Person
+	byName  map[string]*db.Person
+}
+
+func newAttendeeMatcher(people []*db.Person) attendeeMatcher {
+	m := attendeeMatcher{map[string]*db.Person{}, map[string]*db.Person{}}
+	for _, p := range people {
+		if p.Email != "" {
+			m.byEmail[strings.ToLower(p.Email)] = p
+		}
+		m.byName[strings.ToLower(strings.TrimSpace(p.Name))] = p
+	}
+	return m
+}
+
+// match returns the people attending ev, each once.
+func (m attendeeMatcher) match(ev *ical.Component) []*db.Person {
+	var found []*db.Person
+	seen := map[int64]bool{}
+	for _, prop := range ev.Properties {
+		if prop.Name != "ATTENDEE" {
+			continue
+		}
+		email := strings.TrimPrefix(strings.ToLower(prop.Value), "mailto:")
+		p, ok := m.byEmail[email]
+		if !ok {
+			p, ok = m.byName[strings.ToLower(strings.TrimSpace(prop.Params["CN"]))]
+		}
+		if ok && !seen[p.Id] {
+			seen[p.Id] = true
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// importKey identifies the 1:1 imported from an event with a person.  Each
+// user has their own.
+func importKey(uid string, person_id int64) string {
+	return fmt.Sprintf("%d/%s", person_id, uid)
+}
+
+// importEvent records ev as a 1:1 with everyone in it.  imported holds the
+// user's notes that were already imported, by importKey.
+func importEvent(ev *ical.Component, tx db.Store, u *db.User, matcher attendeeMatcher, imported map[string]*db.Note, prep_todos bool) (importResult, error) {
+	r := importResult{UID: ev.Text("UID"), Summary: ev.Text("SUMMARY"), Status: "skipped"}
+	if r.UID == "" {
+		r.Reason = "no UID"
+		return r, nil
+	}
+	if _, ok := ev.Get("RECURRENCE-ID"); ok {
+		r.Reason = "changes a single occurrence of a recurring event"
+		return r, nil
+	}
+	if strings.EqualFold(ev.Text("STATUS"), "CANCELLED") {
+		r.Reason = "cancelled"
+		return r, nil
+	}
+	start, err := ev.Time("DTSTART")
+	if err != nil {
+		r.Reason = fmt.Sprintf("invalid DTSTART: %s", err)
+		return r, nil
+	}
+	r.Start = &start
+
+	people := matcher.match(ev)
+	if len(people) == 0 {
+		r.Status = "unmatched"
+		return r, nil
+	}
+	text := r.Summary
+	if text == "" {
+		text = "1:1"
+	}
+	if description := ev.Text("DESCRIPTION"); description != "" {
+		text += "\n\n" + description
+	}
+
+	r.Status = "unchanged"
+	for _, p := range people {
+		if n, ok := imported[importKey(r.UID, p.Id)]; ok {
+			if n.Date.Equal(start) {
+				continue
+			}
+			n.Date = start
+			if err := tx.UpdateNote(n); err != nil {
+				return r, err
+			}
+			r.Notes = append(r.Notes, n.Id)
+			if r.Status != "created" {
+				r.Status = "updated"
+			}
+			continue
+		}
+
+		n := &db.Note{
+			Person:     p,
+			Author:     u,
+			Text:       text,
+			Category:   db.CategoryOneOnOne,
+			Date:       start,
+			ExternalId: r.UID,
+		}
+		if err := tx.CreateNote(n); err != nil {
+			return r, err
+		}
+		imported[importKey(r.UID, p.Id)] = n
+		r.Notes = append(r.Notes, n.Id)
+		r.Status = "created"
+		if prep_todos {
+			t := &db.Todo{
+				Person:   p,
+				Text:     "Prepare for " + strings.SplitN(text, "\n", 2)[0],
+				Category: db.CategoryOneOnOne,
+				Date:     start,
+			}
+			if err := tx.CreateTodo(t); err != nil {
+				return r, err
+			}
+			r.Todos = append(r.Todos, t.Id)
+		}
+	}
+	return r, nil
+}
+
+func importCalendar(rend render.Render, req *http.Request, u *db.User, m *db.Membership, store db.Store, policy *Policy) {
+	prep_todos := false
+	if v := req.URL.Query().Get(prepTodosParam); v != "" {
+		var err error
+		prep_todos, err = strconv.ParseBool(v)
+		if err != nil {
+			rend.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", prepTodosParam, err))
+			return
+		}
+	}
+	if prep_todos && !canReadTodos(rend, policy) {
+		return
+	}
+	f, err := importFile(req)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	cal, err := ical.Parse(f)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid iCalendar file: %s", err))
+		return
+	}
+
+	scoped := store.InWorkspace(m.Workspace)
+	people, err := scoped.GetPeopleById(nil)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	matcher := newAttendeeMatcher(people)
+	notes, err := scoped.GetNotesById(nil)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	imported := map[string]*db.Note{}
+	for _, n := range notes {
+		if n.ExternalId != "" && n.Author != nil && n.Author.Id == u.Id {
+			imported[importKey(n.ExternalId, n.Person.Id)] = n
+		}
+	}
+
+	results := []importResult{}
+	err = scoped.InTx(func(tx db.Store) error {
+		for _, ev := range cal.All("VEVENT") {
+			r, err := importEvent(ev, tx, u, matcher, imported, prep_todos)
+			if err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+		return nil
+	})
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, ImportResultsJSON{results})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+)
+
+const testImport = `BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+UID:weekly-bob@example.com
+SUMMARY:Bob / Me
+DTSTART:20300107T150000Z
+RRULE:FREQ=WEEKLY
+ATTENDEE;CN=Me:mailto:me@example.com
+ATTENDEE;CN=Robert:mailto:BOB@example.com
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly-bob@example.com
+RECURRENCE-ID:20300114T150000Z
+DTSTART:20300115T150000Z
+ATTENDEE:mailto:bob@example.com
+END:VEVENT
+BEGIN:VEVENT
+UID:carol@example.com
+SUMMARY:Carol and Me
+DESCRIPTION:Talk about the roadmap\, again
+DTSTART;TZID=UTC:%s
+ATTENDEE;CN=carol:mailto:carol@elsewhere.example.com
+END:VEVENT
+BEGIN:VEVENT
+UID:all-hands@example.com
+DTSTART:20300101T170000Z
+ATTENDEE;CN=Everyone:mailto:all@example.com
+END:VEVENT
+BEGIN:VEVENT
+UID:cancelled@example.com
+STATUS:CANCELLED
+DTSTART:20300101T170000Z
+ATTENDEE;CN=Carol:mailto:carol@example.com
+END:VEVENT
+END:VCALENDAR
+`
+
+// serveImport imports the test calendar with Carol's 1:1 at carol_start
+// and returns the status of each event.
+func serveImport(t *testing.T, m *martini.Martini, query string, carol_start string) []string {
+	response := serveAs(m, testToken, "POST", "/api/1/import/ics"+query,
+		strings.NewReader(fmt.Sprintf(testImport, carol_start)), "Content-Type", "text/calendar")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected the calendar to be imported, got %d: %s", response.Code, response.Body)
+	}
+	results := ImportResultsJSON{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &results))
+	statuses := []string{}
+	for _, r := range results.Results {
+		statuses = append(statuses, r.Status)
+	}
+	return statuses
+}
+
+func TestImportCalendar(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			scoped := store.InWorkspace(ws)
+			bob := &db.Person{Name: "Bob", Email: "bob@example.com"}
+			carol := &db.Person{Name: "Carol"}
+			failOnError(t, scoped.CreatePerson(bob))
+			failOnError(t, scoped.CreatePerson(carol))
+			m := createMartini(store)
+
+			statuses := serveImport(t, m, "?prep_todos=true", "20300102T090000")
+			expected := "[created skipped created unmatched skipped]"
+			if fmt.Sprint(statuses) != expected {
+				t.Fatalf("Expected %s, got %v", expected, statuses)
+			}
+			notes, err := scoped.GetNotesById(nil)
+			failOnError(t, err)
+			if len(notes) != 2 || notes[0].Person.Id != bob.Id || notes[0].Category != db.CategoryOneOnOne {
+				t.Fatalf("Expected a 1:1 with Bob and Carol, got %+v", notes)
+			}
+			if notes[1].Text != "Carol and Me\n\nTalk about the roadmap, again" || notes[1].Date.Hour() != 9 {
+				t.Errorf("Expected Carol's 1:1 at 9, got %+v", notes[1])
+			}
+			todos, err := scoped.GetTodos()
+			failOnError(t, err)
+			if len(todos) != 2 || todos[0].Text != "Prepare for Bob / Me" || !todos[0].Date.Equal(notes[0].Date) {
+				t.Errorf("Expected a prep todo for each 1:1, got %+v", todos)
+			}
+
+			// Importing again only moves what was rescheduled.
+			statuses = serveImport(t, m, "?prep_todos=true", "20300102T100000")
+			if fmt.Sprint(statuses) != "[unchanged skipped updated unmatched skipped]" {
+				t.Errorf("Expected only Carol's 1:1 to be updated, got %v", statuses)
+			}
+			notes, err = scoped.GetNotesById(nil)
+			failOnError(t, err)
+			todos, err = scoped.GetTodos()
+			failOnError(t, err)
+			if len(notes) != 2 || len(todos) != 2 || notes[1].Date.Hour() != 10 {
+				t.Errorf("Expected Carol's 1:1 to be moved and nothing else, got %+v and %+v", notes, todos)
+			}
+
+			var b bytes.Buffer
+			w := multipart.NewWriter(&b)
+			part, err := w.CreateFormFile("file", "calendar.ics")
+			failOnError(t, err)
+			fmt.Fprintf(part, testImport, "20300102T100000")
+			w.Close()
+			response := serveAs(m, testToken, "POST", "/api/1/import/ics", &b, "Content-Type", w.FormDataContentType())
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"unchanged"`) {
+				t.Errorf("Expected a multipart upload to be imported, got %d: %s", response.Code, response.Body)
+			}
+
+			response = serveAs(m, testToken, "POST", "/api/1/import/ics", strings.NewReader("BEGIN:VCALENDAR\r\n"))
+			if response.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for a broken calendar, got %d", response.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,506 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/smtpd"
+	"github.com/martini-contrib/render"
+)
+
+// Users can forward email to pointyhair to have it become notes.  POST
+// /inbox gives them an address with a token of their own in it, like the
+// calendar feed's, and DELETE /inbox stops mail to it being taken in.  Mail
+// to <token>+<person>@ becomes a note about the person named by the tag
+// (their name without spaces or punctuation, the start of their email
+// address or their id) and mail without a tag a note about the person
+// named at the start of the subject ("Bob: ..." or "[Bob] ..."), or by all
+// of it.  Only people in workspaces the user can write to are looked for,
+// and exactly one has to match.
+//
+// The note is the subject and the message's text, dated when the message
+// was sent, by the user, with the message's other parts as attachments.
+// It remembers the message's Message-ID so a message delivered twice is
+// only taken in once.
+const (
+	inboxTagSeparator = "+"
+	// Longer text is cut short, like notes sent to the api can't be longer
+	maxInboundText = 65536
+	// Multipart messages nested deeper than this are refused
+	maxMIMEDepth = 10
+)
+
+type inboxJSON struct {
+	Id      int64  `json:"id"`
+	Address string `json:"address"`
+}
+
+// inboxAddress returns the address mail for u is sent to, at the host
+// req was made to.
+func inboxAddress(req *http.Request, u *db.User) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("%s@%s", u.InboxToken, host)
+}
+
+func enableInbox(rend render.Render, req *http.Request, u *db.User, store db.Store, s Serializer) {
+	if u.InboxToken == "" {
+		token, err := db.NewToken()
+		if err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		u.InboxToken = token
+		if err := store.SetInboxToken(u); err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	rend.JSON(http.StatusOK, s.One(newResource(inboxType, u.Id, inboxJSON{u.Id, inboxAddress(req, u)}), nil))
+}
+
+func disableInbox(rend render.Render, u *db.User, store db.Store) {
+	u.InboxToken = ""
+	if err := store.SetInboxToken(u); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
+
+// inboundAttachment is a part of a message that isn't its text.
+type inboundAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// inboundMessage is what's kept of an email.
+type inboundMessage struct {
+	Subject   string
+	Date      time.Time
+	MessageId string
+	// The text/plain body, or the text/html one with the markup removed
+	Text        string
+	Attachments []inboundAttachment
+	// While parsing
+	plain, html *string
+}
+
+var (
+	wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+	// Reply and forward prefixes on subjects, in a few languages
+	subjectPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|wg|tr|sv|vs)\s*:\s*`)
+	// "Bob: text" and "[Bob] text"
+	subjectColon   = regexp.MustCompile(`^([^:]{1,255}):\s*(.*)$`)
+	subjectBracket = regexp.MustCompile(`^\[([^\]]{1,255})\]\s*(.*)$`)
+	// Markup left out of html bodies entirely
+	htmlHidden = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)\s*>`)
+	// Markup that starts a new line
+	htmlBreak = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6])\b[^>]*>`)
+	htmlTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankRuns = regexp.MustCompile(`\n{3,}`)
+)
+
+// charsetReader decodes Latin-1, which is all the charsets besides UTF-8
+// and ASCII that are understood.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unknown charset %s", charset)
+}
+
+// decodeText returns a text part's body as UTF-8.
+func decodeText(b []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "us-ascii":
+	default:
+		if r, err := charsetReader(charset, bytes.NewReader(b)); err == nil {
+			b, _ = ioutil.ReadAll(r)
+		}
+	}
+	return strings.ToValidUTF8(string(b), "�")
+}
+
+// htmlToText returns the text of an html body.
+func htmlToText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(strings.Join(strings.Fields(line), " "))
+	}
+	return blankRuns.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
+
+// cleanText tidies up a message's text and cuts off its signature.
+func cleanText(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	if i := strings.Index(s, "\n-- \n"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// transferDecoder undoes a part's Content-Transfer-Encoding.
+// multipart.Reader has already undone quoted-printable for parts.
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// newlineStripper leaves the line breaks out of base64 bodies.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	kept := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[kept] = c
+			kept++
+		}
+	}
+	return kept, err
+}
+
+// walkPart adds a part of a message, and all the parts inside it, to m.
+func (m *inboundMessage) walkPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxMIMEDepth {
+		return fmt.Errorf("parts nested more than %d deep", maxMIMEDepth)
+	}
+	media, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		media, params = "text/plain", map[string]string{}
+	}
+	body = transferDecoder(header.Get("Content-Transfer-Encoding"), body)
+
+	if strings.HasPrefix(media, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.walkPart(p.Header, p, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := wordDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	if disposition != "attachment" && filename == "" {
+		if media == "text/plain" && m.plain == nil {
+			text := decodeText(b, params["charset"])
+			m.plain = &text
+			return nil
+		}
+		if media == "text/html" && m.html == nil {
+			text := decodeText(b, params["charset"])
+			m.html = &text
+			return nil
+		}
+	}
+	if filename == "" {
+		filename = "attachment"
+		if media == "message/rfc822" {
+			filename = "message.eml"
+		}
+	}
+	m.Attachments = append(m.Attachments, inboundAttachment{filename, media, b})
+	return nil
+}
+
+// parseInbound reads an RFC 5322 message.
+func parseInbound(r io.Reader) (*inboundMessage, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	m := &inboundMessage{
+		Subject:   strings.TrimSpace(subject),
+		MessageId: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		m.Date = date
+	}
+	if err := m.walkPart(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	if m.plain != nil {
+		m.Text = cleanText(*m.plain)
+	} else if m.html != nil {
+		m.Text = cleanText(htmlToText(*m.html))
+	}
+	return m, nil
+}
+
+// personKey is what people's names and tags are compared by: lowercase
+// letters and digits only, so that bob.smith and "Bob Smith" match.
+func personKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// candidate is a person mail might be about, in a workspace the user can
+// write to.
+type candidate struct {
+	m *db.Membership
+	p *db.Person
+}
+
+// matchTag returns the candidates an address tag names.
+func matchTag(candidates []candidate, tag string) []candidate {
+	key := personKey(tag)
+	id, _ := strconv.ParseInt(tag, 10, 64)
+	var found []candidate
+	for _, c := range candidates {
+		local := strings.SplitN(c.p.Email, "@", 2)[0]
+		if (key != "" && personKey(c.p.Name) == key) || (local != "" && strings.EqualFold(local, tag)) || c.p.Id == id {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// matchSubject returns the candidates a subject names and what's left of
+// the subject.
+func matchSubject(candidates []candidate, subject string) ([]candidate, string) {
+	for subjectPrefix.MatchString(subject) {
+		subject = subjectPrefix.ReplaceAllString(subject, "")
+	}
+	for _, pattern := range []*regexp.Regexp{subjectBracket, subjectColon} {
+		if parts := pattern.FindStringSubmatch(subject); parts != nil {
+			if found := matchName(candidates, parts[1]); len(found) > 0 {
+				return found, parts[2]
+			}
+		}
+	}
+	return matchName(candidates, subject), ""
+}
+
+func matchName(candidates []candidate, name string) []candidate {
+	key := personKey(name)
+	var found []candidate
+	for _, c := range candidates {
+		if key != "" && personKey(c.p.Name) == key {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// noteText returns the text of the note made from m, with title in
+// place of the subject.  Attachments too big to keep are listed at the end.
+func noteText(m *inboundMessage, title string) string {
+	var parts []string
+	if title = strings.TrimSpace(title); title != "" {
+		parts = append(parts, title)
+	}
+	if m.Text != "" {
+		parts = append(parts, m.Text)
+	}
+	var too_big []string
+	for _, a := range m.Attachments {
+		if len(a.Data) > maxAttachmentSize {
+			too_big = append(too_big, a.Filename)
+		}
+	}
+	if len(too_big) > 0 {
+		parts = append(parts, "Attachments too big to keep: "+strings.Join(too_big, ", "))
+	}
+	if len(parts) == 0 {
+		return "(empty email)"
+	}
+	text := strings.Join(parts, "\n\n")
+	if utf8.RuneCountInString(text) > maxInboundText {
+		text = string([]rune(text)[:maxInboundText])
+	}
+	return text
+}
+
+// MailIngester makes notes from the email users forward to pointyhair.
+type MailIngester struct {
+	store db.Store
+}
+
+func NewMailIngester(store db.Store) *MailIngester {
+	return &MailIngester{store: hookedStore{Store: store}}
+}
+
+// Deliver takes in a message sent to the given recipients.  It's an
+// smtpd.Handler.  The message is accepted if any recipient takes it in.
+func (ing *MailIngester) Deliver(from string, to []string, data []byte) error {
+	m, err := parseInbound(bytes.NewReader(data))
+	if err != nil {
+		return &smtpd.Error{Code: 554, Message: fmt.Sprintf("Can't read message: %s", err)}
+	}
+	var first_err error
+	delivered := 0
+	for _, rcpt := range to {
+		err := ing.deliverTo(rcpt, m)
+		if err != nil {
+			glog.Infof("Not taking in mail from %s to %s: %s", from, rcpt, err)
+			if first_err == nil {
+				first_err = err
+			}
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return first_err
+	}
+	return nil
+}
+
+// deliverTo takes in m for the user and person named by rcpt.
+func (ing *MailIngester) deliverTo(rcpt string, m *inboundMessage) error {
+	local := rcpt
+	if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+		local = rcpt[:i]
+	}
+	parts := strings.SplitN(local, inboxTagSeparator, 2)
+	u, err := ing.store.GetUserByInboxToken(parts[0])
+	if err == db.ErrNotFound {
+		return &smtpd.Error{Code: 550, Message: "No such mailbox"}
+	}
+	if err != nil {
+		return err
+	}
+
+	ms, err := ing.store.GetMemberships(u)
+	if err != nil {
+		return err
+	}
+	var candidates []candidate
+	for _, mem := range ms {
+		if !mem.CanWrite() {
+			continue
+		}
+		people, err := ing.store.InWorkspace(mem.Workspace).GetPeopleById(nil)
+		if err != nil {
+			return err
+		}
+		for _, p := range people {
+			candidates = append(candidates, candidate{mem, p})
+		}
+	}
+	var found []candidate
+	title := m.Subject
+	if len(parts) == 2 {
+		found = matchTag(candidates, parts[1])
+	} else {
+		found, title = matchSubject(candidates, m.Subject)
+	}
+	if len(found) == 0 {
+		return &smtpd.Error{Code: 550, Message: "No person matches the address or subject"}
+	}
+	if len(found) > 1 {
+		return &smtpd.Error{Code: 550, Message: "More than one person matches the address or subject"}
+	}
+	c := found[0]
+
+	scoped := ing.store.InWorkspace(c.m.Workspace)
+	if m.MessageId != "" {
+		notes, err := scoped.GetNotesById(nil)
+		if err != nil {
+			return err
+		}
+		for _, n := range notes {
+			if n.ExternalId == m.MessageId && n.Author != nil && n.Author.Id == u.Id && n.Person.Id == c.p.Id {
+				return nil
+			}
+		}
+	}
+	return scoped.InTx(func(tx db.Store) error {
+		n := &db.Note{
+			Person:     c.p,
+			Author:     u,
+			Text:       noteText(m, title),
+			Date:       m.Date,
+			ExternalId: m.MessageId,
+		}
+		if err := tx.CreateNote(n); err != nil {
+			return err
+		}
+		for _, att := range m.Attachments {
+			if len(att.Data) > maxAttachmentSize {
+				continue
+			}
+			filename := cleanFilename(att.Filename)
+			a := &db.Attachment{
+				Person:      c.p,
+				Note:        n,
+				Uploader:    u,
+				Filename:    filename,
+				ContentType: sniffContentType(filename, att.Data),
+			}
+			if err := tx.CreateAttachment(a, att.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+	"github.com/hobeone/pointyhair/smtpd"
+)
+
+const plainEmail = `From: Tester <tester@example.com>
+To: inbox+bob.smith@example.com
+Subject: Re: Promotion
+Date: Tue, 1 Jan 2030 10:00:00 +0100
+Message-ID: <1234@example.com>
+Content-Transfer-Encoding: quoted-printable
+
+Bob wants to talk about his promotion.
+--=20
+Sent from my phone
+`
+
+const forwardedEmail = `From: Tester <tester@example.com>
+Subject: Fwd: [carol] =?utf-8?q?Caf=C3=A9?= chat
+Date: Wed, 2 Jan 2030 09:00:00 +0000
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Carol liked the caf=C3=A9.
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Carol liked the <b>caf&eacute;</b>.</p>
+--inner--
+--outer
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="review.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`
+
+const htmlEmail = `From: tester@example.com
+Subject: Carol: Offsite
+Content-Type: text/html; charset=iso-8859-1
+Content-Transfer-Encoding: base64
+
+PGh0bWw+PGhlYWQ+PHN0eWxlPnB7fTwvc3R5bGU+PC9oZWFkPjxib2R5PjxwPkNhcm9sIGlzIGdv
+aW5nPC9wPjxwPnRvIGNoYWlyLjwvcD48L2JvZHk+PC9odG1sPg==
+`
+
+func TestParseInbound(t *testing.T) {
+	m, err := parseInbound(strings.NewReader(forwardedEmail))
+	failOnError(t, err)
+	if m.Subject != "Fwd: [carol] Café chat" || m.Text != "Carol liked the café." {
+		t.Errorf("Expected the decoded subject and text part, got %q and %q", m.Subject, m.Text)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Filename != "review.pdf" ||
+		m.Attachments[0].ContentType != "application/pdf" || string(m.Attachments[0].Data) != "%PDF-1.4\n" {
+		t.Errorf("Expected the decoded attachment, got %+v", m.Attachments)
+	}
+
+	m, err = parseInbound(strings.NewReader(htmlEmail))
+	failOnError(t, err)
+	if m.Text != "Carol is going\nto chair." {
+		t.Errorf("Expected the text of the html, got %q", m.Text)
+	}
+
+	m, err = parseInbound(strings.NewReader(plainEmail))
+	failOnError(t, err)
+	if m.Text != "Bob wants to talk about his promotion." || m.MessageId != "1234@example.com" {
+		t.Errorf("Expected the text without its signature, got %q", m.Text)
+	}
+}
+
+func TestInbound(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			tester, err := store.GetUserByName("tester")
+			failOnError(t, err)
+			scoped := store.InWorkspace(ws)
+			bob := &db.Person{Name: "Bob Smith"}
+			carol := &db.Person{Name: "Carol", Email: "cjones@example.com"}
+			failOnError(t, scoped.CreatePerson(bob))
+			failOnError(t, scoped.CreatePerson(carol))
+			// Only readable, so never matched
+			viewer := &db.User{Name: "owner", Token: "owner-token"}
+			failOnError(t, store.CreateUser(viewer))
+			ro := &db.Workspace{Name: "read only"}
+			failOnError(t, store.CreateWorkspace(ro, viewer))
+			failOnError(t, store.SetMember(ro, tester, db.RoleViewer))
+			failOnError(t, store.InWorkspace(ro).CreatePerson(&db.Person{Name: "Bob Smith"}))
+			m := createMartini(store)
+
+			response := serveAs(m, testToken, "POST", "/api/1/inbox", nil)
+			doc := struct {
+				Inbox inboxJSON `json:"inbox"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+			if response.Code != http.StatusOK || !strings.HasSuffix(doc.Inbox.Address, "@") {
+				t.Fatalf("Expected an inbox address, got %d: %s", response.Code, response.Body)
+			}
+			token := strings.Split(doc.Inbox.Address, "@")[0]
+
+			ing := NewMailIngester(store)
+			deliver := func(to string, msg string) error {
+				return ing.Deliver("tester@example.com", []string{to}, []byte(msg))
+			}
+			failOnError(t, deliver(token+"+bob.smith@pointyhair.example.com", plainEmail))
+			// Delivered again
+			failOnError(t, deliver(token+"+bob.smith@pointyhair.example.com", plainEmail))
+			failOnError(t, deliver(token+"@pointyhair.example.com", forwardedEmail))
+			failOnError(t, deliver(token+"+cjones@pointyhair.example.com", htmlEmail))
+
+			if err, ok := deliver("nobody+bob@pointyhair.example.com", plainEmail).(*smtpd.Error); !ok || err.Code != 550 {
+				t.Errorf("Expected mail to unknown addresses to be refused, got %v", err)
+			}
+			if err, ok := deliver(token+"+dave@pointyhair.example.com", plainEmail).(*smtpd.Error); !ok || err.Code != 550 {
+				t.Errorf("Expected mail about unknown people to be refused, got %v", err)
+			}
+			if err := deliver(token+"@pointyhair.example.com", "Subject: Nobody\n\nhi\n"); err == nil {
+				t.Errorf("Expected mail with no one in the subject to be refused")
+			}
+
+			notes, err := scoped.GetNotesById(nil)
+			failOnError(t, err)
+			if len(notes) != 3 {
+				t.Fatalf("Expected 3 notes, got %d", len(notes))
+			}
+			if notes[0].Person.Id != bob.Id || notes[0].Author.Id != tester.Id ||
+				notes[0].Text != "Re: Promotion\n\nBob wants to talk about his promotion." ||
+				!notes[0].Date.Equal(time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)) {
+				t.Errorf("Expected a note about Bob dated when the email was sent, got %+v", notes[0])
+			}
+			if notes[1].Person.Id != carol.Id || notes[1].Text != "Café chat\n\nCarol liked the café." {
+				t.Errorf("Expected a note about Carol from the subject, got %q", notes[1].Text)
+			}
+			as, err := scoped.GetNoteAttachments(notes[1])
+			failOnError(t, err)
+			if len(as) != 1 || as[0].Filename != "review.pdf" || as[0].ContentType != "application/pdf" {
+				t.Fatalf("Expected the email's attachment on the note, got %+v", as)
+			}
+			if data, err := scoped.GetAttachmentData(as[0]); err != nil || string(data) != "%PDF-1.4\n" {
+				t.Errorf("Expected the attachment's content, got %q, %v", data, err)
+			}
+			if notes[2].Person.Id != carol.Id || notes[2].Text != "Carol: Offsite\n\nCarol is going\nto chair." {
+				t.Errorf("Expected a note about Carol from her email address, got %q", notes[2].Text)
+			}
+
+			if response := serveAs(m, testToken, "DELETE", "/api/1/inbox", nil); response.Code != http.StatusNoContent {
+				t.Errorf("Expected the inbox to be turned off, got %d", response.Code)
+			}
+			if err, ok := deliver(token+"+bob.smith@pointyhair.example.com", forwardedEmail).(*smtpd.Error); !ok || err.Code != 550 {
+				t.Errorf("Expected mail to be refused once the inbox is off, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInboundOverSMTP(t *testing.T) {
+	store := dbtest.NewFakeStore()
+	ws := setupTestWorkspace(t, store, "tester", testToken)
+	failOnError(t, store.InWorkspace(ws).CreatePerson(&db.Person{Name: "Bob Smith"}))
+	u, err := store.GetUserByName("tester")
+	failOnError(t, err)
+	u.InboxToken = "inbox"
+	failOnError(t, store.SetInboxToken(u))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnError(t, err)
+	defer l.Close()
+	s := &smtpd.Server{Handler: NewMailIngester(store).Deliver}
+	go s.Serve(l)
+
+	msg := strings.Replace(plainEmail, "\n", "\r\n", -1)
+	failOnError(t, smtp.SendMail(l.Addr().String(), nil, "tester@example.com", []string{"inbox+bob.smith@example.com"}, []byte(msg)))
+	err = smtp.SendMail(l.Addr().String(), nil, "tester@example.com", []string{"inbox+nobody@example.com"}, []byte(msg))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("Expected mail about nobody to be refused, got %v", err)
+	}
+	notes, err := store.GetNotesById(nil)
+	failOnError(t, err)
+	if len(notes) != 1 || !strings.HasPrefix(notes[0].Text, "Re: Promotion") {
+		t.Errorf("Expected the email as a note, got %+v", notes)
+	}
+}
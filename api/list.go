@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// Lists of people, notes and todos can be narrowed to what was created or
+// updated in a time range and sorted, e.g.
+//
+//	/notes?updated_after=2020-01-02T00:00:00Z&sort=-updated_at,id
+//
+// Times are RFC 3339 and both ends of a range are exclusive.  The store
+// does the filtering and sorting in its query, as the timestamps aren't
+// encrypted; only the policy's filtering happens after reading.
+const sortParam = "sort"
+
+// parseListParams reads the filters and sort order of a list of kind from
+// the parsed form of req.  People have no date to sort by.
+func parseListParams(req *http.Request, kind resourceType) (db.ListOptions, error) {
+	o := db.ListOptions{}
+	times := []struct {
+		param string
+		t     *time.Time
+	}{
+		{"created_after", &o.CreatedAfter},
+		{"created_before", &o.CreatedBefore},
+		{"updated_after", &o.UpdatedAfter},
+		{"updated_before", &o.UpdatedBefore},
+	}
+	for _, p := range times {
+		v := req.Form.Get(p.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return o, fmt.Errorf("Invalid %s: %s", p.param, err)
+		}
+		*p.t = t
+	}
+
+	if req.Form.Get(sortParam) == "" {
+		return o, nil
+	}
+	for _, key := range strings.Split(req.Form.Get(sortParam), ",") {
+		key = strings.TrimSpace(key)
+		switch name := strings.TrimPrefix(key, "-"); {
+		case name == "id", name == "created_at", name == "updated_at":
+		case name == "date" && kind != personType:
+		default:
+			return o, fmt.Errorf("Can't sort %s by %q", kind.Plural, name)
+		}
+		o.OrderBy = append(o.OrderBy, key)
+	}
+	return o, nil
+}
+
+// inRequestOrder returns the position of each of ids, for putting a list
+// asked for by ids back in the order asked for when no sort was given.
+func inRequestOrder(ids []int64) map[int64]int {
+	order := make(map[int64]int, len(ids))
+	for i, id := range ids {
+		order[id] = i
+	}
+	return order
+}
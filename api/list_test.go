@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+func TestListFiltersAndSort(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			scoped := store.InWorkspace(ws)
+			p := &db.Person{Name: "Bob"}
+			failOnError(t, scoped.CreatePerson(p))
+			var notes []*db.Note
+			for _, day := range []int{1, 3, 2} {
+				n := &db.Note{Person: p, Text: "note", Date: time.Date(2020, 1, day, 0, 0, 0, 0, time.UTC)}
+				failOnError(t, scoped.CreateNote(n))
+				notes = append(notes, n)
+			}
+			undated := &db.Todo{Person: p, Text: "undated"}
+			failOnError(t, scoped.CreateTodo(undated))
+			m := createMartini(store)
+
+			created := notes[0].CreatedAt
+			tests := []struct {
+				query string
+				ids   []int64
+			}{
+				{"", []int64{1, 2, 3}},
+				{"sort=date", []int64{1, 3, 2}},
+				{"sort=-date", []int64{2, 3, 1}},
+				{"sort=-id", []int64{3, 2, 1}},
+				{"sort=created_at,-date", []int64{2, 3, 1}},
+				{"created_after=" + url.QueryEscape(created.Add(-time.Hour).Format(time.RFC3339)), []int64{1, 2, 3}},
+				{"created_before=" + url.QueryEscape(created.Format(time.RFC3339)), []int64{}},
+				{"updated_after=" + url.QueryEscape(created.Format(time.RFC3339)), []int64{}},
+				{"ids[]=3&ids[]=1&sort=date", []int64{1, 3}},
+			}
+			for _, test := range tests {
+				response := serveAs(m, testToken, "GET", "/api/1/notes?"+test.query, nil)
+				if response.Code != http.StatusOK {
+					t.Errorf("Expected 200 for %s, got %d: %s", test.query, response.Code, response.Body)
+					continue
+				}
+				listed := NotesJSON{}
+				failOnError(t, json.Unmarshal(response.Body.Bytes(), &listed))
+				ids := []int64{}
+				for _, n := range listed.Notes {
+					ids = append(ids, n.Id)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+					t.Errorf("Expected notes %v for %s, got %v", test.ids, test.query, ids)
+				}
+			}
+
+			response := serveAs(m, testToken, "GET", fmt.Sprintf("/api/1/todos/%d", undated.Id), nil)
+			todo := struct {
+				Todo struct {
+					Date      time.Time `json:"date"`
+					CreatedAt time.Time `json:"created_at"`
+					UpdatedAt time.Time `json:"updated_at"`
+				} `json:"todo"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &todo))
+			if todo.Todo.Date.IsZero() || !todo.Todo.Date.Equal(todo.Todo.CreatedAt) || !todo.Todo.UpdatedAt.Equal(todo.Todo.CreatedAt) {
+				t.Errorf("Expected an undated todo to be dated when it was created, got %s", response.Body)
+			}
+
+			for _, url := range []string{
+				"/api/1/notes?sort=text",
+				"/api/1/todos?created_after=yesterday",
+				"/api/1/people?sort=date",
+			} {
+				response := serveAs(m, testToken, "GET", url, nil)
+				if response.Code != http.StatusBadRequest {
+					t.Errorf("Expected 400 for %s, got %d", url, response.Code)
+				}
+			}
+			response = serveAs(m, testToken, "GET", "/api/1/people?sort=-created_at", nil)
+			if response.Code != http.StatusOK {
+				t.Errorf("Expected 200 sorting people by creation time, got %d: %s", response.Code, response.Body)
+			}
+		})
+	}
+}
@@ -1,11 +1,12 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/codegangsta/martini"
 	"github.com/hobeone/pointyhair/db"
@@ -26,66 +27,190 @@ type NotesJSON struct {
 	Notes []noteWithPersonIdJSON `json:"notes"`
 }
 
+// noteResource returns n as a resource related to its person.
+func noteResource(n *db.Note) resource {
+	r := newResource(noteType, n.Id, n, toOne("person", personType, n.Person.Id))
+	r.Version = n.Version
+	return r
+}
+
 type unmarshalNoteJSON struct {
-	Id       int       `json:"id"`
-	Text     string    `json:"text"`
-	Category string    `json:"category"`
-	Date     time.Time `json:"date"`
-	PersonId int64     `json:"person"`
+	Id         int       `json:"id"`
+	Text       string    `json:"text" validate:"required,max=65536"`
+	Category   string    `json:"category" validate:"category"`
+	Date       time.Time `json:"date" validate:"date"`
+	PersonId   int64     `json:"person" validate:"required"`
+	Visibility string    `json:"visibility" validate:"visibility"`
+	SharedWith []int64   `json:"shared_with"`
+	// A pointer so updates can tell false from not given
+	Confidential *bool `json:"confidential"`
 }
 
 type unmarshalNoteJSONContainer struct {
 	Note unmarshalNoteJSON `json:"note"`
 }
 
-func createNote(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+// Confidential notes are only included in bulk listings when this query
+// parameter is true.
+const includeConfidentialParam = "include_confidential"
+
+// Text of confidential notes in redacted responses.
+const redactedText = "[confidential]"
+
+func includeConfidential(req *http.Request) bool {
+	include, _ := strconv.ParseBool(req.Form.Get(includeConfidentialParam))
+	return include
+}
+
+// redactNotes replaces the text of the confidential notes with a
+// placeholder.
+func redactNotes(notes []*db.Note) {
+	for _, n := range notes {
+		if n.Confidential {
+			n.Text = redactedText
+		}
+	}
+}
+
+// redactedFor returns n, or a copy of it with its text redacted if it's
+// confidential and the user isn't allowed to list it.
+func redactedFor(policy *Policy, n *db.Note) *db.Note {
+	if !n.Confidential || policy.CanListConfidential(n) {
+		return n
+	}
+	redacted := *n
+	redacted.Text = redactedText
+	return &redacted
+}
+
+// checkSharing returns an error if visibility or any of shared_with isn't
+// valid in the request's workspace.
+func checkSharing(policy *Policy, visibility string, shared_with []int64) error {
+	if visibility != "" && !db.ValidVisibility(visibility) {
+		return fmt.Errorf("Unknown visibility: %s", visibility)
+	}
+	for _, uid := range shared_with {
+		if !policy.IsMember(uid) {
+			return fmt.Errorf("Can't share with user %d, they aren't in this workspace", uid)
+		}
+	}
+	return nil
+}
+
+// createNote makes a note from the template given in the template query
+// parameter, if there is one.  Its text is then optional.
+func createNote(rend render.Render, req *http.Request, params martini.Params, store db.NoteStore, people db.PeopleStore, templates db.NoteTemplateStore, policy *Policy, s Serializer) {
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
+	var tmpl *db.NoteTemplate
+	if id := req.Form.Get(templateParam); id != "" {
+		tmpl = templateById(rend, id, templates)
+		if tmpl == nil {
+			return
+		}
+	}
 	u := unmarshalNoteJSON{}
-	err = json.NewDecoder(req.Body).Decode(&u)
+	if !decodeValid(rend, req, s, noteType, &u, tmpl == nil) {
+		return
+	}
+	if tmpl != nil && u.PersonId == 0 {
+		var errs fieldErrors
+		errs.add("person", "is required")
+		rend.JSON(http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	err = checkSharing(policy, u.Visibility, u.SharedWith)
 	if err != nil {
 		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	p := db.Person{Id: u.PersonId}
-	err = dbh.ORM.Read(&p)
+	p, err := people.GetPersonById(u.PersonId)
 	if err != nil {
 		rend.JSON(http.StatusInternalServerError, fmt.Sprintf("Unknown Person ID: %d", u.PersonId))
 		return
 	}
 
 	dbnote := db.Note{
-		Text:     u.Text,
-		Category: u.Category,
-		Date:     u.Date,
-		Person:   &p,
+		Text:       u.Text,
+		Category:   u.Category,
+		Date:       u.Date,
+		Person:     p,
+		Author:     policy.User,
+		Visibility: u.Visibility,
+		SharedWith: u.SharedWith,
 	}
-	err = dbh.CreateNote(&dbnote)
+	if u.Confidential != nil {
+		dbnote.Confidential = *u.Confidential
+	}
+	if tmpl != nil {
+		if dbnote.Date.IsZero() {
+			dbnote.Date = time.Now().Truncate(time.Second)
+		}
+		if err := applyTemplate(&dbnote, tmpl, &u, people, policy); err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The same limit as unmarshalNoteJSON's
+		if utf8.RuneCountInString(dbnote.Text) > 65536 {
+			var errs fieldErrors
+			errs.add("text", "can't be longer than 65536 characters once the template is filled in")
+			rend.JSON(http.StatusUnprocessableEntity, errs)
+			return
+		}
+	}
+	err = store.CreateNote(&dbnote)
 	if err != nil {
 		rend.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
-	rend.JSON(200, noteWithPersonIdJSON{&dbnote, p.Id})
+	rend.JSON(200, s.One(noteResource(&dbnote), nil))
 }
 
-func deleteNote(rend render.Render, params martini.Params, dbh *db.DBHandle) {
+// readableNote returns the note with the given id if the policy lets the user
+// read it.  Otherwise it writes a 404 and returns nil, so the user can't tell
+// notes they can't see from ones that don't exist.
+func readableNote(rend render.Render, id int64, store db.NoteStore, policy *Policy) *db.Note {
+	n, err := store.GetNoteById(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(404, fmt.Sprintf("No Note with id %d found.", id))
+		} else {
+			rend.JSON(500, err.Error())
+		}
+		return nil
+	}
+	if !policy.CanReadNote(n) {
+		rend.JSON(404, fmt.Sprintf("No Note with id %d found.", id))
+		return nil
+	}
+	return n
+}
+
+func deleteNote(rend render.Render, req *http.Request, params martini.Params, store db.NoteStore, policy *Policy, s Serializer) {
 	note_id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	note, err := dbh.GetNoteById(note_id)
-	if err != nil {
-		rend.JSON(http.StatusNotFound, err.Error())
+	note := readableNote(rend, note_id, store, policy)
+	if note == nil {
+		return
+	}
+	if !policy.CanWriteNote(note) {
+		rend.JSON(http.StatusForbidden, "Only the author can delete a note")
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(noteResource(redactedFor(policy, note)), nil)) {
 		return
 	}
 
-	err = dbh.RemoveNote(note)
+	err = store.RemoveNote(note)
 	if err != nil {
 		rend.JSON(http.StatusInternalServerError, err.Error())
 		return
@@ -94,7 +219,7 @@ func deleteNote(rend render.Render, params martini.Params, dbh *db.DBHandle) {
 	rend.JSON(http.StatusNoContent, "")
 }
 
-func updateNote(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func updateNote(rend render.Render, req *http.Request, params martini.Params, store db.NoteStore, policy *Policy, s Serializer) {
 	note_id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(500, err.Error())
@@ -107,79 +232,144 @@ func updateNote(rend render.Render, req *http.Request, params martini.Params, db
 		return
 	}
 
-	u := unmarshalNoteJSONContainer{}
-	err = json.NewDecoder(req.Body).Decode(&u)
+	u := unmarshalNoteJSON{}
+	if !decodeValid(rend, req, s, noteType, &u, false) {
+		return
+	}
+
+	dbnote := readableNote(rend, note_id, store, policy)
+	if dbnote == nil {
+		return
+	}
+	if !policy.CanWriteNote(dbnote) {
+		rend.JSON(http.StatusForbidden, "Only the author can change a note")
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(noteResource(redactedFor(policy, dbnote)), nil)) {
+		return
+	}
+	err = checkSharing(policy, u.Visibility, u.SharedWith)
 	if err != nil {
-		rend.JSON(500, err.Error())
+		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	dbnote := db.Note{Id: note_id}
-	err = dbh.ORM.Read(&dbnote)
+	if u.Visibility != "" {
+		dbnote.Visibility = u.Visibility
+	}
+	if u.SharedWith != nil {
+		dbnote.SharedWith = u.SharedWith
+	}
+	if u.Confidential != nil {
+		dbnote.Confidential = *u.Confidential
+	}
+	if u.Text != "" {
+		dbnote.Text = u.Text
+	}
+	if u.Category != "" {
+		dbnote.Category = u.Category
+	}
+	err = store.UpdateNote(dbnote)
 	if err != nil {
-		rend.JSON(404, err.Error())
+		writeUpdateError(rend, err)
 		return
 	}
+	rend.JSON(http.StatusOK, s.One(noteResource(dbnote), nil))
+}
 
-	if u.Note.Text != "" {
-		dbnote.Text = u.Note.Text
+// patchNote applies a JSON Merge Patch to a note.  Unlike updateNote it can
+// clear fields and move the note to another person.
+func patchNote(rend render.Render, req *http.Request, params martini.Params, store db.NoteStore, people db.PeopleStore, policy *Policy, s Serializer) {
+	note_id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	patch := object{}
+	err = s.Decode(req.Body, noteType, &patch)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbnote := readableNote(rend, note_id, store, policy)
+	if dbnote == nil {
+		return
+	}
+	if !policy.CanWriteNote(dbnote) {
+		rend.JSON(http.StatusForbidden, "Only the author can change a note")
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(noteResource(redactedFor(policy, dbnote)), nil)) {
+		return
 	}
-	if u.Note.Category != "" {
-		dbnote.Category = u.Note.Category
+	errs := applyNotePatch(dbnote, patch, people, policy)
+	errs.merge(validatePatch(patch, &unmarshalNoteJSON{}))
+	if len(errs) > 0 {
+		rend.JSON(http.StatusUnprocessableEntity, errs)
+		return
+	}
+	err = store.UpdateNote(dbnote)
+	if err != nil {
+		writeUpdateError(rend, err)
+		return
 	}
-	dbh.ORM.Update(&dbnote)
+	rend.JSON(http.StatusOK, s.One(noteResource(dbnote), nil))
 }
 
-func getNote(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func getNote(rend render.Render, req *http.Request, params martini.Params, store db.NoteStore, policy *Policy, s Serializer) {
 	id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(500, "Invalid id: "+err.Error())
 		return
 	}
-	n, err := dbh.GetNoteById(id)
-	if err != nil {
-		rend.JSON(500, err.Error())
+	n := readableNote(rend, id, store, policy)
+	if n == nil {
 		return
 	}
 
-	rend.JSON(200, noteWithPersonIdJSON{n, n.Person.Id})
+	rend.JSON(200, s.One(noteResource(redactedFor(policy, n)), nil))
 }
 
-func getNotes(rend render.Render, req *http.Request, dbh *db.DBHandle) {
+func getNotes(rend render.Render, req *http.Request, store db.NoteStore, policy *Policy, s Serializer) {
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(500, err.Error())
 		return
 	}
+	list, err := parseListParams(req, noteType)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
 
-	var notes []noteWithPersonIdJSON
 	param_ids := req.Form["ids[]"]
 	if len(param_ids) > 0 {
-		note_ids, err := parseParamIds(param_ids)
+		list.Ids, err = parseParamIds(param_ids)
 		if err != nil {
 			rend.JSON(500, err.Error())
 			return
 		}
-
-		notes = make([]noteWithPersonIdJSON, len(note_ids))
-		for i, nid := range note_ids {
-			note, err := dbh.GetNoteById(nid)
-			if err != nil {
-				rend.JSON(404, err.Error())
+		for _, nid := range list.Ids {
+			if readableNote(rend, nid, store, policy) == nil {
 				return
 			}
-			notes[i] = noteWithPersonIdJSON{note, note.Person.Id}
-		}
-	} else {
-		dbnotes, err := dbh.GetNotesById([]int64{})
-		notes = make([]noteWithPersonIdJSON, len(dbnotes))
-		for i, n := range dbnotes {
-			notes[i] = noteWithPersonIdJSON{n, n.Person.Id}
-		}
-		if err != nil {
-			rend.JSON(500, err.Error())
-			return
 		}
 	}
-	rend.JSON(http.StatusOK, notes)
+	dbnotes, err := store.ListNotes(list)
+	if err != nil {
+		rend.JSON(500, err.Error())
+		return
+	}
+	if len(list.Ids) > 0 && len(list.OrderBy) == 0 {
+		order := inRequestOrder(list.Ids)
+		sort.SliceStable(dbnotes, func(i, j int) bool { return order[dbnotes[i].Id] < order[dbnotes[j].Id] })
+	}
+	dbnotes = policy.FilterListed(dbnotes, includeConfidential(req))
+	notes := make([]resource, len(dbnotes))
+	for i, n := range dbnotes {
+		notes[i] = noteResource(n)
+	}
+	rend.JSON(http.StatusOK, s.Many(noteType, notes, nil))
 }
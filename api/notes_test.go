@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -16,23 +15,38 @@ const getNoteGoldenResponse = `{
   "notes": [
     {
       "id": 1,
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
       "text": "http://testfeed1/feed.atom",
       "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     },
     {
       "id": 2,
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
       "text": "http://testfeed2/feed.atom",
       "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     },
     {
       "id": 3,
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
       "text": "http://testfeed3/feed.atom",
       "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     }
   ]
@@ -40,13 +54,11 @@ const getNoteGoldenResponse = `{
 
 func TestGetNotes(t *testing.T) {
 	dbh, m := setupTest(t)
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/notes", nil)
+	req, _ := newTestRequest("GET", "/api/1/notes", nil)
 	m.ServeHTTP(response, req)
 
 	if response.Code != 200 {
@@ -54,7 +66,7 @@ func TestGetNotes(t *testing.T) {
 		t.Fatalf("Expected 200 response code, got %d", response.Code)
 	}
 
-	if response.Body.String() != getNoteGoldenResponse {
+	if goldenBody(response) != getNoteGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
@@ -64,16 +76,26 @@ const getNoteWithIdsGoldenResponse = `{
   "notes": [
     {
       "id": 1,
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
       "text": "http://testfeed1/feed.atom",
       "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     },
     {
       "id": 2,
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
       "text": "http://testfeed2/feed.atom",
       "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     }
   ]
@@ -82,13 +104,11 @@ const getNoteWithIdsGoldenResponse = `{
 func TestGetNotesWithIds(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/notes?ids[]=1&ids[]=2", nil)
+	req, _ := newTestRequest("GET", "/api/1/notes?ids[]=1&ids[]=2", nil)
 	m.ServeHTTP(response, req)
 
 	if response.Code != 200 {
@@ -96,7 +116,7 @@ func TestGetNotesWithIds(t *testing.T) {
 		t.Fatalf("Expected 200 response code, got %d", response.Code)
 	}
 
-	if response.Body.String() != getNoteWithIdsGoldenResponse {
+	if goldenBody(response) != getNoteWithIdsGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
@@ -105,9 +125,14 @@ func TestGetNotesWithIds(t *testing.T) {
 const getNoteWithIdGoldenResponse = `{
   "note": {
     "id": 1,
-    "date": "0001-01-01T00:00:00Z",
+    "date": "2014-03-01T10:00:00Z",
     "text": "http://testfeed1/feed.atom",
     "category": "",
+    "visibility": "workspace",
+    "confidential": false,
+    "shared_with": [],
+    "created_at": "",
+    "updated_at": "",
     "person": 3
   }
 }`
@@ -115,13 +140,11 @@ const getNoteWithIdGoldenResponse = `{
 func TestGetNotesById(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/notes/1", nil)
+	req, _ := newTestRequest("GET", "/api/1/notes/1", nil)
 	m.ServeHTTP(response, req)
 
 	if response.Code != 200 {
@@ -129,7 +152,7 @@ func TestGetNotesById(t *testing.T) {
 		t.Fatalf("Expected 200 response code, got %d", response.Code)
 	}
 
-	if response.Body.String() != getNoteWithIdGoldenResponse {
+	if goldenBody(response) != getNoteWithIdGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
@@ -138,9 +161,7 @@ func TestGetNotesById(t *testing.T) {
 func TestCreateWithInvalidPersonId(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	test_person_id := int64(1000)
 	_, err := dbh.GetPersonById(test_person_id)
@@ -162,7 +183,7 @@ func TestCreateWithInvalidPersonId(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/api/1/notes", bytes.NewReader(req_body))
+	req, _ := newTestRequest("POST", "/api/1/notes", bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -175,9 +196,7 @@ func TestCreateWithInvalidPersonId(t *testing.T) {
 func TestCreateNote(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	tdate := time.Now()
 	n := NoteJSON{
@@ -193,7 +212,7 @@ func TestCreateNote(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/api/1/notes", bytes.NewReader(req_body))
+	req, _ := newTestRequest("POST", "/api/1/notes", bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -205,7 +224,7 @@ func TestCreateNote(t *testing.T) {
 	u := unmarshalNoteJSONContainer{}
 	err = json.NewDecoder(response.Body).Decode(&u)
 	failOnError(t, err)
-	if u.Note.Date != tdate {
+	if !u.Note.Date.Equal(tdate) {
 		t.Fatalf("Note Date doesn't match test Date: %v != %v",
 			u.Note.Date, tdate)
 	}
@@ -219,9 +238,7 @@ func TestCreateNote(t *testing.T) {
 func TestUpdateNote(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	dbnote, err := dbh.GetNoteById(1)
 	failOnError(t, err)
@@ -238,7 +255,7 @@ func TestUpdateNote(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/api/1/notes/1", bytes.NewReader(req_body))
+	req, _ := newTestRequest("PUT", "/api/1/notes/1", bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -257,9 +274,7 @@ func TestUpdateNote(t *testing.T) {
 func TestUpdateNonExistingNote(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 	non_existing_id := int64(100)
 
 	_, err := dbh.GetNoteById(non_existing_id)
@@ -277,7 +292,7 @@ func TestUpdateNonExistingNote(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/1/notes/%d", non_existing_id), bytes.NewReader(req_body))
+	req, _ := newTestRequest("PUT", fmt.Sprintf("/api/1/notes/%d", non_existing_id), bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -286,3 +301,31 @@ func TestUpdateNonExistingNote(t *testing.T) {
 		t.Fatalf("Expected 404 response code, got %d", response.Code)
 	}
 }
+
+func TestUpdateNoteFakeStore(t *testing.T) {
+	store, m := setupFakeTest(t)
+
+	n := NoteJSON{
+		Note: noteWithPersonIdJSON{
+			&db.Note{Text: "fake text"},
+			1,
+		},
+	}
+	req_body, err := json.Marshal(n)
+	failOnError(t, err)
+
+	response := httptest.NewRecorder()
+	req, _ := newTestRequest("PUT", "/api/1/notes/1", bytes.NewReader(req_body))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	m.ServeHTTP(response, req)
+	if response.Code != 200 {
+		fmt.Println(response.Body.String())
+		t.Fatalf("Expected 200 response code, got %d", response.Code)
+	}
+
+	dbnote, err := store.GetNoteById(1)
+	failOnError(t, err)
+	if dbnote.Text != "fake text" {
+		t.Fatalf("text field wasn't updated")
+	}
+}
@@ -0,0 +1,1025 @@
+package api
+
+import "net/http"
+
+// openAPISpec describes every route set up in createRouter.  TestOpenAPISpec
+// checks the two agree, so change both together.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "pointyhair",
+    "description": "Helper app for pointy haired managers",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/1"}],
+  "security": [{"token": []}],
+  "paths": {
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document",
+        "security": [],
+        "responses": {"200": {"description": "OpenAPI document", "content": {"application/json": {}}}}
+      }
+    },
+    "/people": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getPeople",
+        "summary": "List people, or the people with the given ids, with their notes and todos sideloaded",
+        "parameters": [
+          {"$ref": "#/components/parameters/ids"},
+          {"$ref": "#/components/parameters/createdAfter"},
+          {"$ref": "#/components/parameters/createdBefore"},
+          {"$ref": "#/components/parameters/updatedAfter"},
+          {"$ref": "#/components/parameters/updatedBefore"},
+          {"$ref": "#/components/parameters/sort"},
+          {"$ref": "#/components/parameters/includeConfidential"},
+          {"$ref": "#/components/parameters/include"},
+          {"$ref": "#/components/parameters/fields"},
+          {"$ref": "#/components/parameters/ifNoneMatch"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/people"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "post": {
+        "operationId": "createPerson",
+        "parameters": [
+          {"$ref": "#/components/parameters/include"},
+          {"$ref": "#/components/parameters/fields"}
+        ],
+        "requestBody": {"$ref": "#/components/requestBodies/person"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/person"},
+          "400": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/people/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/workspace"},
+        {"$ref": "#/components/parameters/id"}
+      ],
+      "get": {
+        "operationId": "getPerson",
+        "parameters": [
+          {"name": "redact", "in": "query", "description": "Replace the text of confidential notes with a placeholder", "schema": {"type": "boolean"}},
+          {"$ref": "#/components/parameters/include"},
+          {"$ref": "#/components/parameters/fields"},
+          {"$ref": "#/components/parameters/ifNoneMatch"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/person"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "delete": {
+        "operationId": "deletePerson",
+        "summary": "Delete a person and all of their notes and todos.  Owners only.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/notes": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getNotes",
+        "summary": "List the notes the user can read, or the ones with the given ids",
+        "parameters": [
+          {"$ref": "#/components/parameters/ids"},
+          {"$ref": "#/components/parameters/createdAfter"},
+          {"$ref": "#/components/parameters/createdBefore"},
+          {"$ref": "#/components/parameters/updatedAfter"},
+          {"$ref": "#/components/parameters/updatedBefore"},
+          {"$ref": "#/components/parameters/sort"},
+          {"$ref": "#/components/parameters/includeConfidential"},
+          {"$ref": "#/components/parameters/fields"},
+          {"$ref": "#/components/parameters/ifNoneMatch"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/notes"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "post": {
+        "operationId": "createNote",
+        "summary": "Create a note, or start one from a template.  With a template the note's text is optional and is added after the template's.",
+        "parameters": [{"name": "template", "in": "query", "description": "Id of the template to fill in for the note's person", "schema": {"type": "integer", "format": "int64"}}],
+        "requestBody": {"$ref": "#/components/requestBodies/note"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/note"},
+          "400": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/notes/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/workspace"},
+        {"$ref": "#/components/parameters/id"}
+      ],
+      "get": {
+        "operationId": "getNote",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/note"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "put": {
+        "operationId": "updateNote",
+        "summary": "Change the given fields of a note.  Authors only.",
+        "requestBody": {"$ref": "#/components/requestBodies/note"},
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/note"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      },
+      "patch": {
+        "operationId": "patchNote",
+        "summary": "Set, clear (with null) or reassign fields of a note.  Authors only.",
+        "requestBody": {"$ref": "#/components/requestBodies/notePatch"},
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/note"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteNote",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/notes/bulk": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "post": {
+        "operationId": "bulkNotes",
+        "summary": "Apply create, update, patch and delete operations to notes in one transaction.  If any fails none are applied.",
+        "requestBody": {"$ref": "#/components/requestBodies/bulk"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/bulkResults"},
+          "400": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/bulkResults"},
+          "500": {"$ref": "#/components/responses/bulkResults"}
+        }
+      }
+    },
+    "/people/{id}/attachments": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getPersonAttachments",
+        "summary": "Files attached to a person and to the notes about them the user can read",
+        "parameters": [{"$ref": "#/components/parameters/includeConfidential"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/attachments"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "post": {
+        "operationId": "uploadPersonAttachments",
+        "summary": "Attach files to a person.  Each file can be up to 10 MB.",
+        "requestBody": {"$ref": "#/components/requestBodies/attachments"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/attachments"},
+          "400": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "413": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/notes/{id}/attachments": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getNoteAttachments",
+        "summary": "Files attached to a note.  A confidential note's are only listed for those allowed to list it.",
+        "parameters": [{"$ref": "#/components/parameters/includeConfidential"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/attachments"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "post": {
+        "operationId": "uploadNoteAttachments",
+        "summary": "Attach files to a note.  Authors only.  Each file can be up to 10 MB.",
+        "requestBody": {"$ref": "#/components/requestBodies/attachments"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/attachments"},
+          "400": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "413": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/attachments/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getAttachment",
+        "responses": {
+          "200": {"$ref": "#/components/responses/attachment"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteAttachment",
+        "summary": "Remove an attachment.  Those on notes can only be removed by the note's author.",
+        "responses": {
+          "204": {"description": "Removed"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/attachments/{id}/content": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getAttachmentContent",
+        "summary": "Download an attached file.  It's always sent as an attachment with the content type sniffed when it was uploaded.",
+        "responses": {
+          "200": {"description": "The file", "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/templates": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getTemplates",
+        "summary": "The workspace's note templates, by name",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/templates"},
+          "304": {"$ref": "#/components/responses/notModified"}
+        }
+      },
+      "post": {
+        "operationId": "createTemplate",
+        "summary": "Add a note template to the workspace.  Its text can have the placeholders {{person.name}}, {{person.email}}, {{author.name}}, {{date}}, {{last_meeting.date}} and {{last_meeting.open_items}}, the unticked \"- [ ]\" items of the person's last note in the same category.",
+        "requestBody": {"$ref": "#/components/requestBodies/template"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/template"},
+          "400": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/templates/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getTemplate",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/template"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "put": {
+        "operationId": "updateTemplate",
+        "summary": "Change the fields of a template that are given.  Its author and owners only.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "requestBody": {"$ref": "#/components/requestBodies/template"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/template"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteTemplate",
+        "summary": "Remove a template.  Its author and owners only.  Notes made from it are kept.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "204": {"description": "Removed"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/todos": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getTodos",
+        "parameters": [
+          {"$ref": "#/components/parameters/ids"},
+          {"$ref": "#/components/parameters/createdAfter"},
+          {"$ref": "#/components/parameters/createdBefore"},
+          {"$ref": "#/components/parameters/updatedAfter"},
+          {"$ref": "#/components/parameters/updatedBefore"},
+          {"$ref": "#/components/parameters/sort"},
+          {"$ref": "#/components/parameters/fields"},
+          {"$ref": "#/components/parameters/ifNoneMatch"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/todos"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "post": {
+        "operationId": "createTodo",
+        "parameters": [{"name": "addToAll", "in": "query", "description": "Give every person a copy of the todo instead of just person.  The copies are returned as a list of todos.", "allowEmptyValue": true, "schema": {"type": "string"}}],
+        "requestBody": {"$ref": "#/components/requestBodies/todo"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/todo"},
+          "403": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/todos/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/workspace"},
+        {"$ref": "#/components/parameters/id"}
+      ],
+      "get": {
+        "operationId": "getTodo",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/todo"},
+          "304": {"$ref": "#/components/responses/notModified"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "put": {
+        "operationId": "updateTodo",
+        "requestBody": {"$ref": "#/components/requestBodies/todo"},
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/todo"},
+          "404": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      },
+      "patch": {
+        "operationId": "patchTodo",
+        "summary": "Set, clear (with null) or reassign fields of a todo",
+        "requestBody": {"$ref": "#/components/requestBodies/todoPatch"},
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/todo"},
+          "404": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteTodo",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "404": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/todos/bulk": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "post": {
+        "operationId": "bulkTodos",
+        "summary": "Apply create, update, patch, delete, complete and reassign operations to todos in one transaction.  If any fails none are applied.",
+        "requestBody": {"$ref": "#/components/requestBodies/bulk"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/bulkResults"},
+          "400": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/bulkResults"},
+          "500": {"$ref": "#/components/responses/bulkResults"}
+        }
+      }
+    },
+    "/import/ics": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "post": {
+        "operationId": "importCalendar",
+        "summary": "Record the events in an iCalendar file that people attend as 1:1s with them.  Events are matched on their UID so importing again only moves rescheduled 1:1s.",
+        "parameters": [{"name": "prep_todos", "in": "query", "description": "Give each new 1:1 a todo to prepare for it", "schema": {"type": "boolean"}}],
+        "requestBody": {"required": true, "content": {
+          "text/calendar": {"schema": {"type": "string"}},
+          "multipart/form-data": {"schema": {"type": "object", "properties": {"file": {"type": "string", "format": "binary"}}}}}},
+        "responses": {
+          "200": {"description": "What was done with each event", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImportResults"}}}},
+          "400": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/webhooks": {
+      "parameters": [{"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getWebhooks",
+        "summary": "List the user's webhooks in the workspace",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/webhooks"},
+          "304": {"$ref": "#/components/responses/notModified"}
+        }
+      },
+      "post": {
+        "operationId": "createWebhook",
+        "summary": "Register a url to be POSTed the people, notes and todos the user can see being created, updated and deleted in the workspace.  The response is the only one with the secret in it.",
+        "requestBody": {"required": true, "content": {
+          "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"webhook": {"$ref": "#/components/schemas/NewWebhook"}}}, {"$ref": "#/components/schemas/NewWebhook"}]}},
+          "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/webhook"},
+          "403": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/webhooks/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "delete": {
+        "operationId": "deleteWebhook",
+        "summary": "Remove one of the user's webhooks and its deliveries",
+        "responses": {
+          "204": {"description": "Removed"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/webhooks/{id}/deliveries": {
+      "parameters": [{"$ref": "#/components/parameters/id"}, {"$ref": "#/components/parameters/workspace"}],
+      "get": {
+        "operationId": "getDeliveries",
+        "summary": "The last 100 deliveries to one of the user's webhooks, newest first",
+        "responses": {
+          "200": {"$ref": "#/components/responses/deliveries"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/calendar": {
+      "post": {
+        "operationId": "enableCalendar",
+        "summary": "Turn on the user's iCalendar feed of todos and 1:1s in all their workspaces, returning its url",
+        "responses": {"200": {"$ref": "#/components/responses/calendar"}}
+      },
+      "delete": {
+        "operationId": "disableCalendar",
+        "summary": "Turn off the user's feed.  Turning it back on gives it a new url.",
+        "responses": {"204": {"description": "Turned off"}}
+      }
+    },
+    "/inbox": {
+      "post": {
+        "operationId": "enableInbox",
+        "summary": "Give the user an address to forward email to.  Mail to it with a +person tag, or a person's name starting the subject, becomes a note about them.",
+        "responses": {"200": {"$ref": "#/components/responses/inbox"}}
+      },
+      "delete": {
+        "operationId": "disableInbox",
+        "summary": "Stop taking in mail to the user's address.  Turning it back on gives it a new address.",
+        "responses": {"204": {"description": "Turned off"}}
+      }
+    },
+    "/digest": {
+      "get": {
+        "operationId": "getDigest",
+        "summary": "Where and how often the user is sent a digest email",
+        "responses": {"200": {"$ref": "#/components/responses/digest"}}
+      },
+      "put": {
+        "operationId": "setDigest",
+        "summary": "Change where and how often the user is sent a digest of overdue and upcoming todos, people due a 1:1 and upcoming 1:1s, or turn it off",
+        "requestBody": {"required": true, "content": {
+          "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"digest": {"$ref": "#/components/schemas/DigestInput"}}}, {"$ref": "#/components/schemas/DigestInput"}]}},
+          "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/digest"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/calendar.ics": {
+      "get": {
+        "operationId": "getCalendarFeed",
+        "summary": "The user's todos as VTODOs and 1:1s (notes in the one_on_one category) as VEVENTs",
+        "security": [],
+        "parameters": [{"name": "token", "in": "query", "required": true, "description": "The feed's token, from its url", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "iCalendar feed", "content": {"text/calendar": {"schema": {"type": "string"}}}},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/workspaces": {
+      "get": {
+        "operationId": "getWorkspaces",
+        "summary": "List the workspaces the user is a member of",
+        "parameters": [{"$ref": "#/components/parameters/ifNoneMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/workspaces"},
+          "304": {"$ref": "#/components/responses/notModified"}
+        }
+      },
+      "post": {
+        "operationId": "createWorkspace",
+        "summary": "Create a workspace owned by the user",
+        "requestBody": {"$ref": "#/components/requestBodies/workspace"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/workspace"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/workspaces/{id}/members": {
+      "parameters": [{"$ref": "#/components/parameters/id"}],
+      "post": {
+        "operationId": "setMember",
+        "summary": "Add a member or change their role and manager.  Owners only.",
+        "requestBody": {"$ref": "#/components/requestBodies/member"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/member"},
+          "400": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "422": {"$ref": "#/components/responses/invalid"}
+        }
+      }
+    },
+    "/workspaces/{id}/members/{user}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/id"},
+        {"name": "user", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "delete": {
+        "operationId": "removeMember",
+        "responses": {
+          "204": {"description": "Removed"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer", "description": "API token printed by pointyhair -add-user"}
+    },
+    "parameters": {
+      "id": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "format": "int64"}},
+      "ids": {"name": "ids[]", "in": "query", "style": "form", "explode": true, "schema": {"type": "array", "items": {"type": "integer", "format": "int64"}}},
+      "include": {"name": "include", "in": "query", "description": "Comma separated relations to load and sideload, notes and/or todos.  Defaults to the relations in the person fieldset.", "schema": {"type": "string"}},
+      "fields": {"name": "fields", "in": "query", "style": "deepObject", "description": "Sparse fieldsets: fields[person]=name,notes only returns those fields of people.  Works for every type, by singular or plural name.", "schema": {"type": "object", "additionalProperties": {"type": "string"}}},
+      "createdAfter": {"name": "created_after", "in": "query", "description": "Only list what was created after this time", "schema": {"type": "string", "format": "date-time"}},
+      "createdBefore": {"name": "created_before", "in": "query", "description": "Only list what was created before this time", "schema": {"type": "string", "format": "date-time"}},
+      "updatedAfter": {"name": "updated_after", "in": "query", "description": "Only list what was last updated after this time", "schema": {"type": "string", "format": "date-time"}},
+      "updatedBefore": {"name": "updated_before", "in": "query", "description": "Only list what was last updated before this time", "schema": {"type": "string", "format": "date-time"}},
+      "sort": {"name": "sort", "in": "query", "description": "Comma separated fields to sort by, each prefixed with - for descending order: id, date (not for people), created_at or updated_at", "schema": {"type": "string"}},
+      "includeConfidential": {"name": "include_confidential", "in": "query", "description": "Include confidential notes the user is allowed to list", "schema": {"type": "boolean"}},
+      "ifMatch": {"name": "If-Match", "in": "header", "description": "Only go ahead if the ETag of the resource, in the same format, is one of these", "schema": {"type": "string"}},
+      "ifNoneMatch": {"name": "If-None-Match", "in": "header", "description": "Return 304 if the ETag of the response would be one of these", "schema": {"type": "string"}},
+      "workspace": {"name": "X-Pointyhair-Workspace", "in": "header", "description": "Workspace id.  Only needed for users in more than one workspace.", "schema": {"type": "integer", "format": "int64"}}
+    },
+    "headers": {
+      "etag": {"description": "Changes whenever the response body or anything in it does.  Send it back in If-None-Match to get a 304 if nothing has changed, or in If-Match to only change or delete something nobody else has since.", "schema": {"type": "string"}}
+    },
+    "requestBodies": {
+      "notePatch": {"required": true, "description": "JSON Merge Patch.  null clears a field, but date and person can't be cleared.", "content": {
+        "application/merge-patch+json": {"schema": {"$ref": "#/components/schemas/NoteInput"}},
+        "application/json": {"schema": {"type": "object", "properties": {"note": {"$ref": "#/components/schemas/NoteInput"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "todoPatch": {"required": true, "description": "JSON Merge Patch.  null clears a field, but date and person can't be cleared.", "content": {
+        "application/merge-patch+json": {"schema": {"$ref": "#/components/schemas/TodoInput"}},
+        "application/json": {"schema": {"type": "object", "properties": {"todo": {"$ref": "#/components/schemas/TodoInput"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "attachments": {"required": true, "content": {
+        "multipart/form-data": {"schema": {"type": "object", "properties": {"file": {"type": "array", "items": {"type": "string", "format": "binary"}}}}}}},
+      "bulk": {"required": true, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/BulkRequest"}}}},
+      "person": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"person": {"$ref": "#/components/schemas/NewPerson"}}}, {"$ref": "#/components/schemas/NewPerson"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "note": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"note": {"$ref": "#/components/schemas/NoteInput"}}}, {"$ref": "#/components/schemas/NoteInput"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "todo": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"todo": {"$ref": "#/components/schemas/TodoInput"}}}, {"$ref": "#/components/schemas/TodoInput"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "template": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"template": {"$ref": "#/components/schemas/Template"}}}, {"$ref": "#/components/schemas/Template"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "workspace": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"workspace": {"$ref": "#/components/schemas/NewWorkspace"}}}, {"$ref": "#/components/schemas/NewWorkspace"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}},
+      "member": {"required": true, "content": {
+        "application/json": {"schema": {"oneOf": [{"type": "object", "properties": {"member": {"$ref": "#/components/schemas/Member"}}}, {"$ref": "#/components/schemas/Member"}]}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIRequest"}}}}
+    },
+    "responses": {
+      "invalid": {"description": "What's wrong with each invalid field", "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"errors": {
+          "type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIErrors"}}}},
+      "notModified": {"description": "Not changed since the ETag given in If-None-Match", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}},
+      "error": {"description": "Error", "content": {
+        "application/json": {"schema": {"type": "string"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIErrors"}}}},
+      "bulkResults": {"description": "The result of each operation, in order.  If any failed the others have a 424 and nothing was applied.", "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/BulkResults"}}}},
+      "person": {"description": "A person with their notes and todos", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/PersonEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "people": {"description": "People with their notes and todos", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/PeopleEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "note": {"description": "A note", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/NoteEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "notes": {"description": "Notes", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/NotesEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "todo": {"description": "A todo", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/TodoEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "todos": {"description": "Todos", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/TodosEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "attachment": {"description": "An attachment", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"attachment": {"$ref": "#/components/schemas/Attachment"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "attachments": {"description": "Attachments", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"attachments": {"type": "array", "items": {"$ref": "#/components/schemas/Attachment"}}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "template": {"description": "A note template", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"template": {"$ref": "#/components/schemas/Template"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "templates": {"description": "Note templates", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"templates": {"type": "array", "items": {"$ref": "#/components/schemas/Template"}}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "calendar": {"description": "The user's calendar feed", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"calendar": {"$ref": "#/components/schemas/Calendar"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "inbox": {"description": "The user's address for email to become notes", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"inbox": {"$ref": "#/components/schemas/Inbox"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "digest": {"description": "The user's digest settings", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"digest": {"$ref": "#/components/schemas/Digest"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "webhook": {"description": "A webhook", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"webhook": {"$ref": "#/components/schemas/Webhook"}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "webhooks": {"description": "Webhooks", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"webhooks": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "deliveries": {"description": "Webhook deliveries", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"type": "object", "properties": {"deliveries": {"type": "array", "items": {"$ref": "#/components/schemas/Delivery"}}}}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "workspace": {"description": "A workspace", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/WorkspaceEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "workspaces": {"description": "Workspaces", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/WorkspacesEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}},
+      "member": {"description": "A member", "headers": {"ETag": {"$ref": "#/components/headers/etag"}}, "content": {
+        "application/json": {"schema": {"$ref": "#/components/schemas/MemberEnvelope"}},
+        "application/vnd.api+json": {"schema": {"$ref": "#/components/schemas/JSONAPIDocument"}}}}
+    },
+    "schemas": {
+      "ImportResults": {
+        "type": "object",
+        "properties": {"results": {"type": "array", "items": {
+          "type": "object",
+          "properties": {
+            "uid": {"type": "string"},
+            "summary": {"type": "string"},
+            "start": {"type": "string", "format": "date-time"},
+            "status": {"type": "string", "enum": ["created", "updated", "unchanged", "unmatched", "skipped"]},
+            "reason": {"type": "string", "description": "Why the event was skipped"},
+            "notes": {"type": "array", "items": {"type": "integer", "format": "int64"}, "description": "Ids of the 1:1s created or moved"},
+            "todos": {"type": "array", "items": {"type": "integer", "format": "int64"}, "description": "Ids of the prep todos created"}
+          }
+        }}}
+      },
+      "DigestInput": {
+        "type": "object",
+        "required": ["schedule"],
+        "properties": {
+          "email": {"type": "string", "format": "email", "maxLength": 255, "description": "Empty to not be sent digests"},
+          "schedule": {"type": "string", "enum": ["daily", "weekly", "off"]}
+        }
+      },
+      "Digest": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "description": "The user's id"},
+          "email": {"type": "string"},
+          "schedule": {"type": "string", "enum": ["daily", "weekly", "off"]},
+          "sent_at": {"type": "string", "format": "date-time", "nullable": true, "description": "When the last digest was sent"}
+        }
+      },
+      "NewWebhook": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {
+          "url": {"type": "string", "format": "uri", "maxLength": 2048, "description": "http or https"},
+          "secret": {"type": "string", "maxLength": 128, "description": "Key of the HMAC-SHA256 of the body sent in X-Pointyhair-Signature, as sha256=<hex>.  Generated if not given."},
+          "events": {"type": "array", "items": {"type": "string"}, "description": "Events to send, like note.created, note.* or *.  All of them if empty."}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "url": {"type": "string", "format": "uri"},
+          "events": {"type": "array", "items": {"type": "string"}},
+          "secret": {"type": "string", "description": "Only when the webhook is registered"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Delivery": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "description": "Also sent in X-Pointyhair-Delivery"},
+          "webhook": {"type": "integer", "format": "int64"},
+          "event": {"type": "string"},
+          "status": {"type": "string", "enum": ["pending", "delivered", "failed"]},
+          "attempts": {"type": "integer"},
+          "next_attempt": {"type": "string", "format": "date-time", "description": "When it's tried next, while pending"},
+          "response_code": {"type": "integer", "description": "Of the last attempt, 0 if there was no response"},
+          "last_error": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Attachment": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "person": {"type": "integer", "format": "int64"},
+          "note": {"type": "integer", "format": "int64", "description": "Missing for files attached to the person directly"},
+          "filename": {"type": "string"},
+          "content_type": {"type": "string", "description": "Sniffed from the content"},
+          "size": {"type": "integer", "format": "int64"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Template": {
+        "type": "object",
+        "required": ["name", "text"],
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "readOnly": true},
+          "name": {"type": "string", "maxLength": 255},
+          "text": {"type": "string", "maxLength": 65536},
+          "category": {"type": "string", "pattern": "^[a-z0-9_-]{1,32}$", "description": "Given, with visibility and confidential, to notes made from the template unless they have their own"},
+          "visibility": {"$ref": "#/components/schemas/Visibility"},
+          "confidential": {"type": "boolean"},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true}
+        }
+      },
+      "Calendar": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "description": "The user's id"},
+          "url": {"type": "string", "format": "uri", "description": "Subscribe to this in a calendar app"}
+        }
+      },
+      "Inbox": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "description": "The user's id"},
+          "address": {"type": "string", "format": "email", "description": "Forward email here, adding +person before the @ to pick who it's about"}
+        }
+      },
+      "BulkRequest": {
+        "type": "object",
+        "required": ["operations"],
+        "properties": {"operations": {"type": "array", "maxItems": 1000, "items": {"$ref": "#/components/schemas/BulkOperation"}}}
+      },
+      "BulkOperation": {
+        "type": "object",
+        "required": ["op"],
+        "properties": {
+          "op": {"type": "string", "enum": ["create", "update", "patch", "delete", "complete", "reassign"], "description": "complete and reassign are only for todos"},
+          "id": {"type": "integer", "format": "int64", "description": "What to update, patch, delete or complete"},
+          "body": {"type": "object", "description": "What POST, PUT or PATCH of a single note or todo would take"},
+          "if_match": {"type": "string", "description": "Only apply the operation if the ETag of what it changes is one of these"},
+          "from": {"type": "integer", "format": "int64", "description": "Person whose todos reassign moves"},
+          "to": {"type": "integer", "format": "int64", "description": "Person reassign moves them to"}
+        }
+      },
+      "BulkResults": {
+        "type": "object",
+        "properties": {"results": {"type": "array", "items": {
+          "type": "object",
+          "properties": {
+            "op": {"type": "string"},
+            "id": {"type": "integer", "format": "int64"},
+            "status": {"type": "integer", "description": "What the operation would have got on its own, or 424 if it wasn't applied as another failed"},
+            "body": {"description": "What the operation would have got on its own"}
+          }
+        }}}
+      },
+      "PersonEnvelope": {
+        "type": "object",
+        "properties": {
+          "person": {"$ref": "#/components/schemas/Person"},
+          "notes": {"type": "array", "items": {"$ref": "#/components/schemas/Note"}},
+          "todos": {"type": "array", "items": {"$ref": "#/components/schemas/Todo"}}
+        }
+      },
+      "PeopleEnvelope": {
+        "type": "object",
+        "properties": {
+          "people": {"type": "array", "items": {"$ref": "#/components/schemas/Person"}},
+          "notes": {"type": "array", "items": {"$ref": "#/components/schemas/Note"}},
+          "todos": {"type": "array", "items": {"$ref": "#/components/schemas/Todo"}}
+        }
+      },
+      "NoteEnvelope": {"type": "object", "properties": {"note": {"$ref": "#/components/schemas/Note"}}},
+      "NotesEnvelope": {"type": "object", "properties": {"notes": {"type": "array", "items": {"$ref": "#/components/schemas/Note"}}}},
+      "TodoEnvelope": {"type": "object", "properties": {"todo": {"$ref": "#/components/schemas/Todo"}}},
+      "TodosEnvelope": {"type": "object", "properties": {"todos": {"type": "array", "items": {"$ref": "#/components/schemas/Todo"}}}},
+      "WorkspaceEnvelope": {"type": "object", "properties": {"workspace": {"$ref": "#/components/schemas/Workspace"}}},
+      "WorkspacesEnvelope": {"type": "object", "properties": {"workspaces": {"type": "array", "items": {"$ref": "#/components/schemas/Workspace"}}}},
+      "MemberEnvelope": {"type": "object", "properties": {"member": {"$ref": "#/components/schemas/Member"}}},
+      "JSONAPIResource": {
+        "type": "object",
+        "description": "Attributes are the fields of the matching Ember schema, less id and relationships",
+        "properties": {
+          "type": {"type": "string", "enum": ["people", "notes", "todos", "workspaces", "members", "calendars"]},
+          "id": {"type": "string"},
+          "attributes": {"type": "object"},
+          "relationships": {"type": "object", "additionalProperties": {
+            "type": "object", "properties": {"data": {}}}}
+        }
+      },
+      "JSONAPIRequest": {
+        "type": "object",
+        "properties": {"data": {"$ref": "#/components/schemas/JSONAPIResource"}}
+      },
+      "JSONAPIDocument": {
+        "type": "object",
+        "properties": {
+          "data": {"oneOf": [
+            {"$ref": "#/components/schemas/JSONAPIResource"},
+            {"type": "array", "items": {"$ref": "#/components/schemas/JSONAPIResource"}}
+          ]},
+          "included": {"type": "array", "items": {"$ref": "#/components/schemas/JSONAPIResource"}}
+        }
+      },
+      "JSONAPIErrors": {
+        "type": "object",
+        "properties": {"errors": {"type": "array", "items": {
+          "type": "object",
+          "properties": {
+            "status": {"type": "string"},
+            "title": {"type": "string"},
+            "detail": {"type": "string"},
+            "source": {"type": "object", "properties": {"pointer": {"type": "string"}}}
+          }
+        }}}
+      },
+      "NewPerson": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string", "minLength": 1, "maxLength": 255},
+          "email": {"type": "string", "format": "email", "maxLength": 255, "description": "Used to match the person to attendees of imported calendars"}
+        }
+      },
+      "Person": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"},
+          "email": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "notes": {"type": "array", "items": {"type": "integer", "format": "int64"}, "description": "Ids of the sideloaded notes"},
+          "todos": {"type": "array", "items": {"type": "integer", "format": "int64"}, "description": "Ids of the sideloaded todos"}
+        }
+      },
+      "Note": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "date": {"type": "string", "format": "date-time"},
+          "text": {"type": "string"},
+          "category": {"type": "string"},
+          "visibility": {"$ref": "#/components/schemas/Visibility"},
+          "confidential": {"type": "boolean"},
+          "shared_with": {"type": "array", "items": {"type": "integer", "format": "int64"}},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "person": {"type": "integer", "format": "int64"}
+        }
+      },
+      "NoteInput": {
+        "type": "object",
+        "properties": {
+          "text": {"type": "string", "maxLength": 65536, "description": "Required when creating without a template"},
+          "category": {"type": "string", "pattern": "^[a-z0-9_-]{1,32}$"},
+          "date": {"type": "string", "format": "date-time", "description": "Defaults to when the note is created"},
+          "person": {"type": "integer", "format": "int64", "description": "Required when creating"},
+          "visibility": {"$ref": "#/components/schemas/Visibility"},
+          "confidential": {"type": "boolean"},
+          "shared_with": {"type": "array", "items": {"type": "integer", "format": "int64"}}
+        }
+      },
+      "Visibility": {
+        "type": "string",
+        "enum": ["private", "manager_chain", "shared", "workspace"]
+      },
+      "Todo": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "date": {"type": "string", "format": "date-time"},
+          "text": {"type": "string"},
+          "category": {"type": "string"},
+          "done": {"type": "boolean"},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "person": {"type": "integer", "format": "int64"}
+        }
+      },
+      "TodoInput": {
+        "type": "object",
+        "properties": {
+          "text": {"type": "string", "maxLength": 65536, "description": "Required when creating"},
+          "category": {"type": "string", "pattern": "^[a-z0-9_-]{1,32}$"},
+          "date": {"type": "string", "format": "date-time", "description": "Defaults to when the todo is created"},
+          "done": {"type": "boolean"},
+          "person": {"type": "integer", "format": "int64", "description": "Required when creating, except with addToAll"}
+        }
+      },
+      "NewWorkspace": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {"name": {"type": "string", "minLength": 1, "maxLength": 255}}
+      },
+      "Workspace": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "role": {"$ref": "#/components/schemas/Role"}
+        }
+      },
+      "Member": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "readOnly": true},
+          "user": {"type": "string", "description": "User name"},
+          "role": {"$ref": "#/components/schemas/Role"},
+          "manager": {"type": "string", "description": "Name of the user the member reports to"}
+        }
+      },
+      "Role": {
+        "type": "string",
+        "enum": ["owner", "editor", "viewer", "hr"]
+      }
+    }
+  }
+}
+`
+
+func getOpenAPI(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte(openAPISpec))
+}
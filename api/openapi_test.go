@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var routeParam = regexp.MustCompile(`:([^/]+)`)
+
+// specPath turns a martini route pattern into an OpenAPI path.
+func specPath(pattern string) string {
+	return routeParam.ReplaceAllString(strings.TrimPrefix(pattern, "/api/1"), "{$1}")
+}
+
+// refs returns every $ref in v.
+func refs(v interface{}) []string {
+	var found []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				found = append(found, ref)
+			} else {
+				found = append(found, refs(child)...)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			found = append(found, refs(child)...)
+		}
+	}
+	return found
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	_, m := setupFakeTest(t)
+	response := serveAs(m, "", "GET", "/api/1/openapi.json", nil)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d getting the spec without a token, got %d", http.StatusOK, response.Code)
+	}
+	var spec map[string]interface{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &spec))
+	paths := spec["paths"].(map[string]interface{})
+
+	routed := map[string]bool{}
+	for _, route := range createRouter().All() {
+		if route.Method() == "OPTIONS" {
+			continue
+		}
+		path := specPath(route.Pattern())
+		method := strings.ToLower(route.Method())
+		routed[path+" "+method] = true
+		ops, _ := paths[path].(map[string]interface{})
+		if _, ok := ops[method]; !ok {
+			t.Errorf("%s %s isn't in the spec", route.Method(), route.Pattern())
+		}
+	}
+
+	operation_ids := map[string]bool{}
+	for path, ops := range paths {
+		for method, op := range ops.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if !routed[path+" "+method] {
+				t.Errorf("%s %s is in the spec but isn't routed", method, path)
+			}
+			id, _ := op.(map[string]interface{})["operationId"].(string)
+			if id == "" || operation_ids[id] {
+				t.Errorf("%s %s has a missing or duplicate operationId %q", method, path, id)
+			}
+			operation_ids[id] = true
+		}
+	}
+
+	for _, ref := range refs(spec) {
+		var target interface{} = spec
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			obj, _ := target.(map[string]interface{})
+			target = obj[part]
+		}
+		if target == nil {
+			t.Errorf("%s doesn't resolve", ref)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// PATCH requests are JSON Merge Patches (RFC 7386): fields that are left
+// out are left alone, null clears a field and anything else sets it.  A
+// note or todo's date and person can be changed but not cleared.  Patches
+// can be sent as application/merge-patch+json or wrapped in the usual Ember
+// or JSON:API envelope.
+const contentTypeMergePatch = "application/merge-patch+json"
+
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// fieldErrors lists everything wrong with a request body, field by field.
+// Handlers give it to rend.JSON with a 422 and the Serializer formats it.
+type fieldErrors []fieldError
+
+func (e fieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *fieldErrors) add(field string, format string, args ...interface{}) {
+	*e = append(*e, fieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// patchValue unmarshals value into v, adding an error for field if it's the
+// wrong type.  v should start out as its zero value, which null leaves it
+// as.
+func (e *fieldErrors) patchValue(field string, value json.RawMessage, v interface{}) bool {
+	if err := json.Unmarshal(value, v); err != nil {
+		e.add(field, "invalid value %s", value)
+		return false
+	}
+	return true
+}
+
+// patchId checks an id in a patch matches the resource's.
+func (e *fieldErrors) patchId(value json.RawMessage, id int64) {
+	var patched *int64
+	if e.patchValue("id", value, &patched) && patched != nil && *patched != id {
+		e.add("id", "can't be changed")
+	}
+}
+
+// patchDate returns the date set by a patch.  Notes and todos always have
+// a date so it can't be cleared.
+func (e *fieldErrors) patchDate(value json.RawMessage) *time.Time {
+	var date *time.Time
+	if !e.patchValue("date", value, &date) {
+		return nil
+	}
+	if date == nil {
+		e.add("date", "can't be cleared")
+	}
+	return date
+}
+
+// patchPerson looks up the person a patch reassigns something to.
+func (e *fieldErrors) patchPerson(value json.RawMessage, people db.PeopleStore) *db.Person {
+	var id *int64
+	if !e.patchValue("person", value, &id) {
+		return nil
+	}
+	if id == nil {
+		e.add("person", "can't be cleared")
+		return nil
+	}
+	p, err := people.GetPersonById(*id)
+	if err != nil {
+		e.add("person", "no person with id %d", *id)
+		return nil
+	}
+	return p
+}
+
+// applyNotePatch applies patch to n, returning every field it couldn't.
+// n may be partly changed if there are errors.
+func applyNotePatch(n *db.Note, patch object, people db.PeopleStore, policy *Policy) fieldErrors {
+	var errs fieldErrors
+	for _, f := range patch {
+		switch f.Key {
+		case "id":
+			errs.patchId(f.Value, n.Id)
+		case "created_at", "updated_at":
+			// Kept by the server, so sending them back is harmless
+		case "text":
+			var text string
+			if errs.patchValue(f.Key, f.Value, &text) {
+				n.Text = text
+			}
+		case "category":
+			var category string
+			if errs.patchValue(f.Key, f.Value, &category) {
+				n.Category = category
+			}
+		case "date":
+			if date := errs.patchDate(f.Value); date != nil {
+				n.Date = *date
+			}
+		case "person":
+			if p := errs.patchPerson(f.Value, people); p != nil {
+				n.Person = p
+			}
+		case "visibility":
+			var visibility string
+			if !errs.patchValue(f.Key, f.Value, &visibility) {
+				continue
+			}
+			if visibility == "" {
+				visibility = db.VisibilityWorkspace
+			}
+			if !db.ValidVisibility(visibility) {
+				errs.add(f.Key, "unknown visibility %s", visibility)
+				continue
+			}
+			n.Visibility = visibility
+		case "confidential":
+			var confidential bool
+			if errs.patchValue(f.Key, f.Value, &confidential) {
+				n.Confidential = confidential
+			}
+		case "shared_with":
+			shared_with := []int64{}
+			if !errs.patchValue(f.Key, f.Value, &shared_with) {
+				continue
+			}
+			if shared_with == nil {
+				shared_with = []int64{}
+			}
+			if err := checkSharing(policy, "", shared_with); err != nil {
+				errs.add(f.Key, "%s", err)
+				continue
+			}
+			n.SharedWith = shared_with
+		default:
+			errs.add(f.Key, "unknown field")
+		}
+	}
+	return errs
+}
+
+// applyTodoPatch applies patch to t, returning every field it couldn't.
+// t may be partly changed if there are errors.
+func applyTodoPatch(t *db.Todo, patch object, people db.PeopleStore) fieldErrors {
+	var errs fieldErrors
+	for _, f := range patch {
+		switch f.Key {
+		case "id":
+			errs.patchId(f.Value, t.Id)
+		case "created_at", "updated_at":
+			// Kept by the server, so sending them back is harmless
+		case "text":
+			var text string
+			if errs.patchValue(f.Key, f.Value, &text) {
+				t.Text = text
+			}
+		case "category":
+			var category string
+			if errs.patchValue(f.Key, f.Value, &category) {
+				t.Category = category
+			}
+		case "done":
+			var done bool
+			if errs.patchValue(f.Key, f.Value, &done) {
+				t.Done = done
+			}
+		case "date":
+			if date := errs.patchDate(f.Value); date != nil {
+				t.Date = *date
+			}
+		case "person":
+			if p := errs.patchPerson(f.Value, people); p != nil {
+				t.Person = p
+			}
+		default:
+			errs.add(f.Key, "unknown field")
+		}
+	}
+	return errs
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func TestPatchNoteAndTodo(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadWorkspaceFixture(t, store, "tester", testToken, "text")
+			scoped := store.InWorkspace(f.Workspace)
+			f.Note.Category = "oneonone"
+			failOnError(t, scoped.UpdateNote(f.Note))
+			other := &db.Person{Name: "other"}
+			failOnError(t, scoped.CreatePerson(other))
+			m := createMartini(store)
+
+			date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			patch := fmt.Sprintf(`{"category": null, "person": %d, "date": "%s", "confidential": true}`,
+				other.Id, date.Format(time.RFC3339))
+			response := serveAs(m, testToken, "PATCH", fmt.Sprintf("/api/1/notes/%d", f.Note.Id),
+				strings.NewReader(patch), "Content-Type", contentTypeMergePatch)
+			if response.Code != http.StatusOK {
+				t.Fatalf("Expected 200 patching the note, got %d: %s", response.Code, response.Body)
+			}
+			n, err := scoped.GetNoteById(f.Note.Id)
+			failOnError(t, err)
+			if n.Category != "" || n.Person.Id != other.Id || !n.Date.Equal(date) || !n.Confidential {
+				t.Errorf("Expected the note to be patched, got %+v", n)
+			}
+			if n.Text != "text" || n.Visibility != db.VisibilityWorkspace {
+				t.Errorf("Expected fields left out of the patch to be left alone, got %+v", n)
+			}
+
+			patch = fmt.Sprintf(`{"todo": {"person": %d, "category": "later", "date": "%s"}}`,
+				other.Id, date.Format(time.RFC3339))
+			response = serveAs(m, testToken, "PATCH", fmt.Sprintf("/api/1/todos/%d", f.Todo.Id), strings.NewReader(patch))
+			if response.Code != http.StatusOK {
+				t.Fatalf("Expected 200 patching the todo, got %d: %s", response.Code, response.Body)
+			}
+			todo, err := scoped.GetTodoById(f.Todo.Id)
+			failOnError(t, err)
+			if todo.Person.Id != other.Id || todo.Category != "later" || !todo.Date.Equal(date) || todo.Text != "text" {
+				t.Errorf("Expected the todo to be patched, got %+v", todo)
+			}
+
+			response = serveAs(m, testToken, "PATCH", fmt.Sprintf("/api/1/todos/%d", f.Todo.Id),
+				strings.NewReader(`{"text": null}`))
+			todo, err = scoped.GetTodoById(f.Todo.Id)
+			failOnError(t, err)
+			if response.Code != http.StatusOK || todo.Text != "" {
+				t.Errorf("Expected the todo's text to be cleared, got %d: %+v", response.Code, todo)
+			}
+		})
+	}
+}
+
+func TestPatchFieldErrors(t *testing.T) {
+	store := dbtest.NewFakeStore()
+	f := loadWorkspaceFixture(t, store, "tester", testToken, "text")
+	m := createMartini(store)
+	url := fmt.Sprintf("/api/1/notes/%d", f.Note.Id)
+	patch := `{"id": 12345, "text": 1, "person": null, "date": null, "visibility": "everyone", "shared_with": [999], "colour": "red"}`
+	fields := []string{"id", "text", "person", "date", "visibility", "shared_with", "colour"}
+
+	response := serveAs(m, testToken, "PATCH", url, strings.NewReader(patch))
+	if response.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusUnprocessableEntity, response.Code, response.Body)
+	}
+	ember := struct {
+		Errors map[string][]string `json:"errors"`
+	}{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &ember))
+	for _, field := range fields {
+		if len(ember.Errors[field]) != 1 {
+			t.Errorf("Expected an error for %s, got %v", field, ember.Errors)
+		}
+	}
+
+	body := fmt.Sprintf(`{"data": {"type": "notes", "id": "%d", "attributes": {"text": 1},
+		"relationships": {"person": {"data": null}}}}`, f.Note.Id)
+	response = serveAs(m, testToken, "PATCH", url, strings.NewReader(body), "Content-Type", contentTypeJSONAPI)
+	if response.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusUnprocessableEntity, response.Code, response.Body)
+	}
+	jsonapi := jsonAPIErrors{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &jsonapi))
+	pointers := map[string]bool{}
+	for _, e := range jsonapi.Errors {
+		if e.Source != nil {
+			pointers[e.Source.Pointer] = true
+		}
+	}
+	for _, pointer := range []string{"/data/attributes/text", "/data/relationships/person"} {
+		if !pointers[pointer] {
+			t.Errorf("Expected an error pointing at %s, got %+v", pointer, jsonapi.Errors)
+		}
+	}
+
+	n, err := store.InWorkspace(f.Workspace).GetNoteById(f.Note.Id)
+	failOnError(t, err)
+	if n.Text != "text" || n.Person.Id != f.Person.Id {
+		t.Errorf("Expected an invalid patch not to change the note, got %+v", n)
+	}
+}
@@ -1,12 +1,11 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 
-	"github.com/astaxie/beego/orm"
 	"github.com/codegangsta/martini"
 	"github.com/golang/glog"
 	"github.com/hobeone/pointyhair/db"
@@ -14,34 +13,107 @@ import (
 )
 
 type PeopleJSON struct {
-	People []*personWithRelations `json:"people"`
+	People []personWithRelations `json:"people"`
 }
 
 type PersonJSON struct {
 	Person personWithRelations `json:"person"`
 }
 
+// personWithRelations is a person with the notes and todos the user may
+// see.  Notes or Todos is nil if it wasn't loaded.
 type personWithRelations struct {
 	db.Person
 	Notes []*db.Note `json:"notes"`
 	Todos []*db.Todo `json:"todos"`
-	//	NoteIds []int64 `json:"notes"`
-	//	TodoIds []int64 `json:"todos"`
 }
 
+// resources returns the person as a resource related to the notes and
+// todos that were loaded, along with the notes and todos to sideload.
+func (pn personWithRelations) resources() (resource, []resource) {
+	var included []resource
+	var rels []relationship
+	if pn.Notes != nil {
+		note_ids := make([]int64, len(pn.Notes))
+		for i, n := range pn.Notes {
+			note_ids[i] = n.Id
+			included = append(included, noteResource(n))
+		}
+		rels = append(rels, toMany("notes", noteType, note_ids))
+	}
+	if pn.Todos != nil {
+		todo_ids := make([]int64, len(pn.Todos))
+		for i, t := range pn.Todos {
+			todo_ids[i] = t.Id
+			included = append(included, todoResource(t))
+		}
+		rels = append(rels, toMany("todos", todoType, todo_ids))
+	}
+	r := newResource(personType, pn.Id, pn.Person, rels...)
+	r.Version = pn.Version
+	return r, included
+}
+
+// personRelations returns which of a person's relations to load and
+// sideload: the ones named with ?include=notes,todos or, without an include
+// parameter, the ones in the person fieldset, which is all of them unless
+// ?fields[person] says otherwise.
+func personRelations(req *http.Request, fields fieldsets) (map[string]bool, error) {
+	include, err := parseInclude(req, "notes", "todos")
+	if err != nil || include != nil {
+		return include, err
+	}
+	return map[string]bool{
+		"notes": fields.wants(personType, "notes"),
+		"todos": fields.wants(personType, "todos"),
+	}, nil
+}
+
+// writePeople writes people, sideloading their notes and todos.
+func writePeople(rend render.Render, s Serializer, people []personWithRelations) {
+	rs := make([]resource, len(people))
+	var included []resource
+	for i, pn := range people {
+		r, inc := pn.resources()
+		rs[i] = r
+		included = append(included, inc...)
+	}
+	rend.JSON(http.StatusOK, s.Many(personType, rs, included))
+}
+
+// GET /people/:id?redact=true replaces the text of confidential notes with
+// a placeholder.
+const redactParam = "redact"
+
 type unmarshalPersonJSON struct {
-	Name string `json:"name"`
+	Name  string `json:"name" validate:"required,max=255"`
+	Email string `json:"email" validate:"max=255,email"`
 }
 
-func getPerson(rend render.Render, params martini.Params, dbh *db.DBHandle) {
+func getPerson(rend render.Render, req *http.Request, params martini.Params, store db.PeopleStore, policy *Policy, s Serializer, fields fieldsets) {
+	err := req.ParseForm()
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	redact, err := parseRedact(req)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	rels, err := personRelations(req, fields)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
 	id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(500, "Invalid id: "+err.Error())
 		return
 	}
-	p, err := dbh.GetPersonById(id)
+	p, err := store.GetPersonById(id)
 	if err != nil {
-		if err == orm.ErrNoRows {
+		if err == db.ErrNotFound {
 			rend.JSON(404, fmt.Sprintf("No Person with id %d found.", id))
 			return
 		} else {
@@ -50,119 +122,212 @@ func getPerson(rend render.Render, params martini.Params, dbh *db.DBHandle) {
 		}
 	}
 
-	pn, err := newPersonWithRelations(p, dbh)
+	pn, err := personView(p, store, policy, rels, redact)
 	if err != nil {
 		rend.JSON(500, err)
 		return
 	}
-	rend.JSON(200, pn)
+	rend.JSON(200, s.One(pn.resources()))
 }
 
-func newPersonWithRelations(p *db.Person, dbh *db.DBHandle) (personWithRelations, error) {
-	err := p.LoadRelated(dbh)
+// parseRedact returns the value of the redact parameter.
+func parseRedact(req *http.Request) (bool, error) {
+	if req.Form.Get(redactParam) == "" {
+		return false, nil
+	}
+	redact, err := strconv.ParseBool(req.Form.Get(redactParam))
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s: %s", redactParam, err)
+	}
+	return redact, nil
+}
+
+// personView returns p the way getPerson shows it, which is also what an
+// If-Match header for p is checked against.
+func personView(p *db.Person, store db.PeopleStore, policy *Policy, rels map[string]bool, redact bool) (personWithRelations, error) {
+	// Asking for a single person counts as asking for their confidential
+	// notes.
+	people, err := loadPeopleWithRelations([]*db.Person{p}, store, policy, true, rels)
 	if err != nil {
 		return personWithRelations{}, err
 	}
-	note_ids := make([]int64, len(p.Notes))
-	for ni, n := range p.Notes {
-		note_ids[ni] = n.Id
+	pn := people[0]
+	if redact {
+		redactNotes(pn.Notes)
 	}
-	todo_ids := make([]int64, len(p.Todos))
-	for ti, t := range p.Todos {
-		todo_ids[ti] = t.Id
+	return pn, nil
+}
+
+// loadPeopleWithRelations loads the relations of people named in rels, all
+// at once, leaving out the notes and todos policy doesn't let the user
+// see.  Confidential notes are left out unless include_confidential is set.
+func loadPeopleWithRelations(people []*db.Person, store db.PeopleStore, policy *Policy, include_confidential bool, rels map[string]bool) ([]personWithRelations, error) {
+	err := store.LoadPeopleRelations(people, rels["notes"], rels["todos"])
+	if err != nil {
+		return nil, err
 	}
 
-	pn := personWithRelations{
-		*p,
-		p.Notes,
-		p.Todos,
+	people_json := make([]personWithRelations, len(people))
+	for i, p := range people {
+		pn := personWithRelations{Person: *p}
+		if rels["notes"] {
+			pn.Notes = policy.FilterListed(p.Notes, include_confidential)
+		}
+		if rels["todos"] {
+			pn.Todos = p.Todos
+			if !policy.CanReadTodos() {
+				pn.Todos = []*db.Todo{}
+			}
+		}
+		people_json[i] = pn
 	}
-	return pn, nil
+	return people_json, nil
 }
 
-func getPeople(rend render.Render, req *http.Request, dbh *db.DBHandle) {
+func getPeople(rend render.Render, req *http.Request, store db.PeopleStore, policy *Policy, s Serializer, fields fieldsets) {
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(500, err.Error())
 		return
 	}
+	rels, err := personRelations(req, fields)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	list, err := parseListParams(req, personType)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
 
-	var people_json []*personWithRelations
 	param_ids := req.Form["ids[]"]
 	if len(param_ids) > 0 {
-		people_ids, err := parseParamIds(param_ids)
+		list.Ids, err = parseParamIds(param_ids)
 		if err != nil {
 			rend.JSON(500, err.Error())
 			return
 		}
-		people_json = make([]*personWithRelations, len(people_ids))
-		for i, pid := range people_ids {
-			person, err := dbh.GetPersonById(pid)
-			if err != nil {
-				if err == orm.ErrNoRows {
-					rend.JSON(404, fmt.Sprintf("Person with ID %d doesn't exist", pid))
-					return
-				} else {
-					rend.JSON(500, err.Error())
-					return
-				}
-			}
-			pn, err := newPersonWithRelations(person, dbh)
-			if err != nil {
-				rend.JSON(500, err)
-				return
-			}
-
-			people_json[i] = &pn
-		}
-	} else {
-		people, err := dbh.GetPeopleById([]int64{})
+		known, err := store.GetPeopleById(list.Ids)
 		if err != nil {
 			rend.JSON(500, err)
 			return
 		}
-
-		people_json = make([]*personWithRelations, len(people))
-		for i, p := range people {
-			pn, err := newPersonWithRelations(p, dbh)
-			if err != nil {
-				rend.JSON(500, err)
+		found := make(map[int64]bool, len(known))
+		for _, p := range known {
+			found[p.Id] = true
+		}
+		for _, pid := range list.Ids {
+			if !found[pid] {
+				rend.JSON(404, fmt.Sprintf("Person with ID %d doesn't exist", pid))
 				return
 			}
-			people_json[i] = &pn
 		}
 	}
-	rend.JSON(200, people_json)
+	people, err := store.ListPeople(list)
+	if err != nil {
+		rend.JSON(500, err)
+		return
+	}
+	if len(list.Ids) > 0 && len(list.OrderBy) == 0 {
+		// Return them in the order asked for.
+		order := inRequestOrder(list.Ids)
+		sort.SliceStable(people, func(i, j int) bool { return order[people[i].Id] < order[people[j].Id] })
+	}
+
+	people_json, err := loadPeopleWithRelations(people, store, policy, includeConfidential(req), rels)
+	if err != nil {
+		rend.JSON(500, err)
+		return
+	}
+	writePeople(rend, s, people_json)
 }
 
-func createPerson(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func createPerson(rend render.Render, req *http.Request, params martini.Params, store db.PeopleStore, policy *Policy, s Serializer, fields fieldsets) {
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
+	rels, err := personRelations(req, fields)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	u := unmarshalPersonJSON{}
 	glog.Info("Decoding person creation request")
-	err = json.NewDecoder(req.Body).Decode(&u)
-	if err != nil {
-		rend.JSON(http.StatusBadRequest, err.Error())
+	if !decodeValid(rend, req, s, personType, &u, true) {
 		return
 	}
 
 	dbPerson := db.Person{
-		Name: u.Name,
+		Name:  u.Name,
+		Email: u.Email,
 	}
 
-	_, err = dbh.ORM.Insert(&dbPerson)
+	err = store.CreatePerson(&dbPerson)
 	if err != nil {
 		rend.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
-	pn, err := newPersonWithRelations(&dbPerson, dbh)
+	people, err := loadPeopleWithRelations([]*db.Person{&dbPerson}, store, policy, false, rels)
 	if err != nil {
 		rend.JSON(500, err)
 		return
 	}
-	rend.JSON(http.StatusOK, pn)
+	rend.JSON(http.StatusOK, s.One(people[0].resources()))
+}
+
+func deletePerson(rend render.Render, req *http.Request, params martini.Params, store db.PeopleStore, policy *Policy, s Serializer, fields fieldsets) {
+	if !policy.CanRemovePerson() {
+		rend.JSON(http.StatusForbidden, "Only owners can delete people")
+		return
+	}
+	person_id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	person, err := store.GetPersonById(person_id)
+	if err != nil {
+		rend.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	// The person's ETag covers their notes and todos, so only load them if
+	// it's needed.
+	if req.Header.Get("If-Match") != "" {
+		err = req.ParseForm()
+		if err != nil {
+			rend.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		rels, err := personRelations(req, fields)
+		if err != nil {
+			rend.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		redact, err := parseRedact(req)
+		if err != nil {
+			rend.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		pn, err := personView(person, store, policy, rels, redact)
+		if err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !checkIfMatch(rend, req, s.One(pn.resources())) {
+			return
+		}
+	}
+
+	err = store.RemovePerson(person)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rend.JSON(http.StatusNoContent, "")
 }
@@ -1,34 +1,93 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
 )
 
 const getPersonByIdGoldenResponse = `{
   "person": {
     "id": 3,
     "name": "test3",
+    "email": "",
+    "created_at": "",
+    "updated_at": "",
     "notes": [
       1,
       2,
       3
+    ],
+    "todos": [
+      3
     ]
-  }
+  },
+  "notes": [
+    {
+      "id": 1,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed1/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    },
+    {
+      "id": 2,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed2/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    },
+    {
+      "id": 3,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed3/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    }
+  ],
+  "todos": [
+    {
+      "id": 3,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo3",
+      "category": "",
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    }
+  ]
 }`
 
 func TestGetPersonById(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/people/3", nil)
+	req, _ := newTestRequest("GET", "/api/1/people/3", nil)
 	m.ServeHTTP(response, req)
 
 	if response.Code != 200 {
@@ -36,14 +95,14 @@ func TestGetPersonById(t *testing.T) {
 		t.Fatalf("Expected 200 response code, got %d", response.Code)
 	}
 
-	if response.Body.String() != getPersonByIdGoldenResponse {
+	if goldenBody(response) != getPersonByIdGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
 
 	// Non existing id
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/1/people/100", nil)
+	req, _ = newTestRequest("GET", "/api/1/people/100", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusNotFound {
 		fmt.Println(response.Body.String())
@@ -56,47 +115,253 @@ const getPeopleByIdGoldenResponse = `{
     {
       "id": 2,
       "name": "test2",
-      "notes": []
+      "email": "",
+      "created_at": "",
+      "updated_at": "",
+      "notes": [],
+      "todos": [
+        2
+      ]
     },
     {
       "id": 3,
       "name": "test3",
+      "email": "",
+      "created_at": "",
+      "updated_at": "",
       "notes": [
         1,
         2,
         3
+      ],
+      "todos": [
+        3
       ]
     }
+  ],
+  "todos": [
+    {
+      "id": 2,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo2",
+      "category": "",
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 2
+    },
+    {
+      "id": 3,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo3",
+      "category": "",
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    }
+  ],
+  "notes": [
+    {
+      "id": 1,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed1/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    },
+    {
+      "id": 2,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed2/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    },
+    {
+      "id": 3,
+      "date": "2014-03-01T10:00:00Z",
+      "text": "http://testfeed3/feed.atom",
+      "category": "",
+      "visibility": "workspace",
+      "confidential": false,
+      "shared_with": [],
+      "created_at": "",
+      "updated_at": "",
+      "person": 3
+    }
   ]
 }`
 
 func TestGetPeopleWithIds(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/people?ids[]=2&ids[]=3", nil)
+	req, _ := newTestRequest("GET", "/api/1/people?ids[]=2&ids[]=3", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != 200 {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Expected 200 response code, got %d", response.Code)
 	}
 
-	if response.Body.String() != getPeopleByIdGoldenResponse {
+	if goldenBody(response) != getPeopleByIdGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
 
 	// Non existing id
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/1/people?ids[]=100", nil)
+	req, _ = newTestRequest("GET", "/api/1/people?ids[]=100", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusNotFound {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Expected %d response code, got %d", http.StatusNotFound, response.Code)
 	}
 }
+
+func TestCreateAndDeletePersonFakeStore(t *testing.T) {
+	store, m := setupFakeTest(t)
+
+	response := httptest.NewRecorder()
+	req, _ := newTestRequest("POST", "/api/1/people", strings.NewReader(`{"name": "newperson"}`))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	m.ServeHTTP(response, req)
+	if response.Code != http.StatusOK {
+		fmt.Println(response.Body.String())
+		t.Fatalf("Expected %d response code, got %d", http.StatusOK, response.Code)
+	}
+
+	created := struct {
+		Person db.Person `json:"person"`
+	}{}
+	err := json.NewDecoder(response.Body).Decode(&created)
+	failOnError(t, err)
+	p := created.Person
+	if p.Name != "newperson" {
+		t.Fatalf("Expected created person to be named newperson, got %s", p.Name)
+	}
+
+	response = httptest.NewRecorder()
+	req, _ = newTestRequest("DELETE", fmt.Sprintf("/api/1/people/%d", p.Id), nil)
+	m.ServeHTTP(response, req)
+	if response.Code != http.StatusNoContent {
+		fmt.Println(response.Body.String())
+		t.Fatalf("Expected %d response code, got %d", http.StatusNoContent, response.Code)
+	}
+
+	_, err = store.GetPersonById(p.Id)
+	if err != db.ErrNotFound {
+		t.Fatalf("Expected person to be deleted, got %v", err)
+	}
+}
+
+func TestGetPeopleIncludeAndFields(t *testing.T) {
+	p, m := setupSerializerTest(t)
+
+	tests := []struct {
+		query  string
+		person []string
+		keys   []string
+	}{
+		{"", []string{"id", "name", "email", "created_at", "updated_at", "notes", "todos"}, []string{"person", "notes", "todos"}},
+		{"include=", []string{"id", "name", "email", "created_at", "updated_at"}, []string{"person"}},
+		{"include=notes", []string{"id", "name", "email", "created_at", "updated_at", "notes"}, []string{"person", "notes"}},
+		{"fields[person]=name", []string{"id", "name"}, []string{"person"}},
+		{"fields[people]=name,todos", []string{"id", "name", "todos"}, []string{"person", "todos"}},
+		{"fields[person]=name&include=notes", []string{"id", "name"}, []string{"person", "notes"}},
+	}
+	for _, test := range tests {
+		url := fmt.Sprintf("/api/1/people/%d?%s", p.Id, test.query)
+		response := serveAs(m, testToken, "GET", url, nil)
+		if response.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s, got %d: %s", url, response.Code, response.Body)
+			continue
+		}
+		raw := map[string]json.RawMessage{}
+		failOnError(t, json.Unmarshal(response.Body.Bytes(), &raw))
+		person := map[string]interface{}{}
+		failOnError(t, json.Unmarshal(raw["person"], &person))
+		if len(person) != len(test.person) {
+			t.Errorf("Expected person fields %v for %s, got %v", test.person, url, person)
+		}
+		for _, f := range test.person {
+			if _, ok := person[f]; !ok {
+				t.Errorf("Expected person field %s for %s, got %v", f, url, person)
+			}
+		}
+		if len(raw) != len(test.keys) {
+			t.Errorf("Expected keys %v for %s, got %s", test.keys, url, response.Body)
+		}
+		for _, k := range test.keys {
+			if _, ok := raw[k]; !ok {
+				t.Errorf("Expected key %s for %s, got %s", k, url, response.Body)
+			}
+		}
+	}
+
+	response := serveAs(m, testToken, "GET", "/api/1/notes?fields[note]=text", nil)
+	notes := NotesJSON{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &notes))
+	if len(notes.Notes) != 1 || notes.Notes[0].Text != "note" || notes.Notes[0].PersonId != 0 {
+		t.Errorf("Expected notes with only their text, got %s", response.Body)
+	}
+
+	for _, url := range []string{"/api/1/people?include=bogus", "/api/1/people?fields[bogus]=name"} {
+		response := serveAs(m, testToken, "GET", url, nil)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", url, response.Code)
+		}
+	}
+}
+
+// BenchmarkGetPeople lists 500 people with 50 notes each from sqlite.
+func BenchmarkGetPeople(b *testing.B) {
+	dbh, err := db.NewMemoryDBHandle("benchmark", false)
+	failOnError(b, err)
+	defer dbh.Close()
+	ws := setupTestWorkspace(b, dbh, "tester", testToken)
+	scoped := dbh.InWorkspace(ws)
+	failOnError(b, dbh.ORM.Begin())
+	for i := 0; i < 500; i++ {
+		p := &db.Person{Name: fmt.Sprintf("person%d", i)}
+		failOnError(b, scoped.CreatePerson(p))
+		for j := 0; j < 50; j++ {
+			n := &db.Note{Person: p, Text: fmt.Sprintf("note %d", j), Date: time.Now()}
+			failOnError(b, scoped.CreateNote(n))
+		}
+	}
+	failOnError(b, dbh.ORM.Commit())
+	m := createMartini(dbh)
+
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"default", ""},
+		{"include_notes", "include=notes"},
+		{"include_none", "include="},
+		{"fields_name", "fields[person]=name"},
+	}
+	for _, q := range queries {
+		query := q.query
+		b.Run(q.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				response := serveAs(m, testToken, "GET", "/api/1/people?"+query, nil)
+				if response.Code != http.StatusOK {
+					b.Fatalf("Expected 200, got %d: %s", response.Code, response.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/db"
+)
+
+// Policy decides what the user making a request may see and change in the
+// workspace the request is made in.  withWorkspace maps one for every
+// request and every handler that returns or changes notes and todos asks it
+// first.
+type Policy struct {
+	User       *db.User
+	Membership *db.Membership
+	store      db.WorkspaceStore
+	// Cache of whether User is above an author in the management chain
+	manages map[int64]bool
+}
+
+func newPolicy(u *db.User, m *db.Membership, store db.WorkspaceStore) *Policy {
+	return &Policy{
+		User:       u,
+		Membership: m,
+		store:      store,
+		manages:    map[int64]bool{},
+	}
+}
+
+// inTx returns a copy of p that looks things up through tx, for deciding
+// about changes made inside a transaction.
+func (p *Policy) inTx(tx db.WorkspaceStore) *Policy {
+	c := *p
+	c.store = tx
+	return &c
+}
+
+// CanWrite returns true if the user may create, change and delete things
+// in the workspace at all.
+func (p *Policy) CanWrite() bool {
+	return p.Membership.CanWrite()
+}
+
+// CanReadTodos returns true if the user may see the workspace's todos.
+func (p *Policy) CanReadTodos() bool {
+	return p.Membership.Role != db.RoleHR
+}
+
+// CanRemovePerson returns true if the user may delete a person.  Deleting a
+// person deletes all of their notes, including ones the user can't read, so
+// only owners can.
+func (p *Policy) CanRemovePerson() bool {
+	return p.Membership.Role == db.RoleOwner
+}
+
+// IsMember returns true if the user with the given id is a member of the
+// workspace.
+func (p *Policy) IsMember(user_id int64) bool {
+	_, err := p.store.GetMembership(p.Membership.Workspace, &db.User{Id: user_id})
+	if err != nil && err != db.ErrNotFound {
+		glog.Errorf("Error looking up membership of user %d: %s", user_id, err)
+	}
+	return err == nil
+}
+
+func (p *Policy) isAuthor(n *db.Note) bool {
+	return n.Author != nil && n.Author.Id == p.User.Id
+}
+
+// CanReadNote returns true if the user may see n.  Authors can always see
+// their notes, HR partners only see CategoryHR notes that aren't private and
+// everyone else goes by the note's visibility.
+func (p *Policy) CanReadNote(n *db.Note) bool {
+	if p.isAuthor(n) {
+		return true
+	}
+	if n.Visibility == db.VisibilityPrivate {
+		return false
+	}
+	if p.Membership.Role == db.RoleHR {
+		return n.Category == db.CategoryHR
+	}
+	// Notes from before authors were recorded are visible to everyone, as
+	// they always were.
+	if n.Author == nil {
+		return true
+	}
+
+	switch n.Visibility {
+	case db.VisibilityWorkspace, "":
+		return true
+	case db.VisibilityManagerChain:
+		return p.managesUser(n.Author)
+	case db.VisibilityShared:
+		for _, uid := range n.SharedWith {
+			if uid == p.User.Id {
+				return true
+			}
+		}
+		return p.managesUser(n.Author)
+	}
+	return false
+}
+
+// CanWriteNote returns true if the user may change or delete n.  Only
+// authors can change their notes.
+func (p *Policy) CanWriteNote(n *db.Note) bool {
+	if !p.CanWrite() {
+		return false
+	}
+	return n.Author == nil || p.isAuthor(n)
+}
+
+// CanListConfidential returns true if the user may have the confidential
+// note n included in bulk listings by asking for it.  Only its author and
+// owners can.
+func (p *Policy) CanListConfidential(n *db.Note) bool {
+	return p.isAuthor(n) || p.Membership.Role == db.RoleOwner
+}
+
+// CanReadAttachment returns true if the user may see an attachment on note,
+// or on a person directly if note is nil.  Attachments on notes are as
+// private as their note, and can't be redacted like its text, so ones on
+// confidential notes are only seen by those who can list the note.  Ones
+// on people are seen by everyone in the workspace, like the people
+// themselves.
+func (p *Policy) CanReadAttachment(note *db.Note) bool {
+	if note == nil {
+		return true
+	}
+	return p.CanReadNote(note) && (!note.Confidential || p.CanListConfidential(note))
+}
+
+// CanWriteAttachment returns true if the user may add or remove an
+// attachment on note, or on a person directly if note is nil.
+func (p *Policy) CanWriteAttachment(note *db.Note) bool {
+	if note == nil {
+		return p.CanWrite()
+	}
+	return p.CanWriteNote(note)
+}
+
+// CanWriteTemplate returns true if the user may change or delete t.
+// Templates are shared by the workspace but only their author and owners
+// can change them.
+func (p *Policy) CanWriteTemplate(t *db.NoteTemplate) bool {
+	if !p.CanWrite() {
+		return false
+	}
+	return t.Author == nil || t.Author.Id == p.User.Id || p.Membership.Role == db.RoleOwner
+}
+
+// FilterListed returns the notes the user may read in a bulk listing.
+// Confidential notes are left out unless include_confidential is set and
+// the user is allowed to list them.
+func (p *Policy) FilterListed(notes []*db.Note, include_confidential bool) []*db.Note {
+	listed := make([]*db.Note, 0, len(notes))
+	for _, n := range p.FilterNotes(notes) {
+		if n.Confidential && !(include_confidential && p.CanListConfidential(n)) {
+			continue
+		}
+		listed = append(listed, n)
+	}
+	return listed
+}
+
+// FilterNotes returns the notes the user may read.
+func (p *Policy) FilterNotes(notes []*db.Note) []*db.Note {
+	visible := make([]*db.Note, 0, len(notes))
+	for _, n := range notes {
+		if p.CanReadNote(n) {
+			visible = append(visible, n)
+		}
+	}
+	return visible
+}
+
+// managesUser returns true if the user is somewhere above u in the
+// workspace's management chain.
+func (p *Policy) managesUser(u *db.User) bool {
+	if manages, ok := p.manages[u.Id]; ok {
+		return manages
+	}
+
+	manages := false
+	seen := map[int64]bool{u.Id: true}
+	cur := u
+	for {
+		m, err := p.store.GetMembership(p.Membership.Workspace, cur)
+		if err != nil {
+			if err != db.ErrNotFound {
+				glog.Errorf("Error walking management chain of user %d: %s", u.Id, err)
+			}
+			break
+		}
+		if m.Manager == nil || seen[m.Manager.Id] {
+			break
+		}
+		if m.Manager.Id == p.User.Id {
+			manages = true
+			break
+		}
+		seen[m.Manager.Id] = true
+		cur = m.Manager
+	}
+	p.manages[u.Id] = manages
+	return manages
+}
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+// policyFixture is a workspace owned by dana with this org chart:
+//
+//	dana (owner)
+//	├── alice (editor)
+//	│   └── bob (editor)
+//	└── eve (editor)
+//
+// plus vic, a viewer, and hank, an HR partner.  Bob has written a note at
+// every visibility level about his report.
+type policyFixture struct {
+	Workspace *db.Workspace
+	Users     map[string]*db.User
+	Person    *db.Person
+	Todo      *db.Todo
+	Notes     map[string]*db.Note
+}
+
+func loadPolicyFixture(t *testing.T, store db.Store) policyFixture {
+	ws := setupTestWorkspace(t, store, "dana", "danatoken")
+	f := policyFixture{
+		Workspace: ws,
+		Users:     map[string]*db.User{},
+		Notes:     map[string]*db.Note{},
+	}
+	f.Users["dana"], _ = store.GetUserByName("dana")
+
+	members := []struct {
+		name    string
+		role    string
+		manager string
+	}{
+		{"alice", db.RoleEditor, "dana"},
+		{"bob", db.RoleEditor, "alice"},
+		{"eve", db.RoleEditor, "dana"},
+		{"vic", db.RoleViewer, ""},
+		{"hank", db.RoleHR, ""},
+	}
+	for _, m := range members {
+		u := &db.User{Name: m.name, Token: m.name + "token"}
+		failOnError(t, store.CreateUser(u))
+		failOnError(t, store.SetMember(ws, u, m.role))
+		f.Users[m.name] = u
+	}
+	for _, m := range members {
+		if m.manager != "" {
+			failOnError(t, store.SetManager(ws, f.Users[m.name], f.Users[m.manager]))
+		}
+	}
+
+	scoped := store.InWorkspace(ws)
+	f.Person = &db.Person{Name: "bob's report"}
+	failOnError(t, scoped.CreatePerson(f.Person))
+	f.Todo = &db.Todo{Person: f.Person, Text: "bob todo", Date: time.Now()}
+	failOnError(t, scoped.CreateTodo(f.Todo))
+
+	notes := []struct {
+		name       string
+		visibility string
+		category   string
+		shared     []int64
+	}{
+		{"private", db.VisibilityPrivate, "", nil},
+		{"chain", db.VisibilityManagerChain, "", nil},
+		{"shared", db.VisibilityShared, "", []int64{f.Users["eve"].Id}},
+		{"workspace", db.VisibilityWorkspace, "", nil},
+		{"hr", db.VisibilityWorkspace, db.CategoryHR, nil},
+		{"private hr", db.VisibilityPrivate, db.CategoryHR, nil},
+	}
+	for _, n := range notes {
+		note := &db.Note{
+			Person:     f.Person,
+			Author:     f.Users["bob"],
+			Text:       "bob " + n.name + " note",
+			Category:   n.category,
+			Date:       time.Now(),
+			Visibility: n.visibility,
+			SharedWith: n.shared,
+		}
+		failOnError(t, scoped.CreateNote(note))
+		f.Notes[n.name] = note
+	}
+	return f
+}
+
+// Who can read each of bob's notes.
+var noteReaders = map[string][]string{
+	"private":    {"bob"},
+	"chain":      {"bob", "alice", "dana"},
+	"shared":     {"bob", "eve", "alice", "dana"},
+	"workspace":  {"bob", "alice", "dana", "eve", "vic"},
+	"hr":         {"bob", "alice", "dana", "eve", "vic", "hank"},
+	"private hr": {"bob"},
+}
+
+func canRead(note string, user string) bool {
+	for _, u := range noteReaders[note] {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func expectCode(t *testing.T, m *martini.Martini, user string, method string, url string, body []byte, code int) string {
+	response := serveAs(m, user+"token", method, url, bytes.NewReader(body))
+	if response.Code != code {
+		t.Errorf("%s %s as %s: expected %d response code, got %d: %s",
+			method, url, user, code, response.Code, response.Body.String())
+	}
+	return response.Body.String()
+}
+
+func TestPolicyReads(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadPolicyFixture(t, store)
+			m := createMartini(store)
+
+			for user := range f.Users {
+				all_notes := expectCode(t, m, user, "GET", "/api/1/notes", nil, http.StatusOK)
+				person := expectCode(t, m, user, "GET", fmt.Sprintf("/api/1/people/%d", f.Person.Id), nil, http.StatusOK)
+				people := expectCode(t, m, user, "GET", "/api/1/people", nil, http.StatusOK)
+
+				for note_name, note := range f.Notes {
+					code := http.StatusNotFound
+					if canRead(note_name, user) {
+						code = http.StatusOK
+					}
+					expectCode(t, m, user, "GET", fmt.Sprintf("/api/1/notes/%d", note.Id), nil, code)
+					expectCode(t, m, user, "GET", fmt.Sprintf("/api/1/notes?ids[]=%d", note.Id), nil, code)
+
+					for where, body := range map[string]string{
+						"notes":  all_notes,
+						"person": person,
+						"people": people,
+					} {
+						if strings.Contains(body, `"`+note.Text+`"`) != canRead(note_name, user) {
+							t.Errorf("%s: %s note in %s response is %v, expected %v",
+								user, note_name, where, !canRead(note_name, user), canRead(note_name, user))
+						}
+					}
+				}
+
+				todo_code := http.StatusOK
+				if user == "hank" {
+					todo_code = http.StatusForbidden
+				}
+				expectCode(t, m, user, "GET", "/api/1/todos", nil, todo_code)
+				expectCode(t, m, user, "GET", fmt.Sprintf("/api/1/todos/%d", f.Todo.Id), nil, todo_code)
+				expectCode(t, m, user, "GET", fmt.Sprintf("/api/1/todos?ids[]=%d", f.Todo.Id), nil, todo_code)
+				if strings.Contains(person, f.Todo.Text) != (user != "hank") {
+					t.Errorf("%s: unexpected todos in person response: %s", user, person)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyWrites(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadPolicyFixture(t, store)
+			m := createMartini(store)
+
+			update_note, _ := json.Marshal(unmarshalNoteJSONContainer{Note: unmarshalNoteJSON{Text: "changed"}})
+			update_todo, _ := json.Marshal(unmarshalTodoJSONContainer{Todo: unmarshalTodoJSON{Text: "changed"}})
+			create_note, _ := json.Marshal(unmarshalNoteJSON{Text: "x", Date: time.Now(), PersonId: f.Person.Id})
+			create_todo, _ := json.Marshal(unmarshalTodoJSON{Text: "x", Date: time.Now(), PersonId: f.Person.Id})
+
+			for user := range f.Users {
+				if user == "bob" {
+					continue
+				}
+				for note_name, note := range f.Notes {
+					code := http.StatusNotFound
+					if canRead(note_name, user) {
+						code = http.StatusForbidden
+					}
+					url := fmt.Sprintf("/api/1/notes/%d", note.Id)
+					// Viewers and HR partners are stopped before the note
+					// is looked at.
+					if user == "vic" || user == "hank" {
+						code = http.StatusForbidden
+					}
+					expectCode(t, m, user, "PUT", url, update_note, code)
+					expectCode(t, m, user, "DELETE", url, nil, code)
+				}
+
+				write_code := http.StatusOK
+				if user == "vic" || user == "hank" {
+					write_code = http.StatusForbidden
+				}
+				expectCode(t, m, user, "POST", "/api/1/notes", create_note, write_code)
+				expectCode(t, m, user, "POST", "/api/1/todos", create_todo, write_code)
+				expectCode(t, m, user, "PUT", fmt.Sprintf("/api/1/todos/%d", f.Todo.Id), update_todo, write_code)
+				expectCode(t, m, user, "POST", "/api/1/people", []byte(`{"name": "`+user+`'s person"}`), write_code)
+
+				// Only owners can delete people; dana does so at the end.
+				if user != "dana" {
+					expectCode(t, m, user, "DELETE", fmt.Sprintf("/api/1/people/%d", f.Person.Id), nil, http.StatusForbidden)
+				}
+			}
+
+			// Bob's notes are untouched and he can still change and delete them.
+			scoped := store.InWorkspace(f.Workspace)
+			for note_name, note := range f.Notes {
+				n, err := scoped.GetNoteById(note.Id)
+				failOnError(t, err)
+				if n.Text != note.Text {
+					t.Errorf("bob's %s note was changed to %q", note_name, n.Text)
+				}
+				url := fmt.Sprintf("/api/1/notes/%d", note.Id)
+				expectCode(t, m, "bob", "PUT", url, update_note, http.StatusOK)
+				expectCode(t, m, "bob", "DELETE", url, nil, http.StatusNoContent)
+			}
+
+			expectCode(t, m, "dana", "DELETE", fmt.Sprintf("/api/1/people/%d", f.Person.Id), nil, http.StatusNoContent)
+		})
+	}
+}
+
+func TestPolicySharing(t *testing.T) {
+	store := dbtest.NewFakeStore()
+	f := loadPolicyFixture(t, store)
+	m := createMartini(store)
+	outsider := db.User{Name: "mallory", Token: "mallorytoken"}
+	failOnError(t, store.CreateUser(&outsider))
+
+	// Notes can only be shared with members of the workspace.
+	share, _ := json.Marshal(unmarshalNoteJSON{
+		Text: "x", Date: time.Now(), PersonId: f.Person.Id,
+		Visibility: db.VisibilityShared, SharedWith: []int64{outsider.Id},
+	})
+	expectCode(t, m, "bob", "POST", "/api/1/notes", share, http.StatusBadRequest)
+	bad_visibility, _ := json.Marshal(unmarshalNoteJSON{Text: "x", Date: time.Now(), PersonId: f.Person.Id, Visibility: "everyone"})
+	expectCode(t, m, "bob", "POST", "/api/1/notes", bad_visibility, http.StatusUnprocessableEntity)
+
+	// Sharing the private note with vic lets vic read it.
+	url := fmt.Sprintf("/api/1/notes/%d", f.Notes["private"].Id)
+	expectCode(t, m, "vic", "GET", url, nil, http.StatusNotFound)
+	share, _ = json.Marshal(unmarshalNoteJSONContainer{Note: unmarshalNoteJSON{
+		Visibility: db.VisibilityShared, SharedWith: []int64{f.Users["vic"].Id},
+	}})
+	expectCode(t, m, "bob", "PUT", url, share, http.StatusOK)
+	expectCode(t, m, "vic", "GET", url, nil, http.StatusOK)
+	expectCode(t, m, "eve", "GET", url, nil, http.StatusNotFound)
+
+	// Moving bob under eve lets eve read his manager-chain notes.
+	url = fmt.Sprintf("/api/1/notes/%d", f.Notes["chain"].Id)
+	expectCode(t, m, "eve", "GET", url, nil, http.StatusNotFound)
+	members := fmt.Sprintf("/api/1/workspaces/%d/members", f.Workspace.Id)
+	expectCode(t, m, "dana", "POST", members, []byte(`{"user": "bob", "role": "editor", "manager": "eve"}`), http.StatusOK)
+	expectCode(t, m, "eve", "GET", url, nil, http.StatusOK)
+	expectCode(t, m, "alice", "GET", url, nil, http.StatusNotFound)
+	expectCode(t, m, "dana", "GET", url, nil, http.StatusOK)
+
+	// Managers have to be members, and not the user themselves.
+	expectCode(t, m, "dana", "POST", members, []byte(`{"user": "bob", "role": "editor", "manager": "mallory"}`), http.StatusBadRequest)
+	expectCode(t, m, "dana", "POST", members, []byte(`{"user": "bob", "role": "editor", "manager": "bob"}`), http.StatusBadRequest)
+}
+
+func TestConfidentialNotes(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			f := loadPolicyFixture(t, store)
+			m := createMartini(store)
+
+			yes := true
+			create, _ := json.Marshal(unmarshalNoteJSON{
+				Text: "bob confidential note", Date: time.Now(), PersonId: f.Person.Id, Confidential: &yes,
+			})
+			body := expectCode(t, m, "bob", "POST", "/api/1/notes", create, http.StatusOK)
+			created := NoteJSON{}
+			failOnError(t, json.Unmarshal([]byte(body), &created))
+			if !created.Note.Confidential {
+				t.Fatalf("Expected created note to be confidential: %s", body)
+			}
+			secret := `"bob confidential note"`
+			person_url := fmt.Sprintf("/api/1/people/%d", f.Person.Id)
+			note_url := fmt.Sprintf("/api/1/notes/%d", created.Note.Id)
+			ids_url := fmt.Sprintf("/api/1/notes?ids[]=%d", created.Note.Id)
+
+			tests := []struct {
+				user string
+				url  string
+				// Whether the confidential note's text is in the response
+				listed bool
+			}{
+				{"bob", "/api/1/notes", false},
+				{"bob", "/api/1/notes?include_confidential=true", true},
+				{"dana", "/api/1/notes?include_confidential=true", true},
+				{"alice", "/api/1/notes?include_confidential=true", false},
+				{"dana", "/api/1/people", false},
+				{"dana", "/api/1/people?include_confidential=true", true},
+				{"eve", "/api/1/people?include_confidential=true", false},
+				{"dana", person_url, true},
+				{"alice", person_url, false},
+				{"dana", person_url + "?redact=true", false},
+				{"bob", note_url, true},
+				{"dana", note_url, true},
+				{"alice", note_url, false},
+				{"bob", ids_url, false},
+				{"bob", ids_url + "&include_confidential=true", true},
+				{"dana", ids_url + "&include_confidential=true", true},
+				{"alice", ids_url, false},
+				{"alice", ids_url + "&include_confidential=true", false},
+			}
+			for _, test := range tests {
+				body := expectCode(t, m, test.user, "GET", test.url, nil, http.StatusOK)
+				if strings.Contains(body, secret) != test.listed {
+					t.Errorf("GET %s as %s: expected confidential note listed to be %v: %s",
+						test.url, test.user, test.listed, body)
+				}
+				if test.url == note_url || strings.HasPrefix(test.url, ids_url) {
+					continue
+				}
+				if !strings.Contains(body, `"bob workspace note"`) {
+					t.Errorf("GET %s as %s: expected other notes to be listed: %s", test.url, test.user, body)
+				}
+			}
+
+			body = expectCode(t, m, "dana", "GET", person_url+"?redact=true", nil, http.StatusOK)
+			if !strings.Contains(body, `"`+redactedText+`"`) {
+				t.Errorf("Expected a placeholder for the confidential note: %s", body)
+			}
+			expectCode(t, m, "dana", "GET", person_url+"?redact=maybe", nil, http.StatusBadRequest)
+
+			// Users who can't list it still see the note exists, without its text.
+			body = expectCode(t, m, "alice", "GET", note_url, nil, http.StatusOK)
+			if !strings.Contains(body, `"`+redactedText+`"`) {
+				t.Errorf("Expected a placeholder for the confidential note: %s", body)
+			}
+
+			// Turning the flag off lists the note again.
+			no := false
+			update, _ := json.Marshal(unmarshalNoteJSONContainer{Note: unmarshalNoteJSON{Confidential: &no}})
+			expectCode(t, m, "bob", "PUT", fmt.Sprintf("/api/1/notes/%d", created.Note.Id), update, http.StatusOK)
+			body = expectCode(t, m, "alice", "GET", "/api/1/notes", nil, http.StatusOK)
+			if !strings.Contains(body, secret) {
+				t.Errorf("Expected note to be listed once it isn't confidential: %s", body)
+			}
+		})
+	}
+}
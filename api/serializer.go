@@ -0,0 +1,701 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Requests and responses are in one of two formats:
+//
+// The Ember Data REST adapter format, used unless the request asks for
+// JSON:API.  Resources are wrapped in a key named after their type,
+// relationships are ids and related resources are sideloaded under their
+// own keys:
+//
+//	{"person": {"id": 1, "name": "Bob", "notes": [2]}, "notes": [{"id": 2, ...}]}
+//
+// JSON:API (https://jsonapi.org), used when the Accept or Content-Type
+// header is application/vnd.api+json.  Related resources are sideloaded in
+// "included".
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeJSONAPI = "application/vnd.api+json"
+)
+
+type resourceType struct {
+	Singular string
+	Plural   string
+}
+
+var (
+	personType     = resourceType{"person", "people"}
+	noteType       = resourceType{"note", "notes"}
+	todoType       = resourceType{"todo", "todos"}
+	workspaceType  = resourceType{"workspace", "workspaces"}
+	memberType     = resourceType{"member", "members"}
+	calendarType   = resourceType{"calendar", "calendars"}
+	webhookType    = resourceType{"webhook", "webhooks"}
+	deliveryType   = resourceType{"delivery", "deliveries"}
+	digestType     = resourceType{"digest", "digests"}
+	inboxType      = resourceType{"inbox", "inboxes"}
+	attachmentType = resourceType{"attachment", "attachments"}
+	templateType   = resourceType{"template", "templates"}
+
+	resourceTypes = []resourceType{personType, noteType, todoType, workspaceType, memberType, calendarType, webhookType, deliveryType, digestType, inboxType, attachmentType, templateType}
+)
+
+// lookupType returns the resource type with the singular or plural name
+// given.
+func lookupType(name string) (resourceType, bool) {
+	for _, kind := range resourceTypes {
+		if name == kind.Singular || name == kind.Plural {
+			return kind, true
+		}
+	}
+	return resourceType{}, false
+}
+
+type field struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// object is a JSON object that keeps its keys in order, so responses list
+// fields in the order the structs they were made from do.
+type object []field
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(f.Value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (o *object) UnmarshalJSON(b []byte) error {
+	decoded, err := decodeObject(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	*o = decoded
+	return nil
+}
+
+func (o object) get(key string) (json.RawMessage, bool) {
+	for _, f := range o {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o object) set(key string, v interface{}) object {
+	value, err := json.Marshal(v)
+	if err != nil {
+		// Only ever called with ids and slices of ids.
+		panic(err)
+	}
+	for i, f := range o {
+		if f.Key == key {
+			o[i].Value = value
+			return o
+		}
+	}
+	return append(o, field{key, value})
+}
+
+func (o object) without(keys ...string) object {
+	kept := make(object, 0, len(o))
+	for _, f := range o {
+		drop := false
+		for _, k := range keys {
+			drop = drop || f.Key == k
+		}
+		if !drop {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// decodeObject reads a JSON object from r keeping its keys in order.
+func decodeObject(r io.Reader) (object, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("Expected a JSON object")
+	}
+	o := object{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		o = append(o, field{tok.(string), value})
+	}
+	return o, nil
+}
+
+// toObject returns v as it would be marshalled to JSON.
+func toObject(v interface{}) (object, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObject(bytes.NewReader(b))
+}
+
+// relationship links a resource to one or many others by id.
+type relationship struct {
+	Name string
+	Type resourceType
+	Ids  []int64
+	Many bool
+}
+
+func toOne(name string, kind resourceType, id int64) relationship {
+	return relationship{Name: name, Type: kind, Ids: []int64{id}}
+}
+
+func toMany(name string, kind resourceType, ids []int64) relationship {
+	return relationship{Name: name, Type: kind, Ids: ids, Many: true}
+}
+
+type resource struct {
+	Type          resourceType
+	Id            int64
+	Attributes    object
+	Relationships []relationship
+	// db version of what the resource was made from, if it has one
+	Version int64
+}
+
+// newResource makes a resource from v, which must marshal to a JSON object
+// with an "id".
+func newResource(kind resourceType, id int64, v interface{}, relationships ...relationship) resource {
+	attrs, err := toObject(v)
+	if err != nil {
+		// Only ever called with the api's own structs.
+		panic(err)
+	}
+	names := []string{"id"}
+	for _, rel := range relationships {
+		names = append(names, rel.Name)
+	}
+	return resource{
+		Type:          kind,
+		Id:            id,
+		Attributes:    attrs.without(names...),
+		Relationships: relationships,
+	}
+}
+
+// fieldsets holds the fields asked for with fields[type]=a,b for each
+// resource type, like JSON:API's sparse fieldsets.  Resources of types
+// without one keep all of their fields.
+type fieldsets map[resourceType]map[string]bool
+
+// parseFieldsets reads the fields[type] parameters of req.  The type can be
+// given by its singular or plural name.
+func parseFieldsets(req *http.Request) (fieldsets, error) {
+	fields := fieldsets{}
+	for key, values := range req.URL.Query() {
+		if !strings.HasPrefix(key, "fields[") || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "fields["), "]")
+		kind, ok := lookupType(name)
+		if !ok {
+			return fieldsets{}, fmt.Errorf("Unknown type %q in %s", name, key)
+		}
+		names := map[string]bool{}
+		for _, v := range values {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					names[f] = true
+				}
+			}
+		}
+		fields[kind] = names
+	}
+	return fields, nil
+}
+
+// wants returns true if resources of type kind should have the field name.
+func (f fieldsets) wants(kind resourceType, name string) bool {
+	names, ok := f[kind]
+	return !ok || names[name]
+}
+
+// apply drops the attributes and relationships of r that weren't asked
+// for.  The id is always kept.
+func (f fieldsets) apply(r resource) resource {
+	if _, ok := f[r.Type]; !ok {
+		return r
+	}
+	attrs := object{}
+	for _, a := range r.Attributes {
+		if f.wants(r.Type, a.Key) {
+			attrs = append(attrs, a)
+		}
+	}
+	var rels []relationship
+	for _, rel := range r.Relationships {
+		if f.wants(r.Type, rel.Name) {
+			rels = append(rels, rel)
+		}
+	}
+	r.Attributes = attrs
+	r.Relationships = rels
+	return r
+}
+
+// parseInclude returns the set of relationships named in the include
+// parameter of req, or nil if there isn't one.  Only the ones in allowed
+// can be asked for.
+func parseInclude(req *http.Request, allowed ...string) (map[string]bool, error) {
+	values, ok := req.URL.Query()["include"]
+	if !ok {
+		return nil, nil
+	}
+	include := map[string]bool{}
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := false
+			for _, a := range allowed {
+				found = found || a == name
+			}
+			if !found {
+				return nil, fmt.Errorf("Can't include %q, only %s", name, strings.Join(allowed, ", "))
+			}
+			include[name] = true
+		}
+	}
+	return include, nil
+}
+
+// Serializer turns resources into response documents and request bodies
+// into the flat structs handlers decode, like unmarshalNoteJSON.
+type Serializer interface {
+	// Decode reads a single resource of type kind from body into v.  The
+	// error is fieldErrors if it was a resource but had unknown fields or
+	// ones of the wrong type.
+	Decode(body io.Reader, kind resourceType, v interface{}) error
+	One(r resource, included []resource) document
+	Many(kind resourceType, rs []resource, included []resource) document
+	Error(status int, msg string) interface{}
+	// FieldErrors formats the problems with a request body
+	FieldErrors(status int, errs fieldErrors) interface{}
+	ContentType() string
+}
+
+// selectSerializer maps the Serializer for the format the request asks for
+// and a render.Render that writes responses, including the plain string
+// errors handlers give to rend.JSON, in that format.  It also maps the
+// request's fieldsets, which the Serializer applies to every resource.
+func selectSerializer(c martini.Context, req *http.Request, rend render.Render) {
+	fields, err := parseFieldsets(req)
+	var s Serializer = emberSerializer{fields}
+	if strings.Contains(req.Header.Get("Accept"), contentTypeJSONAPI) ||
+		strings.HasPrefix(req.Header.Get("Content-Type"), contentTypeJSONAPI) {
+		s = jsonAPISerializer{fields}
+	}
+	c.MapTo(s, (*Serializer)(nil))
+	c.MapTo(formatRender{rend, s, req}, (*render.Render)(nil))
+	c.Map(fields)
+	if err != nil {
+		formatRender{rend, s, req}.JSON(http.StatusBadRequest, err.Error())
+	}
+}
+
+type formatRender struct {
+	render.Render
+	s   Serializer
+	req *http.Request
+}
+
+func (r formatRender) JSON(status int, v interface{}) {
+	if doc, ok := v.(document); ok {
+		r.writeDocument(status, doc)
+		return
+	}
+	v = errorBody(r.s, status, v)
+	if r.s.ContentType() == contentTypeJSON {
+		r.Render.JSON(status, v)
+		return
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		r.Render.Text(http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.Header().Set("Content-Type", r.s.ContentType())
+	r.Data(status, b)
+}
+
+// errorBody returns what s makes of the fieldErrors, string or error a
+// handler gives rend.JSON with an error status, or v itself.
+func errorBody(s Serializer, status int, v interface{}) interface{} {
+	if status < 400 {
+		return v
+	}
+	switch e := v.(type) {
+	case fieldErrors:
+		return s.FieldErrors(status, e)
+	case string:
+		return s.Error(status, e)
+	case error:
+		return s.Error(status, e.Error())
+	}
+	return v
+}
+
+func (r formatRender) writeDocument(status int, doc document) {
+	b, etag, err := doc.marshal()
+	if err != nil {
+		r.Render.Text(http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.Header().Set("ETag", etag)
+	r.Header().Add("Vary", "Accept")
+	if (r.req.Method == "GET" || r.req.Method == "HEAD") && status == http.StatusOK &&
+		etagMatches(r.req.Header.Get("If-None-Match"), etag, true) {
+		r.Status(http.StatusNotModified)
+		return
+	}
+	content_type := r.s.ContentType()
+	if content_type == contentTypeJSON {
+		content_type += "; charset=UTF-8"
+	}
+	r.Header().Set("Content-Type", content_type)
+	r.Data(status, b)
+}
+
+type emberSerializer struct {
+	fields fieldsets
+}
+
+func (emberSerializer) ContentType() string {
+	return contentTypeJSON
+}
+
+// Decode accepts the resource both wrapped in its type's key, as Ember
+// sends it, and bare.
+func (emberSerializer) Decode(body io.Reader, kind resourceType, v interface{}) error {
+	o, err := decodeObject(body)
+	if err != nil {
+		return err
+	}
+	if len(o) == 1 && o[0].Key == kind.Singular {
+		o, err = decodeObject(bytes.NewReader(o[0].Value))
+		if err != nil {
+			return err
+		}
+	}
+	return o.decode(v)
+}
+
+func (s emberSerializer) object(r resource) object {
+	r = s.fields.apply(r)
+	o := object{}.set("id", r.Id)
+	o = append(o, r.Attributes...)
+	for _, rel := range r.Relationships {
+		switch {
+		case rel.Many && rel.Ids == nil:
+			o = o.set(rel.Name, []int64{})
+		case rel.Many:
+			o = o.set(rel.Name, rel.Ids)
+		case len(rel.Ids) == 0:
+			o = o.set(rel.Name, nil)
+		default:
+			o = o.set(rel.Name, rel.Ids[0])
+		}
+	}
+	return o
+}
+
+// sideload adds included to doc under their types' plural keys.
+func (s emberSerializer) sideload(doc object, included []resource) object {
+	var order []resourceType
+	by_type := map[resourceType][]object{}
+	seen := map[resourceType]map[int64]bool{}
+	for _, r := range included {
+		if seen[r.Type] == nil {
+			seen[r.Type] = map[int64]bool{}
+			order = append(order, r.Type)
+			by_type[r.Type] = []object{}
+		}
+		if seen[r.Type][r.Id] {
+			continue
+		}
+		seen[r.Type][r.Id] = true
+		by_type[r.Type] = append(by_type[r.Type], s.object(r))
+	}
+	for _, kind := range order {
+		if _, ok := doc.get(kind.Plural); ok {
+			continue
+		}
+		doc = doc.set(kind.Plural, by_type[kind])
+	}
+	return doc
+}
+
+func (s emberSerializer) One(r resource, included []resource) document {
+	body := s.sideload(object{}.set(r.Type.Singular, s.object(r)), included)
+	return newDocument(body, []resource{r}, included)
+}
+
+func (s emberSerializer) Many(kind resourceType, rs []resource, included []resource) document {
+	objects := make([]object, len(rs))
+	for i, r := range rs {
+		objects[i] = s.object(r)
+	}
+	return newDocument(s.sideload(object{}.set(kind.Plural, objects), included), rs, included)
+}
+
+// Error responses are the bare message, as they always were.
+func (emberSerializer) Error(status int, msg string) interface{} {
+	return msg
+}
+
+// FieldErrors are in the format Ember's InvalidError expects:
+//
+//	{"errors": {"text": ["invalid value 1"]}}
+func (emberSerializer) FieldErrors(status int, errs fieldErrors) interface{} {
+	by_field := object{}
+	for _, e := range errs {
+		var msgs []string
+		if value, ok := by_field.get(e.Field); ok {
+			json.Unmarshal(value, &msgs)
+		}
+		by_field = by_field.set(e.Field, append(msgs, e.Message))
+	}
+	return object{}.set("errors", by_field)
+}
+
+type jsonAPISerializer struct {
+	fields fieldsets
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type jsonAPIRelationship struct {
+	Data interface{} `json:"data"`
+}
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	Id            string                         `json:"id,omitempty"`
+	Attributes    object                         `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+}
+
+type jsonAPIDocument struct {
+	Data     interface{}       `json:"data"`
+	Included []jsonAPIResource `json:"included,omitempty"`
+}
+
+type jsonAPIError struct {
+	Status string              `json:"status"`
+	Title  string              `json:"title"`
+	Detail string              `json:"detail"`
+	Source *jsonAPIErrorSource `json:"source,omitempty"`
+}
+
+type jsonAPIErrorSource struct {
+	Pointer string `json:"pointer"`
+}
+
+type jsonAPIErrors struct {
+	Errors []jsonAPIError `json:"errors"`
+}
+
+func (jsonAPISerializer) ContentType() string {
+	return contentTypeJSONAPI
+}
+
+// Decode flattens the resource's attributes, id and relationships into one
+// object and unmarshals that into v.
+func (jsonAPISerializer) Decode(body io.Reader, kind resourceType, v interface{}) error {
+	doc := struct {
+		Data *struct {
+			Type          string `json:"type"`
+			Id            string `json:"id"`
+			Attributes    object `json:"attributes"`
+			Relationships map[string]struct {
+				Data json.RawMessage `json:"data"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.Data == nil {
+		return errors.New("Missing data")
+	}
+	if doc.Data.Type != kind.Plural {
+		return fmt.Errorf("Expected a resource of type %s, got %q", kind.Plural, doc.Data.Type)
+	}
+
+	o := doc.Data.Attributes
+	if doc.Data.Id != "" {
+		id, err := strconv.ParseInt(doc.Data.Id, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid id: %s", err)
+		}
+		o = o.set("id", id)
+	}
+	for name, rel := range doc.Data.Relationships {
+		var one *jsonAPIIdentifier
+		if err := json.Unmarshal(rel.Data, &one); err == nil {
+			if one == nil {
+				o = o.set(name, nil)
+				continue
+			}
+			id, err := strconv.ParseInt(one.Id, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %s id: %s", name, err)
+			}
+			o = o.set(name, id)
+			continue
+		}
+		var many []jsonAPIIdentifier
+		if err := json.Unmarshal(rel.Data, &many); err != nil {
+			return fmt.Errorf("Invalid relationship %s: %s", name, err)
+		}
+		ids := make([]int64, len(many))
+		for i, m := range many {
+			id, err := strconv.ParseInt(m.Id, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %s id: %s", name, err)
+			}
+			ids[i] = id
+		}
+		o = o.set(name, ids)
+	}
+	return o.decode(v)
+}
+
+func (s jsonAPISerializer) resource(r resource) jsonAPIResource {
+	r = s.fields.apply(r)
+	jr := jsonAPIResource{
+		Type:       r.Type.Plural,
+		Id:         strconv.FormatInt(r.Id, 10),
+		Attributes: r.Attributes,
+	}
+	if jr.Attributes == nil {
+		jr.Attributes = object{}
+	}
+	if len(r.Relationships) > 0 {
+		jr.Relationships = map[string]jsonAPIRelationship{}
+	}
+	for _, rel := range r.Relationships {
+		ids := make([]jsonAPIIdentifier, len(rel.Ids))
+		for i, id := range rel.Ids {
+			ids[i] = jsonAPIIdentifier{rel.Type.Plural, strconv.FormatInt(id, 10)}
+		}
+		switch {
+		case rel.Many:
+			jr.Relationships[rel.Name] = jsonAPIRelationship{ids}
+		case len(ids) == 0:
+			jr.Relationships[rel.Name] = jsonAPIRelationship{nil}
+		default:
+			jr.Relationships[rel.Name] = jsonAPIRelationship{ids[0]}
+		}
+	}
+	return jr
+}
+
+func (s jsonAPISerializer) included(included []resource) []jsonAPIResource {
+	var rs []jsonAPIResource
+	seen := map[jsonAPIIdentifier]bool{}
+	for _, r := range included {
+		jr := s.resource(r)
+		id := jsonAPIIdentifier{jr.Type, jr.Id}
+		if !seen[id] {
+			seen[id] = true
+			rs = append(rs, jr)
+		}
+	}
+	return rs
+}
+
+func (s jsonAPISerializer) One(r resource, included []resource) document {
+	body := jsonAPIDocument{Data: s.resource(r), Included: s.included(included)}
+	return newDocument(body, []resource{r}, included)
+}
+
+func (s jsonAPISerializer) Many(kind resourceType, rs []resource, included []resource) document {
+	data := make([]jsonAPIResource, len(rs))
+	for i, r := range rs {
+		data[i] = s.resource(r)
+	}
+	return newDocument(jsonAPIDocument{Data: data, Included: s.included(included)}, rs, included)
+}
+
+func (jsonAPISerializer) Error(status int, msg string) interface{} {
+	return jsonAPIErrors{[]jsonAPIError{{
+		Status: strconv.Itoa(status),
+		Title:  http.StatusText(status),
+		Detail: msg,
+	}}}
+}
+
+// relationshipNames are the fields that are relationships rather than
+// attributes in JSON:API documents.
+var relationshipNames = map[string]bool{"person": true, "notes": true, "todos": true}
+
+// FieldErrors point at the attribute or relationship each error is about.
+func (jsonAPISerializer) FieldErrors(status int, errs fieldErrors) interface{} {
+	doc := jsonAPIErrors{[]jsonAPIError{}}
+	for _, e := range errs {
+		pointer := "/data/attributes/" + e.Field
+		if e.Field == "id" {
+			pointer = "/data/id"
+		} else if relationshipNames[e.Field] {
+			pointer = "/data/relationships/" + e.Field
+		}
+		doc.Errors = append(doc.Errors, jsonAPIError{
+			Status: strconv.Itoa(status),
+			Title:  http.StatusText(status),
+			Detail: e.Field + " " + e.Message,
+			Source: &jsonAPIErrorSource{pointer},
+		})
+	}
+	return doc
+}
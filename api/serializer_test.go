@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+// setupSerializerTest returns a person with one note and one todo.
+func setupSerializerTest(t *testing.T) (*db.Person, *martini.Martini) {
+	store := dbtest.NewFakeStore()
+	ws := setupTestWorkspace(t, store, "tester", testToken)
+	scoped := store.InWorkspace(ws)
+	p := &db.Person{Name: "Bob"}
+	failOnError(t, scoped.CreatePerson(p))
+	failOnError(t, scoped.CreateNote(&db.Note{Person: p, Text: "note", Date: time.Now()}))
+	failOnError(t, scoped.CreateTodo(&db.Todo{Person: p, Text: "todo", Date: time.Now()}))
+	return p, createMartini(store)
+}
+
+func serveJSONAPI(m *martini.Martini, method string, url string, body string) (int, string, map[string]interface{}) {
+	response := serveAs(m, testToken, method, url, strings.NewReader(body),
+		"Content-Type", contentTypeJSONAPI, "Accept", contentTypeJSONAPI)
+	doc := map[string]interface{}{}
+	json.Unmarshal(response.Body.Bytes(), &doc)
+	return response.Code, response.Header().Get("Content-Type"), doc
+}
+
+func TestEmberFormat(t *testing.T) {
+	p, m := setupSerializerTest(t)
+
+	response := serveAs(m, testToken, "GET", fmt.Sprintf("/api/1/people/%d", p.Id), nil)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 getting the person, got %d: %s", response.Code, response.Body)
+	}
+	if ct := response.Header().Get("Content-Type"); !strings.HasPrefix(ct, contentTypeJSON) {
+		t.Errorf("Expected content type %s, got %s", contentTypeJSON, ct)
+	}
+	doc := struct {
+		Person struct {
+			Id    int64   `json:"id"`
+			Name  string  `json:"name"`
+			Notes []int64 `json:"notes"`
+			Todos []int64 `json:"todos"`
+		} `json:"person"`
+		Notes []struct {
+			Id     int64 `json:"id"`
+			Person int64 `json:"person"`
+		} `json:"notes"`
+		Todos []struct {
+			Id     int64 `json:"id"`
+			Person int64 `json:"person"`
+		} `json:"todos"`
+	}{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+	if doc.Person.Name != "Bob" || len(doc.Person.Notes) != 1 || len(doc.Person.Todos) != 1 {
+		t.Fatalf("Expected Bob with one note and todo id, got %+v", doc.Person)
+	}
+	if len(doc.Notes) != 1 || doc.Notes[0].Id != doc.Person.Notes[0] || doc.Notes[0].Person != p.Id {
+		t.Errorf("Expected the note to be sideloaded, got %+v", doc.Notes)
+	}
+	if len(doc.Todos) != 1 || doc.Todos[0].Id != doc.Person.Todos[0] || doc.Todos[0].Person != p.Id {
+		t.Errorf("Expected the todo to be sideloaded, got %+v", doc.Todos)
+	}
+
+	// Ember wraps request bodies, but bare ones are accepted too.
+	bodies := []string{
+		fmt.Sprintf(`{"note": {"text": "wrapped", "person": %d}}`, p.Id),
+		fmt.Sprintf(`{"text": "bare", "person": %d}`, p.Id),
+	}
+	for _, body := range bodies {
+		response := serveAs(m, testToken, "POST", "/api/1/notes", strings.NewReader(body))
+		if response.Code != http.StatusOK {
+			t.Fatalf("Expected 200 creating a note from %s, got %d: %s", body, response.Code, response.Body)
+		}
+		created := NoteJSON{}
+		failOnError(t, json.Unmarshal(response.Body.Bytes(), &created))
+		if created.Note.Id == 0 || created.Note.PersonId != p.Id {
+			t.Errorf("Expected the created note from %s, got %s", body, response.Body)
+		}
+
+		url := fmt.Sprintf("/api/1/notes/%d", created.Note.Id)
+		response = serveAs(m, testToken, "PUT", url, strings.NewReader(strings.Replace(body, `"text": "`, `"text": "changed `, 1)))
+		updated := NoteJSON{}
+		json.Unmarshal(response.Body.Bytes(), &updated)
+		if response.Code != http.StatusOK || !strings.HasPrefix(updated.Note.Text, "changed ") {
+			t.Errorf("Expected the updated note from %s, got %d: %s", body, response.Code, response.Body)
+		}
+	}
+
+	response = serveAs(m, testToken, "GET", "/api/1/notes/12345", nil)
+	if response.Code != http.StatusNotFound || !strings.HasPrefix(response.Body.String(), `"`) {
+		t.Errorf("Expected a bare error message, got %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestJSONAPIFormat(t *testing.T) {
+	p, m := setupSerializerTest(t)
+
+	code, ct, doc := serveJSONAPI(m, "GET", fmt.Sprintf("/api/1/people/%d", p.Id), "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 getting the person, got %d: %v", code, doc)
+	}
+	if ct != contentTypeJSONAPI {
+		t.Errorf("Expected content type %s, got %s", contentTypeJSONAPI, ct)
+	}
+	data := doc["data"].(map[string]interface{})
+	if data["type"] != "people" || data["id"] != fmt.Sprint(p.Id) {
+		t.Errorf("Expected the person as data, got %v", data)
+	}
+	if data["attributes"].(map[string]interface{})["name"] != "Bob" {
+		t.Errorf("Expected the person's name in attributes, got %v", data["attributes"])
+	}
+	rels := data["relationships"].(map[string]interface{})
+	notes := rels["notes"].(map[string]interface{})["data"].([]interface{})
+	if len(notes) != 1 {
+		t.Fatalf("Expected one related note, got %v", rels)
+	}
+	note_id := notes[0].(map[string]interface{})["id"]
+	included := doc["included"].([]interface{})
+	if len(included) != 2 {
+		t.Fatalf("Expected the note and todo to be included, got %v", included)
+	}
+	found := false
+	for _, inc := range included {
+		r := inc.(map[string]interface{})
+		if r["type"] == "notes" && r["id"] == note_id {
+			found = true
+			person := r["relationships"].(map[string]interface{})["person"].(map[string]interface{})["data"]
+			if person.(map[string]interface{})["id"] != fmt.Sprint(p.Id) {
+				t.Errorf("Expected the included note to link back to the person, got %v", person)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected note %v in included, got %v", note_id, included)
+	}
+
+	body := fmt.Sprintf(`{"data": {"type": "notes", "attributes": {"text": "created"},
+		"relationships": {"person": {"data": {"type": "people", "id": "%d"}}}}}`, p.Id)
+	code, _, doc = serveJSONAPI(m, "POST", "/api/1/notes", body)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 creating a note, got %d: %v", code, doc)
+	}
+	data = doc["data"].(map[string]interface{})
+	if data["type"] != "notes" || data["attributes"].(map[string]interface{})["text"] != "created" {
+		t.Errorf("Expected the created note, got %v", data)
+	}
+
+	code, _, doc = serveJSONAPI(m, "GET", "/api/1/notes", "")
+	if code != http.StatusOK || len(doc["data"].([]interface{})) != 2 {
+		t.Errorf("Expected a list of 2 notes, got %d: %v", code, doc)
+	}
+
+	code, ct, doc = serveJSONAPI(m, "POST", "/api/1/notes", `{"data": {"type": "todos", "attributes": {"text": "x"}}}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected 400 posting a todo to /notes, got %d", code)
+	}
+	if ct != contentTypeJSONAPI {
+		t.Errorf("Expected errors to have content type %s, got %s", contentTypeJSONAPI, ct)
+	}
+	errs, _ := doc["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["status"] != "400" {
+		t.Errorf("Expected a JSON:API error document, got %v", doc)
+	}
+}
+
+func TestAddToAllFormats(t *testing.T) {
+	p, m := setupSerializerTest(t)
+	response := serveAs(m, testToken, "POST", "/api/1/people", strings.NewReader(`{"person": {"name": "Alice"}}`))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 creating a person, got %d: %s", response.Code, response.Body)
+	}
+
+	response = serveAs(m, testToken, "POST", "/api/1/todos?addToAll", strings.NewReader(`{"todo": {"text": "everyone"}}`))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding a todo to everyone, got %d: %s", response.Code, response.Body)
+	}
+	created := TodosJSON{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	if len(created.Todos) != 2 {
+		t.Fatalf("Expected a todo for each person, got %s", response.Body)
+	}
+	for _, todo := range created.Todos {
+		if todo.Id == 0 || todo.Text != "everyone" || todo.PersonId == 0 {
+			t.Errorf("Expected a created todo, got %+v", todo)
+		}
+	}
+	if created.Todos[0].PersonId == created.Todos[1].PersonId {
+		t.Errorf("Expected the todos to be for different people, got %s", response.Body)
+	}
+
+	code, _, doc := serveJSONAPI(m, "POST", "/api/1/todos?addToAll", `{"data": {"type": "todos", "attributes": {"text": "everyone again"}}}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 adding a todo to everyone, got %d: %v", code, doc)
+	}
+	data, _ := doc["data"].([]interface{})
+	if len(data) != 2 {
+		t.Fatalf("Expected a list of 2 todos, got %v", doc)
+	}
+	people := map[interface{}]bool{}
+	for _, d := range data {
+		r := d.(map[string]interface{})
+		if r["type"] != "todos" || r["attributes"].(map[string]interface{})["text"] != "everyone again" {
+			t.Errorf("Expected a created todo, got %v", r)
+		}
+		person := r["relationships"].(map[string]interface{})["person"].(map[string]interface{})["data"]
+		people[person.(map[string]interface{})["id"]] = true
+	}
+	if !people[fmt.Sprint(p.Id)] || len(people) != 2 {
+		t.Errorf("Expected the todos to be for Bob and Alice, got %v", data)
+	}
+}
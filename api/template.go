@@ -0,0 +1,269 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Note templates are managed at /templates and a note is made from one with
+// POST /notes?template=ID.  Their text can have these placeholders:
+//
+//	{{person.name}}              the name of the person the note is about
+//	{{person.email}}             their email address
+//	{{author.name}}              the name of the user making the note
+//	{{date}}                     the note's date, like Mon 2 Jan 2006
+//	{{last_meeting.date}}        the date of the person's last note in the
+//	                             new note's category (1:1s if it has none)
+//	                             that the user can read
+//	{{last_meeting.open_items}}  the unticked "- [ ]" items of that note
+const templateParam = "template"
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([a-z_.]+)\s*\}\}`)
+
+var placeholders = map[string]bool{
+	"person.name":             true,
+	"person.email":            true,
+	"author.name":             true,
+	"date":                    true,
+	"last_meeting.date":       true,
+	"last_meeting.open_items": true,
+}
+
+// openItemPattern matches an unticked markdown checklist item.
+var openItemPattern = regexp.MustCompile(`^\s*[-*] \[ \]\s+(.+?)\s*$`)
+
+type unmarshalTemplateJSON struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name" validate:"required,max=255"`
+	Text         string `json:"text" validate:"required,max=65536,template"`
+	Category     string `json:"category" validate:"category"`
+	Visibility   string `json:"visibility" validate:"visibility"`
+	Confidential *bool  `json:"confidential"`
+}
+
+func templateResource(t *db.NoteTemplate) resource {
+	r := newResource(templateType, t.Id, t)
+	r.Version = t.Version
+	return r
+}
+
+// unknownPlaceholders returns the placeholders in text that aren't in
+// placeholders.
+func unknownPlaceholders(text string) []string {
+	var unknown []string
+	for _, m := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+		if !placeholders[m[1]] {
+			unknown = append(unknown, m[0])
+		}
+	}
+	return unknown
+}
+
+// expandTemplate replaces the placeholders in text with their values.
+func expandTemplate(text string, values map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(p string) string {
+		name := placeholderPattern.FindStringSubmatch(p)[1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// openItems returns the unticked checklist items in text, as unticked
+// checklist items.
+func openItems(text string) string {
+	var items []string
+	for _, line := range strings.Split(text, "\n") {
+		if m := openItemPattern.FindStringSubmatch(line); m != nil {
+			items = append(items, "- [ ] "+m[1])
+		}
+	}
+	return strings.Join(items, "\n")
+}
+
+// lastMeeting returns the latest note about p in category, before n's
+// date, that the user can read, or nil if there isn't one.
+func lastMeeting(people db.PeopleStore, policy *Policy, n *db.Note, category string) (*db.Note, error) {
+	p := &db.Person{Id: n.Person.Id}
+	if err := people.LoadPeopleRelations([]*db.Person{p}, true, false); err != nil {
+		return nil, err
+	}
+	notes := p.Notes
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Date.After(notes[j].Date) })
+	for _, past := range notes {
+		if past.Category == category && past.Date.Before(n.Date) && policy.CanReadNote(past) {
+			return past, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyTemplate fills in n from t: its text is t's, expanded, followed by
+// any text n already has, and its category, visibility and confidentiality
+// are t's unless the request gave them.
+func applyTemplate(n *db.Note, t *db.NoteTemplate, u *unmarshalNoteJSON, people db.PeopleStore, policy *Policy) error {
+	if n.Category == "" {
+		n.Category = t.Category
+	}
+	if n.Visibility == "" {
+		n.Visibility = t.Visibility
+	}
+	if u.Confidential == nil {
+		n.Confidential = t.Confidential
+	}
+	category := n.Category
+	if category == "" {
+		category = db.CategoryOneOnOne
+	}
+	last, err := lastMeeting(people, policy, n, category)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{
+		"person.name":             n.Person.Name,
+		"person.email":            n.Person.Email,
+		"author.name":             policy.User.Name,
+		"date":                    n.Date.Format("Mon 2 Jan 2006"),
+		"last_meeting.date":       "",
+		"last_meeting.open_items": "",
+	}
+	if last != nil {
+		values["last_meeting.date"] = last.Date.Format("Mon 2 Jan 2006")
+		values["last_meeting.open_items"] = openItems(last.Text)
+	}
+	text := expandTemplate(t.Text, values)
+	if n.Text != "" {
+		text += "\n\n" + n.Text
+	}
+	n.Text = text
+	return nil
+}
+
+// templateById returns the template with the given id.  Otherwise it
+// writes an error response and returns nil.
+func templateById(rend render.Render, id_param string, templates db.NoteTemplateStore) *db.NoteTemplate {
+	id, err := strconv.ParseInt(id_param, 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid template id %s: %s", id_param, err))
+		return nil
+	}
+	t, err := templates.GetNoteTemplateById(id)
+	if err == db.ErrNotFound {
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No template %d found.", id))
+		return nil
+	}
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	return t
+}
+
+func getTemplates(rend render.Render, templates db.NoteTemplateStore, s Serializer) {
+	ts, err := templates.GetNoteTemplates()
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rs := make([]resource, len(ts))
+	for i, t := range ts {
+		rs[i] = templateResource(t)
+	}
+	rend.JSON(http.StatusOK, s.Many(templateType, rs, nil))
+}
+
+func getTemplate(rend render.Render, params martini.Params, templates db.NoteTemplateStore, s Serializer) {
+	t := templateById(rend, params["id"], templates)
+	if t == nil {
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(templateResource(t), nil))
+}
+
+func createTemplate(rend render.Render, req *http.Request, templates db.NoteTemplateStore, policy *Policy, s Serializer) {
+	u := unmarshalTemplateJSON{}
+	if !decodeValid(rend, req, s, templateType, &u, true) {
+		return
+	}
+	t := db.NoteTemplate{
+		Author:     policy.User,
+		Name:       u.Name,
+		Text:       u.Text,
+		Category:   u.Category,
+		Visibility: u.Visibility,
+	}
+	if u.Confidential != nil {
+		t.Confidential = *u.Confidential
+	}
+	if err := templates.CreateNoteTemplate(&t); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(templateResource(&t), nil))
+}
+
+func updateTemplate(rend render.Render, req *http.Request, params martini.Params, templates db.NoteTemplateStore, policy *Policy, s Serializer) {
+	u := unmarshalTemplateJSON{}
+	if !decodeValid(rend, req, s, templateType, &u, false) {
+		return
+	}
+	t := templateById(rend, params["id"], templates)
+	if t == nil {
+		return
+	}
+	if !policy.CanWriteTemplate(t) {
+		rend.JSON(http.StatusForbidden, "Only the author or an owner can change a template")
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(templateResource(t), nil)) {
+		return
+	}
+	if u.Name != "" {
+		t.Name = u.Name
+	}
+	if u.Text != "" {
+		t.Text = u.Text
+	}
+	if u.Category != "" {
+		t.Category = u.Category
+	}
+	if u.Visibility != "" {
+		t.Visibility = u.Visibility
+	}
+	if u.Confidential != nil {
+		t.Confidential = *u.Confidential
+	}
+	if err := templates.UpdateNoteTemplate(t); err != nil {
+		writeUpdateError(rend, err)
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(templateResource(t), nil))
+}
+
+func deleteTemplate(rend render.Render, req *http.Request, params martini.Params, templates db.NoteTemplateStore, policy *Policy, s Serializer) {
+	t := templateById(rend, params["id"], templates)
+	if t == nil {
+		return
+	}
+	if !policy.CanWriteTemplate(t) {
+		rend.JSON(http.StatusForbidden, "Only the author or an owner can delete a template")
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(templateResource(t), nil)) {
+		return
+	}
+	if err := templates.RemoveNoteTemplate(t); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	values := map[string]string{"person.name": "Bob", "date": "Mon 2 Mar 2026"}
+	got := expandTemplate("{{person.name}} on {{ date }}, {{nothing}}", values)
+	if got != "Bob on Mon 2 Mar 2026, {{nothing}}" {
+		t.Errorf("Expected the placeholders to be filled in, got %q", got)
+	}
+	if unknown := unknownPlaceholders("{{person.name}} {{person.age}} {{Date}}"); len(unknown) != 1 || unknown[0] != "{{person.age}}" {
+		t.Errorf("Expected {{person.age}} to be unknown, got %v", unknown)
+	}
+	items := openItems("Agenda\n- [x] Done\n- [ ] Send offer\n  * [ ]  Book training \n- [] not an item")
+	if items != "- [ ] Send offer\n- [ ] Book training" {
+		t.Errorf("Expected the unticked items, got %q", items)
+	}
+}
+
+func TestNoteTemplates(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			tester, err := store.GetUserByName("tester")
+			failOnError(t, err)
+			editor := &db.User{Name: "editor", Token: "editor-token"}
+			failOnError(t, store.CreateUser(editor))
+			failOnError(t, store.SetMember(ws, editor, db.RoleEditor))
+			scoped := store.InWorkspace(ws)
+			bob := &db.Person{Name: "Bob", Email: "bob@example.com"}
+			failOnError(t, scoped.CreatePerson(bob))
+			for _, n := range []*db.Note{
+				{Person: bob, Author: tester, Category: db.CategoryOneOnOne, Date: time.Date(2026, 2, 23, 10, 0, 0, 0, time.UTC),
+					Text: "Agenda\n- [x] Salary review\n- [ ] Send offer\n* [ ] Book training"},
+				// Later, but tester can't read it
+				{Person: bob, Author: editor, Category: db.CategoryOneOnOne, Date: time.Date(2026, 2, 27, 10, 0, 0, 0, time.UTC),
+					Text: "- [ ] Private", Visibility: db.VisibilityPrivate},
+				{Person: bob, Author: tester, Category: "career", Date: time.Date(2026, 2, 28, 10, 0, 0, 0, time.UTC),
+					Text: "- [ ] Other kind of meeting"},
+			} {
+				failOnError(t, scoped.CreateNote(n))
+			}
+			m := createMartini(store)
+
+			body := `{"template": {"name": "Weekly 1:1", "category": "one_on_one",
+				"text": "1:1 with {{person.name}} ({{ person.email }}) on {{date}} by {{author.name}}\nLast time, {{last_meeting.date}}:\n{{last_meeting.open_items}}"}}`
+			response := serveAs(m, testToken, "POST", "/api/1/templates", strings.NewReader(body))
+			created := struct {
+				Template struct {
+					Id int64 `json:"id"`
+				} `json:"template"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &created))
+			if response.Code != http.StatusOK || created.Template.Id == 0 {
+				t.Fatalf("Expected the template to be created, got %d: %s", response.Code, response.Body)
+			}
+			template_url := fmt.Sprintf("/api/1/templates/%d", created.Template.Id)
+			response = serveAs(m, testToken, "POST", "/api/1/templates", strings.NewReader(`{"template": {"name": "Bad", "text": "{{person.age}}"}}`))
+			if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "{{person.age}}") {
+				t.Errorf("Expected unknown placeholders to be invalid, got %d: %s", response.Code, response.Body)
+			}
+			career := `{"template": {"name": "Career", "text": "Goals", "category": "career", "confidential": true}}`
+			if response := serveAs(m, "editor-token", "POST", "/api/1/templates", strings.NewReader(career)); response.Code != http.StatusOK {
+				t.Fatalf("Expected editors to create templates, got %d: %s", response.Code, response.Body)
+			}
+			response = serveAs(m, "editor-token", "GET", "/api/1/templates", nil)
+			if response.Code != http.StatusOK || strings.Index(response.Body.String(), "Career") > strings.Index(response.Body.String(), "Weekly") {
+				t.Errorf("Expected both templates by name, got %d: %s", response.Code, response.Body)
+			}
+			if response := serveAs(m, "editor-token", "PUT", template_url, strings.NewReader(`{"template": {"name": "Mine"}}`)); response.Code != http.StatusForbidden {
+				t.Errorf("Expected only the author to change the template, got %d", response.Code)
+			}
+
+			note := struct {
+				Note struct {
+					Text         string `json:"text"`
+					Category     string `json:"category"`
+					Confidential bool   `json:"confidential"`
+				} `json:"note"`
+			}{}
+			body = fmt.Sprintf(`{"note": {"person": %d, "date": "2026-03-02T10:00:00Z", "text": "Extra"}}`, bob.Id)
+			response = serveAs(m, testToken, "POST", "/api/1/notes?template="+fmt.Sprint(created.Template.Id), strings.NewReader(body))
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &note))
+			expected := "1:1 with Bob (bob@example.com) on Mon 2 Mar 2026 by tester\nLast time, Mon 23 Feb 2026:\n- [ ] Send offer\n- [ ] Book training\n\nExtra"
+			if response.Code != http.StatusOK || note.Note.Text != expected || note.Note.Category != db.CategoryOneOnOne {
+				t.Errorf("Expected the note made from the template, got %d: %s", response.Code, response.Body)
+			}
+
+			response = serveAs(m, testToken, "GET", "/api/1/templates", nil)
+			all := struct {
+				Templates []struct {
+					Id   int64  `json:"id"`
+					Name string `json:"name"`
+				} `json:"templates"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &all))
+			career_url := fmt.Sprintf("/api/1/notes?template=%d", all.Templates[0].Id)
+			body = fmt.Sprintf(`{"note": {"person": %d}}`, bob.Id)
+			response = serveAs(m, testToken, "POST", career_url, strings.NewReader(body))
+			note.Note.Confidential = false
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &note))
+			if response.Code != http.StatusOK || note.Note.Text != "Goals" || note.Note.Category != "career" || !note.Note.Confidential {
+				t.Errorf("Expected a confidential career note, got %d: %s", response.Code, response.Body)
+			}
+			body = fmt.Sprintf(`{"note": {"person": %d, "confidential": false}}`, bob.Id)
+			response = serveAs(m, testToken, "POST", career_url, strings.NewReader(body))
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &note))
+			if response.Code != http.StatusOK || note.Note.Confidential {
+				t.Errorf("Expected the request to override the template, got %d: %s", response.Code, response.Body)
+			}
+			if response := serveAs(m, testToken, "POST", career_url, strings.NewReader(`{"note": {}}`)); response.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Expected a person to be required, got %d", response.Code)
+			}
+			if response := serveAs(m, testToken, "POST", "/api/1/notes?template=999", strings.NewReader(body)); response.Code != http.StatusNotFound {
+				t.Errorf("Expected a 404 for an unknown template, got %d", response.Code)
+			}
+
+			// Owners can change and remove anyone's templates.
+			career_template := fmt.Sprintf("/api/1/templates/%d", all.Templates[0].Id)
+			response = serveAs(m, testToken, "PUT", career_template, strings.NewReader(`{"template": {"text": "Goals for {{person.name}}"}}`))
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "Goals for {{person.name}}") {
+				t.Errorf("Expected the owner to change the template, got %d: %s", response.Code, response.Body)
+			}
+			if response := serveAs(m, testToken, "DELETE", career_template, nil); response.Code != http.StatusNoContent {
+				t.Errorf("Expected the template to be removed, got %d", response.Code)
+			}
+			if response := serveAs(m, testToken, "GET", career_template, nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected the template to be gone, got %d", response.Code)
+			}
+		})
+	}
+}
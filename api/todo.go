@@ -1,16 +1,14 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
-	"github.com/astaxie/beego/orm"
 	"github.com/codegangsta/martini"
-	"github.com/golang/glog"
 	"github.com/hobeone/pointyhair/db"
 	"github.com/martini-contrib/render"
 )
@@ -30,67 +28,95 @@ type TodosJSON struct {
 
 type unmarshalTodoJSON struct {
 	Id       int       `json:"id"`
-	Text     string    `json:"text"`
-	Category string    `json:"category"`
-	Date     time.Time `json:"date"`
-	PersonId int64     `json:"person"`
+	Text     string    `json:"text" validate:"required,max=65536"`
+	Category string    `json:"category" validate:"category"`
+	Date     time.Time `json:"date" validate:"date"`
+	// A pointer so updates can tell false from not given
+	Done *bool `json:"done"`
+	// Not needed when adding the todo to everyone
+	PersonId int64 `json:"person"`
 }
 
 type unmarshalTodoJSONContainer struct {
 	Todo unmarshalTodoJSON `json:"todo"`
 }
 
-func getTodos(rend render.Render, req *http.Request, dbh *db.DBHandle) {
+// todoResource returns t as a resource related to its person.
+func todoResource(t *db.Todo) resource {
+	r := newResource(todoType, t.Id, t, toOne("person", personType, t.Person.Id))
+	r.Version = t.Version
+	return r
+}
+
+// canReadTodos writes a 403 and returns false if policy doesn't let the user
+// see todos.
+func canReadTodos(rend render.Render, policy *Policy) bool {
+	if !policy.CanReadTodos() {
+		rend.JSON(http.StatusForbidden, fmt.Sprintf("%s can't see todos", policy.Membership.Role))
+		return false
+	}
+	return true
+}
+
+func getTodos(rend render.Render, req *http.Request, store db.TodoStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(500, err.Error())
 		return
 	}
-	var todos []todoWithPersonIdJSON
+	list, err := parseListParams(req, todoType)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	param_ids := req.Form["ids[]"]
 	if len(param_ids) > 0 {
-		todo_ids, err := parseParamIds(param_ids)
+		list.Ids, err = parseParamIds(param_ids)
 		if err != nil {
 			rend.JSON(500, err.Error())
 			return
 		}
-
-		todos = make([]todoWithPersonIdJSON, len(todo_ids))
-		for i, tid := range todo_ids {
-			todo := db.Todo{Id: tid}
-			err = dbh.ORM.Read(&todo)
+		for _, tid := range list.Ids {
+			_, err := store.GetTodoById(tid)
 			if err != nil {
 				rend.JSON(404, err.Error())
 				return
 			}
-			todos[i] = todoWithPersonIdJSON{&todo, todo.Person.Id}
-		}
-	} else {
-		db_todos := []*db.Todo{}
-		_, err := dbh.ORM.QueryTable("todo").All(&db_todos)
-		if err != nil {
-			rend.JSON(500, err.Error())
-			return
-		}
-		todos = make([]todoWithPersonIdJSON, len(db_todos))
-		for i, todo := range db_todos {
-			todos[i] = todoWithPersonIdJSON{todo, todo.Person.Id}
 		}
 	}
-	rend.JSON(http.StatusOK, todos)
+	db_todos, err := store.ListTodos(list)
+	if err != nil {
+		rend.JSON(500, err.Error())
+		return
+	}
+	if len(list.Ids) > 0 && len(list.OrderBy) == 0 {
+		order := inRequestOrder(list.Ids)
+		sort.SliceStable(db_todos, func(i, j int) bool { return order[db_todos[i].Id] < order[db_todos[j].Id] })
+	}
+	todos := make([]resource, len(db_todos))
+	for i, todo := range db_todos {
+		todos[i] = todoResource(todo)
+	}
+	rend.JSON(http.StatusOK, s.Many(todoType, todos, nil))
 }
 
-func getTodo(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func getTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
 	id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(500, fmt.Sprintf("Invalid id %s: %s", params["id"], err.Error()))
 		return
 	}
-	p := db.Todo{Id: id}
-	err = dbh.ORM.Read(&p)
+	p, err := store.GetTodoById(id)
 
 	if err != nil {
-		if err == orm.ErrNoRows {
+		if err == db.ErrNotFound {
 			rend.JSON(404, fmt.Sprintf("No Todo with id %d found.", id))
 			return
 		} else {
@@ -99,20 +125,20 @@ func getTodo(rend render.Render, req *http.Request, params martini.Params, dbh *
 		}
 	}
 
-	rend.JSON(200, todoWithPersonIdJSON{&p, p.Person.Id})
+	rend.JSON(200, s.One(todoResource(p), nil))
 }
 
-func createTodo(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func createTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, people db.PeopleStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
 	err := req.ParseForm()
 	if err != nil {
 		rend.JSON(500, err.Error())
 		return
 	}
 	u := unmarshalTodoJSON{}
-	glog.Info("Decoded json: %+v", u)
-	err = json.NewDecoder(req.Body).Decode(&u)
-	if err != nil {
-		rend.JSON(500, err.Error())
+	if !decodeValid(rend, req, s, todoType, &u, true) {
 		return
 	}
 
@@ -121,35 +147,45 @@ func createTodo(rend render.Render, req *http.Request, params martini.Params, db
 		Text:     u.Text,
 		Category: u.Category,
 		Date:     u.Date,
+		Done:     u.Done != nil && *u.Done,
 	}
 
 	if _, ok := queryParams["addToAll"]; ok {
-		glog.Info(u)
-		//do something here
-		err = dbh.AddTodoToAllPeople(&dbtodo)
+		db_todos, err := store.AddTodoToAllPeople(&dbtodo)
 		if err != nil {
 			rend.JSON(http.StatusInternalServerError, err.Error())
 			return
 		}
+		todos := make([]resource, len(db_todos))
+		for i, todo := range db_todos {
+			todos[i] = todoResource(todo)
+		}
+		rend.JSON(200, s.Many(todoType, todos, nil))
 	} else {
-		p := db.Person{Id: u.PersonId}
-		err = dbh.ORM.Read(&p)
+		if u.PersonId == 0 {
+			rend.JSON(http.StatusUnprocessableEntity, fieldErrors{{"person", "is required"}})
+			return
+		}
+		p, err := people.GetPersonById(u.PersonId)
 		if err != nil {
 			rend.JSON(500, fmt.Sprintf("Unknown Person id: %d", u.PersonId))
 			return
 		}
 
-		dbtodo.Person = &p
-		_, err = dbh.ORM.Insert(&dbtodo)
+		dbtodo.Person = p
+		err = store.CreateTodo(&dbtodo)
 		if err != nil {
 			rend.JSON(500, err.Error())
 			return
 		}
-		rend.JSON(200, todoWithPersonIdJSON{&dbtodo, p.Id})
+		rend.JSON(200, s.One(todoResource(&dbtodo), nil))
 	}
 }
 
-func updateTodo(rend render.Render, req *http.Request, params martini.Params, dbh *db.DBHandle) {
+func updateTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
 	todo_id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(500, err.Error())
@@ -162,17 +198,14 @@ func updateTodo(rend render.Render, req *http.Request, params martini.Params, db
 		return
 	}
 
-	u := unmarshalTodoJSONContainer{}
-	err = json.NewDecoder(req.Body).Decode(&u)
-	if err != nil {
-		rend.JSON(500, err.Error())
+	u := unmarshalTodoJSON{}
+	if !decodeValid(rend, req, s, todoType, &u, false) {
 		return
 	}
 
-	dbtodo := db.Todo{Id: todo_id}
-	err = dbh.ORM.Read(&dbtodo)
+	dbtodo, err := store.GetTodoById(todo_id)
 	if err != nil {
-		if err == orm.ErrNoRows {
+		if err == db.ErrNotFound {
 			rend.JSON(404, fmt.Sprintf("No Todo with id %d found.", todo_id))
 			return
 		} else {
@@ -180,30 +213,91 @@ func updateTodo(rend render.Render, req *http.Request, params martini.Params, db
 			return
 		}
 	}
-	if u.Todo.Text != "" {
-		dbtodo.Text = u.Todo.Text
+	if !checkIfMatch(rend, req, s.One(todoResource(dbtodo), nil)) {
+		return
+	}
+	if u.Text != "" {
+		dbtodo.Text = u.Text
+	}
+	if u.Category != "" {
+		dbtodo.Category = u.Category
+	}
+	if u.Done != nil {
+		dbtodo.Done = *u.Done
+	}
+	err = store.UpdateTodo(dbtodo)
+	if err != nil {
+		writeUpdateError(rend, err)
+		return
+	}
+	rend.JSON(200, s.One(todoResource(dbtodo), nil))
+}
+
+// patchTodo applies a JSON Merge Patch to a todo.  Unlike updateTodo it can
+// clear fields, change the date and reassign the todo to another person.
+func patchTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, people db.PeopleStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
+	todo_id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	patch := object{}
+	err = s.Decode(req.Body, todoType, &patch)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbtodo, err := store.GetTodoById(todo_id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(404, fmt.Sprintf("No Todo with id %d found.", todo_id))
+		} else {
+			rend.JSON(500, err.Error())
+		}
+		return
+	}
+	if !checkIfMatch(rend, req, s.One(todoResource(dbtodo), nil)) {
+		return
 	}
-	if u.Todo.Category != "" {
-		dbtodo.Category = u.Todo.Category
+	errs := applyTodoPatch(dbtodo, patch, people)
+	errs.merge(validatePatch(patch, &unmarshalTodoJSON{}))
+	if len(errs) > 0 {
+		rend.JSON(http.StatusUnprocessableEntity, errs)
+		return
+	}
+	err = store.UpdateTodo(dbtodo)
+	if err != nil {
+		writeUpdateError(rend, err)
+		return
 	}
-	dbh.ORM.Update(&dbtodo)
-	rend.JSON(200, todoWithPersonIdJSON{&dbtodo, dbtodo.Person.Id})
+	rend.JSON(200, s.One(todoResource(dbtodo), nil))
 }
 
-func deleteTodo(rend render.Render, params martini.Params, dbh *db.DBHandle) {
+func deleteTodo(rend render.Render, req *http.Request, params martini.Params, store db.TodoStore, policy *Policy, s Serializer) {
+	if !canReadTodos(rend, policy) {
+		return
+	}
 	todo_id, err := strconv.ParseInt(params["id"], 10, 64)
 	if err != nil {
 		rend.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	todo, err := dbh.GetTodoById(todo_id)
+	todo, err := store.GetTodoById(todo_id)
 	if err != nil {
 		rend.JSON(http.StatusNotFound, err.Error())
 		return
 	}
+	if !checkIfMatch(rend, req, s.One(todoResource(todo), nil)) {
+		return
+	}
 
-	err = dbh.RemoveTodo(todo)
+	err = store.RemoveTodo(todo)
 	if err != nil {
 		rend.JSON(http.StatusInternalServerError, err.Error())
 		return
@@ -15,23 +15,23 @@ import (
 const getTodoGoldenResponse = `{
   "todo": {
     "id": 1,
-    "subject": "test todo1",
-    "date": "0001-01-01T00:00:00Z",
+    "date": "2014-03-01T10:00:00Z",
+    "text": "test todo1",
     "category": "",
-    "Notes": "test todo1 notes",
-    "person": 3
+    "done": false,
+    "created_at": "",
+    "updated_at": "",
+    "person": 1
   }
 }`
 
 func TestGetTodo(t *testing.T) {
 	dbh, m := setupTest(t)
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	response := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/api/1/todos/1", nil)
+	req, _ := newTestRequest("GET", "/api/1/todos/1", nil)
 	m.ServeHTTP(response, req)
 
 	if response.Code != http.StatusOK {
@@ -39,14 +39,14 @@ func TestGetTodo(t *testing.T) {
 		t.Fatalf("Expected %d response code, got %d", http.StatusOK, response.Code)
 	}
 
-	if response.Body.String() != getTodoGoldenResponse {
+	if goldenBody(response) != getTodoGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
 
 	// Non existing id
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/1/todos/100", nil)
+	req, _ = newTestRequest("GET", "/api/1/todos/100", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusNotFound {
 		fmt.Println(response.Body.String())
@@ -59,26 +59,32 @@ const getTodosGoldenResponse = `{
   "todos": [
     {
       "id": 1,
-      "subject": "test todo1",
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo1",
       "category": "",
-      "Notes": "test todo1 notes",
-      "person": 3
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 1
     },
     {
       "id": 2,
-      "subject": "test todo2",
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo2",
       "category": "",
-      "Notes": "test todo2 notes",
-      "person": 3
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 2
     },
     {
       "id": 3,
-      "subject": "test todo3",
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo3",
       "category": "",
-      "Notes": "test todo3 notes",
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
       "person": 3
     }
   ]
@@ -88,19 +94,23 @@ const getTodosByIdGoldenResponse = `{
   "todos": [
     {
       "id": 1,
-      "subject": "test todo1",
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo1",
       "category": "",
-      "Notes": "test todo1 notes",
-      "person": 3
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 1
     },
     {
       "id": 2,
-      "subject": "test todo2",
-      "date": "0001-01-01T00:00:00Z",
+      "date": "2014-03-01T10:00:00Z",
+      "text": "test todo2",
       "category": "",
-      "Notes": "test todo2 notes",
-      "person": 3
+      "done": false,
+      "created_at": "",
+      "updated_at": "",
+      "person": 2
     }
   ]
 }`
@@ -108,41 +118,39 @@ const getTodosByIdGoldenResponse = `{
 func TestGetTodos(t *testing.T) {
 	dbh, m := setupTest(t)
 
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	//ALL
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/api/1/todos", nil)
+	req, _ := newTestRequest("GET", "/api/1/todos", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusOK {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Expected %d response code, got %d", http.StatusOK, response.Code)
 	}
 
-	if response.Body.String() != getTodosGoldenResponse {
+	if goldenBody(response) != getTodosGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
 
 	// By ID
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/1/todos?ids[]=1&ids[]=2", nil)
+	req, _ = newTestRequest("GET", "/api/1/todos?ids[]=1&ids[]=2", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusOK {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Expected %d response code, got %d", http.StatusOK, response.Code)
 	}
 
-	if response.Body.String() != getTodosByIdGoldenResponse {
+	if goldenBody(response) != getTodosByIdGoldenResponse {
 		fmt.Println(response.Body.String())
 		t.Fatalf("Response doesn't match golden response")
 	}
 
 	// Non existing id
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/1/people?ids[]=100", nil)
+	req, _ = newTestRequest("GET", "/api/1/people?ids[]=100", nil)
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusNotFound {
 		fmt.Println(response.Body.String())
@@ -152,16 +160,14 @@ func TestGetTodos(t *testing.T) {
 
 func TestCreateTodo(t *testing.T) {
 	dbh, m := setupTest(t)
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	tdate := time.Now()
 	n := TodoJSON{
 		Todo: todoWithPersonIdJSON{
 			&db.Todo{
-				Subject: "testtext",
-				Date:    tdate,
+				Text: "testtext",
+				Date: tdate,
 			},
 			1,
 		},
@@ -170,7 +176,7 @@ func TestCreateTodo(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("POST", "/api/1/todos", bytes.NewReader(req_body))
+	req, _ := newTestRequest("POST", "/api/1/todos", bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -182,7 +188,7 @@ func TestCreateTodo(t *testing.T) {
 	resp_todo := unmarshalTodoJSONContainer{}
 	err = json.NewDecoder(response.Body).Decode(&resp_todo)
 	failOnError(t, err)
-	if resp_todo.Todo.Date != tdate {
+	if !resp_todo.Todo.Date.Equal(tdate) {
 		t.Fatalf("Todo Date doesn't match set date: %v != %v", resp_todo.Todo.Date,
 			tdate)
 	}
@@ -190,15 +196,13 @@ func TestCreateTodo(t *testing.T) {
 
 func TestUpdateTodo(t *testing.T) {
 	dbh, m := setupTest(t)
-	dbh.ORM.Begin()
-	defer dbh.ORM.Rollback()
-	loadFixtures(dbh)
+	loadFixtures(t, dbh)
 
 	db_todo, err := dbh.GetTodoById(int64(1))
 	failOnError(t, err)
 
-	test_new_text := db_todo.Subject + "new text"
-	db_todo.Subject = test_new_text
+	test_new_text := db_todo.Text + "new text"
+	db_todo.Text = test_new_text
 
 	n := TodoJSON{
 		Todo: todoWithPersonIdJSON{
@@ -210,7 +214,7 @@ func TestUpdateTodo(t *testing.T) {
 	failOnError(t, err)
 
 	response := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/1/todos/%d", db_todo.Id), bytes.NewReader(req_body))
+	req, _ := newTestRequest("PUT", fmt.Sprintf("/api/1/todos/%d", db_todo.Id), bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 
@@ -225,9 +229,9 @@ func TestUpdateTodo(t *testing.T) {
 		t.Fatalf("Error decoding response: %v", response.Body)
 	}
 
-	if resp_todo.Todo.Subject != test_new_text {
-		t.Fatalf("Todo Subject doesn't match set subject: %v != %v",
-			resp_todo.Todo.Subject,
+	if resp_todo.Todo.Text != test_new_text {
+		t.Fatalf("Todo Text doesn't match set text: %v != %v",
+			resp_todo.Todo.Text,
 			test_new_text)
 	}
 
@@ -242,7 +246,7 @@ func TestUpdateTodo(t *testing.T) {
 	failOnError(t, err)
 
 	response = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/api/1/todos/1000", bytes.NewReader(req_body))
+	req, _ = newTestRequest("PUT", "/api/1/todos/1000", bytes.NewReader(req_body))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	m.ServeHTTP(response, req)
 	if response.Code != http.StatusNotFound {
@@ -251,3 +255,30 @@ func TestUpdateTodo(t *testing.T) {
 	}
 
 }
+
+func TestCreateTodoForAllFakeStore(t *testing.T) {
+	store, m := setupFakeTest(t)
+
+	before, err := store.GetTodos()
+	failOnError(t, err)
+
+	req_body, err := json.Marshal(unmarshalTodoJSON{Text: "everyone", Date: time.Now()})
+	failOnError(t, err)
+
+	response := httptest.NewRecorder()
+	req, _ := newTestRequest("POST", "/api/1/todos?addToAll", bytes.NewReader(req_body))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	m.ServeHTTP(response, req)
+	if response.Code != http.StatusOK {
+		fmt.Println(response.Body.String())
+		t.Fatalf("Expected %d response code, got %d", http.StatusOK, response.Code)
+	}
+
+	people, err := store.GetPeopleById([]int64{})
+	failOnError(t, err)
+	after, err := store.GetTodos()
+	failOnError(t, err)
+	if len(after)-len(before) != len(people) {
+		t.Fatalf("Expected %d new todos, got %d", len(people), len(after)-len(before))
+	}
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Request bodies are decoded strictly into the unmarshal*JSON structs:
+// unknown fields are errors, except for ids and the timestamps responses
+// have, which clients may send back.  The structs' validate tags then list
+// the rules for each field, separated by commas:
+//
+//	required    must be given when creating (empty strings don't count)
+//	max=N       at most N characters
+//	category    lowercase letters, digits, - and _, at most 32 of them
+//	date        between 1900 and a hundred years from now, if given
+//	visibility  a note visibility, if given
+//	role        a workspace role
+//	email       an email address, if given
+//	url         an absolute http or https url, if given
+//	events      webhook events, like note.created or todo.*
+//	digest      a digest schedule
+//	template    note template text, with only known placeholders
+var readOnlyFields = map[string]bool{"id": true, "created_at": true, "updated_at": true}
+
+var categoryPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var minDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// jsonName returns the name f has in JSON, or "" if it has none.
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// merge adds the errors in other for fields that e doesn't already have
+// an error for.
+func (e *fieldErrors) merge(other fieldErrors) {
+	failed := map[string]bool{}
+	for _, f := range *e {
+		failed[f.Field] = true
+	}
+	for _, f := range other {
+		if !failed[f.Field] {
+			*e = append(*e, f)
+		}
+	}
+}
+
+// decode unmarshals o into v, which must point to an object or a struct.
+// Each field is unmarshalled on its own so the fieldErrors returned list
+// every unknown field and every one of the wrong type.
+func (o object) decode(v interface{}) error {
+	if p, ok := v.(*object); ok {
+		*p = o
+		return nil
+	}
+	rv := reflect.ValueOf(v).Elem()
+	by_name := map[string]int{}
+	for i := 0; i < rv.NumField(); i++ {
+		if name := jsonName(rv.Type().Field(i)); name != "" {
+			by_name[name] = i
+		}
+	}
+	var errs fieldErrors
+	for _, f := range o {
+		i, ok := by_name[f.Key]
+		if !ok {
+			if !readOnlyFields[f.Key] {
+				errs.add(f.Key, "unknown field")
+			}
+			continue
+		}
+		errs.patchValue(f.Key, f.Value, rv.Field(i).Addr().Interface())
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkRule returns what's wrong with value by rule, or "" if nothing is.
+func checkRule(rule string, value reflect.Value, creating bool) string {
+	str := ""
+	if value.Kind() == reflect.String {
+		str = value.String()
+	}
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+	switch name {
+	case "required":
+		if creating && (value.IsZero() || value.Kind() == reflect.String && strings.TrimSpace(str) == "") {
+			return "is required"
+		}
+	case "max":
+		max, err := strconv.Atoi(arg)
+		if err != nil {
+			// Only ever used with the api's own structs.
+			panic(fmt.Sprintf("Invalid validate rule %q", rule))
+		}
+		if utf8.RuneCountInString(str) > max {
+			return fmt.Sprintf("can't be longer than %d characters", max)
+		}
+	case "category":
+		if str != "" && !categoryPattern.MatchString(str) {
+			return "must be lowercase letters, digits, - and _, at most 32 of them"
+		}
+	case "date":
+		date := value.Interface().(time.Time)
+		if !date.IsZero() && (date.Before(minDate) || date.After(time.Now().AddDate(100, 0, 0))) {
+			return fmt.Sprintf("%s isn't a sensible date", date.Format(time.RFC3339))
+		}
+	case "visibility":
+		if str != "" && !db.ValidVisibility(str) {
+			return fmt.Sprintf("unknown visibility %s", str)
+		}
+	case "email":
+		if str != "" {
+			if a, err := mail.ParseAddress(str); err != nil || a.Address != str {
+				return fmt.Sprintf("%s isn't an email address", str)
+			}
+		}
+	case "url":
+		if str != "" {
+			if u, err := url.Parse(str); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Sprintf("%s isn't an http or https url", str)
+			}
+		}
+	case "events":
+		for i := 0; i < value.Len(); i++ {
+			if e := value.Index(i).String(); !validEvent(e) {
+				return fmt.Sprintf("unknown event %s", e)
+			}
+		}
+	case "digest":
+		if str != "" && !db.ValidDigestSchedule(str) {
+			return fmt.Sprintf("unknown schedule %s", str)
+		}
+	case "template":
+		if unknown := unknownPlaceholders(str); len(unknown) > 0 {
+			return fmt.Sprintf("unknown placeholders %s", strings.Join(unknown, ", "))
+		}
+	case "role":
+		if !db.ValidRole(str) {
+			return fmt.Sprintf("unknown role %s", str)
+		}
+	default:
+		panic(fmt.Sprintf("Unknown validate rule %q", rule))
+	}
+	return ""
+}
+
+// validate checks the struct v points to against the rules in its validate
+// tags.  Required fields only have to be given when creating.  If given
+// isn't nil only the fields in it are checked, as for patches.
+func validate(v interface{}, creating bool, given object) fieldErrors {
+	rv := reflect.ValueOf(v).Elem()
+	var errs fieldErrors
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		name := jsonName(f)
+		if name == "" || f.Tag.Get("validate") == "" {
+			continue
+		}
+		if _, ok := given.get(name); given != nil && !ok {
+			continue
+		}
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if msg := checkRule(rule, rv.Field(i), creating); msg != "" {
+				errs.add(name, "%s", msg)
+			}
+		}
+	}
+	return errs
+}
+
+// decodeValid decodes the request body into v, the unmarshal struct for
+// kind, and validates it.  If it can't it writes a 400 for a body that
+// isn't a resource at all or a 422 listing every invalid field, and
+// returns false.
+func decodeValid(rend render.Render, req *http.Request, s Serializer, kind resourceType, v interface{}, creating bool) bool {
+	err := s.Decode(req.Body, kind, v)
+	errs, invalid := err.(fieldErrors)
+	if err != nil && !invalid {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return false
+	}
+	errs.merge(validate(v, creating, nil))
+	if len(errs) > 0 {
+		rend.JSON(http.StatusUnprocessableEntity, errs)
+		return false
+	}
+	return true
+}
+
+// validatePatch checks the fields a patch sets against the rules for the
+// unmarshal struct v points to.
+func validatePatch(patch object, v interface{}) fieldErrors {
+	errs, _ := patch.decode(v).(fieldErrors)
+	errs.merge(validate(v, false, patch))
+	return errs
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// invalidFields returns the fields of an Ember 422 response, sorted.
+func invalidFields(t *testing.T, body []byte) []string {
+	doc := struct {
+		Errors map[string][]string `json:"errors"`
+	}{}
+	failOnError(t, json.Unmarshal(body, &doc))
+	fields := []string{}
+	for f := range doc.Errors {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidation(t *testing.T) {
+	p, m := setupSerializerTest(t)
+	notes := NotesJSON{}
+	failOnError(t, json.Unmarshal(serveAs(m, testToken, "GET", "/api/1/notes", nil).Body.Bytes(), &notes))
+	note_url := fmt.Sprintf("/api/1/notes/%d", notes.Notes[0].Id)
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		fields []string
+	}{
+		{"POST", "/api/1/people", `{"person": {"name": " "}}`, []string{"name"}},
+		{"POST", "/api/1/people", `{"name": "Carol", "nickname": "C"}`, []string{"nickname"}},
+		{"POST", "/api/1/people", `{"name": "Dave", "email": "Dave <dave@example.com>"}`, []string{"email"}},
+		{"POST", "/api/1/people", fmt.Sprintf(`{"name": "%s"}`, strings.Repeat("x", 256)), []string{"name"}},
+		{"POST", "/api/1/notes", `{"note": {"text": "", "category": "One on One", "date": "1800-01-01T00:00:00Z",
+			"person": "Bob", "colour": "red", "visibility": "everyone"}}`,
+			[]string{"category", "colour", "date", "person", "text", "visibility"}},
+		{"POST", "/api/1/todos", `{"todo": {"text": "todo"}}`, []string{"person"}},
+		{"POST", "/api/1/todos", `{"todo": {"text": 1, "person": 1}}`, []string{"text"}},
+		{"PUT", note_url, `{"note": {"category": "HR"}}`, []string{"category"}},
+		{"PATCH", note_url, `{"text": "fine", "date": "2500-01-01T00:00:00Z", "bogus": null}`, []string{"bogus", "date"}},
+		{"POST", "/api/1/workspaces", `{"workspace": {}}`, []string{"name"}},
+		{"POST", fmt.Sprintf("/api/1/workspaces/%d/members", p.Workspace.Id),
+			`{"member": {"user": "", "role": "boss"}}`, []string{"role", "user"}},
+	}
+	for _, test := range tests {
+		response := serveAs(m, testToken, test.method, test.url, strings.NewReader(test.body))
+		if response.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s %s, got %d: %s", test.method, test.body, response.Code, response.Body)
+			continue
+		}
+		fields := invalidFields(t, response.Body.Bytes())
+		if fmt.Sprint(fields) != fmt.Sprint(test.fields) {
+			t.Errorf("Expected errors for %v from %s, got %s", test.fields, test.body, response.Body)
+		}
+	}
+
+	// Updates only change what's given and what responses return can be
+	// sent back.
+	response := serveAs(m, testToken, "GET", note_url, nil)
+	note := map[string]map[string]interface{}{}
+	failOnError(t, json.Unmarshal(response.Body.Bytes(), &note))
+	note["note"]["text"] = ""
+	body, _ := json.Marshal(note)
+	response = serveAs(m, testToken, "PUT", note_url, strings.NewReader(string(body)))
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected a note to be sent back unchanged, got %d: %s", response.Code, response.Body)
+	}
+
+	code, _, doc := serveJSONAPI(m, "POST", "/api/1/notes",
+		`{"data": {"type": "notes", "attributes": {"text": "", "colour": "red"}}}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 from JSON:API, got %d: %v", code, doc)
+	}
+	pointers := []string{}
+	for _, e := range doc["errors"].([]interface{}) {
+		pointers = append(pointers, e.(map[string]interface{})["source"].(map[string]interface{})["pointer"].(string))
+	}
+	sort.Strings(pointers)
+	expected := []string{"/data/attributes/colour", "/data/attributes/text", "/data/relationships/person"}
+	if fmt.Sprint(pointers) != fmt.Sprint(expected) {
+		t.Errorf("Expected errors pointing at %v, got %v", expected, pointers)
+	}
+}
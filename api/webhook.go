@@ -0,0 +1,500 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Users can register webhooks in a workspace to be sent the people, notes
+// and todos created, updated and deleted in it, as events like
+// "note.created".  Each change queues a delivery for every webhook that
+// wants its event in the same transaction as the change, so nothing is
+// sent for changes that are rolled back.  Webhooks only get what their
+// owner may see: notes they can't read are left out and the text of
+// confidential ones is redacted.  Deleting a person only sends
+// person.deleted, not an event for each of their notes and todos.
+//
+// Deliveries are POSTed by webhookDispatcher, signed with an HMAC-SHA256
+// of the body keyed with the webhook's secret, and retried with
+// exponential backoff until the receiver answers with a 2xx.
+const (
+	webhookEventHeader     = "X-Pointyhair-Event"
+	webhookDeliveryHeader  = "X-Pointyhair-Delivery"
+	webhookSignatureHeader = "X-Pointyhair-Signature"
+)
+
+const (
+	// Attempts at a delivery before giving up on it
+	maxDeliveryAttempts = 8
+	firstRetryDelay     = 30 * time.Second
+	maxRetryDelay       = 6 * time.Hour
+	deliveryTimeout     = 10 * time.Second
+	// Deliveries made in one go by the dispatcher
+	deliveryBatch = 100
+	// How often the dispatcher looks for deliveries that are due
+	deliveryPollInterval = 5 * time.Second
+	// Deliveries returned by the delivery log
+	deliveryLogLength = 100
+)
+
+var (
+	webhookKinds   = []string{"person", "note", "todo"}
+	webhookActions = []string{"created", "updated", "deleted"}
+)
+
+// validEvent returns true if e is an event, like note.created, a wildcard
+// for all of a type's events, like note.*, or * for all of them.
+func validEvent(e string) bool {
+	if e == "*" {
+		return true
+	}
+	parts := strings.Split(e, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	kind_ok, action_ok := false, parts[1] == "*"
+	for _, k := range webhookKinds {
+		kind_ok = kind_ok || parts[0] == k
+	}
+	for _, a := range webhookActions {
+		action_ok = action_ok || parts[1] == a
+	}
+	return kind_ok && action_ok
+}
+
+type webhookJSON struct {
+	*db.Webhook
+	// Empty for all events
+	Events []string `json:"events"`
+	// Only returned when the webhook is registered
+	Secret string `json:"secret,omitempty"`
+}
+
+func webhookResource(w *db.Webhook, secret string) resource {
+	events := []string{}
+	if w.Events != "" {
+		events = strings.Split(w.Events, ",")
+	}
+	return newResource(webhookType, w.Id, webhookJSON{w, events, secret})
+}
+
+type unmarshalWebhookJSON struct {
+	Id  int64  `json:"id"`
+	URL string `json:"url" validate:"required,max=2048,url"`
+	// Generated if not given
+	Secret string   `json:"secret" validate:"max=128"`
+	Events []string `json:"events" validate:"events"`
+}
+
+// hookedStore queues webhook deliveries for the changes made through it.
+// Only changes made in a workspace are sent anywhere.
+type hookedStore struct {
+	db.Store
+	ws *db.Workspace
+}
+
+func (s hookedStore) InWorkspace(ws *db.Workspace) db.Store {
+	return hookedStore{s.Store.InWorkspace(ws), ws}
+}
+
+func (s hookedStore) InTx(f func(s db.Store) error) error {
+	return s.Store.InTx(func(tx db.Store) error {
+		return f(hookedStore{tx, s.ws})
+	})
+}
+
+// change runs f, which makes a change, and queues event in the same
+// transaction.  visible returns the resource to send to a webhook whose
+// owner has the given policy, if they may see it.
+func (s hookedStore) change(event string, f func(tx db.Store) error, visible func(p *Policy) (resource, bool)) error {
+	if s.ws == nil {
+		return f(s.Store)
+	}
+	return s.Store.InTx(func(tx db.Store) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		return queueEvent(tx, s.ws, event, visible)
+	})
+}
+
+// queueEvent queues a delivery of event to every webhook in ws that wants
+// it and whose owner may see it.
+func queueEvent(tx db.Store, ws *db.Workspace, event string, visible func(p *Policy) (resource, bool)) error {
+	hooks, err := tx.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	occurred := time.Now().UTC()
+	for _, w := range hooks {
+		if !w.Wants(event) {
+			continue
+		}
+		m, err := tx.GetMembership(ws, w.Owner)
+		if err == db.ErrNotFound {
+			// The owner has left the workspace.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r, ok := visible(newPolicy(w.Owner, m, tx))
+		if !ok {
+			continue
+		}
+		payload := object{}.set("event", event).set("workspace", ws.Id).set("occurred_at", occurred).
+			set(r.Type.Singular, emberSerializer{}.object(r))
+		b, err := payload.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		err = tx.CreateDelivery(&db.WebhookDelivery{
+			Webhook:     w,
+			Event:       event,
+			Payload:     string(b),
+			Status:      db.DeliveryPending,
+			NextAttempt: occurred,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func personEvent(p *db.Person) func(*Policy) (resource, bool) {
+	return func(*Policy) (resource, bool) {
+		return newResource(personType, p.Id, p), true
+	}
+}
+
+func noteEvent(n *db.Note) func(*Policy) (resource, bool) {
+	return func(policy *Policy) (resource, bool) {
+		if !policy.CanReadNote(n) {
+			return resource{}, false
+		}
+		return noteResource(redactedFor(policy, n)), true
+	}
+}
+
+func todoEvent(t *db.Todo) func(*Policy) (resource, bool) {
+	return func(policy *Policy) (resource, bool) {
+		return todoResource(t), policy.CanReadTodos()
+	}
+}
+
+func (s hookedStore) CreatePerson(p *db.Person) error {
+	return s.change("person.created", func(tx db.Store) error { return tx.CreatePerson(p) }, personEvent(p))
+}
+
+func (s hookedStore) UpdatePerson(p *db.Person) error {
+	return s.change("person.updated", func(tx db.Store) error { return tx.UpdatePerson(p) }, personEvent(p))
+}
+
+func (s hookedStore) RemovePerson(p *db.Person) error {
+	return s.change("person.deleted", func(tx db.Store) error { return tx.RemovePerson(p) }, personEvent(p))
+}
+
+func (s hookedStore) CreateNote(n *db.Note) error {
+	return s.change("note.created", func(tx db.Store) error { return tx.CreateNote(n) }, noteEvent(n))
+}
+
+func (s hookedStore) UpdateNote(n *db.Note) error {
+	return s.change("note.updated", func(tx db.Store) error { return tx.UpdateNote(n) }, noteEvent(n))
+}
+
+func (s hookedStore) RemoveNote(n *db.Note) error {
+	return s.change("note.deleted", func(tx db.Store) error { return tx.RemoveNote(n) }, noteEvent(n))
+}
+
+func (s hookedStore) CreateTodo(t *db.Todo) error {
+	return s.change("todo.created", func(tx db.Store) error { return tx.CreateTodo(t) }, todoEvent(t))
+}
+
+func (s hookedStore) UpdateTodo(t *db.Todo) error {
+	return s.change("todo.updated", func(tx db.Store) error { return tx.UpdateTodo(t) }, todoEvent(t))
+}
+
+func (s hookedStore) RemoveTodo(t *db.Todo) error {
+	return s.change("todo.deleted", func(tx db.Store) error { return tx.RemoveTodo(t) }, todoEvent(t))
+}
+
+// AddTodoToAllPeople creates the copies one by one so each gets its own
+// todo.created.
+func (s hookedStore) AddTodoToAllPeople(t *db.Todo) ([]*db.Todo, error) {
+	if s.ws == nil {
+		return s.Store.AddTodoToAllPeople(t)
+	}
+	var todos []*db.Todo
+	err := s.InTx(func(tx db.Store) error {
+		people, err := tx.GetPeopleById(nil)
+		if err != nil {
+			return err
+		}
+		for _, p := range people {
+			pt := *t
+			pt.Id = 0
+			pt.Person = p
+			if err := tx.CreateTodo(&pt); err != nil {
+				return err
+			}
+			todos = append(todos, &pt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+func getWebhooks(rend render.Render, u *db.User, m *db.Membership, store db.Store, s Serializer) {
+	hooks, err := store.InWorkspace(m.Workspace).GetWebhooks()
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rs := []resource{}
+	for _, w := range hooks {
+		if w.Owner.Id == u.Id {
+			rs = append(rs, webhookResource(w, ""))
+		}
+	}
+	rend.JSON(http.StatusOK, s.Many(webhookType, rs, nil))
+}
+
+// createWebhook returns the webhook's secret, which is never returned
+// again.
+func createWebhook(rend render.Render, req *http.Request, u *db.User, m *db.Membership, store db.Store, s Serializer) {
+	uw := unmarshalWebhookJSON{}
+	if !decodeValid(rend, req, s, webhookType, &uw, true) {
+		return
+	}
+	if uw.Secret == "" {
+		secret, err := db.NewToken()
+		if err != nil {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		uw.Secret = secret
+	}
+	w := db.Webhook{
+		Owner:  u,
+		URL:    uw.URL,
+		Secret: uw.Secret,
+		Events: strings.Join(uw.Events, ","),
+	}
+	if err := store.InWorkspace(m.Workspace).CreateWebhook(&w); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(webhookResource(&w, w.Secret), nil))
+}
+
+// ownWebhook returns the user's webhook with the id given in the url.
+// Otherwise it writes an error response and returns nil.
+func ownWebhook(rend render.Render, params martini.Params, u *db.User, scoped db.Store) *db.Webhook {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid id %s: %s", params["id"], err))
+		return nil
+	}
+	w, err := scoped.GetWebhookById(id)
+	if err == db.ErrNotFound || err == nil && w.Owner.Id != u.Id {
+		// Other people's webhooks look like they don't exist.
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No webhook %d found.", id))
+		return nil
+	}
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	return w
+}
+
+func deleteWebhook(rend render.Render, params martini.Params, u *db.User, m *db.Membership, store db.Store) {
+	scoped := store.InWorkspace(m.Workspace)
+	w := ownWebhook(rend, params, u, scoped)
+	if w == nil {
+		return
+	}
+	if err := scoped.RemoveWebhook(w); err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
+
+// GET /webhooks/:id/deliveries is the webhook's delivery log: its last
+// deliveryLogLength deliveries, newest first.
+func getDeliveries(rend render.Render, params martini.Params, u *db.User, m *db.Membership, store db.Store, s Serializer) {
+	scoped := store.InWorkspace(m.Workspace)
+	w := ownWebhook(rend, params, u, scoped)
+	if w == nil {
+		return
+	}
+	ds, err := scoped.GetDeliveries(w, deliveryLogLength)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rs := make([]resource, len(ds))
+	for i, d := range ds {
+		rs[i] = newResource(deliveryType, d.Id, d, toOne("webhook", webhookType, w.Id))
+	}
+	rend.JSON(http.StatusOK, s.Many(deliveryType, rs, nil))
+}
+
+// signPayload returns the value of webhookSignatureHeader for body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay returns how long to wait before trying a delivery again after
+// the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	d := firstRetryDelay << uint(attempts-1)
+	if d <= 0 || d > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return d
+}
+
+// webhookDispatcher sends the deliveries that are due.
+type webhookDispatcher struct {
+	store  db.Store
+	client *http.Client
+	now    func() time.Time
+	// Whether deliveries may be sent to an address
+	allowed func(ip net.IP) bool
+}
+
+func newWebhookDispatcher(store db.Store) *webhookDispatcher {
+	d := &webhookDispatcher{
+		store:   store,
+		now:     time.Now,
+		allowed: isPublicIP,
+	}
+	// The address is checked after the name is resolved, when connecting,
+	// so a webhook can't reach the server's own network by naming a host
+	// that resolves into it.  There's no proxy, as that would be what was
+	// checked instead.
+	dialer := &net.Dialer{
+		Timeout: deliveryTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !d.allowed(ip) {
+				return fmt.Errorf("Webhooks can't be sent to %s", host)
+			}
+			return nil
+		},
+	}
+	d.client = &http.Client{
+		Timeout:   deliveryTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	return d
+}
+
+// isPublicIP returns whether ip is reachable on the internet, rather than
+// on the loopback, link-local or a private network.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// run sends deliveries as they become due, forever.
+func (d *webhookDispatcher) run(interval time.Duration) {
+	for {
+		for {
+			n, err := d.deliverDue()
+			if err != nil {
+				glog.Errorf("Error sending webhook deliveries: %s", err)
+			}
+			if err != nil || n < deliveryBatch {
+				break
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// deliverDue makes an attempt at up to deliveryBatch deliveries that are
+// due and returns how many it made.
+func (d *webhookDispatcher) deliverDue() (int, error) {
+	ds, err := d.store.GetDueDeliveries(d.now(), deliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+	for _, dl := range ds {
+		d.attempt(dl)
+		if err := d.store.UpdateDelivery(dl); err != nil {
+			return 0, err
+		}
+	}
+	return len(ds), nil
+}
+
+// attempt sends dl and records how it went.
+func (d *webhookDispatcher) attempt(dl *db.WebhookDelivery) {
+	dl.Attempts++
+	code, err := d.post(dl)
+	dl.ResponseCode = code
+	if err == nil {
+		dl.Status = db.DeliveryDelivered
+		dl.LastError = ""
+		return
+	}
+	dl.LastError = err.Error()
+	if dl.Attempts >= maxDeliveryAttempts {
+		glog.Warningf("Giving up on webhook delivery %d to %s: %s", dl.Id, dl.Webhook.URL, err)
+		dl.Status = db.DeliveryFailed
+		return
+	}
+	dl.NextAttempt = d.now().Add(retryDelay(dl.Attempts))
+}
+
+// post sends dl and returns the status code of the response, if there was
+// one.  Anything but a 2xx is an error.
+func (d *webhookDispatcher) post(dl *db.WebhookDelivery) (int, error) {
+	body := []byte(dl.Payload)
+	req, err := http.NewRequest("POST", dl.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set("User-Agent", "pointyhair-webhooks")
+	req.Header.Set(webhookEventHeader, dl.Event)
+	req.Header.Set(webhookDeliveryHeader, fmt.Sprint(dl.Id))
+	req.Header.Set(webhookSignatureHeader, signPayload(dl.Webhook.Secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	// Only the status is kept, as the body could be anything at all.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// testReceiver is a webhook receiver that records what it's sent and
+// answers with status.
+type testReceiver struct {
+	mu       sync.Mutex
+	status   int
+	events   []string
+	payloads []map[string]interface{}
+	bad_sigs int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(webhookSignatureHeader) != signPayload("s3cret", body) {
+		r.bad_sigs++
+	}
+	payload := map[string]interface{}{}
+	json.Unmarshal(body, &payload)
+	r.events = append(r.events, req.Header.Get(webhookEventHeader))
+	r.payloads = append(r.payloads, payload)
+	w.WriteHeader(r.status)
+	w.Write([]byte("Something private"))
+}
+
+func TestWebhooks(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ws := setupTestWorkspace(t, store, "tester", testToken)
+			other := &db.User{Name: "other", Token: "other-token"}
+			failOnError(t, store.CreateUser(other))
+			failOnError(t, store.SetMember(ws, other, db.RoleEditor))
+			receiver := &testReceiver{status: http.StatusNoContent}
+			srv := httptest.NewServer(receiver)
+			defer srv.Close()
+			m := createMartini(store)
+
+			response := serveAs(m, testToken, "POST", "/api/1/webhooks",
+				strings.NewReader(`{"webhook": {"url": "ftp://example.com", "events": ["note.eaten"]}}`))
+			if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "url") ||
+				!strings.Contains(response.Body.String(), "unknown event note.eaten") {
+				t.Errorf("Expected 422 for a bad url and event, got %d: %s", response.Code, response.Body)
+			}
+			body := fmt.Sprintf(`{"webhook": {"url": %q, "secret": "s3cret", "events": ["note.*", "person.created"]}}`, srv.URL)
+			response = serveAs(m, testToken, "POST", "/api/1/webhooks", strings.NewReader(body))
+			doc := struct {
+				Webhook webhookJSON `json:"webhook"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &doc))
+			if response.Code != http.StatusOK || doc.Webhook.Secret != "s3cret" {
+				t.Fatalf("Expected the webhook with its secret, got %d: %s", response.Code, response.Body)
+			}
+			hook_url := fmt.Sprintf("/api/1/webhooks/%d", doc.Webhook.Id)
+			response = serveAs(m, testToken, "GET", "/api/1/webhooks", nil)
+			if response.Code != http.StatusOK || strings.Contains(response.Body.String(), "s3cret") ||
+				!strings.Contains(response.Body.String(), srv.URL) {
+				t.Errorf("Expected the webhook to be listed without its secret, got %d: %s", response.Code, response.Body)
+			}
+			if response := serveAs(m, "other-token", "GET", hook_url+"/deliveries", nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected other people's webhooks to be hidden, got %d", response.Code)
+			}
+
+			response = serveAs(m, testToken, "POST", "/api/1/people", strings.NewReader(`{"person": {"name": "Bob"}}`))
+			bob := struct {
+				Person struct{ Id int64 } `json:"person"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &bob))
+			note := fmt.Sprintf(`{"note": {"text": "Doing well", "person": %d}}`, bob.Person.Id)
+			serveAs(m, testToken, "POST", "/api/1/notes", strings.NewReader(note))
+			// Not wanted, and not visible to the webhook's owner.
+			serveAs(m, testToken, "POST", "/api/1/todos", strings.NewReader(fmt.Sprintf(`{"todo": {"text": "1:1", "person": %d}}`, bob.Person.Id)))
+			private := fmt.Sprintf(`{"note": {"text": "Mine", "person": %d, "visibility": "private"}}`, bob.Person.Id)
+			serveAs(m, "other-token", "POST", "/api/1/notes", strings.NewReader(private))
+
+			d := newWebhookDispatcher(store)
+			d.allowed = func(net.IP) bool { return true }
+			if n, err := d.deliverDue(); err != nil || n != 2 {
+				t.Fatalf("Expected 2 deliveries, got %d, %v", n, err)
+			}
+			if fmt.Sprint(receiver.events) != "[person.created note.created]" || receiver.bad_sigs != 0 {
+				t.Fatalf("Expected signed person.created and note.created, got %v with %d bad signatures", receiver.events, receiver.bad_sigs)
+			}
+			sent, ok := receiver.payloads[1]["note"].(map[string]interface{})
+			if !ok || sent["text"] != "Doing well" || receiver.payloads[1]["workspace"] != float64(ws.Id) {
+				t.Errorf("Expected the note in the payload, got %+v", receiver.payloads[1])
+			}
+			if n, err := d.deliverDue(); err != nil || n != 0 {
+				t.Errorf("Expected nothing left to deliver, got %d, %v", n, err)
+			}
+
+			// Failed deliveries are retried, further and further apart.
+			receiver.status = http.StatusInternalServerError
+			serveAs(m, testToken, "POST", "/api/1/notes", strings.NewReader(note))
+			d.deliverDue()
+			if n, err := d.deliverDue(); err != nil || n != 0 {
+				t.Errorf("Expected the failed delivery to wait before being retried, got %d, %v", n, err)
+			}
+			start := time.Now()
+			for i := 1; i < maxDeliveryAttempts; i++ {
+				d.now = func() time.Time { return start.Add(time.Duration(i) * maxRetryDelay) }
+				if n, err := d.deliverDue(); err != nil || n != 1 {
+					t.Fatalf("Expected attempt %d to be due, got %d, %v", i+1, n, err)
+				}
+			}
+			d.now = func() time.Time { return start.Add(100 * maxRetryDelay) }
+			if n, err := d.deliverDue(); err != nil || n != 0 {
+				t.Errorf("Expected the delivery to be given up on, got %d, %v", n, err)
+			}
+
+			response = serveAs(m, testToken, "GET", hook_url+"/deliveries", nil)
+			log := struct {
+				Deliveries []db.WebhookDelivery `json:"deliveries"`
+			}{}
+			failOnError(t, json.Unmarshal(response.Body.Bytes(), &log))
+			if len(log.Deliveries) != 3 || log.Deliveries[2].Status != db.DeliveryDelivered {
+				t.Fatalf("Expected 3 deliveries, newest first, got %s", response.Body)
+			}
+			failed := log.Deliveries[0]
+			if failed.Status != db.DeliveryFailed || failed.Attempts != maxDeliveryAttempts || failed.ResponseCode != 500 ||
+				failed.LastError != "HTTP 500" {
+				t.Errorf("Expected the last delivery to have failed, got %+v", failed)
+			}
+
+			if response := serveAs(m, "other-token", "DELETE", hook_url, nil); response.Code != http.StatusNotFound {
+				t.Errorf("Expected only the owner to delete the webhook, got %d", response.Code)
+			}
+			if response := serveAs(m, testToken, "DELETE", hook_url, nil); response.Code != http.StatusNoContent {
+				t.Errorf("Expected the webhook to be deleted, got %d", response.Code)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if retryDelay(1) != firstRetryDelay || retryDelay(3) != 4*firstRetryDelay {
+		t.Errorf("Expected the delay to double, got %s and %s", retryDelay(1), retryDelay(3))
+	}
+	if retryDelay(40) != maxRetryDelay || retryDelay(100) != maxRetryDelay {
+		t.Errorf("Expected the delay to be capped at %s, got %s", maxRetryDelay, retryDelay(40))
+	}
+}
+
+func TestWebhookDestinations(t *testing.T) {
+	srv := httptest.NewServer(&testReceiver{status: http.StatusNoContent})
+	defer srv.Close()
+	d := newWebhookDispatcher(nil)
+	for _, url := range []string{srv.URL, "http://169.254.169.254/latest/meta-data/", "http://localhost:9/"} {
+		dl := &db.WebhookDelivery{Webhook: &db.Webhook{URL: url}, Payload: "{}"}
+		if code, err := d.post(dl); err == nil || !strings.Contains(err.Error(), "can't be sent") {
+			t.Errorf("Expected %s to be refused, got %d, %v", url, code, err)
+		}
+	}
+
+	for ip, public := range map[string]bool{
+		"127.0.0.1":       false,
+		"169.254.169.254": false,
+		"10.1.2.3":        false,
+		"192.168.0.1":     false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+	} {
+		if isPublicIP(net.ParseIP(ip)) != public {
+			t.Errorf("Expected isPublicIP(%s) to be %v", ip, public)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/martini-contrib/render"
+)
+
+// Requests pick the workspace they are made in with this header.  It can be
+// left out by users who are only a member of one workspace.
+const workspaceHeader = "X-Pointyhair-Workspace"
+
+type workspaceWithRoleJSON struct {
+	*db.Workspace
+	Role string `json:"role"`
+}
+
+func (w workspaceWithRoleJSON) resource() resource {
+	return newResource(workspaceType, w.Id, w)
+}
+
+type unmarshalWorkspaceJSON struct {
+	Name string `json:"name" validate:"required,max=255"`
+}
+
+type unmarshalMemberJSON struct {
+	User string `json:"user" validate:"required,max=255"`
+	Role string `json:"role" validate:"role"`
+	// Name of the user the member reports to, if any
+	Manager string `json:"manager,omitempty" validate:"max=255"`
+}
+
+// authenticate maps the *db.User whose API token is given in the
+// Authorization header ("Bearer <token>").
+func authenticate(c martini.Context, rend render.Render, req *http.Request, store db.Store) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	u, err := store.GetUserByToken(token)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(http.StatusUnauthorized, "Missing or unknown API token")
+		} else {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	c.Map(u)
+}
+
+// withWorkspace works out which workspace the request is made in, checks the
+// user's role allows the request and maps the user's *db.Membership, their
+// *Policy and the people, note and todo stores limited to that workspace.
+// It must come after authenticate.
+func withWorkspace(c martini.Context, rend render.Render, req *http.Request, u *db.User, store db.Store) {
+	m, err := resolveMembership(req, u, store)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(http.StatusNotFound, fmt.Sprintf("No workspace %s found.", req.Header.Get(workspaceHeader)))
+		} else {
+			rend.JSON(http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if req.Method != "GET" && !m.CanWrite() {
+		rend.JSON(http.StatusForbidden, fmt.Sprintf("%s can't make changes in workspace %d", m.Role, m.Workspace.Id))
+		return
+	}
+
+	scoped := store.InWorkspace(m.Workspace)
+	c.Map(m)
+	c.Map(newPolicy(u, m, store))
+	c.MapTo(scoped, (*db.PeopleStore)(nil))
+	c.MapTo(scoped, (*db.NoteStore)(nil))
+	c.MapTo(scoped, (*db.TodoStore)(nil))
+	c.MapTo(scoped, (*db.NoteTemplateStore)(nil))
+}
+
+func resolveMembership(req *http.Request, u *db.User, store db.Store) (*db.Membership, error) {
+	ws_header := req.Header.Get(workspaceHeader)
+	if ws_header == "" {
+		ms, err := store.GetMemberships(u)
+		if err != nil {
+			return nil, err
+		}
+		if len(ms) != 1 {
+			return nil, fmt.Errorf("%s header is required for users in %d workspaces", workspaceHeader, len(ms))
+		}
+		return ms[0], nil
+	}
+
+	ws_id, err := strconv.ParseInt(ws_header, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid workspace id: %s", err)
+	}
+	// Not being a member looks the same as the workspace not existing.
+	return store.GetMembership(&db.Workspace{Id: ws_id}, u)
+}
+
+func getWorkspaces(rend render.Render, u *db.User, store db.Store, s Serializer) {
+	ms, err := store.GetMemberships(u)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	workspaces := make([]resource, len(ms))
+	for i, m := range ms {
+		workspaces[i] = workspaceWithRoleJSON{m.Workspace, m.Role}.resource()
+	}
+	rend.JSON(http.StatusOK, s.Many(workspaceType, workspaces, nil))
+}
+
+func createWorkspace(rend render.Render, req *http.Request, u *db.User, store db.Store, s Serializer) {
+	uw := unmarshalWorkspaceJSON{}
+	if !decodeValid(rend, req, s, workspaceType, &uw, true) {
+		return
+	}
+
+	ws := db.Workspace{Name: uw.Name}
+	err := store.CreateWorkspace(&ws, u)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusOK, s.One(workspaceWithRoleJSON{&ws, db.RoleOwner}.resource(), nil))
+}
+
+// ownedWorkspace returns the workspace with the id given in the url if u is
+// its owner.  Otherwise it writes an error response and returns nil.
+func ownedWorkspace(rend render.Render, params martini.Params, u *db.User, store db.Store) *db.Workspace {
+	ws_id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		rend.JSON(http.StatusBadRequest, err.Error())
+		return nil
+	}
+	m, err := store.GetMembership(&db.Workspace{Id: ws_id}, u)
+	if err != nil {
+		if err == db.ErrNotFound {
+			rend.JSON(http.StatusNotFound, fmt.Sprintf("No workspace %d found.", ws_id))
+		} else {
+			rend.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return nil
+	}
+	if m.Role != db.RoleOwner {
+		rend.JSON(http.StatusForbidden, "Only owners can change a workspace's members")
+		return nil
+	}
+	return m.Workspace
+}
+
+func setMember(rend render.Render, req *http.Request, params martini.Params, u *db.User, store db.Store, s Serializer) {
+	ws := ownedWorkspace(rend, params, u, store)
+	if ws == nil {
+		return
+	}
+
+	um := unmarshalMemberJSON{}
+	if !decodeValid(rend, req, s, memberType, &um, true) {
+		return
+	}
+	member, err := store.GetUserByName(um.User)
+	if err != nil {
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No user %s found.", um.User))
+		return
+	}
+
+	var manager *db.User
+	if um.Manager != "" {
+		manager, err = store.GetUserByName(um.Manager)
+		if err != nil {
+			rend.JSON(http.StatusNotFound, fmt.Sprintf("No user %s found.", um.Manager))
+			return
+		}
+		if manager.Id == member.Id {
+			rend.JSON(http.StatusBadRequest, "Users can't manage themselves")
+			return
+		}
+		_, err = store.GetMembership(ws, manager)
+		if err != nil {
+			rend.JSON(http.StatusBadRequest, fmt.Sprintf("%s isn't a member of workspace %d", um.Manager, ws.Id))
+			return
+		}
+	}
+
+	err = store.InTx(func(s db.Store) error {
+		err := s.SetMember(ws, member, um.Role)
+		if err != nil {
+			return err
+		}
+		return s.SetManager(ws, member, manager)
+	})
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Members are identified by their user's id.
+	rend.JSON(http.StatusOK, s.One(newResource(memberType, member.Id, um), nil))
+}
+
+func removeMember(rend render.Render, params martini.Params, u *db.User, store db.Store) {
+	ws := ownedWorkspace(rend, params, u, store)
+	if ws == nil {
+		return
+	}
+
+	member, err := store.GetUserByName(params["user"])
+	if err != nil {
+		rend.JSON(http.StatusNotFound, fmt.Sprintf("No user %s found.", params["user"]))
+		return
+	}
+	if member.Id == u.Id {
+		rend.JSON(http.StatusBadRequest, "Owners can't remove themselves")
+		return
+	}
+
+	err = store.RemoveMember(ws, member)
+	if err != nil {
+		rend.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rend.JSON(http.StatusNoContent, "")
+}
+
+// OpenWorkspace is withWorkspace for code running in process, like the
+// terminal ui, as u in the workspace with the given id (or their only one
+// if it's 0).  Changes made through the returned Store fire webhooks, and
+// the Policy decides what u may see and change, as they would over http.
+func OpenWorkspace(store db.Store, u *db.User, ws_id int64) (db.Store, *Policy, error) {
+	var m *db.Membership
+	if ws_id == 0 {
+		ms, err := store.GetMemberships(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ms) != 1 {
+			return nil, nil, fmt.Errorf("%s is in %d workspaces, a workspace has to be picked", u.Name, len(ms))
+		}
+		m = ms[0]
+	} else {
+		var err error
+		m, err = store.GetMembership(&db.Workspace{Id: ws_id}, u)
+		if err == db.ErrNotFound {
+			return nil, nil, fmt.Errorf("No workspace %d found for %s", ws_id, u.Name)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return hookedStore{Store: store}.InWorkspace(m.Workspace), newPolicy(u, m, store), nil
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/hobeone/pointyhair/blob"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+const bobSecret = "bob secret"
+
+type workspaceFixture struct {
+	Workspace *db.Workspace
+	Person    *db.Person
+	Note      *db.Note
+	Todo      *db.Todo
+}
+
+func loadWorkspaceFixture(t *testing.T, store db.Store, name string, token string, text string) workspaceFixture {
+	ws := setupTestWorkspace(t, store, name, token)
+	scoped := store.InWorkspace(ws)
+
+	f := workspaceFixture{
+		Workspace: ws,
+		Person:    &db.Person{Name: name + "'s report"},
+	}
+	failOnError(t, scoped.CreatePerson(f.Person))
+	f.Note = &db.Note{Person: f.Person, Text: text, Date: time.Now()}
+	failOnError(t, scoped.CreateNote(f.Note))
+	f.Todo = &db.Todo{Person: f.Person, Text: text, Date: time.Now()}
+	failOnError(t, scoped.CreateTodo(f.Todo))
+	return f
+}
+
+// isolationStores are the stores the isolation tests are run against.
+func isolationStores(t *testing.T) map[string]db.Store {
+	dbh, err := db.NewMemoryDBHandle("isolation", false)
+	failOnError(t, err)
+	blobs, err := blob.NewDir(t.TempDir())
+	failOnError(t, err)
+	dbh.SetBlobs(blobs)
+	return map[string]db.Store{
+		"fake":    dbtest.NewFakeStore(),
+		"sqlite3": dbh,
+	}
+}
+
+func serveAs(m *martini.Martini, token string, method string, url string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, body)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	response := httptest.NewRecorder()
+	m.ServeHTTP(response, req)
+	return response
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	for name, store := range isolationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			alice := loadWorkspaceFixture(t, store, "alice", "alicetoken", "alice note")
+			bob := loadWorkspaceFixture(t, store, "bob", "bobtoken", bobSecret)
+			m := createMartini(store)
+
+			create_note, _ := json.Marshal(unmarshalNoteJSON{Text: "x", Date: time.Now(), PersonId: bob.Person.Id})
+			create_todo, _ := json.Marshal(unmarshalTodoJSON{Text: "x", Date: time.Now(), PersonId: bob.Person.Id})
+			update_note, _ := json.Marshal(unmarshalNoteJSONContainer{Note: unmarshalNoteJSON{Text: "changed by alice"}})
+			update_todo, _ := json.Marshal(unmarshalTodoJSONContainer{Todo: unmarshalTodoJSON{Text: "changed by alice"}})
+
+			tests := []struct {
+				method string
+				url    string
+				body   []byte
+				code   int
+			}{
+				{"GET", "/api/1/people", nil, http.StatusOK},
+				{"GET", fmt.Sprintf("/api/1/people/%d", bob.Person.Id), nil, http.StatusNotFound},
+				{"GET", fmt.Sprintf("/api/1/people?ids[]=%d", bob.Person.Id), nil, http.StatusNotFound},
+				{"GET", "/api/1/notes", nil, http.StatusOK},
+				{"GET", fmt.Sprintf("/api/1/notes/%d", bob.Note.Id), nil, http.StatusNotFound},
+				{"GET", fmt.Sprintf("/api/1/notes?ids[]=%d", bob.Note.Id), nil, http.StatusNotFound},
+				{"PUT", fmt.Sprintf("/api/1/notes/%d", bob.Note.Id), update_note, http.StatusNotFound},
+				{"POST", "/api/1/notes", create_note, http.StatusInternalServerError},
+				{"GET", "/api/1/todos", nil, http.StatusOK},
+				{"GET", fmt.Sprintf("/api/1/todos/%d", bob.Todo.Id), nil, http.StatusNotFound},
+				{"GET", fmt.Sprintf("/api/1/todos?ids[]=%d", bob.Todo.Id), nil, http.StatusNotFound},
+				{"PUT", fmt.Sprintf("/api/1/todos/%d", bob.Todo.Id), update_todo, http.StatusNotFound},
+				{"POST", "/api/1/todos", create_todo, http.StatusInternalServerError},
+				{"DELETE", fmt.Sprintf("/api/1/notes/%d", bob.Note.Id), nil, http.StatusNotFound},
+				{"DELETE", fmt.Sprintf("/api/1/todos/%d", bob.Todo.Id), nil, http.StatusNotFound},
+				{"DELETE", fmt.Sprintf("/api/1/people/%d", bob.Person.Id), nil, http.StatusNotFound},
+			}
+			for _, test := range tests {
+				response := serveAs(m, "alicetoken", test.method, test.url, bytes.NewReader(test.body))
+				if response.Code != test.code {
+					t.Errorf("%s %s: expected %d response code, got %d: %s",
+						test.method, test.url, test.code, response.Code, response.Body.String())
+				}
+				if strings.Contains(response.Body.String(), bobSecret) {
+					t.Errorf("%s %s: response contains bob's data: %s",
+						test.method, test.url, response.Body.String())
+				}
+
+				// Asking for bob's workspace explicitly doesn't help.
+				response = serveAs(m, "alicetoken", test.method, test.url, bytes.NewReader(test.body),
+					workspaceHeader, fmt.Sprint(bob.Workspace.Id))
+				if response.Code != http.StatusNotFound {
+					t.Errorf("%s %s in bob's workspace: expected %d response code, got %d",
+						test.method, test.url, http.StatusNotFound, response.Code)
+				}
+			}
+
+			// Bob's data is untouched and still visible to bob.
+			bob_store := store.InWorkspace(bob.Workspace)
+			for _, check := range []func() error{
+				func() error { _, err := bob_store.GetPersonById(bob.Person.Id); return err },
+				func() error {
+					n, err := bob_store.GetNoteById(bob.Note.Id)
+					if err == nil && n.Text != bobSecret {
+						err = fmt.Errorf("note text changed to %q", n.Text)
+					}
+					return err
+				},
+				func() error {
+					todo, err := bob_store.GetTodoById(bob.Todo.Id)
+					if err == nil && todo.Text != bobSecret {
+						err = fmt.Errorf("todo text changed to %q", todo.Text)
+					}
+					return err
+				},
+			} {
+				if err := check(); err != nil {
+					t.Errorf("Bob's data was changed: %s", err)
+				}
+			}
+
+			response := serveAs(m, "bobtoken", "GET", "/api/1/notes", nil)
+			if !strings.Contains(response.Body.String(), bobSecret) {
+				t.Errorf("Expected bob to see his own notes: %s", response.Body.String())
+			}
+			if strings.Contains(response.Body.String(), "alice note") {
+				t.Errorf("Bob can see alice's notes: %s", response.Body.String())
+			}
+			response = serveAs(m, "alicetoken", "GET", fmt.Sprintf("/api/1/notes/%d", alice.Note.Id), nil)
+			if response.Code != http.StatusOK {
+				t.Errorf("Expected alice to see her own note, got %d", response.Code)
+			}
+		})
+	}
+}
+
+func TestWorkspaceRoles(t *testing.T) {
+	store := dbtest.NewFakeStore()
+	alice := loadWorkspaceFixture(t, store, "alice", "alicetoken", "alice note")
+	m := createMartini(store)
+
+	carol := db.User{Name: "carol", Token: "caroltoken"}
+	failOnError(t, store.CreateUser(&carol))
+
+	// Not a member yet.
+	response := serveAs(m, "caroltoken", "GET", "/api/1/notes", nil)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d for a user without workspaces, got %d", http.StatusBadRequest, response.Code)
+	}
+
+	// Only owners can add members.
+	add_carol := strings.NewReader(`{"user": "carol", "role": "viewer"}`)
+	response = serveAs(m, "caroltoken", "POST", fmt.Sprintf("/api/1/workspaces/%d/members", alice.Workspace.Id), add_carol)
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d adding yourself to a workspace, got %d", http.StatusNotFound, response.Code)
+	}
+	add_carol = strings.NewReader(`{"user": "carol", "role": "viewer"}`)
+	response = serveAs(m, "alicetoken", "POST", fmt.Sprintf("/api/1/workspaces/%d/members", alice.Workspace.Id), add_carol)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d adding a viewer, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+
+	// Viewers can read but not write.
+	response = serveAs(m, "caroltoken", "GET", "/api/1/notes", nil)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected viewer to get %d reading notes, got %d", http.StatusOK, response.Code)
+	}
+	response = serveAs(m, "caroltoken", "DELETE", fmt.Sprintf("/api/1/notes/%d", alice.Note.Id), nil)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("Expected viewer to get %d deleting a note, got %d", http.StatusForbidden, response.Code)
+	}
+
+	// Editors can write.
+	make_editor := strings.NewReader(`{"user": "carol", "role": "editor"}`)
+	response = serveAs(m, "alicetoken", "POST", fmt.Sprintf("/api/1/workspaces/%d/members", alice.Workspace.Id), make_editor)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d changing a role, got %d", http.StatusOK, response.Code)
+	}
+	response = serveAs(m, "caroltoken", "DELETE", fmt.Sprintf("/api/1/notes/%d", alice.Note.Id), nil)
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Expected editor to get %d deleting a note, got %d", http.StatusNoContent, response.Code)
+	}
+
+	// A second workspace means the header is required.
+	response = serveAs(m, "caroltoken", "POST", "/api/1/workspaces", strings.NewReader(`{"name": "carol's"}`))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d creating a workspace, got %d", http.StatusOK, response.Code)
+	}
+	response = serveAs(m, "caroltoken", "GET", "/api/1/notes", nil)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d without %s, got %d", http.StatusBadRequest, workspaceHeader, response.Code)
+	}
+	response = serveAs(m, "caroltoken", "GET", "/api/1/notes", nil, workspaceHeader, fmt.Sprint(alice.Workspace.Id))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d with %s, got %d", http.StatusOK, workspaceHeader, response.Code)
+	}
+
+	// Removed members lose access.
+	response = serveAs(m, "alicetoken", "DELETE", fmt.Sprintf("/api/1/workspaces/%d/members/carol", alice.Workspace.Id), nil)
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d removing a member, got %d", http.StatusNoContent, response.Code)
+	}
+	response = serveAs(m, "caroltoken", "GET", "/api/1/notes", nil, workspaceHeader, fmt.Sprint(alice.Workspace.Id))
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d after being removed, got %d", http.StatusNotFound, response.Code)
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	_, m := setupFakeTest(t)
+
+	for _, token := range []string{"", "wrongtoken"} {
+		response := serveAs(m, token, "GET", "/api/1/people", nil)
+		if response.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %d with token %q, got %d", http.StatusUnauthorized, token, response.Code)
+		}
+	}
+}
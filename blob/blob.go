@@ -0,0 +1,119 @@
+// Package blob stores the contents of attachments, as opaque byte strings
+// under keys chosen by the caller.  The database only keeps the keys.
+package blob
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Keys are lowercase hex, which keeps them safe to use as file names.
+var keyPattern = regexp.MustCompile(`^[0-9a-f]{8,128}$`)
+
+type Store interface {
+	// Put stores data under key, replacing anything already there.
+	Put(key string, data []byte) error
+	// Get returns ErrNotFound if there's nothing stored under key.
+	Get(key string) ([]byte, error)
+	// Delete doesn't mind if there's nothing stored under key.
+	Delete(key string) error
+	// Walk calls f with the key of everything stored and when it was put,
+	// stopping at the first error f returns.
+	Walk(f func(key string, put time.Time) error) error
+}
+
+// Dir is a Store keeping each blob in a file of its own under a directory,
+// spread over subdirectories named after the first two characters of the
+// keys.
+type Dir struct {
+	path string
+}
+
+var _ Store = (*Dir)(nil)
+
+// NewDir returns a Dir storing blobs under path, which is created if it
+// doesn't exist.
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &Dir{path}, nil
+}
+
+func (d *Dir) file(key string) (string, error) {
+	if !keyPattern.MatchString(key) {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(d.path, key[:2], key), nil
+}
+
+// Put writes data to a temporary file and renames it into place, so a blob
+// is never seen half written.
+func (d *Dir) Put(key string, data []byte) error {
+	path, err := d.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *Dir) Get(key string) ([]byte, error) {
+	path, err := d.file(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (d *Dir) Delete(key string) error {
+	path, err := d.file(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *Dir) Walk(f func(key string, put time.Time) error) error {
+	return filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !keyPattern.MatchString(info.Name()) {
+			return nil
+		}
+		return f(info.Name(), info.ModTime())
+	})
+}
@@ -0,0 +1,65 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDir(t *testing.T) {
+	path, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	d, err := NewDir(filepath.Join(path, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Get("0123456789abcdef"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing blob, got %v", err)
+	}
+	for _, key := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if err := d.Put(key, []byte("data of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put("0123456789abcdef", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := d.Get("0123456789abcdef"); err != nil || string(data) != "replaced" {
+		t.Errorf("Expected the replaced blob, got %q, %v", data, err)
+	}
+	for _, key := range []string{"../../etc/passwd", "ABCDEF0123456789", ""} {
+		if err := d.Put(key, nil); err == nil {
+			t.Errorf("Expected %q to be refused as a key", key)
+		}
+	}
+
+	var keys []string
+	err = d.Walk(func(key string, put time.Time) error {
+		if time.Since(put) > time.Minute {
+			t.Errorf("Expected %s to have just been put, got %s", key, put)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	sort.Strings(keys)
+	if err != nil || len(keys) != 2 || keys[0] != "0123456789abcdef" || keys[1] != "fedcba9876543210" {
+		t.Errorf("Expected to walk both blobs, got %v, %v", keys, err)
+	}
+
+	if err := d.Delete("fedcba9876543210"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("fedcba9876543210"); err != nil {
+		t.Errorf("Expected deleting a missing blob to be fine, got %v", err)
+	}
+	if _, err := d.Get("fedcba9876543210"); err != ErrNotFound {
+		t.Errorf("Expected the blob to be gone, got %v", err)
+	}
+}
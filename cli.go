@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/client"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/tui"
+)
+
+// The people, note and todo commands work as a user, either through a
+// running server or on the database directly by running the api in
+// process, so they're allowed to do the same things either way.
+var serverURL = flag.String("server", "",
+	"URL of a running server for the people, note and todo commands to use instead of -db, like http://localhost:3001")
+var apiToken = flag.String("token", "",
+	"API token to use with -server.  Can also be given in $"+tokenEnv)
+var asUser = flag.String("user", "",
+	"User the people, note, todo and tui commands act as on -db.  Only needed if there's more than one.")
+var workspaceId = flag.Int64("workspace", 0,
+	"Workspace the people, note, todo and tui commands work in, for users in more than one")
+
+// Environment variable the API token can be given in instead of -token.
+const tokenEnv = "POINTYHAIR_TOKEN"
+
+const cliUsage = `Commands:
+  serve                    Run the api (the default)
+  rotate-key NEW_KEY_FILE  Re-encrypt everything with a new key
+  send-digests             Send the digests that are due
+  people list
+  people add NAME
+  note add -person NAME [-category CATEGORY] [-template ID]
+                           The text is read from stdin, or $EDITOR if it's a terminal
+  todo list [-overdue] [-all]
+  todo done ID
+  tui                      People, their recent notes and open todos, in the terminal
+
+people, note and todo take -format table (the default) or json.
+`
+
+var errUsage = errors.New("usage")
+
+type cli struct {
+	c   *client.Client
+	in  io.Reader
+	out io.Writer
+	// Whether to ask for text with $EDITOR rather than read it from in
+	interactive bool
+}
+
+// handlerTransport sends requests straight to an http.Handler.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.h.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+// newClient returns a client for -server, or for the api run in process on
+// -db as -user.
+func newClient() (*client.Client, error) {
+	var c *client.Client
+	if *serverURL != "" {
+		token := *apiToken
+		if token == "" {
+			token = os.Getenv(tokenEnv)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("-server needs -token or $%s", tokenEnv)
+		}
+		c = client.New(*serverURL, token)
+	} else {
+		dbh, _, err := openDB(false)
+		if err != nil {
+			return nil, err
+		}
+		u, err := cliUser(dbh, *asUser)
+		if err != nil {
+			return nil, err
+		}
+		c = client.New("http://pointyhair", u.Token)
+		c.HTTP = &http.Client{Transport: handlerTransport{api.NewQuietHandler(dbh)}}
+	}
+	if *workspaceId != 0 {
+		c = c.InWorkspace(*workspaceId)
+	}
+	return c, nil
+}
+
+// cliUser returns the user called name, or the only user if name is empty.
+func cliUser(dbh *db.DBHandle, name string) (*db.User, error) {
+	if name != "" {
+		u, err := dbh.GetUserByName(name)
+		if err == db.ErrNotFound {
+			return nil, fmt.Errorf("No user %s", name)
+		}
+		return u, err
+	}
+	users, err := dbh.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, fmt.Errorf("-user is needed with %d users in the database", len(users))
+	}
+	return users[0], nil
+}
+
+// runCLI runs the people, note or todo command in args, reading from in
+// and writing to out.
+func runCLI(args []string, in io.Reader, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	cmd := &cli{c: c, in: in, out: out}
+	if f, ok := in.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			cmd.interactive = true
+		}
+	}
+	return cmd.run(args)
+}
+
+func (c *cli) run(args []string) error {
+	commands := map[string]func(args []string) error{
+		"people list": c.listPeople,
+		"people add":  c.addPerson,
+		"note add":    c.addNote,
+		"todo list":   c.listTodos,
+		"todo done":   c.completeTodo,
+	}
+	f, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		return errUsage
+	}
+	return f(args[2:])
+}
+
+// flags returns a FlagSet for a command, with its -format flag.
+func flags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	format := fs.String("format", "table", "table or json")
+	return fs, format
+}
+
+// write writes v as JSON, or the rows as a table under header, as format
+// says.
+func (c *cli) write(format string, v interface{}, header []string, rows [][]string) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.out, "%s\n", b)
+		return err
+	case "table":
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		if header != nil {
+			fmt.Fprintln(w, strings.Join(header, "\t"))
+		}
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("Unknown -format %s, it can be table or json", format)
+}
+
+func (c *cli) listPeople(args []string) error {
+	fs, format := flags("people list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	people, err := c.c.GetPeople()
+	if err != nil {
+		return err
+	}
+	sort.Slice(people, func(i, j int) bool { return strings.ToLower(people[i].Name) < strings.ToLower(people[j].Name) })
+	rows := make([][]string, len(people))
+	for i, p := range people {
+		rows[i] = []string{strconv.FormatInt(p.Id, 10), p.Name, p.Email}
+	}
+	return c.write(*format, people, []string{"ID", "NAME", "EMAIL"}, rows)
+}
+
+func (c *cli) addPerson(args []string) error {
+	fs, format := flags("people add")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if name == "" {
+		return errors.New("people add needs a name")
+	}
+	p, err := c.c.CreatePerson(name)
+	if err != nil {
+		return err
+	}
+	return c.write(*format, p, nil, [][]string{{fmt.Sprintf("Added %s with id %d", p.Name, p.Id)}})
+}
+
+// findPerson returns the person called name, or with name as their id.
+// Failing that a name that only one person's contains will do.
+func findPerson(people []*client.Person, name string) (*client.Person, error) {
+	var matches []*client.Person
+	for _, p := range people {
+		if strings.EqualFold(p.Name, name) || strconv.FormatInt(p.Id, 10) == name {
+			return p, nil
+		}
+		if strings.Contains(strings.ToLower(p.Name), strings.ToLower(name)) {
+			matches = append(matches, p)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("Nobody called %s", name)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, p := range matches {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("%s could be any of %s", name, strings.Join(names, ", "))
+}
+
+// readText returns the text the user gives, from $EDITOR or in.
+func (c *cli) readText() (string, error) {
+	if !c.interactive {
+		b, err := ioutil.ReadAll(c.in)
+		return strings.TrimSpace(string(b)), err
+	}
+	return editText()
+}
+
+// editText returns the text the user writes in $VISUAL or $EDITOR.
+func editText() (string, error) {
+	f, err := ioutil.TempFile("", "pointyhair-note-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	args := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Running %s: %s", editor, err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	return strings.TrimSpace(string(b)), err
+}
+
+// runTUI runs the terminal ui on -db as -user.
+func runTUI() error {
+	if *serverURL != "" {
+		return errors.New("tui only works on -db")
+	}
+	dbh, _, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer dbh.Close()
+	u, err := cliUser(dbh, *asUser)
+	if err != nil {
+		return err
+	}
+	return tui.Run(dbh, u, *workspaceId, editText)
+}
+
+func (c *cli) addNote(args []string) error {
+	fs, format := flags("note add")
+	person := fs.String("person", "", "Who the note is about, by name or id")
+	category := fs.String("category", "", "The note's category, like one_on_one")
+	template := fs.Int64("template", 0, "Id of a template to start the note from")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *person == "" || fs.NArg() > 0 {
+		return errors.New("note add needs -person and takes its text from stdin or $EDITOR")
+	}
+	people, err := c.c.GetPeople()
+	if err != nil {
+		return err
+	}
+	p, err := findPerson(people, *person)
+	if err != nil {
+		return err
+	}
+	text, err := c.readText()
+	if err != nil {
+		return err
+	}
+	n := &client.Note{PersonId: p.Id, Text: text, Category: *category, Date: time.Now()}
+	if *template != 0 {
+		err = c.c.CreateNoteFromTemplate(*template, n)
+	} else if text == "" {
+		return errors.New("Empty note, nothing saved")
+	} else {
+		err = c.c.CreateNote(n)
+	}
+	if err != nil {
+		return err
+	}
+	return c.write(*format, n, nil, [][]string{{fmt.Sprintf("Added note %d about %s", n.Id, p.Name)}})
+}
+
+// firstLine returns the first line of text, cut short if it's long.
+func firstLine(text string) string {
+	line := strings.SplitN(strings.TrimSpace(text), "\n", 2)[0]
+	if r := []rune(line); len(r) > 60 {
+		line = string(r[:59]) + "…"
+	}
+	return line
+}
+
+func (c *cli) listTodos(args []string) error {
+	fs, format := flags("todo list")
+	overdue := fs.Bool("overdue", false, "Only open todos dated before today")
+	all := fs.Bool("all", false, "Include done todos")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	todos, err := c.c.GetTodos()
+	if err != nil {
+		return err
+	}
+	people, err := c.c.GetPeople()
+	if err != nil {
+		return err
+	}
+	names := map[int64]string{}
+	for _, p := range people {
+		names[p.Id] = p.Name
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	listed := []*client.Todo{}
+	for _, t := range todos {
+		if t.Done && (!*all || *overdue) || *overdue && !t.Date.Before(today) {
+			continue
+		}
+		listed = append(listed, t)
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		if !listed[i].Date.Equal(listed[j].Date) {
+			return listed[i].Date.Before(listed[j].Date)
+		}
+		return listed[i].Id < listed[j].Id
+	})
+	header := []string{"ID", "DATE", "PERSON", "TODO"}
+	if *all {
+		header = append(header, "DONE")
+	}
+	rows := make([][]string, len(listed))
+	for i, t := range listed {
+		rows[i] = []string{strconv.FormatInt(t.Id, 10), t.Date.Local().Format("2006-01-02"), names[t.PersonId], firstLine(t.Text)}
+		if *all && t.Done {
+			rows[i] = append(rows[i], "yes")
+		}
+	}
+	return c.write(*format, listed, header, rows)
+}
+
+func (c *cli) completeTodo(args []string) error {
+	fs, format := flags("todo done")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("todo done needs the id of a todo")
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid todo id %s", fs.Arg(0))
+	}
+	done := true
+	t, err := c.c.UpdateTodo(id, client.TodoUpdate{Done: &done})
+	if err != nil {
+		return err
+	}
+	return c.write(*format, t, nil, [][]string{{fmt.Sprintf("Done: %s", firstLine(t.Text))}})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// setupCLI points -db at a new database with one user in one workspace.
+func setupCLI(t *testing.T) (db.Store, func()) {
+	dir, err := ioutil.TempDir("", "pointyhair-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.sql")
+	dbh, err := db.NewDBHandle(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := db.User{Name: "tester"}
+	if err := dbh.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	ws := db.Workspace{Name: "test"}
+	if err := dbh.CreateWorkspace(&ws, &u); err != nil {
+		t.Fatal(err)
+	}
+	old_path, old_user := *dbPath, *asUser
+	*dbPath, *asUser = path, ""
+	return dbh.InWorkspace(&ws), func() {
+		*dbPath, *asUser = old_path, old_user
+		dbh.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	err := runCLI(args, strings.NewReader(stdin), out)
+	return out.String(), err
+}
+
+func TestCLI(t *testing.T) {
+	store, teardown := setupCLI(t)
+	defer teardown()
+
+	for _, name := range []string{"Alice Smith", "Bob"} {
+		if _, err := runCommand(t, "", "people", "add", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := runCommand(t, "", "people", "list")
+	if err != nil || !strings.HasPrefix(out, "ID  NAME") || strings.Index(out, "Alice Smith") > strings.Index(out, "Bob") {
+		t.Fatalf("Expected a table of people by name, got %q, %v", out, err)
+	}
+	out, err = runCommand(t, "", "people", "list", "-format", "json")
+	people := []struct {
+		Id   int64  `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err != nil || json.Unmarshal([]byte(out), &people) != nil || len(people) != 2 {
+		t.Fatalf("Expected the people as json, got %q, %v", out, err)
+	}
+	if _, err := runCommand(t, "", "people", "list", "-format", "xml"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+
+	if _, err := runCommand(t, "Talked about the offer\n", "note", "add", "-person", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.GetPersonById(people[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadPeopleRelations([]*db.Person{alice}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.Notes) != 1 || alice.Notes[0].Text != "Talked about the offer" {
+		t.Fatalf("Expected the note read from stdin, got %+v", alice.Notes)
+	}
+	if _, err := runCommand(t, "text", "note", "add", "-person", "Carol"); err == nil || !strings.Contains(err.Error(), "Carol") {
+		t.Errorf("Expected an error for an unknown person, got %v", err)
+	}
+	if _, err := runCommand(t, "", "note", "add", "-person", "Bob"); err == nil {
+		t.Errorf("Expected an error for an empty note")
+	}
+	if _, err := runCommand(t, "", "todo"); err != errUsage {
+		t.Errorf("Expected a usage error without a subcommand, got %v", err)
+	}
+
+	overdue := &db.Todo{Person: alice, Text: "Send the offer", Date: time.Now().AddDate(0, 0, -2)}
+	upcoming := &db.Todo{Person: alice, Text: "Book training", Date: time.Now().AddDate(0, 0, 2)}
+	for _, todo := range []*db.Todo{overdue, upcoming} {
+		if err := store.CreateTodo(todo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err = runCommand(t, "", "todo", "list", "-overdue")
+	if err != nil || !strings.Contains(out, "Send the offer") || !strings.Contains(out, "Alice Smith") || strings.Contains(out, "Book training") {
+		t.Fatalf("Expected only the overdue todo, got %q, %v", out, err)
+	}
+	if _, err := runCommand(t, "", "todo", "done", fmt.Sprint(overdue.Id)); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runCommand(t, "", "todo", "list", "-format", "json")
+	todos := []struct {
+		Id int64 `json:"id"`
+	}{}
+	if err != nil || json.Unmarshal([]byte(out), &todos) != nil || len(todos) != 1 || todos[0].Id != upcoming.Id {
+		t.Fatalf("Expected only the open todo, got %q, %v", out, err)
+	}
+	if _, err := runCommand(t, "", "todo", "done", "999"); err == nil {
+		t.Errorf("Expected an error for an unknown todo")
+	}
+}
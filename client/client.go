@@ -0,0 +1,695 @@
+// Package client is a typed Go client for the pointyhair api, as described
+// by /api/1/openapi.json.  It speaks the api's Ember Data REST format.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Must match workspaceHeader in the api package.
+const workspaceHeader = "X-Pointyhair-Workspace"
+
+type Person struct {
+	Id      int64   `json:"id"`
+	Name    string  `json:"name"`
+	Email   string  `json:"email"`
+	NoteIds []int64 `json:"notes,omitempty"`
+	TodoIds []int64 `json:"todos,omitempty"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Filled in from the notes and todos sideloaded with the person
+	Notes []*Note `json:"-"`
+	Todos []*Todo `json:"-"`
+}
+
+type Note struct {
+	Id           int64     `json:"id,omitempty"`
+	Date         time.Time `json:"date"`
+	Text         string    `json:"text"`
+	Category     string    `json:"category"`
+	Visibility   string    `json:"visibility,omitempty"`
+	Confidential bool      `json:"confidential"`
+	SharedWith   []int64   `json:"shared_with,omitempty"`
+	PersonId     int64     `json:"person"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Todo struct {
+	Id       int64     `json:"id,omitempty"`
+	Date     time.Time `json:"date"`
+	Text     string    `json:"text"`
+	Category string    `json:"category"`
+	Done     bool      `json:"done"`
+	PersonId int64     `json:"person"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Workspace struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Member struct {
+	User    string `json:"user"`
+	Role    string `json:"role"`
+	Manager string `json:"manager,omitempty"`
+}
+
+// Webhook is a url sent changes in a workspace.  Secret is only returned
+// when the webhook is created.
+type Webhook struct {
+	Id     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Template is the skeleton of a kind of note.  See the api's docs for the
+// placeholders Text can have.
+type Template struct {
+	Id           int64  `json:"id,omitempty"`
+	Name         string `json:"name"`
+	Text         string `json:"text"`
+	Category     string `json:"category,omitempty"`
+	Visibility   string `json:"visibility,omitempty"`
+	Confidential bool   `json:"confidential"`
+	// Set by the server
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Attachment is a file attached to a note, or to a person directly.
+type Attachment struct {
+	Id       int64 `json:"id"`
+	PersonId int64 `json:"person"`
+	// 0 for files attached to the person directly
+	NoteId   int64  `json:"note"`
+	Filename string `json:"filename"`
+	// Set by the server
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Delivery is an attempt, or several, at sending an event to a webhook.
+type Delivery struct {
+	Id           int64     `json:"id"`
+	Event        string    `json:"event"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	NextAttempt  time.Time `json:"next_attempt"`
+	ResponseCode int       `json:"response_code"`
+	LastError    string    `json:"last_error"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Digest is where and how often the user is sent a digest email.
+type Digest struct {
+	Email string `json:"email"`
+	// daily, weekly or off
+	Schedule string `json:"schedule"`
+	// Set by the server
+	SentAt *time.Time `json:"sent_at,omitempty"`
+}
+
+// NoteUpdate holds the fields to change with UpdateNote.  Fields left at
+// their zero value (nil for pointers) are left alone.
+type NoteUpdate struct {
+	Text         string  `json:"text,omitempty"`
+	Category     string  `json:"category,omitempty"`
+	Visibility   string  `json:"visibility,omitempty"`
+	Confidential *bool   `json:"confidential,omitempty"`
+	SharedWith   []int64 `json:"shared_with,omitempty"`
+}
+
+// TodoUpdate holds the fields to change with UpdateTodo.  Fields left at
+// their zero value (nil for pointers) are left alone.
+type TodoUpdate struct {
+	Text     string `json:"text,omitempty"`
+	Category string `json:"category,omitempty"`
+	Done     *bool  `json:"done,omitempty"`
+}
+
+// BulkOperation is one of the operations BulkNotes and BulkTodos apply.
+// Body is what CreateNote, UpdateNote, PatchNote or their todo equivalents
+// would send, e.g. map[string]interface{}{"todo": t}.
+type BulkOperation struct {
+	Op      string      `json:"op"`
+	Id      int64       `json:"id,omitempty"`
+	Body    interface{} `json:"body,omitempty"`
+	IfMatch string      `json:"if_match,omitempty"`
+	// Only for reassign
+	From int64 `json:"from,omitempty"`
+	To   int64 `json:"to,omitempty"`
+}
+
+// BulkResult is the status and body an operation would have got if it had
+// been sent on its own.
+type BulkResult struct {
+	Op     string          `json:"op"`
+	Id     int64           `json:"id"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// envelope holds every key a request or response can have.
+type envelope struct {
+	Person      *Person       `json:"person,omitempty"`
+	People      []*Person     `json:"people,omitempty"`
+	Note        *Note         `json:"note,omitempty"`
+	Notes       []*Note       `json:"notes,omitempty"`
+	Todo        *Todo         `json:"todo,omitempty"`
+	Todos       []*Todo       `json:"todos,omitempty"`
+	Workspace   *Workspace    `json:"workspace,omitempty"`
+	Workspaces  []*Workspace  `json:"workspaces,omitempty"`
+	Member      *Member       `json:"member,omitempty"`
+	Webhook     *Webhook      `json:"webhook,omitempty"`
+	Webhooks    []*Webhook    `json:"webhooks,omitempty"`
+	Deliveries  []*Delivery   `json:"deliveries,omitempty"`
+	Digest      *Digest       `json:"digest,omitempty"`
+	Template    *Template     `json:"template,omitempty"`
+	Templates   []*Template   `json:"templates,omitempty"`
+	Attachment  *Attachment   `json:"attachment,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	Calendar    *struct {
+		URL string `json:"url"`
+	} `json:"calendar,omitempty"`
+	Inbox *struct {
+		Address string `json:"address"`
+	} `json:"inbox,omitempty"`
+}
+
+// link fills in the people's Notes and Todos from the sideloaded ones.
+func (e *envelope) link() {
+	notes := map[int64]*Note{}
+	for _, n := range e.Notes {
+		notes[n.Id] = n
+	}
+	todos := map[int64]*Todo{}
+	for _, t := range e.Todos {
+		todos[t.Id] = t
+	}
+	people := e.People
+	if e.Person != nil {
+		people = append(people, e.Person)
+	}
+	for _, p := range people {
+		for _, id := range p.NoteIds {
+			if n, ok := notes[id]; ok {
+				n.PersonId = p.Id
+				p.Notes = append(p.Notes, n)
+			}
+		}
+		for _, id := range p.TodoIds {
+			if t, ok := todos[id]; ok {
+				t.PersonId = p.Id
+				p.Todos = append(p.Todos, t)
+			}
+		}
+	}
+}
+
+// Error is returned for responses with an error status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pointyhair: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound returns true if err is a 404 from the api.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+	// e.g. http://localhost:3001
+	BaseURL string
+	Token   string
+	// The workspace requests are made in.  Only needed for users in more
+	// than one workspace.
+	Workspace int64
+	HTTP      *http.Client
+}
+
+// New returns a Client for the api at base_url that authenticates with the
+// given API token.
+func New(base_url string, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(base_url, "/"),
+		Token:   token,
+		HTTP:    http.DefaultClient,
+	}
+}
+
+// InWorkspace returns a copy of the client that makes requests in the
+// workspace with the given id.
+func (c *Client) InWorkspace(id int64) *Client {
+	wc := *c
+	wc.Workspace = id
+	return &wc
+}
+
+// do makes a request to path (relative to /api/1) and decodes the response
+// into out, if it isn't nil.
+func (c *Client) do(method string, path string, query url.Values, in interface{}, out interface{}) error {
+	u := c.BaseURL + "/api/1" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	b, err := c.send(method, u, "application/json; charset=UTF-8", body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return err
+	}
+	if e, ok := out.(*envelope); ok {
+		e.link()
+	}
+	return nil
+}
+
+// send makes a request to u with a body of the given content type, and
+// returns the body of the response.
+func (c *Client) send(method string, u string, content_type string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if content_type != "" {
+		req.Header.Set("Content-Type", content_type)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if c.Workspace != 0 {
+		req.Header.Set(workspaceHeader, strconv.FormatInt(c.Workspace, 10))
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		e := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(b, &e.Message) != nil {
+			e.Message = string(b)
+		}
+		return nil, e
+	}
+	return b, nil
+}
+
+func idsQuery(ids []int64) url.Values {
+	q := url.Values{}
+	for _, id := range ids {
+		q.Add("ids[]", strconv.FormatInt(id, 10))
+	}
+	return q
+}
+
+// GetPeople returns the people with the given ids, or everyone if there are
+// none.
+func (c *Client) GetPeople(ids ...int64) ([]*Person, error) {
+	out := envelope{}
+	err := c.do("GET", "/people", idsQuery(ids), nil, &out)
+	return out.People, err
+}
+
+func (c *Client) GetPerson(id int64) (*Person, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/people/%d", id), nil, nil, &out)
+	return out.Person, err
+}
+
+func (c *Client) CreatePerson(name string) (*Person, error) {
+	out := envelope{}
+	in := map[string]map[string]string{"person": {"name": name}}
+	err := c.do("POST", "/people", nil, in, &out)
+	return out.Person, err
+}
+
+func (c *Client) DeletePerson(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/people/%d", id), nil, nil, nil)
+}
+
+// GetNotes returns the notes with the given ids, or all the notes the user
+// can read if there are none.
+func (c *Client) GetNotes(ids ...int64) ([]*Note, error) {
+	out := envelope{}
+	err := c.do("GET", "/notes", idsQuery(ids), nil, &out)
+	return out.Notes, err
+}
+
+func (c *Client) GetNote(id int64) (*Note, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/notes/%d", id), nil, nil, &out)
+	return out.Note, err
+}
+
+// CreateNote creates n and fills in its id.
+func (c *Client) CreateNote(n *Note) error {
+	return c.do("POST", "/notes", nil, &envelope{Note: n}, &envelope{Note: n})
+}
+
+// CreateNoteFromTemplate creates a note about n.PersonId from the template
+// with the given id, and fills in n.  n's date and text are sent if set;
+// the template gives the rest.
+func (c *Client) CreateNoteFromTemplate(template_id int64, n *Note) error {
+	in := map[string]interface{}{"person": n.PersonId}
+	if !n.Date.IsZero() {
+		in["date"] = n.Date
+	}
+	if n.Text != "" {
+		in["text"] = n.Text
+	}
+	q := url.Values{"template": {strconv.FormatInt(template_id, 10)}}
+	return c.do("POST", "/notes", q, map[string]interface{}{"note": in}, &envelope{Note: n})
+}
+
+func (c *Client) UpdateNote(id int64, u NoteUpdate) (*Note, error) {
+	in := map[string]NoteUpdate{"note": u}
+	out := envelope{}
+	err := c.do("PUT", fmt.Sprintf("/notes/%d", id), nil, in, &out)
+	return out.Note, err
+}
+
+// PatchNote applies a JSON Merge Patch to the note with the given id.  nil
+// values clear fields.
+func (c *Client) PatchNote(id int64, patch map[string]interface{}) (*Note, error) {
+	out := envelope{}
+	err := c.do("PATCH", fmt.Sprintf("/notes/%d", id), nil, patch, &out)
+	return out.Note, err
+}
+
+func (c *Client) DeleteNote(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/notes/%d", id), nil, nil, nil)
+}
+
+// GetTodos returns the todos with the given ids, or all todos if there are
+// none.
+func (c *Client) GetTodos(ids ...int64) ([]*Todo, error) {
+	out := envelope{}
+	err := c.do("GET", "/todos", idsQuery(ids), nil, &out)
+	return out.Todos, err
+}
+
+func (c *Client) GetTodo(id int64) (*Todo, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/todos/%d", id), nil, nil, &out)
+	return out.Todo, err
+}
+
+// CreateTodo creates t and fills in its id.
+func (c *Client) CreateTodo(t *Todo) error {
+	return c.do("POST", "/todos", nil, &envelope{Todo: t}, &envelope{Todo: t})
+}
+
+// AddTodoToAll gives every person a copy of t and returns the copies.
+func (c *Client) AddTodoToAll(t *Todo) ([]*Todo, error) {
+	out := envelope{}
+	err := c.do("POST", "/todos", url.Values{"addToAll": {""}}, &envelope{Todo: t}, &out)
+	return out.Todos, err
+}
+
+func (c *Client) UpdateTodo(id int64, u TodoUpdate) (*Todo, error) {
+	in := map[string]TodoUpdate{"todo": u}
+	out := envelope{}
+	err := c.do("PUT", fmt.Sprintf("/todos/%d", id), nil, in, &out)
+	return out.Todo, err
+}
+
+// PatchTodo applies a JSON Merge Patch to the todo with the given id.  nil
+// values clear fields.
+func (c *Client) PatchTodo(id int64, patch map[string]interface{}) (*Todo, error) {
+	out := envelope{}
+	err := c.do("PATCH", fmt.Sprintf("/todos/%d", id), nil, patch, &out)
+	return out.Todo, err
+}
+
+func (c *Client) DeleteTodo(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/todos/%d", id), nil, nil, nil)
+}
+
+// BulkNotes applies ops to notes in one transaction.  If any fails none are
+// applied and the *Error returned has every result in its Message.
+func (c *Client) BulkNotes(ops []BulkOperation) ([]BulkResult, error) {
+	return c.bulk("/notes/bulk", ops)
+}
+
+// BulkTodos is BulkNotes for todos, which can also be completed and
+// reassigned.
+func (c *Client) BulkTodos(ops []BulkOperation) ([]BulkResult, error) {
+	return c.bulk("/todos/bulk", ops)
+}
+
+func (c *Client) bulk(path string, ops []BulkOperation) ([]BulkResult, error) {
+	out := struct {
+		Results []BulkResult `json:"results"`
+	}{}
+	err := c.do("POST", path, nil, map[string][]BulkOperation{"operations": ops}, &out)
+	return out.Results, err
+}
+
+// ReassignTodos moves all of the todos of the person with id from to the
+// person with id to, returning the todos moved.
+func (c *Client) ReassignTodos(from int64, to int64) ([]*Todo, error) {
+	results, err := c.BulkTodos([]BulkOperation{{Op: "reassign", From: from, To: to}})
+	if err != nil {
+		return nil, err
+	}
+	out := envelope{}
+	if err := json.Unmarshal(results[0].Body, &out); err != nil {
+		return nil, err
+	}
+	return out.Todos, nil
+}
+
+// EnableCalendar turns on the user's iCalendar feed, if it isn't already,
+// and returns its url.
+func (c *Client) EnableCalendar() (string, error) {
+	out := envelope{}
+	if err := c.do("POST", "/calendar", nil, nil, &out); err != nil {
+		return "", err
+	}
+	if out.Calendar == nil {
+		return "", errors.New("no calendar in response")
+	}
+	return out.Calendar.URL, nil
+}
+
+// DisableCalendar turns off the user's feed.  Enabling it again gives it a
+// new url.
+func (c *Client) DisableCalendar() error {
+	return c.do("DELETE", "/calendar", nil, nil, nil)
+}
+
+// EnableInbox gives the user an address to forward email to, if they
+// don't already have one, and returns it.  Add +person before the @ to say
+// who the email is about.
+func (c *Client) EnableInbox() (string, error) {
+	out := envelope{}
+	if err := c.do("POST", "/inbox", nil, nil, &out); err != nil {
+		return "", err
+	}
+	if out.Inbox == nil {
+		return "", errors.New("no inbox in response")
+	}
+	return out.Inbox.Address, nil
+}
+
+// DisableInbox stops email to the user's address being taken in.  Enabling
+// it again gives it a new address.
+func (c *Client) DisableInbox() error {
+	return c.do("DELETE", "/inbox", nil, nil, nil)
+}
+
+func (c *Client) GetDigest() (*Digest, error) {
+	out := envelope{}
+	err := c.do("GET", "/digest", nil, nil, &out)
+	return out.Digest, err
+}
+
+// SetDigest changes where and how often the user is sent a digest.
+func (c *Client) SetDigest(email string, schedule string) (*Digest, error) {
+	out := envelope{}
+	err := c.do("PUT", "/digest", nil, &envelope{Digest: &Digest{Email: email, Schedule: schedule}}, &out)
+	return out.Digest, err
+}
+
+// CreateWebhook registers w.URL to be sent w.Events (all of them if
+// empty), signed with w.Secret or, if it's empty, a generated secret that
+// is filled in.
+func (c *Client) CreateWebhook(w *Webhook) error {
+	out := envelope{}
+	if err := c.do("POST", "/webhooks", nil, &envelope{Webhook: w}, &out); err != nil {
+		return err
+	}
+	if out.Webhook == nil {
+		return errors.New("no webhook in response")
+	}
+	*w = *out.Webhook
+	return nil
+}
+
+// GetWebhooks returns the user's webhooks, without their secrets.
+func (c *Client) GetWebhooks() ([]*Webhook, error) {
+	out := envelope{}
+	err := c.do("GET", "/webhooks", nil, nil, &out)
+	return out.Webhooks, err
+}
+
+func (c *Client) DeleteWebhook(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/webhooks/%d", id), nil, nil, nil)
+}
+
+// GetDeliveries returns the last deliveries to a webhook, newest first.
+func (c *Client) GetDeliveries(webhook_id int64) ([]*Delivery, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/webhooks/%d/deliveries", webhook_id), nil, nil, &out)
+	return out.Deliveries, err
+}
+
+// GetTemplates returns the workspace's note templates, by name.
+func (c *Client) GetTemplates() ([]*Template, error) {
+	out := envelope{}
+	err := c.do("GET", "/templates", nil, nil, &out)
+	return out.Templates, err
+}
+
+// CreateTemplate creates t and fills in its id.
+func (c *Client) CreateTemplate(t *Template) error {
+	return c.do("POST", "/templates", nil, &envelope{Template: t}, &envelope{Template: t})
+}
+
+func (c *Client) DeleteTemplate(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/templates/%d", id), nil, nil, nil)
+}
+
+// AttachToNote uploads files, keyed by their name, to the note with the
+// given id.
+func (c *Client) AttachToNote(note_id int64, files map[string]io.Reader) ([]*Attachment, error) {
+	return c.upload(fmt.Sprintf("/notes/%d/attachments", note_id), files)
+}
+
+// AttachToPerson uploads files, keyed by their name, to the person with
+// the given id.
+func (c *Client) AttachToPerson(person_id int64, files map[string]io.Reader) ([]*Attachment, error) {
+	return c.upload(fmt.Sprintf("/people/%d/attachments", person_id), files)
+}
+
+func (c *Client) upload(path string, files map[string]io.Reader) ([]*Attachment, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for name, r := range files {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, r); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	b, err := c.send("POST", c.BaseURL+"/api/1"+path, w.FormDataContentType(), body)
+	if err != nil {
+		return nil, err
+	}
+	out := envelope{}
+	err = json.Unmarshal(b, &out)
+	return out.Attachments, err
+}
+
+// GetPersonAttachments returns the files attached to the person with the
+// given id and to the notes about them the user can read.
+func (c *Client) GetPersonAttachments(person_id int64) ([]*Attachment, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/people/%d/attachments", person_id), nil, nil, &out)
+	return out.Attachments, err
+}
+
+func (c *Client) GetNoteAttachments(note_id int64) ([]*Attachment, error) {
+	out := envelope{}
+	err := c.do("GET", fmt.Sprintf("/notes/%d/attachments", note_id), nil, nil, &out)
+	return out.Attachments, err
+}
+
+// GetAttachmentContent downloads the content of the attachment with the
+// given id.
+func (c *Client) GetAttachmentContent(id int64) ([]byte, error) {
+	return c.send("GET", fmt.Sprintf("%s/api/1/attachments/%d/content", c.BaseURL, id), "", nil)
+}
+
+func (c *Client) DeleteAttachment(id int64) error {
+	return c.do("DELETE", fmt.Sprintf("/attachments/%d", id), nil, nil, nil)
+}
+
+// GetWorkspaces returns the workspaces the user is a member of.
+func (c *Client) GetWorkspaces() ([]*Workspace, error) {
+	out := envelope{}
+	err := c.do("GET", "/workspaces", nil, nil, &out)
+	return out.Workspaces, err
+}
+
+// CreateWorkspace creates a workspace owned by the user.
+func (c *Client) CreateWorkspace(name string) (*Workspace, error) {
+	out := envelope{}
+	in := map[string]map[string]string{"workspace": {"name": name}}
+	err := c.do("POST", "/workspaces", nil, in, &out)
+	return out.Workspace, err
+}
+
+// SetMember adds a member to the workspace with the given id, or changes
+// their role and manager.
+func (c *Client) SetMember(workspace_id int64, m Member) error {
+	return c.do("POST", fmt.Sprintf("/workspaces/%d/members", workspace_id), nil, &envelope{Member: &m}, nil)
+}
+
+func (c *Client) RemoveMember(workspace_id int64, user string) error {
+	return c.do("DELETE", fmt.Sprintf("/workspaces/%d/members/%s", workspace_id, url.PathEscape(user)), nil, nil, nil)
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func setupTest(t *testing.T) (*Client, *httptest.Server) {
+	store := dbtest.NewFakeStore()
+	u := db.User{Name: "tester", Token: "testtoken"}
+	if err := store.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateWorkspace(&db.Workspace{Name: "test"}, &u); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(api.NewHandler(store))
+	return New(server.URL, "testtoken"), server
+}
+
+func TestClient(t *testing.T) {
+	c, server := setupTest(t)
+	defer server.Close()
+
+	p, err := c.CreatePerson("Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Note{PersonId: p.Id, Text: "note", Date: time.Now()}
+	if err := c.CreateNote(n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Id == 0 || n.Visibility != "workspace" {
+		t.Fatalf("Expected the created note to be filled in, got %+v", n)
+	}
+	todo := &Todo{PersonId: p.Id, Text: "todo", Date: time.Now()}
+	if err := c.CreateTodo(todo); err != nil {
+		t.Fatal(err)
+	}
+
+	yes := true
+	updated, err := c.UpdateNote(n.Id, NoteUpdate{Text: "changed", Confidential: &yes})
+	if err != nil || updated.Text != "changed" {
+		t.Fatalf("Expected the updated note back, got %+v, %v", updated, err)
+	}
+	got, err := c.GetNote(n.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "changed" || !got.Confidential || got.PersonId != p.Id {
+		t.Fatalf("Expected the note to be changed, got %+v", got)
+	}
+	if got.CreatedAt.IsZero() || got.UpdatedAt.Before(got.CreatedAt) {
+		t.Errorf("Expected the note's timestamps to be set, got %+v", got)
+	}
+	changed, err := c.UpdateTodo(todo.Id, TodoUpdate{Text: "changed"})
+	if err != nil || changed.Text != "changed" {
+		t.Fatalf("Expected the todo to be changed, got %+v, %v", changed, err)
+	}
+
+	person, err := c.GetPerson(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(person.Notes) != 1 || len(person.Todos) != 1 {
+		t.Fatalf("Expected the person's notes and todos, got %+v", person)
+	}
+	people, err := c.GetPeople(p.Id)
+	if err != nil || len(people) != 1 || people[0].Name != "Bob" {
+		t.Fatalf("Expected to get Bob, got %+v, %v", people, err)
+	}
+
+	copies, err := c.AddTodoToAll(&Todo{Text: "everyone", Date: time.Now()})
+	if err != nil || len(copies) != 1 || copies[0].PersonId != p.Id {
+		t.Fatalf("Expected a copy for Bob, got %+v, %v", copies, err)
+	}
+	todos, err := c.GetTodos()
+	if err != nil || len(todos) != 2 {
+		t.Fatalf("Expected 2 todos, got %+v, %v", todos, err)
+	}
+
+	other, err := c.CreatePerson("Carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := c.PatchTodo(todo.Id, map[string]interface{}{"person": other.Id, "category": nil})
+	if err != nil || patched.PersonId != other.Id || patched.Category != "" {
+		t.Fatalf("Expected the todo to be moved to Carol, got %+v, %v", patched, err)
+	}
+	if _, err := c.PatchNote(n.Id, map[string]interface{}{"person": nil}); err == nil {
+		t.Fatalf("Expected an error clearing the note's person")
+	}
+
+	results, err := c.BulkTodos([]BulkOperation{
+		{Op: "complete", Id: todo.Id},
+		{Op: "create", Body: map[string]*Todo{"todo": {PersonId: other.Id, Text: "bulk"}}},
+	})
+	if err != nil || len(results) != 2 || results[0].Status != 200 || results[1].Status != 200 {
+		t.Fatalf("Expected both bulk operations to work, got %+v, %v", results, err)
+	}
+	moved, err := c.ReassignTodos(other.Id, p.Id)
+	if err != nil || len(moved) != 2 || !moved[0].Done || moved[1].PersonId != p.Id {
+		t.Fatalf("Expected Carol's todos to be reassigned to Bob, got %+v, %v", moved, err)
+	}
+	if _, err := c.BulkNotes([]BulkOperation{{Op: "delete", Id: n.Id}, {Op: "delete", Id: 999}}); err == nil {
+		t.Fatalf("Expected an error from a failed bulk request")
+	}
+
+	attached, err := c.AttachToNote(n.Id, map[string]io.Reader{"offer.pdf": strings.NewReader("%PDF-1.4 offer")})
+	if err != nil || len(attached) != 1 || attached[0].NoteId != n.Id || attached[0].ContentType != "application/pdf" {
+		t.Fatalf("Expected the attached pdf, got %+v, %v", attached, err)
+	}
+	if _, err := c.AttachToPerson(p.Id, map[string]io.Reader{"photo.png": strings.NewReader("\x89PNG\r\n\x1a\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if as, err := c.GetPersonAttachments(p.Id); err != nil || len(as) != 1 || as[0].NoteId != 0 {
+		t.Fatalf("Expected only the person's attachment, as the note is confidential, got %+v, %v", as, err)
+	}
+	if content, err := c.GetAttachmentContent(attached[0].Id); err != nil || string(content) != "%PDF-1.4 offer" {
+		t.Fatalf("Expected the pdf's content, got %q, %v", content, err)
+	}
+	if err := c.DeleteAttachment(attached[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if as, err := c.GetNoteAttachments(n.Id); err != nil || len(as) != 0 {
+		t.Fatalf("Expected the note's attachment to be removed, got %+v, %v", as, err)
+	}
+
+	tmpl := &Template{Name: "1:1", Text: "1:1 with {{person.name}}", Category: "one_on_one", Confidential: true}
+	if err := c.CreateTemplate(tmpl); err != nil || tmpl.Id == 0 {
+		t.Fatalf("Expected the template to be created, got %+v, %v", tmpl, err)
+	}
+	from_template := &Note{PersonId: p.Id, Text: "Went well"}
+	if err := c.CreateNoteFromTemplate(tmpl.Id, from_template); err != nil {
+		t.Fatal(err)
+	}
+	if from_template.Text != "1:1 with Bob\n\nWent well" || !from_template.Confidential || from_template.Category != "one_on_one" {
+		t.Fatalf("Expected the note made from the template, got %+v", from_template)
+	}
+	if templates, err := c.GetTemplates(); err != nil || len(templates) != 1 {
+		t.Fatalf("Expected the template, got %+v, %v", templates, err)
+	}
+	if err := c.DeleteTemplate(tmpl.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.DeleteNote(n.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetNote(n.Id); !IsNotFound(err) {
+		t.Fatalf("Expected a not found error for a deleted note, got %v", err)
+	}
+	if err := c.DeleteTodo(todo.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{p.Id, other.Id} {
+		if err := c.DeletePerson(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if people, err := c.GetPeople(); err != nil || len(people) != 0 {
+		t.Fatalf("Expected nobody left, got %+v, %v", people, err)
+	}
+
+	feed, err := c.EnableCalendar()
+	if err != nil || !strings.HasPrefix(feed, server.URL+"/api/1/calendar.ics?token=") {
+		t.Fatalf("Expected the calendar's url, got %q, %v", feed, err)
+	}
+	resp, err := http.Get(feed)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to get the calendar, got %+v, %v", resp, err)
+	}
+	resp.Body.Close()
+	if err := c.DisableCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, err := c.EnableInbox()
+	if err != nil || !strings.HasSuffix(inbox, "@127.0.0.1") {
+		t.Fatalf("Expected an inbox address, got %q, %v", inbox, err)
+	}
+	if err := c.DisableInbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := c.SetDigest("tester@example.com", "weekly")
+	if err != nil || digest.Schedule != "weekly" || digest.SentAt != nil {
+		t.Fatalf("Expected weekly digests, got %+v, %v", digest, err)
+	}
+	if digest, err := c.GetDigest(); err != nil || digest.Email != "tester@example.com" {
+		t.Errorf("Expected the digest settings, got %+v, %v", digest, err)
+	}
+
+	w := &Webhook{URL: "https://example.com/hook", Events: []string{"note.*"}}
+	if err := c.CreateWebhook(w); err != nil || w.Id == 0 || w.Secret == "" {
+		t.Fatalf("Expected the webhook with a generated secret, got %+v, %v", w, err)
+	}
+	if hooks, err := c.GetWebhooks(); err != nil || len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Fatalf("Expected the webhook without its secret, got %+v, %v", hooks, err)
+	}
+	if deliveries, err := c.GetDeliveries(w.Id); err != nil || len(deliveries) != 0 {
+		t.Errorf("Expected no deliveries yet, got %+v, %v", deliveries, err)
+	}
+	if err := c.DeleteWebhook(w.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientWorkspaces(t *testing.T) {
+	c, server := setupTest(t)
+	defer server.Close()
+
+	ws, err := c.CreateWorkspace("second")
+	if err != nil || ws.Role != "owner" {
+		t.Fatalf("Expected to own the new workspace, got %+v, %v", ws, err)
+	}
+	workspaces, err := c.GetWorkspaces()
+	if err != nil || len(workspaces) != 2 {
+		t.Fatalf("Expected 2 workspaces, got %+v, %v", workspaces, err)
+	}
+
+	// With two workspaces the client has to pick one.
+	if _, err := c.GetPeople(); err == nil {
+		t.Fatalf("Expected an error without a workspace")
+	}
+	if _, err := c.InWorkspace(ws.Id).CreatePerson("Alice"); err != nil {
+		t.Fatal(err)
+	}
+	people, err := c.InWorkspace(workspaces[0].Id).GetPeople()
+	if err != nil || len(people) != 0 {
+		t.Fatalf("Expected no people in the first workspace, got %+v, %v", people, err)
+	}
+
+	err = c.SetMember(ws.Id, Member{User: "nobody", Role: "viewer"})
+	if !IsNotFound(err) {
+		t.Fatalf("Expected a not found error for an unknown user, got %v", err)
+	}
+	if err := c.RemoveMember(ws.Id, "nobody"); !IsNotFound(err) {
+		t.Fatalf("Expected a not found error for an unknown user, got %v", err)
+	}
+
+	bad := New(server.URL, "wrongtoken")
+	_, err = bad.GetWorkspaces()
+	if e, ok := err.(*Error); !ok || e.StatusCode != 401 || e.Message == "" {
+		t.Fatalf("Expected a 401 error with a message, got %v", err)
+	}
+}
+
+// recorder is an http.RoundTripper that keeps the requests it makes.
+type recorder struct {
+	requests []*http.Request
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+var pathParam = regexp.MustCompile(`\\\{[^}]+\\\}`)
+
+// specOperation returns the operation in spec that a request to path with
+// method is for, along with the parameters of its path.  Paths without
+// parameters win, as the router tries them first.
+func specOperation(spec map[string]interface{}, method string, path string) (map[string]interface{}, []interface{}) {
+	paths := spec["paths"].(map[string]interface{})
+	ops, ok := paths[path].(map[string]interface{})
+	if !ok {
+		for pattern, pattern_ops := range paths {
+			re := "^" + pathParam.ReplaceAllString(regexp.QuoteMeta(pattern), "[^/]+") + "$"
+			if regexp.MustCompile(re).MatchString(path) {
+				ops = pattern_ops.(map[string]interface{})
+				break
+			}
+		}
+	}
+	op, _ := ops[strings.ToLower(method)].(map[string]interface{})
+	params, _ := ops["parameters"].([]interface{})
+	return op, params
+}
+
+// parameterNames returns the names of the query parameters in params,
+// following their $refs in spec.
+func parameterNames(spec map[string]interface{}, params []interface{}) map[string]bool {
+	names := map[string]bool{}
+	for _, p := range params {
+		p := p.(map[string]interface{})
+		if ref, ok := p["$ref"].(string); ok {
+			name := strings.TrimPrefix(ref, "#/components/parameters/")
+			p = spec["components"].(map[string]interface{})["parameters"].(map[string]interface{})[name].(map[string]interface{})
+		}
+		if p["in"] == "query" {
+			names[p["name"].(string)] = true
+		}
+	}
+	return names
+}
+
+// TestClientMatchesSpec calls every method of Client and checks the
+// requests it makes are described by the api's OpenAPI document.
+func TestClientMatchesSpec(t *testing.T) {
+	c, server := setupTest(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var spec map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{}
+	c.HTTP = &http.Client{Transport: rec}
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumMethod(); i++ {
+		name := v.Type().Method(i).Name
+		method := v.Method(i)
+		if name == "InWorkspace" {
+			continue
+		}
+		// Call it with made up arguments, as only the requests matter.
+		args := make([]reflect.Value, method.Type().NumIn())
+		for j := range args {
+			arg_type := method.Type().In(j)
+			switch arg_type.Kind() {
+			case reflect.Int64:
+				args[j] = reflect.ValueOf(int64(1))
+			case reflect.String:
+				args[j] = reflect.ValueOf("x")
+			case reflect.Ptr:
+				args[j] = reflect.New(arg_type.Elem())
+			case reflect.Map:
+				args[j] = reflect.MakeMap(arg_type)
+			default:
+				args[j] = reflect.Zero(arg_type)
+			}
+		}
+		rec.requests = nil
+		if method.Type().IsVariadic() {
+			method.CallSlice(args)
+		} else {
+			method.Call(args)
+		}
+
+		if len(rec.requests) == 0 {
+			t.Errorf("%s made no request", name)
+		}
+		for _, req := range rec.requests {
+			path := strings.TrimPrefix(req.URL.Path, "/api/1")
+			op, path_params := specOperation(spec, req.Method, path)
+			if op == nil {
+				t.Errorf("%s: %s %s isn't in the spec", name, req.Method, path)
+				continue
+			}
+			params, _ := op["parameters"].([]interface{})
+			known := parameterNames(spec, append(path_params, params...))
+			for key := range req.URL.Query() {
+				if !known[key] {
+					t.Errorf("%s: %s %s has no %q parameter in the spec", name, req.Method, path, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/hobeone/pointyhair/blob"
+)
+
+var ErrNoBlobs = errors.New("no storage for attachments has been set up")
+
+// Attachment is a file attached to a note, or to a person directly.  Its
+// content is kept in a blob.Store under BlobKey, not in the database.
+//
+// With a cipher the content is encrypted with a data key of its own, which
+// is kept in DataKey encrypted like note text, so rotating the master key
+// only has to rewrap DataKey.  Content stored before there was a cipher
+// stays unencrypted.
+type Attachment struct {
+	Id        int64      `json:"id"`
+	Workspace *Workspace `orm:"rel(fk);null" json:"-"`
+	Person    *Person    `orm:"rel(fk)" json:"-"`
+	// Nil for attachments on the person themselves
+	Note        *Note  `orm:"rel(fk);null" json:"-"`
+	Uploader    *User  `orm:"rel(fk);null" json:"-"`
+	Filename    string `orm:"size(255)" json:"filename"`
+	ContentType string `orm:"size(255)" json:"content_type"`
+	// Of the content before it was encrypted
+	Size    int64  `json:"size"`
+	BlobKey string `orm:"size(64);index" json:"-"`
+	DataKey string `orm:"type(text)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+// SetBlobs sets where the content of attachments is kept.  It must be
+// called before any copies of the handle are made with InWorkspace.
+func (dbh *DBHandle) SetBlobs(b blob.Store) {
+	dbh.blobs = b
+}
+
+// sealBlob encrypts data stored under key with a new data key if the
+// handle has a cipher, returning it and the encrypted data key.
+func (dbh *DBHandle) sealBlob(key string, data []byte) ([]byte, string, error) {
+	if dbh.cipher == nil {
+		return data, "", nil
+	}
+	data_key, err := NewKey()
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := newAEAD(data_key)
+	if err != nil {
+		return nil, "", err
+	}
+	sealed, err := seal(aead, data, []byte(key))
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := dbh.cipher.Encrypt(base64.StdEncoding.EncodeToString(data_key))
+	if err != nil {
+		return nil, "", err
+	}
+	return sealed, wrapped, nil
+}
+
+// openBlob decrypts the content of a, if it's encrypted.
+func (dbh *DBHandle) openBlob(a *Attachment, sealed []byte) ([]byte, error) {
+	if a.DataKey == "" {
+		return sealed, nil
+	}
+	if dbh.cipher == nil {
+		return nil, ErrNoKey
+	}
+	encoded, err := dbh.cipher.Decrypt(a.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	data_key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(data_key)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, sealed, []byte(a.BlobKey))
+}
+
+// CreateAttachment stores data as the content of a and creates a.  The
+// content is stored first; if creating a fails it's left for
+// RemoveOrphanedBlobs.
+func (dbh *DBHandle) CreateAttachment(a *Attachment, data []byte) error {
+	if dbh.blobs == nil {
+		return ErrNoBlobs
+	}
+	if err := dbh.checkPersonScope(a.Person); err != nil {
+		return err
+	}
+	if a.Note != nil {
+		if err := dbh.checkScope("note", a.Note.Id); err != nil {
+			return err
+		}
+	}
+	if dbh.workspace != nil {
+		a.Workspace = dbh.workspace
+	}
+	key, err := NewToken()
+	if err != nil {
+		return err
+	}
+	sealed, data_key, err := dbh.sealBlob(key, data)
+	if err != nil {
+		return err
+	}
+	if err := dbh.blobs.Put(key, sealed); err != nil {
+		return err
+	}
+	a.BlobKey = key
+	a.DataKey = data_key
+	a.Size = int64(len(data))
+	a.CreatedAt = now()
+	a.UpdatedAt = a.CreatedAt
+	_, err = dbh.ORM.Insert(a)
+	return err
+}
+
+func (dbh *DBHandle) GetAttachmentById(id int64) (*Attachment, error) {
+	a := Attachment{}
+	if err := dbh.table("attachment").Filter("id", id).One(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetAttachments returns all of p's attachments, including those on
+// their notes, oldest first.
+func (dbh *DBHandle) GetAttachments(p *Person) ([]*Attachment, error) {
+	var as []*Attachment
+	_, err := dbh.table("attachment").Filter("person_id", p.Id).OrderBy("id").Limit(-1).All(&as)
+	return as, err
+}
+
+func (dbh *DBHandle) GetNoteAttachments(n *Note) ([]*Attachment, error) {
+	var as []*Attachment
+	_, err := dbh.table("attachment").Filter("note_id", n.Id).OrderBy("id").Limit(-1).All(&as)
+	return as, err
+}
+
+// GetAttachmentData returns the content of a.
+func (dbh *DBHandle) GetAttachmentData(a *Attachment) ([]byte, error) {
+	if dbh.blobs == nil {
+		return nil, ErrNoBlobs
+	}
+	sealed, err := dbh.blobs.Get(a.BlobKey)
+	if err == blob.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dbh.openBlob(a, sealed)
+}
+
+// RemoveAttachment removes a.  Its content is left for
+// RemoveOrphanedBlobs, so that it's still there if the transaction a is
+// removed in is rolled back.
+func (dbh *DBHandle) RemoveAttachment(a *Attachment) error {
+	if err := dbh.checkScope("attachment", a.Id); err != nil {
+		return err
+	}
+	_, err := dbh.ORM.Delete(&Attachment{Id: a.Id})
+	return err
+}
+
+// RemoveOrphanedBlobs removes the stored content that no attachment in any
+// workspace has any more, like that of removed notes' attachments.  Only
+// content stored before the given time is removed, so that attachments
+// being created aren't removed before their row is.  It returns how many
+// were removed.
+func (dbh *DBHandle) RemoveOrphanedBlobs(before time.Time) (int, error) {
+	if dbh.blobs == nil {
+		return 0, nil
+	}
+	var rows []*Attachment
+	if _, err := dbh.ORM.QueryTable("attachment").Limit(-1).All(&rows, "BlobKey"); err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool, len(rows))
+	for _, a := range rows {
+		used[a.BlobKey] = true
+	}
+	var keys []string
+	err := dbh.blobs.Walk(func(key string, put time.Time) error {
+		if !used[key] && put.Before(before) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := dbh.blobs.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,144 @@
+package db_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/blob"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func TestAttachments(t *testing.T) {
+	path, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	blobs, err := blob.NewDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbh := db.SetupTestDB(t)
+	old_cipher, old_key := db.NewTestCipher(t)
+	dbh.SetCipher(old_cipher)
+	dbh.SetBlobs(blobs)
+	stores := map[string]db.Store{"sqlite3": dbh, "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			u := &db.User{Name: "attachments"}
+			if err := store.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+			ws := &db.Workspace{Name: "attachments"}
+			if err := store.CreateWorkspace(ws, u); err != nil {
+				t.Fatal(err)
+			}
+			scoped := store.InWorkspace(ws)
+			p := &db.Person{Name: "attached"}
+			if err := scoped.CreatePerson(p); err != nil {
+				t.Fatal(err)
+			}
+			n := &db.Note{Person: p, Text: "see attached"}
+			if err := scoped.CreateNote(n); err != nil {
+				t.Fatal(err)
+			}
+			offer := []byte("%PDF-1.4 offer letter")
+			on_note := &db.Attachment{Person: p, Note: n, Uploader: u, Filename: "offer.pdf", ContentType: "application/pdf"}
+			on_person := &db.Attachment{Person: p, Uploader: u, Filename: "photo.png", ContentType: "image/png"}
+			if err := scoped.CreateAttachment(on_note, offer); err != nil {
+				t.Fatal(err)
+			}
+			if err := scoped.CreateAttachment(on_person, []byte("png")); err != nil {
+				t.Fatal(err)
+			}
+			if on_note.Size != int64(len(offer)) || on_note.BlobKey == "" {
+				t.Errorf("Expected the size and blob key to be set, got %+v", on_note)
+			}
+			if store == dbh {
+				raw, err := blobs.Get(on_note.BlobKey)
+				if err != nil || bytes.Contains(raw, []byte("offer letter")) || !db.IsEncrypted(on_note.DataKey) {
+					t.Errorf("Expected the content to be encrypted, got %q, %v", raw, err)
+				}
+			}
+
+			other := store.InWorkspace(&db.Workspace{Id: ws.Id + 100})
+			if _, err := other.GetAttachmentById(on_note.Id); err != db.ErrNotFound {
+				t.Errorf("Expected the attachment to be hidden from other workspaces, got %v", err)
+			}
+			if as, err := scoped.GetAttachments(p); err != nil || len(as) != 2 || as[0].Id != on_note.Id {
+				t.Errorf("Expected both of the person's attachments, got %+v, %v", as, err)
+			}
+			if as, err := scoped.GetNoteAttachments(n); err != nil || len(as) != 1 || as[0].Filename != "offer.pdf" {
+				t.Errorf("Expected the note's attachment, got %+v, %v", as, err)
+			}
+			a, err := scoped.GetAttachmentById(on_note.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := scoped.GetAttachmentData(a); err != nil || !bytes.Equal(data, offer) {
+				t.Errorf("Expected the content back, got %q, %v", data, err)
+			}
+
+			if store == dbh {
+				new_cipher, _ := db.NewTestCipher(t, old_key)
+				if _, err := dbh.RotateKey(new_cipher); err != nil {
+					t.Fatal(err)
+				}
+				a, _ := dbh.GetAttachmentById(on_note.Id)
+				if a.DataKey == on_note.DataKey {
+					t.Errorf("Expected the data key to be rewrapped")
+				}
+				if data, err := dbh.GetAttachmentData(a); err != nil || !bytes.Equal(data, offer) {
+					t.Errorf("Expected the content to be readable with the new key, got %q, %v", data, err)
+				}
+			}
+
+			// Moving the note to someone else moves its attachment too.
+			moved_to := &db.Person{Name: "reassigned"}
+			if err := scoped.CreatePerson(moved_to); err != nil {
+				t.Fatal(err)
+			}
+			n.Person = moved_to
+			if err := scoped.UpdateNote(n); err != nil {
+				t.Fatal(err)
+			}
+			if as, err := scoped.GetAttachments(moved_to); err != nil || len(as) != 1 || as[0].Id != on_note.Id {
+				t.Errorf("Expected the note's attachment to move with it, got %+v, %v", as, err)
+			}
+			if as, err := scoped.GetAttachments(p); err != nil || len(as) != 1 || as[0].Id != on_person.Id {
+				t.Errorf("Expected only the person's own attachment to stay, got %+v, %v", as, err)
+			}
+
+			// Removing the note orphans its attachment's content.
+			if err := scoped.RemoveNote(n); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := scoped.GetAttachmentById(on_note.Id); err != db.ErrNotFound {
+				t.Errorf("Expected the note's attachment to be removed with it, got %v", err)
+			}
+			if removed, err := store.RemoveOrphanedBlobs(time.Now().Add(-time.Hour)); err != nil || removed != 0 {
+				t.Errorf("Expected content stored since then to be kept, got %d, %v", removed, err)
+			}
+			if removed, err := store.RemoveOrphanedBlobs(time.Now().Add(time.Second)); err != nil || removed != 1 {
+				t.Errorf("Expected the orphaned content to be removed, got %d, %v", removed, err)
+			}
+			if _, err := scoped.GetAttachmentData(on_note); err != db.ErrNotFound {
+				t.Errorf("Expected the orphaned content to be gone, got %v", err)
+			}
+			if data, err := scoped.GetAttachmentData(on_person); err != nil || string(data) != "png" {
+				t.Errorf("Expected the person's attachment to be kept, got %q, %v", data, err)
+			}
+
+			if err := scoped.RemoveAttachment(on_person); err != nil {
+				t.Fatal(err)
+			}
+			if removed, err := store.RemoveOrphanedBlobs(time.Now().Add(time.Second)); err != nil || removed != 1 {
+				t.Errorf("Expected the removed attachment's content to be removed, got %d, %v", removed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Note and todo text is optionally encrypted at rest with envelope
+// encryption: every value gets its own random data key which encrypts the
+// text with AES-GCM, and the data key is itself encrypted ("wrapped") with
+// the master key.  Rotating the master key only has to rewrap the data keys.
+//
+// Encrypted values are stored in the text column as
+//
+//	pointyhair:v1:<key id>:<wrapped data key>:<ciphertext>
+//
+// with the last two base64 encoded.  The database only ever sees
+// ciphertext, so it can't search or sort on encrypted text; anything that
+// searches note or todo text has to do it after the getters have decrypted
+// it.
+const encryptedPrefix = "pointyhair:v1:"
+
+// KeySize is the size in bytes of master keys.
+const KeySize = 32
+
+var ErrNoKey = errors.New("text is encrypted and no key to decrypt it was given")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Cipher encrypts text with its current master key and decrypts text
+// encrypted with the current key or any of the old ones.
+type Cipher struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+// NewCipher returns a Cipher that encrypts with key and can also decrypt
+// text encrypted with any of old_keys.
+func NewCipher(key []byte, old_keys ...[]byte) (*Cipher, error) {
+	c := &Cipher{keys: map[string]*masterKey{}}
+	for i, k := range append([][]byte{key}, old_keys...) {
+		mk, err := newMasterKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			c.current = mk
+		}
+		c.keys[mk.id] = mk
+	}
+	return c, nil
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Encryption keys must be %d bytes, got %d", KeySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewKey returns a new random master key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseKey decodes a base64 encoded master key, as made by
+// `openssl rand -base64 32`.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %s", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Encryption keys must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadKeyFile reads a base64 encoded master key from path.
+func LoadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(b))
+}
+
+// IsEncrypted returns true if s was made by Cipher.Encrypt.
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, encryptedPrefix)
+}
+
+func seal(aead cipher.AEAD, plain []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Encrypted value is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], additional)
+}
+
+// wrap encrypts data_key with the current master key.
+func (c *Cipher) wrap(data_key []byte) (string, error) {
+	wrapped, err := seal(c.current.aead, data_key, []byte(c.current.id))
+	if err != nil {
+		return "", err
+	}
+	return c.current.id + ":" + base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// unwrap splits an encrypted value into its data key and ciphertext.
+func (c *Cipher) unwrap(s string) ([]byte, string, error) {
+	parts := strings.Split(strings.TrimPrefix(s, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, "", errors.New("Malformed encrypted value")
+	}
+	mk, ok := c.keys[parts[0]]
+	if !ok {
+		return nil, "", fmt.Errorf("Text is encrypted with unknown key %s", parts[0])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, "", err
+	}
+	data_key, err := open(mk.aead, wrapped, []byte(mk.id))
+	if err != nil {
+		return nil, "", fmt.Errorf("Can't decrypt data key: %s", err)
+	}
+	return data_key, parts[2], nil
+}
+
+// Encrypt encrypts plain with a new data key.
+func (c *Cipher) Encrypt(plain string) (string, error) {
+	data_key, err := NewKey()
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(data_key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, []byte(plain), nil)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := c.wrap(data_key)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + wrapped + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the text s was made from.  Text that isn't encrypted is
+// returned as is.
+func (c *Cipher) Decrypt(s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	data_key, ciphertext, err := c.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(data_key)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(aead, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("Can't decrypt text: %s", err)
+	}
+	return string(plain), nil
+}
+
+// Rewrap returns s with its data key wrapped with the current master key.
+// Text that isn't encrypted yet is encrypted.
+func (c *Cipher) Rewrap(s string) (string, error) {
+	if !IsEncrypted(s) {
+		return c.Encrypt(s)
+	}
+	data_key, ciphertext, err := c.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := c.wrap(data_key)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + wrapped + ":" + ciphertext, nil
+}
+
+// SetCipher turns on encryption of note and todo text written through the
+// handle.  It must be called before any copies of the handle are made with
+// InWorkspace.
+func (dbh *DBHandle) SetCipher(c *Cipher) {
+	dbh.cipher = c
+}
+
+// sealText encrypts *text in place if the handle has a cipher.  The
+// returned func puts the plaintext back, so callers' structs are only
+// changed while they are being written.
+func (dbh *DBHandle) sealText(text *string) (func(), error) {
+	plain := *text
+	restore := func() { *text = plain }
+	if dbh.cipher == nil {
+		return restore, nil
+	}
+	sealed, err := dbh.cipher.Encrypt(plain)
+	if err != nil {
+		return restore, err
+	}
+	*text = sealed
+	return restore, nil
+}
+
+// openText decrypts *text in place if it's encrypted.
+func (dbh *DBHandle) openText(text *string) error {
+	if !IsEncrypted(*text) {
+		return nil
+	}
+	if dbh.cipher == nil {
+		return ErrNoKey
+	}
+	plain, err := dbh.cipher.Decrypt(*text)
+	if err != nil {
+		return err
+	}
+	*text = plain
+	return nil
+}
+
+func (dbh *DBHandle) openNotes(notes []*Note) error {
+	for _, n := range notes {
+		if err := dbh.openText(&n.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbh *DBHandle) openTodos(todos []*Todo) error {
+	for _, t := range todos {
+		if err := dbh.openText(&t.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateKey rewraps the data key of every note, todo, webhook delivery and
+// encrypted attachment, in every workspace, with the current key of c and
+// encrypts any text that isn't encrypted yet.  c must also hold the old
+// keys.  The handle uses c afterwards.
+func (dbh *DBHandle) RotateKey(c *Cipher) (int, error) {
+	count := 0
+	err := dbh.WithTx(func(tx *Tx) error {
+		var notes []*Note
+		if _, err := tx.ORM.QueryTable("note").All(&notes, "Id", "Text"); err != nil {
+			return err
+		}
+		for _, n := range notes {
+			text, err := c.Rewrap(n.Text)
+			if err != nil {
+				return fmt.Errorf("Note %d: %s", n.Id, err)
+			}
+			n.Text = text
+			if _, err := tx.ORM.Update(n, "Text"); err != nil {
+				return err
+			}
+		}
+
+		var todos []*Todo
+		if _, err := tx.ORM.QueryTable("todo").All(&todos, "Id", "Text"); err != nil {
+			return err
+		}
+		for _, t := range todos {
+			text, err := c.Rewrap(t.Text)
+			if err != nil {
+				return fmt.Errorf("Todo %d: %s", t.Id, err)
+			}
+			t.Text = text
+			if _, err := tx.ORM.Update(t, "Text"); err != nil {
+				return err
+			}
+		}
+
+		var deliveries []*WebhookDelivery
+		if _, err := tx.ORM.QueryTable("webhook_delivery").Limit(-1).All(&deliveries, "Id", "Payload"); err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			payload, err := c.Rewrap(d.Payload)
+			if err != nil {
+				return fmt.Errorf("Webhook delivery %d: %s", d.Id, err)
+			}
+			d.Payload = payload
+			if _, err := tx.ORM.Update(d, "Payload"); err != nil {
+				return err
+			}
+		}
+
+		// Attachments stored without a cipher have no data key to rewrap.
+		var attachments []*Attachment
+		if _, err := tx.ORM.QueryTable("attachment").Exclude("data_key", "").Limit(-1).All(&attachments, "Id", "DataKey"); err != nil {
+			return err
+		}
+		for _, a := range attachments {
+			data_key, err := c.Rewrap(a.DataKey)
+			if err != nil {
+				return fmt.Errorf("Attachment %d: %s", a.Id, err)
+			}
+			a.DataKey = data_key
+			if _, err := tx.ORM.Update(a, "DataKey"); err != nil {
+				return err
+			}
+		}
+		count = len(notes) + len(todos) + len(deliveries) + len(attachments)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	dbh.cipher = c
+	return count, nil
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCipher(t *testing.T, old_keys ...[]byte) (*Cipher, []byte) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCipher(key, old_keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, key
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, _ := newTestCipher(t)
+	for _, plain := range []string{"", "raise to 120k", "pointyhair:v1: looks encrypted"} {
+		sealed, err := c.Encrypt(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(sealed) || (plain != "" && strings.Contains(sealed, plain)) {
+			t.Fatalf("Expected %q to be encrypted, got %q", plain, sealed)
+		}
+		again, _ := c.Encrypt(plain)
+		if again == sealed {
+			t.Fatalf("Expected every encryption to use a new data key and nonce")
+		}
+		opened, err := c.Decrypt(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened != plain {
+			t.Fatalf("Expected %q, got %q", plain, opened)
+		}
+	}
+
+	if s, err := c.Decrypt("plain text"); err != nil || s != "plain text" {
+		t.Fatalf("Expected plaintext to be returned as is, got %q, %v", s, err)
+	}
+
+	other, _ := newTestCipher(t)
+	sealed, _ := c.Encrypt("secret")
+	if _, err := other.Decrypt(sealed); err == nil {
+		t.Fatalf("Expected decrypting with the wrong key to fail")
+	}
+	tampered := sealed[:len(sealed)-4] + "AAA="
+	if _, err := c.Decrypt(tampered); err == nil {
+		t.Fatalf("Expected decrypting tampered text to fail")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, _ := NewKey()
+	parsed, err := ParseKey(base64.StdEncoding.EncodeToString(key) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parsed) != string(key) {
+		t.Fatalf("Parsed key doesn't match")
+	}
+	if _, err := ParseKey(base64.StdEncoding.EncodeToString(key[:16])); err == nil {
+		t.Fatalf("Expected short keys to be rejected")
+	}
+	if _, err := ParseKey("not base64!"); err == nil {
+		t.Fatalf("Expected invalid base64 to be rejected")
+	}
+}
+
+// rawText returns what is stored in the text column of the given row.
+func rawText(t *testing.T, dbh *DBHandle, table string, id int64) string {
+	var text string
+	err := dbh.ORM.Raw("SELECT text FROM "+table+" WHERE id = ?", id).QueryRow(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+func TestEncryptedNotesAndTodos(t *testing.T) {
+	dbh := setupTestDB(t)
+	c, _ := newTestCipher(t)
+	dbh.SetCipher(c)
+
+	p := &Person{Name: "encrypted"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+	n := &Note{Person: p, Text: "health disclosure", Date: time.Now()}
+	if err := dbh.CreateNote(n); err != nil {
+		t.Fatal(err)
+	}
+	todo := &Todo{Person: p, Text: "discuss raise", Date: time.Now()}
+	if err := dbh.CreateTodo(todo); err != nil {
+		t.Fatal(err)
+	}
+	if n.Text != "health disclosure" || todo.Text != "discuss raise" {
+		t.Fatalf("Expected callers' text to be left as plaintext, got %q and %q", n.Text, todo.Text)
+	}
+	if raw := rawText(t, dbh, "note", n.Id); !IsEncrypted(raw) {
+		t.Fatalf("Expected note text to be encrypted in the database, got %q", raw)
+	}
+	if raw := rawText(t, dbh, "todo", todo.Id); !IsEncrypted(raw) {
+		t.Fatalf("Expected todo text to be encrypted in the database, got %q", raw)
+	}
+
+	n.Text = "changed"
+	if err := dbh.UpdateNote(n); err != nil {
+		t.Fatal(err)
+	}
+	if raw := rawText(t, dbh, "note", n.Id); !IsEncrypted(raw) {
+		t.Fatalf("Expected updated note text to be encrypted, got %q", raw)
+	}
+
+	got, err := dbh.GetNoteById(n.Id)
+	if err != nil || got.Text != "changed" {
+		t.Fatalf("Expected decrypted note text, got %+v, %v", got, err)
+	}
+	notes, err := dbh.GetNotesById([]int64{})
+	if err != nil || len(notes) != 1 || notes[0].Text != "changed" {
+		t.Fatalf("Expected decrypted notes, got %+v, %v", notes, err)
+	}
+	got_todo, err := dbh.GetTodoById(todo.Id)
+	if err != nil || got_todo.Text != "discuss raise" {
+		t.Fatalf("Expected decrypted todo text, got %+v, %v", got_todo, err)
+	}
+	if err := dbh.LoadPersonRelations(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Notes[0].Text != "changed" || p.Todos[0].Text != "discuss raise" {
+		t.Fatalf("Expected decrypted relations, got %q and %q", p.Notes[0].Text, p.Todos[0].Text)
+	}
+
+	dbh.SetCipher(nil)
+	if _, err := dbh.GetNoteById(n.Id); err != ErrNoKey {
+		t.Fatalf("Expected %v reading encrypted text without a key, got %v", ErrNoKey, err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "rotate"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+	// Written before encryption was turned on.
+	plain := &Note{Person: p, Text: "old plaintext", Date: time.Now()}
+	if err := dbh.CreateNote(plain); err != nil {
+		t.Fatal(err)
+	}
+
+	old_cipher, old_key := newTestCipher(t)
+	dbh.SetCipher(old_cipher)
+	sealed := &Todo{Person: p, Text: "old key", Date: time.Now()}
+	if err := dbh.CreateTodo(sealed); err != nil {
+		t.Fatal(err)
+	}
+	before := rawText(t, dbh, "todo", sealed.Id)
+
+	new_cipher, new_key := newTestCipher(t, old_key)
+	count, err := dbh.RotateKey(new_cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 rows to be rotated, got %d", count)
+	}
+
+	after := rawText(t, dbh, "todo", sealed.Id)
+	if after == before || !IsEncrypted(after) {
+		t.Fatalf("Expected todo to be rewrapped, got %q", after)
+	}
+	// The ciphertext itself doesn't change, only the wrapped data key.
+	if before[strings.LastIndex(before, ":"):] != after[strings.LastIndex(after, ":"):] {
+		t.Fatalf("Expected only the data key to be rewrapped")
+	}
+	if raw := rawText(t, dbh, "note", plain.Id); !IsEncrypted(raw) {
+		t.Fatalf("Expected plaintext note to be encrypted by rotation, got %q", raw)
+	}
+
+	// Only the new key is needed from now on.
+	only_new, err := NewCipher(new_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbh.SetCipher(only_new)
+	if n, err := dbh.GetNoteById(plain.Id); err != nil || n.Text != "old plaintext" {
+		t.Fatalf("Expected note readable with the new key, got %+v, %v", n, err)
+	}
+	if todo, err := dbh.GetTodoById(sealed.Id); err != nil || todo.Text != "old key" {
+		t.Fatalf("Expected todo readable with the new key, got %+v, %v", todo, err)
+	}
+	dbh.SetCipher(old_cipher)
+	if _, err := dbh.GetTodoById(sealed.Id); err == nil {
+		t.Fatalf("Expected the old key to no longer work")
+	}
+}
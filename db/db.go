@@ -1,12 +1,17 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/astaxie/beego/orm"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
+	"github.com/hobeone/pointyhair/blob"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -16,48 +21,116 @@ type RecurringTodo struct {
 	Subject    string
 }
 
+// now is the time rows are created and updated at, to the second as that's
+// all datetime columns keep.
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
 type DBHandle struct {
 	ORM       orm.Ormer
-	syncMutex sync.Mutex
+	Alias     string
+	sqlDB     *sql.DB
+	workspace *Workspace
+	// Set on the copies InTx hands out, whose ORM is inside tx
+	tx *Tx
+	// Encrypts note and todo text if set
+	cipher *Cipher
+	// Where the content of attachments is kept
+	blobs blob.Store
 }
 
-func NewDBHandle(db_path string, verbose bool) (*DBHandle, error) {
-	d := &DBHandle{}
-	err, o := createAndOpenDB(db_path, verbose, false)
-	if err != nil {
-		return nil, err
-	}
-	d.ORM = o
-	return d, nil
+// NewDBHandle opens (and creates if needed) the database described by dsn.
+// A dsn starting with postgres:// or postgresql:// is handed to the Postgres
+// driver as is, anything else is taken as the path of a sqlite3 database
+// file.
+func NewDBHandle(dsn string, verbose bool) (*DBHandle, error) {
+	driver, source := parseDSN(dsn)
+	return createAndOpenDB(driver, source, verbose)
 }
 
+// NewMemoryDBHandle opens a new, empty, in-memory sqlite3 database.  Every
+// handle gets its own database, even if db_path is reused.
 func NewMemoryDBHandle(db_path string, verbose bool) (*DBHandle, error) {
-	d := &DBHandle{}
-	err, o := createAndOpenDB(db_path, verbose, true)
-	if err != nil {
-		return nil, err
+	// A memory database lives and dies with its connection, a second one
+	// would open an empty database of its own.  So the handle has only the
+	// one and everything on it takes turns using it: a WithTx callback that
+	// goes through the handle rather than its Tx waits for itself forever.
+	return createAndOpenDB("sqlite3", fmt.Sprintf("file:%s?mode=memory", db_path), verbose, 1, 1)
+}
+
+// parseDSN returns the database/sql driver name and data source for dsn.
+//
+// sqlite3 files are opened in WAL mode so reads aren't held up by a
+// transaction writing at the same time.  Transactions take the write lock
+// when they begin, and whoever doesn't get it waits for up to
+// sqliteBusyTimeout instead of failing straight away.
+func parseDSN(dsn string) (string, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres", dsn
 	}
-	d.ORM = o
-	return d, nil
+	return "sqlite3", fmt.Sprintf("file:%s?mode=rwc&_journal_mode=WAL&_txlock=immediate&_busy_timeout=%d",
+		strings.TrimPrefix(dsn, "sqlite3://"), sqliteBusyTimeout/time.Millisecond)
 }
 
-func createAndOpenDB(db_path string, verbose bool, memory bool) (error, orm.Ormer) {
+// sqliteBusyTimeout is how long a sqlite3 file connection waits for another
+// one to let go of the write lock.
+const sqliteBusyTimeout = 5 * time.Second
 
-	mode := "rwc"
-	if memory {
-		mode = "memory"
+var (
+	aliasMutex sync.Mutex
+	aliasCount int
+)
+
+// createAndOpenDB registers the database under an alias of its own so any
+// number of handles can be open at once.  beego refuses to work without a
+// "default" alias so the first database opened also gets registered as
+// that, but nothing in this package uses it.
+func createAndOpenDB(driver string, source string, verbose bool, conns ...int) (*DBHandle, error) {
+	aliasMutex.Lock()
+	defer aliasMutex.Unlock()
+
+	aliasCount++
+	d := &DBHandle{
+		Alias: fmt.Sprintf("pointyhair%d", aliasCount),
 	}
-	db_path_ext := fmt.Sprintf("file:%s?mode=%s", db_path, mode)
 
-	orm.RegisterDataBase("default", "sqlite3", db_path_ext)
+	err := orm.RegisterDataBase(d.Alias, driver, source, conns...)
+	if err != nil {
+		return nil, err
+	}
+	d.sqlDB, err = orm.GetDB(d.Alias)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := orm.GetDB("default"); err != nil {
+		err = orm.AddAliasWthDB("default", driver, d.sqlDB)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
 	orm.Debug = verbose
 
-	err := orm.RunSyncdb("default", false, verbose)
+	err = orm.RunSyncdb(d.Alias, false, verbose)
 	if err != nil {
-		return err, nil
+		d.Close()
+		return nil, err
 	}
 
-	return nil, orm.NewOrm()
+	d.ORM = orm.NewOrm()
+	err = d.ORM.Using(d.Alias)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Close closes the handle's connections.  beego has no way of unregistering
+// an alias so the handle's alias is never reused.
+func (dbh *DBHandle) Close() error {
+	return dbh.sqlDB.Close()
 }
 
 func init() {
@@ -65,6 +138,14 @@ func init() {
 	orm.RegisterModel(new(Note))
 	orm.RegisterModel(new(Todo))
 	orm.RegisterModel(new(RecurringTodo))
+	orm.RegisterModel(new(Workspace))
+	orm.RegisterModel(new(User))
+	orm.RegisterModel(new(Membership))
+	orm.RegisterModel(new(NoteShare))
+	orm.RegisterModel(new(Webhook))
+	orm.RegisterModel(new(WebhookDelivery))
+	orm.RegisterModel(new(Attachment))
+	orm.RegisterModel(new(NoteTemplate))
 }
 
 func Demo() {
@@ -94,6 +175,7 @@ func Demo() {
 		Person:   &p1,
 		Text:     "testing\nfoo",
 		Category: "test",
+		Date:     time.Now(),
 	}
 
 	_, err = dbh.ORM.Insert(&n1)
@@ -1,9 +1,203 @@
 package db
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+// testDSNEnv names the environment variable holding the DSN to run the db
+// tests against.  When it's empty the tests use an in-memory sqlite3
+// database and then, if a Postgres server can be started locally, run again
+// against that (see postgres_test.go).
+const testDSNEnv = "POINTYHAIR_TEST_DSN"
+
+// requirePostgresEnv names the environment variable that, when set, makes
+// the tests fail instead of skipping the Postgres run if no Postgres server
+// can be started.
+const requirePostgresEnv = "POINTYHAIR_TEST_REQUIRE_PG"
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if os.Getenv(testDSNEnv) != "" {
+		os.Exit(code)
+	}
+	// Run against Postgres even if sqlite failed, so both results are seen.
+	pg_code, ran := runWithLocalPostgres()
+	pg_result := "skipped"
+	if ran {
+		pg_result = testResult(pg_code)
+	} else if os.Getenv(requirePostgresEnv) != "" {
+		pg_code = 1
+		pg_result = "FAIL (no initdb and pg_ctl found)"
+	}
+	fmt.Printf("sqlite3: %s, postgres: %s\n", testResult(code), pg_result)
+	if code == 0 {
+		code = pg_code
+	}
+	os.Exit(code)
+}
+
+func testResult(code int) string {
+	if code == 0 {
+		return "ok"
+	}
+	return "FAIL"
+}
+
+// setupTestDB returns a handle to an empty test database.
+func setupTestDB(t *testing.T) *DBHandle {
+	var dbh *DBHandle
+	var err error
+	if dsn := os.Getenv(testDSNEnv); dsn != "" {
+		dbh, err = NewDBHandle(dsn, false)
+	} else {
+		dbh, err = NewMemoryDBHandle("testing", false)
+	}
+	if err != nil {
+		t.Fatalf("Couldn't set up the test database: %s", err)
+	}
+
+	// Every table the schema creates, the ones pointing at others first.
+	tables := []string{"webhook_delivery", "webhook", "attachment", "note_template", "note_share", "note", "todo", "recurring_todo", "person", "membership", "workspace", "user"}
+	for _, table := range tables {
+		if _, err := dbh.ORM.QueryTable(table).Filter("id__gte", 0).Delete(); err != nil {
+			t.Fatalf("Error clearing table %s: %s", table, err)
+		}
+	}
+	return dbh
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn    string
+		driver string
+		source string
+	}{
+		{"test.sql", "sqlite3", "file:test.sql?mode=rwc&_journal_mode=WAL&_txlock=immediate&_busy_timeout=5000"},
+		{"sqlite3:///var/lib/pointyhair.db", "sqlite3", "file:/var/lib/pointyhair.db?mode=rwc&_journal_mode=WAL&_txlock=immediate&_busy_timeout=5000"},
+		{"postgres://ph@localhost/ph?sslmode=disable", "postgres", "postgres://ph@localhost/ph?sslmode=disable"},
+		{"postgresql://localhost/ph", "postgres", "postgresql://localhost/ph"},
+	}
+	for _, test := range tests {
+		driver, source := parseDSN(test.dsn)
+		if driver != test.driver || source != test.source {
+			t.Errorf("parseDSN(%q) = %q, %q; expected %q, %q",
+				test.dsn, driver, source, test.driver, test.source)
+		}
+	}
+}
+
 func TestMe(t *testing.T) {
+	if os.Getenv(testDSNEnv) != "" {
+		t.Skip("Demo always uses an in-memory sqlite3 database")
+	}
 	Demo()
 }
+
+func TestHandlesAreIndependent(t *testing.T) {
+	a, err := NewMemoryDBHandle("testing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewMemoryDBHandle("testing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if a.Alias == b.Alias {
+		t.Fatalf("Expected handles to have different aliases, both are %s", a.Alias)
+	}
+
+	if err := a.CreatePerson(&Person{Name: "only in a"}); err != nil {
+		t.Fatal(err)
+	}
+	people, err := b.GetPeopleById([]int64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 0 {
+		t.Fatalf("Expected no people in second handle, got %d", len(people))
+	}
+
+	// The same name can be used in both databases.
+	if err := b.CreatePerson(&Person{Name: "only in a"}); err != nil {
+		t.Fatalf("Error creating person in second handle: %s", err)
+	}
+}
+
+func TestParallelHandles(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Run(fmt.Sprintf("handle%d", i), func(t *testing.T) {
+			t.Parallel()
+			dbh, err := NewMemoryDBHandle("parallel", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbh.Close()
+
+			for j := 0; j <= i; j++ {
+				p := &Person{Name: fmt.Sprintf("person%d", j)}
+				if err := dbh.CreatePerson(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			people, err := dbh.GetPeopleById([]int64{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(people) != i+1 {
+				t.Fatalf("Expected %d people, got %d", i+1, len(people))
+			}
+		})
+	}
+}
+
+func TestReadDuringWithTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pointyhair-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbh, err := NewDBHandle(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+
+	p := &Person{Name: "reader"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	in_tx := make(chan bool)
+	read := make(chan error, 1)
+	go func() {
+		<-in_tx
+		_, err := dbh.GetPersonById(p.Id)
+		read <- err
+	}()
+	err = dbh.WithTx(func(tx *Tx) error {
+		todo := Todo{Person: p, Text: "written in tx", Date: time.Now()}
+		if _, err := tx.ORM.Insert(&todo); err != nil {
+			return err
+		}
+		close(in_tx)
+		select {
+		case err := <-read:
+			return err
+		case <-time.After(time.Second):
+			return errors.New("read didn't finish while the transaction was open")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1336 @@
+// Package dbtest has an in-memory db.Store for tests that don't need a
+// real database.
+package dbtest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+// FakeStore is an in-memory Store for tests that don't need a real
+// database.  Like the ORM it only fills in the Id of related people when
+// returning notes and todos.
+type FakeStore struct {
+	*fakeData
+	workspace *db.Workspace
+}
+
+// fakeData is shared between a FakeStore and the copies returned by
+// InWorkspace.
+type fakeData struct {
+	mu             sync.Mutex
+	lastPerson     int64
+	lastNote       int64
+	lastTodo       int64
+	lastUser       int64
+	lastWorkspace  int64
+	lastMembership int64
+	lastWebhook    int64
+	lastDelivery   int64
+	lastAttachment int64
+	lastTemplate   int64
+	people         map[int64]db.Person
+	notes          map[int64]db.Note
+	todos          map[int64]db.Todo
+	users          map[int64]db.User
+	workspaces     map[int64]db.Workspace
+	memberships    map[int64]db.Membership
+	webhooks       map[int64]db.Webhook
+	deliveries     map[int64]db.WebhookDelivery
+	attachments    map[int64]db.Attachment
+	templates      map[int64]db.NoteTemplate
+	// Attachment content by blob key.  Like a real blob.Store it isn't
+	// rolled back with the rest.
+	blobs map[string]fakeBlob
+}
+
+type fakeBlob struct {
+	data []byte
+	put  time.Time
+}
+
+var _ db.Store = (*FakeStore)(nil)
+
+func NewFakeStore() *FakeStore {
+	return &FakeStore{
+		fakeData: &fakeData{
+			people:      map[int64]db.Person{},
+			notes:       map[int64]db.Note{},
+			todos:       map[int64]db.Todo{},
+			users:       map[int64]db.User{},
+			workspaces:  map[int64]db.Workspace{},
+			memberships: map[int64]db.Membership{},
+			webhooks:    map[int64]db.Webhook{},
+			deliveries:  map[int64]db.WebhookDelivery{},
+			attachments: map[int64]db.Attachment{},
+			templates:   map[int64]db.NoteTemplate{},
+			blobs:       map[string]fakeBlob{},
+		},
+	}
+}
+
+func (s *FakeStore) InWorkspace(ws *db.Workspace) db.Store {
+	return &FakeStore{fakeData: s.fakeData, workspace: ws}
+}
+
+// InTx runs f on s and puts everything back the way it was if f fails or
+// panics.  Unlike a real transaction, others using the store see f's
+// changes before it returns.
+func (s *FakeStore) InTx(f func(s db.Store) error) (err error) {
+	s.mu.Lock()
+	saved := s.fakeData.copy()
+	s.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.mu.Lock()
+			s.restore(saved)
+			s.mu.Unlock()
+			panic(r)
+		}
+	}()
+
+	err = f(s)
+	if err != nil {
+		s.mu.Lock()
+		s.restore(saved)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// copy returns a copy of d's rows and counters.  Stored rows are only ever
+// replaced, never changed in place, so the maps' values can be shared.
+func (d *fakeData) copy() *fakeData {
+	c := &fakeData{
+		lastPerson:     d.lastPerson,
+		lastNote:       d.lastNote,
+		lastTodo:       d.lastTodo,
+		lastUser:       d.lastUser,
+		lastWorkspace:  d.lastWorkspace,
+		lastMembership: d.lastMembership,
+		lastWebhook:    d.lastWebhook,
+		lastDelivery:   d.lastDelivery,
+		lastAttachment: d.lastAttachment,
+		lastTemplate:   d.lastTemplate,
+		people:         map[int64]db.Person{},
+		notes:          map[int64]db.Note{},
+		todos:          map[int64]db.Todo{},
+		users:          map[int64]db.User{},
+		workspaces:     map[int64]db.Workspace{},
+		memberships:    map[int64]db.Membership{},
+		webhooks:       map[int64]db.Webhook{},
+		deliveries:     map[int64]db.WebhookDelivery{},
+		attachments:    map[int64]db.Attachment{},
+		templates:      map[int64]db.NoteTemplate{},
+		blobs:          d.blobs,
+	}
+	for id, p := range d.people {
+		c.people[id] = p
+	}
+	for id, n := range d.notes {
+		c.notes[id] = n
+	}
+	for id, t := range d.todos {
+		c.todos[id] = t
+	}
+	for id, u := range d.users {
+		c.users[id] = u
+	}
+	for id, ws := range d.workspaces {
+		c.workspaces[id] = ws
+	}
+	for id, m := range d.memberships {
+		c.memberships[id] = m
+	}
+	for id, w := range d.webhooks {
+		c.webhooks[id] = w
+	}
+	for id, dl := range d.deliveries {
+		c.deliveries[id] = dl
+	}
+	for id, a := range d.attachments {
+		c.attachments[id] = a
+	}
+	for id, t := range d.templates {
+		c.templates[id] = t
+	}
+	return c
+}
+
+// restore puts back the rows and counters of a copy of d.
+func (d *fakeData) restore(c *fakeData) {
+	d.lastPerson, d.lastNote, d.lastTodo = c.lastPerson, c.lastNote, c.lastTodo
+	d.lastUser, d.lastWorkspace, d.lastMembership = c.lastUser, c.lastWorkspace, c.lastMembership
+	d.people, d.notes, d.todos = c.people, c.notes, c.todos
+	d.users, d.workspaces, d.memberships = c.users, c.workspaces, c.memberships
+	d.lastWebhook, d.lastDelivery = c.lastWebhook, c.lastDelivery
+	d.webhooks, d.deliveries = c.webhooks, c.deliveries
+	d.lastAttachment, d.attachments = c.lastAttachment, c.attachments
+	d.lastTemplate, d.templates = c.lastTemplate, c.templates
+}
+
+// visible returns true if something in ws can be seen from s.
+func (s *FakeStore) visible(ws *db.Workspace) bool {
+	if s.workspace == nil {
+		return true
+	}
+	return ws != nil && ws.Id == s.workspace.Id
+}
+
+func userRef(u *db.User) *db.User {
+	if u == nil {
+		return nil
+	}
+	return &db.User{Id: u.Id}
+}
+
+// copyNote returns a copy of n that doesn't share anything with it.
+func copyNote(n db.Note) *db.Note {
+	n.Person = personRef(n.Person)
+	n.Author = userRef(n.Author)
+	n.SharedWith = append([]int64{}, n.SharedWith...)
+	return &n
+}
+
+func workspaceRef(ws *db.Workspace) *db.Workspace {
+	if ws == nil {
+		return nil
+	}
+	return &db.Workspace{Id: ws.Id}
+}
+
+func sortedIds(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// now is the time rows are created and updated at, to the second like the
+// db package's.
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// stampTodo sets the timestamps of a new todo, and its date if it has none.
+func stampTodo(t *db.Todo) {
+	t.CreatedAt = now()
+	t.UpdatedAt = t.CreatedAt
+	if t.Date.IsZero() {
+		t.Date = t.CreatedAt
+	}
+}
+
+// listStamps are what db.ListOptions filters and orders on.
+type listStamps struct {
+	Id        int64
+	Date      time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func outside(t time.Time, after time.Time, before time.Time) bool {
+	return (!after.IsZero() && !t.After(after)) || (!before.IsZero() && !t.Before(before))
+}
+
+func compareTimes(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// listed returns the indexes of the n things o keeps, in the order it puts
+// them.  stamps returns the stamps of the i'th thing.
+func listed(o db.ListOptions, n int, stamps func(i int) listStamps) []int {
+	kept := []int{}
+	for i := 0; i < n; i++ {
+		s := stamps(i)
+		if outside(s.CreatedAt, o.CreatedAfter, o.CreatedBefore) || outside(s.UpdatedAt, o.UpdatedAfter, o.UpdatedBefore) {
+			continue
+		}
+		kept = append(kept, i)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		a, b := stamps(kept[i]), stamps(kept[j])
+		for _, col := range append(o.OrderBy, "id") {
+			c := 0
+			switch strings.TrimPrefix(col, "-") {
+			case "id":
+				switch {
+				case a.Id < b.Id:
+					c = -1
+				case a.Id > b.Id:
+					c = 1
+				}
+			case "date":
+				c = compareTimes(a.Date, b.Date)
+			case "created_at":
+				c = compareTimes(a.CreatedAt, b.CreatedAt)
+			case "updated_at":
+				c = compareTimes(a.UpdatedAt, b.UpdatedAt)
+			}
+			if strings.HasPrefix(col, "-") {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return kept
+}
+
+func personRef(p *db.Person) *db.Person {
+	if p == nil {
+		return nil
+	}
+	return &db.Person{Id: p.Id}
+}
+
+func (s *FakeStore) checkPerson(p *db.Person) error {
+	if p == nil {
+		return errors.New("no person given")
+	}
+	if existing, ok := s.people[p.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func sameWorkspace(a, b *db.Workspace) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Id == b.Id
+}
+
+func (s *FakeStore) GetPeopleById(ids []int64) ([]*db.Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ids) == 0 {
+		ids = s.personIds()
+	}
+	people := []*db.Person{}
+	for _, id := range ids {
+		if p, ok := s.people[id]; ok && s.visible(p.Workspace) {
+			people = append(people, &p)
+		}
+	}
+	return people, nil
+}
+
+func (s *FakeStore) ListPeople(o db.ListOptions) ([]*db.Person, error) {
+	people, err := s.GetPeopleById(o.Ids)
+	if err != nil {
+		return nil, err
+	}
+	kept := listed(o, len(people), func(i int) listStamps {
+		return listStamps{Id: people[i].Id, CreatedAt: people[i].CreatedAt, UpdatedAt: people[i].UpdatedAt}
+	})
+	list := make([]*db.Person, len(kept))
+	for j, i := range kept {
+		list[j] = people[i]
+	}
+	return list, nil
+}
+
+func (s *FakeStore) GetPersonById(id int64) (*db.Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.people[id]
+	if !ok || !s.visible(p.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	return &p, nil
+}
+
+func (s *FakeStore) CreatePerson(p *db.Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.workspace != nil {
+		p.Workspace = s.workspace
+	}
+	for _, existing := range s.people {
+		if existing.Name == p.Name && sameWorkspace(existing.Workspace, p.Workspace) {
+			return errors.New("UNIQUE constraint failed: person.workspace_id, person.name")
+		}
+	}
+	s.lastPerson++
+	p.Id = s.lastPerson
+	p.CreatedAt = now()
+	p.UpdatedAt = p.CreatedAt
+	s.people[p.Id] = db.Person{Id: p.Id, Name: p.Name, Email: p.Email, Workspace: workspaceRef(p.Workspace),
+		CreatedAt: p.CreatedAt, UpdatedAt: p.UpdatedAt}
+	return nil
+}
+
+func (s *FakeStore) UpdatePerson(p *db.Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.people[p.Id]
+	if !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	if existing.Version != p.Version {
+		return db.ErrConflict
+	}
+	p.Version++
+	p.UpdatedAt = now()
+	s.people[p.Id] = db.Person{Id: p.Id, Name: p.Name, Email: p.Email, Workspace: existing.Workspace, Version: p.Version,
+		CreatedAt: p.CreatedAt, UpdatedAt: p.UpdatedAt}
+	return nil
+}
+
+func (s *FakeStore) RemovePerson(p *db.Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkPerson(p); err != nil {
+		return err
+	}
+	for id, n := range s.notes {
+		if n.Person.Id == p.Id {
+			delete(s.notes, id)
+		}
+	}
+	for id, t := range s.todos {
+		if t.Person.Id == p.Id {
+			delete(s.todos, id)
+		}
+	}
+	for id, a := range s.attachments {
+		if a.Person.Id == p.Id {
+			delete(s.attachments, id)
+		}
+	}
+	delete(s.people, p.Id)
+	return nil
+}
+
+func (s *FakeStore) LoadPersonRelations(p *db.Person) error {
+	return s.LoadPeopleRelations([]*db.Person{p}, true, true)
+}
+
+func (s *FakeStore) LoadPeopleRelations(people []*db.Person, notes bool, todos bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	by_id := make(map[int64]*db.Person, len(people))
+	for _, p := range people {
+		if err := s.checkPerson(p); err != nil {
+			return err
+		}
+		by_id[p.Id] = p
+		if notes {
+			p.Notes = []*db.Note{}
+		}
+		if todos {
+			p.Todos = []*db.Todo{}
+		}
+	}
+	if notes {
+		for _, id := range s.noteIds() {
+			n := s.notes[id]
+			if p, ok := by_id[n.Person.Id]; ok {
+				p.Notes = append(p.Notes, copyNote(n))
+			}
+		}
+	}
+	if todos {
+		for _, id := range s.todoIds() {
+			t := s.todos[id]
+			if p, ok := by_id[t.Person.Id]; ok {
+				p.Todos = append(p.Todos, &t)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FakeStore) noteIds() []int64 {
+	ids := make([]int64, 0, len(s.notes))
+	for id := range s.notes {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) GetNotesById(ids []int64) ([]*db.Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ids) == 0 {
+		ids = s.noteIds()
+	}
+	notes := []*db.Note{}
+	for _, id := range ids {
+		if n, ok := s.notes[id]; ok && s.visible(n.Workspace) {
+			notes = append(notes, copyNote(n))
+		}
+	}
+	return notes, nil
+}
+
+func (s *FakeStore) ListNotes(o db.ListOptions) ([]*db.Note, error) {
+	notes, err := s.GetNotesById(o.Ids)
+	if err != nil {
+		return nil, err
+	}
+	kept := listed(o, len(notes), func(i int) listStamps {
+		return listStamps{notes[i].Id, notes[i].Date, notes[i].CreatedAt, notes[i].UpdatedAt}
+	})
+	list := make([]*db.Note, len(kept))
+	for j, i := range kept {
+		list[j] = notes[i]
+	}
+	return list, nil
+}
+
+func (s *FakeStore) GetNoteById(id int64) (*db.Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[id]
+	if !ok || !s.visible(n.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	return copyNote(n), nil
+}
+
+func (s *FakeStore) CreateNote(n *db.Note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkPerson(n.Person); err != nil {
+		return err
+	}
+	s.lastNote++
+	n.Id = s.lastNote
+	n.Workspace = s.people[n.Person.Id].Workspace
+	if n.Visibility == "" {
+		n.Visibility = db.VisibilityWorkspace
+	}
+	n.CreatedAt = now()
+	n.UpdatedAt = n.CreatedAt
+	if n.Date.IsZero() {
+		n.Date = n.CreatedAt
+	}
+	s.notes[n.Id] = *copyNote(*n)
+	return nil
+}
+
+func (s *FakeStore) UpdateNote(n *db.Note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.notes[n.Id]
+	if !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	if err := s.checkPerson(n.Person); err != nil {
+		return err
+	}
+	if existing.Version != n.Version {
+		return db.ErrConflict
+	}
+	n.Version++
+	n.UpdatedAt = now()
+	n.Workspace = s.people[n.Person.Id].Workspace
+	s.notes[n.Id] = *copyNote(*n)
+	for id, a := range s.attachments {
+		if a.Note != nil && a.Note.Id == n.Id {
+			a.Person = personRef(n.Person)
+			s.attachments[id] = a
+		}
+	}
+	return nil
+}
+
+func (s *FakeStore) RemoveNote(n *db.Note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.notes[n.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	for id, a := range s.attachments {
+		if a.Note != nil && a.Note.Id == n.Id {
+			delete(s.attachments, id)
+		}
+	}
+	delete(s.notes, n.Id)
+	return nil
+}
+
+func (s *FakeStore) todoIds() []int64 {
+	ids := make([]int64, 0, len(s.todos))
+	for id := range s.todos {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) GetTodoById(id int64) (*db.Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.todos[id]
+	if !ok || !s.visible(t.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	t.Person = personRef(t.Person)
+	return &t, nil
+}
+
+func (s *FakeStore) GetTodos() ([]*db.Todo, error) {
+	return s.GetTodosByIds(nil)
+}
+
+func (s *FakeStore) GetTodosByIds(ids []int64) ([]*db.Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ids == nil {
+		ids = s.todoIds()
+	}
+	todos := []*db.Todo{}
+	for _, id := range ids {
+		if t, ok := s.todos[id]; ok && s.visible(t.Workspace) {
+			t.Person = personRef(t.Person)
+			todos = append(todos, &t)
+		}
+	}
+	return todos, nil
+}
+
+func (s *FakeStore) ListTodos(o db.ListOptions) ([]*db.Todo, error) {
+	todos, err := s.GetTodosByIds(o.Ids)
+	if err != nil {
+		return nil, err
+	}
+	kept := listed(o, len(todos), func(i int) listStamps {
+		return listStamps{todos[i].Id, todos[i].Date, todos[i].CreatedAt, todos[i].UpdatedAt}
+	})
+	list := make([]*db.Todo, len(kept))
+	for j, i := range kept {
+		list[j] = todos[i]
+	}
+	return list, nil
+}
+
+func (s *FakeStore) CreateTodo(t *db.Todo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createTodo(t)
+}
+
+func (s *FakeStore) createTodo(t *db.Todo) error {
+	if err := s.checkPerson(t.Person); err != nil {
+		return err
+	}
+	s.lastTodo++
+	t.Id = s.lastTodo
+	stampTodo(t)
+	t.Workspace = s.people[t.Person.Id].Workspace
+	stored := *t
+	stored.Person = personRef(t.Person)
+	s.todos[t.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) UpdateTodo(t *db.Todo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.todos[t.Id]
+	if !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	if err := s.checkPerson(t.Person); err != nil {
+		return err
+	}
+	if existing.Version != t.Version {
+		return db.ErrConflict
+	}
+	t.Version++
+	t.UpdatedAt = now()
+	t.Workspace = s.people[t.Person.Id].Workspace
+	stored := *t
+	stored.Person = personRef(t.Person)
+	s.todos[t.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) RemoveTodo(t *db.Todo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.todos[t.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	delete(s.todos, t.Id)
+	return nil
+}
+
+func (s *FakeStore) AddTodoToAllPeople(t *db.Todo) ([]*db.Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var todos []*db.Todo
+	for _, id := range s.personIds() {
+		p := s.people[id]
+		if !s.visible(p.Workspace) {
+			continue
+		}
+		pt := *t
+		pt.Person = &p
+		if err := s.createTodo(&pt); err != nil {
+			return nil, err
+		}
+		todos = append(todos, &pt)
+	}
+	return todos, nil
+}
+
+func (s *FakeStore) personIds() []int64 {
+	ids := make([]int64, 0, len(s.people))
+	for id := range s.people {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) CreateUser(u *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u.Token == "" {
+		token, err := db.NewToken()
+		if err != nil {
+			return err
+		}
+		u.Token = token
+	}
+	for _, existing := range s.users {
+		if existing.Name == u.Name || existing.Token == u.Token {
+			return errors.New("UNIQUE constraint failed: user.name")
+		}
+	}
+	s.lastUser++
+	u.Id = s.lastUser
+	u.CreatedAt = now()
+	u.UpdatedAt = u.CreatedAt
+	s.users[u.Id] = *u
+	return nil
+}
+
+func (s *FakeStore) GetUserById(id int64) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return &u, nil
+}
+
+func (s *FakeStore) GetUserByName(name string) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Name == name {
+			return &u, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (s *FakeStore) GetUserByToken(token string) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if token != "" && u.Token == token {
+			return &u, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (s *FakeStore) GetUserByCalendarToken(token string) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if token != "" && u.CalendarToken == token {
+			return &u, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (s *FakeStore) SetCalendarToken(u *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[u.Id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	existing.CalendarToken = u.CalendarToken
+	existing.UpdatedAt = now()
+	u.UpdatedAt = existing.UpdatedAt
+	s.users[u.Id] = existing
+	return nil
+}
+
+func (s *FakeStore) GetUserByInboxToken(token string) (*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if token != "" && u.InboxToken == token {
+			return &u, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (s *FakeStore) SetInboxToken(u *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[u.Id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	existing.InboxToken = u.InboxToken
+	existing.UpdatedAt = now()
+	u.UpdatedAt = existing.UpdatedAt
+	s.users[u.Id] = existing
+	return nil
+}
+
+func (s *FakeStore) GetUsers() ([]*db.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int64, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	users := []*db.User{}
+	for _, id := range sortedIds(ids) {
+		u := s.users[id]
+		users = append(users, &u)
+	}
+	return users, nil
+}
+
+func (s *FakeStore) SetDigest(u *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[u.Id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	existing.Email, existing.DigestSchedule, existing.DigestSentAt = u.Email, u.DigestSchedule, u.DigestSentAt
+	existing.UpdatedAt = now()
+	u.UpdatedAt = existing.UpdatedAt
+	s.users[u.Id] = existing
+	return nil
+}
+
+func (s *FakeStore) CreateWorkspace(ws *db.Workspace, owner *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[owner.Id]; !ok {
+		return db.ErrNotFound
+	}
+	s.lastWorkspace++
+	ws.Id = s.lastWorkspace
+	ws.CreatedAt = now()
+	ws.UpdatedAt = ws.CreatedAt
+	s.workspaces[ws.Id] = *ws
+	s.setMember(ws, owner, db.RoleOwner)
+	return nil
+}
+
+func (s *FakeStore) GetWorkspaceById(id int64) (*db.Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return &ws, nil
+}
+
+func (s *FakeStore) membershipIds() []int64 {
+	ids := make([]int64, 0, len(s.memberships))
+	for id := range s.memberships {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) loadMembership(m db.Membership) *db.Membership {
+	ws := s.workspaces[m.Workspace.Id]
+	u := s.users[m.User.Id]
+	m.Workspace = &ws
+	m.User = &u
+	m.Manager = userRef(m.Manager)
+	return &m
+}
+
+func (s *FakeStore) GetMemberships(u *db.User) ([]*db.Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := []*db.Membership{}
+	for _, id := range s.membershipIds() {
+		if m := s.memberships[id]; m.User.Id == u.Id {
+			ms = append(ms, s.loadMembership(m))
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Workspace.Id < ms[j].Workspace.Id })
+	return ms, nil
+}
+
+func (s *FakeStore) getMembership(ws *db.Workspace, u *db.User) (*db.Membership, error) {
+	for _, m := range s.memberships {
+		if m.Workspace.Id == ws.Id && m.User.Id == u.Id {
+			return s.loadMembership(m), nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (s *FakeStore) GetMembership(ws *db.Workspace, u *db.User) (*db.Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.getMembership(ws, u)
+}
+
+func (s *FakeStore) setMember(ws *db.Workspace, u *db.User, role string) {
+	if m, err := s.getMembership(ws, u); err == nil {
+		m.Role = role
+		m.UpdatedAt = now()
+		s.memberships[m.Id] = *m
+		return
+	}
+	s.lastMembership++
+	created := now()
+	s.memberships[s.lastMembership] = db.Membership{
+		Id:        s.lastMembership,
+		Workspace: &db.Workspace{Id: ws.Id},
+		User:      &db.User{Id: u.Id},
+		Role:      role,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+}
+
+func (s *FakeStore) SetMember(ws *db.Workspace, u *db.User, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !db.ValidRole(role) {
+		return errors.New("Unknown role: " + role)
+	}
+	s.setMember(ws, u, role)
+	return nil
+}
+
+func (s *FakeStore) SetManager(ws *db.Workspace, u *db.User, manager *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.getMembership(ws, u)
+	if err != nil {
+		return err
+	}
+	m.Manager = userRef(manager)
+	m.UpdatedAt = now()
+	s.memberships[m.Id] = *m
+	return nil
+}
+
+func (s *FakeStore) RemoveMember(ws *db.Workspace, u *db.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, err := s.getMembership(ws, u); err == nil {
+		delete(s.memberships, m.Id)
+	}
+	return nil
+}
+
+func (s *FakeStore) CreateWebhook(w *db.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.workspace != nil {
+		w.Workspace = s.workspace
+	}
+	s.lastWebhook++
+	w.Id = s.lastWebhook
+	w.CreatedAt = now()
+	w.UpdatedAt = w.CreatedAt
+	stored := *w
+	stored.Workspace = workspaceRef(w.Workspace)
+	stored.Owner = userRef(w.Owner)
+	s.webhooks[w.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) webhookIds() []int64 {
+	ids := make([]int64, 0, len(s.webhooks))
+	for id := range s.webhooks {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) GetWebhooks() ([]*db.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hooks := []*db.Webhook{}
+	for _, id := range s.webhookIds() {
+		if w := s.webhooks[id]; s.visible(w.Workspace) {
+			hooks = append(hooks, &w)
+		}
+	}
+	return hooks, nil
+}
+
+func (s *FakeStore) GetWebhookById(id int64) (*db.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.webhooks[id]
+	if !ok || !s.visible(w.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	return &w, nil
+}
+
+func (s *FakeStore) RemoveWebhook(w *db.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.webhooks[w.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	for id, d := range s.deliveries {
+		if d.Webhook.Id == w.Id {
+			delete(s.deliveries, id)
+		}
+	}
+	delete(s.webhooks, w.Id)
+	return nil
+}
+
+func (s *FakeStore) CreateDelivery(d *db.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.webhooks[d.Webhook.Id]; !ok || !s.visible(w.Workspace) {
+		return db.ErrNotFound
+	}
+	s.lastDelivery++
+	d.Id = s.lastDelivery
+	d.NextAttempt = d.NextAttempt.Truncate(time.Second)
+	d.CreatedAt = now()
+	d.UpdatedAt = d.CreatedAt
+	stored := *d
+	stored.Webhook = &db.Webhook{Id: d.Webhook.Id}
+	s.deliveries[d.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) UpdateDelivery(d *db.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.deliveries[d.Id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	d.NextAttempt = d.NextAttempt.Truncate(time.Second)
+	d.UpdatedAt = now()
+	existing.Status, existing.Attempts, existing.NextAttempt = d.Status, d.Attempts, d.NextAttempt
+	existing.ResponseCode, existing.LastError, existing.UpdatedAt = d.ResponseCode, d.LastError, d.UpdatedAt
+	s.deliveries[d.Id] = existing
+	return nil
+}
+
+func (s *FakeStore) deliveryIds() []int64 {
+	ids := make([]int64, 0, len(s.deliveries))
+	for id := range s.deliveries {
+		ids = append(ids, id)
+	}
+	return sortedIds(ids)
+}
+
+func (s *FakeStore) GetDueDeliveries(t time.Time, limit int) ([]*db.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds := []*db.WebhookDelivery{}
+	for _, id := range s.deliveryIds() {
+		d := s.deliveries[id]
+		if d.Status == db.DeliveryPending && !d.NextAttempt.After(t) {
+			w := s.webhooks[d.Webhook.Id]
+			d.Webhook = &w
+			ds = append(ds, &d)
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].NextAttempt.Before(ds[j].NextAttempt) })
+	if len(ds) > limit {
+		ds = ds[:limit]
+	}
+	return ds, nil
+}
+
+func (s *FakeStore) GetDeliveries(w *db.Webhook, limit int) ([]*db.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.webhooks[w.Id]; !ok || !s.visible(existing.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	ids := s.deliveryIds()
+	ds := []*db.WebhookDelivery{}
+	for i := len(ids) - 1; i >= 0 && len(ds) < limit; i-- {
+		if d := s.deliveries[ids[i]]; d.Webhook.Id == w.Id {
+			ds = append(ds, &d)
+		}
+	}
+	return ds, nil
+}
+
+func noteRef(n *db.Note) *db.Note {
+	if n == nil {
+		return nil
+	}
+	return &db.Note{Id: n.Id}
+}
+
+func (s *FakeStore) CreateAttachment(a *db.Attachment, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkPerson(a.Person); err != nil {
+		return err
+	}
+	if a.Note != nil {
+		if n, ok := s.notes[a.Note.Id]; !ok || !s.visible(n.Workspace) {
+			return db.ErrNotFound
+		}
+	}
+	if s.workspace != nil {
+		a.Workspace = s.workspace
+	}
+	key, err := db.NewToken()
+	if err != nil {
+		return err
+	}
+	s.lastAttachment++
+	a.Id = s.lastAttachment
+	a.BlobKey = key
+	a.Size = int64(len(data))
+	a.CreatedAt = now()
+	a.UpdatedAt = a.CreatedAt
+	s.blobs[key] = fakeBlob{append([]byte{}, data...), a.CreatedAt}
+	stored := *a
+	stored.Workspace = workspaceRef(a.Workspace)
+	stored.Person = personRef(a.Person)
+	stored.Note = noteRef(a.Note)
+	stored.Uploader = userRef(a.Uploader)
+	s.attachments[a.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) GetAttachmentById(id int64) (*db.Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attachments[id]
+	if !ok || !s.visible(a.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	return &a, nil
+}
+
+// attachmentsWhere returns the visible attachments f is true for, oldest
+// first.
+func (s *FakeStore) attachmentsWhere(f func(a db.Attachment) bool) []*db.Attachment {
+	ids := make([]int64, 0, len(s.attachments))
+	for id := range s.attachments {
+		ids = append(ids, id)
+	}
+	as := []*db.Attachment{}
+	for _, id := range sortedIds(ids) {
+		a := s.attachments[id]
+		if s.visible(a.Workspace) && f(a) {
+			as = append(as, &a)
+		}
+	}
+	return as
+}
+
+func (s *FakeStore) GetAttachments(p *db.Person) ([]*db.Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attachmentsWhere(func(a db.Attachment) bool { return a.Person.Id == p.Id }), nil
+}
+
+func (s *FakeStore) GetNoteAttachments(n *db.Note) ([]*db.Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attachmentsWhere(func(a db.Attachment) bool { return a.Note != nil && a.Note.Id == n.Id }), nil
+}
+
+func (s *FakeStore) GetAttachmentData(a *db.Attachment) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[a.BlobKey]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return append([]byte{}, b.data...), nil
+}
+
+func (s *FakeStore) RemoveAttachment(a *db.Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.attachments[a.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	delete(s.attachments, a.Id)
+	return nil
+}
+
+func (s *FakeStore) RemoveOrphanedBlobs(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := map[string]bool{}
+	for _, a := range s.attachments {
+		used[a.BlobKey] = true
+	}
+	removed := 0
+	for key, b := range s.blobs {
+		if !used[key] && b.put.Before(before) {
+			delete(s.blobs, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *FakeStore) CreateNoteTemplate(t *db.NoteTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.workspace != nil {
+		t.Workspace = s.workspace
+	}
+	s.lastTemplate++
+	t.Id = s.lastTemplate
+	t.CreatedAt = now()
+	t.UpdatedAt = t.CreatedAt
+	stored := *t
+	stored.Workspace = workspaceRef(t.Workspace)
+	stored.Author = userRef(t.Author)
+	s.templates[t.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) GetNoteTemplates() ([]*db.NoteTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := []*db.NoteTemplate{}
+	for _, t := range s.templates {
+		if s.visible(t.Workspace) {
+			t := t
+			ts = append(ts, &t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Name != ts[j].Name {
+			return ts[i].Name < ts[j].Name
+		}
+		return ts[i].Id < ts[j].Id
+	})
+	return ts, nil
+}
+
+func (s *FakeStore) GetNoteTemplateById(id int64) (*db.NoteTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.templates[id]
+	if !ok || !s.visible(t.Workspace) {
+		return nil, db.ErrNotFound
+	}
+	return &t, nil
+}
+
+func (s *FakeStore) UpdateNoteTemplate(t *db.NoteTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.templates[t.Id]
+	if !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	if existing.Version != t.Version {
+		return db.ErrConflict
+	}
+	t.Version++
+	t.UpdatedAt = now()
+	t.Workspace = existing.Workspace
+	stored := *t
+	stored.Author = userRef(t.Author)
+	s.templates[t.Id] = stored
+	return nil
+}
+
+func (s *FakeStore) RemoveNoteTemplate(t *db.NoteTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.templates[t.Id]; !ok || !s.visible(existing.Workspace) {
+		return db.ErrNotFound
+	}
+	delete(s.templates, t.Id)
+	return nil
+}
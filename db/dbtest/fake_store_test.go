@@ -0,0 +1,72 @@
+package dbtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+)
+
+func TestInTxRestores(t *testing.T) {
+	store := NewFakeStore()
+	p := &db.Person{Name: "in_tx"}
+	if err := store.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+	kept := &db.Todo{Person: p, Text: "kept", Date: time.Now()}
+	if err := store.CreateTodo(kept); err != nil {
+		t.Fatal(err)
+	}
+
+	change := func(tx db.Store) error {
+		if err := tx.CreateTodo(&db.Todo{Person: p, Text: "rolled back", Date: time.Now()}); err != nil {
+			return err
+		}
+		changed := *kept
+		changed.Text = "changed"
+		return tx.UpdateTodo(&changed)
+	}
+	checkRestored := func() {
+		todos, err := store.GetTodos()
+		if err != nil || len(todos) != 1 || todos[0].Text != "kept" {
+			t.Fatalf("Expected everything done in the transaction to be undone, got %+v, %v", todos, err)
+		}
+	}
+
+	expected := errors.New("boom")
+	err := store.InTx(func(tx db.Store) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		return expected
+	})
+	if err != expected {
+		t.Fatalf("Expected InTx to return %v, got %v", expected, err)
+	}
+	checkRestored()
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("Expected InTx to re-raise the panic")
+			}
+		}()
+		store.InTx(func(tx db.Store) error {
+			if err := change(tx); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+	checkRestored()
+
+	// Ids handed out in an undone transaction are handed out again.
+	n := &db.Todo{Person: p, Text: "committed", Date: time.Now()}
+	if err := store.InTx(func(tx db.Store) error { return tx.CreateTodo(n) }); err != nil {
+		t.Fatal(err)
+	}
+	if n.Id != kept.Id+1 {
+		t.Errorf("Expected the new todo to get id %d, got %d", kept.Id+1, n.Id)
+	}
+}
@@ -0,0 +1,6 @@
+package db
+
+var (
+	SetupTestDB   = setupTestDB
+	NewTestCipher = newTestCipher
+)
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// ListOptions narrows down and orders a list of people, notes or todos.
+// Both ends of the time ranges are exclusive and zero times are ignored.
+type ListOptions struct {
+	// Only these ids, if any are given
+	Ids           []int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Columns to order by, prefixed with "-" for descending order.  Rows
+	// that order the same are left in id order.
+	OrderBy []string
+}
+
+// query narrows down and orders q.
+func (o ListOptions) query(q orm.QuerySeter) orm.QuerySeter {
+	if len(o.Ids) > 0 {
+		q = q.Filter("id__in", o.Ids)
+	}
+	// The columns only keep whole seconds, so each range is turned into
+	// one between whole seconds that includes its start.  That's also the
+	// only way they compare right in sqlite, which keeps them as text with
+	// the zone on the end.
+	ranges := []struct {
+		expr  string
+		t     time.Time
+		after bool
+	}{
+		{"created_at__gte", o.CreatedAfter, true},
+		{"created_at__lt", o.CreatedBefore, false},
+		{"updated_at__gte", o.UpdatedAfter, true},
+		{"updated_at__lt", o.UpdatedBefore, false},
+	}
+	for _, r := range ranges {
+		if r.t.IsZero() {
+			continue
+		}
+		t := r.t.Truncate(time.Second)
+		if r.after || t.Before(r.t) {
+			t = t.Add(time.Second)
+		}
+		q = q.Filter(r.expr, t)
+	}
+	order := append([]string{}, o.OrderBy...)
+	by_id := false
+	for _, col := range order {
+		by_id = by_id || strings.TrimPrefix(col, "-") == "id"
+	}
+	if !by_id {
+		order = append(order, "id")
+	}
+	return q.OrderBy(order...)
+}
@@ -1,49 +1,229 @@
 package db
 
-import "time"
+import (
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// Who besides the author can read a note.  HR partners can only read notes
+// in the CategoryHR category, whatever their visibility (except private).
+const (
+	// Only the author
+	VisibilityPrivate = "private"
+	// The author and everyone above them in the workspace's management chain
+	VisibilityManagerChain = "manager_chain"
+	// The manager chain and the users listed in SharedWith
+	VisibilityShared = "shared"
+	// Everyone in the workspace
+	VisibilityWorkspace = "workspace"
+)
+
+const CategoryHR = "hr"
+
+// Notes in CategoryOneOnOne are 1:1s with their person, held on their date.
+const CategoryOneOnOne = "one_on_one"
+
+func ValidVisibility(v string) bool {
+	switch v {
+	case VisibilityPrivate, VisibilityManagerChain, VisibilityShared, VisibilityWorkspace:
+		return true
+	}
+	return false
+}
 
 type Note struct {
-	Id       int64     `json:"id"`
-	Date     time.Time `json:"date"`
-	Person   *Person   `orm:"rel(fk)"  json:"-"`
-	Text     string    `orm:"type(text)" json:"text"`
-	Category string    `json:"category"`
+	Id         int64      `json:"id"`
+	Date       time.Time  `json:"date"`
+	Person     *Person    `orm:"rel(fk)"  json:"-"`
+	Text       string     `orm:"type(text)" json:"text"`
+	Category   string     `json:"category"`
+	Workspace  *Workspace `orm:"rel(fk);null" json:"-"`
+	Author     *User      `orm:"rel(fk);null" json:"-"`
+	Visibility string     `orm:"size(16)" json:"visibility"`
+	// Confidential notes are left out of bulk listings unless asked for and
+	// can be redacted.
+	Confidential bool `json:"confidential"`
+	// Ids of the users a VisibilityShared note is shared with, stored in
+	// NoteShare.
+	SharedWith []int64 `orm:"-" json:"shared_with"`
+	// UID of the calendar event, or Message-ID of the email, a note was
+	// imported from, if it was
+	ExternalId string `orm:"size(255);index" json:"-"`
+	// Bumped by every update
+	Version int64 `orm:"default(0)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+type NoteShare struct {
+	Id   int64
+	Note *Note `orm:"rel(fk)"`
+	User *User `orm:"rel(fk)"`
+}
+
+// loadShares fills in SharedWith for all the given notes.
+func (dbh *DBHandle) loadShares(notes []*Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	by_id := make(map[int64]*Note, len(notes))
+	ids := make([]int64, len(notes))
+	for i, n := range notes {
+		n.SharedWith = []int64{}
+		by_id[n.Id] = n
+		ids[i] = n.Id
+	}
+	for _, batch := range idBatches(ids) {
+		var shares []*NoteShare
+		_, err := dbh.ORM.QueryTable("note_share").Filter("note_id__in", batch).OrderBy("id").Limit(-1).All(&shares)
+		if err != nil {
+			return err
+		}
+		for _, s := range shares {
+			n := by_id[s.Note.Id]
+			n.SharedWith = append(n.SharedWith, s.User.Id)
+		}
+	}
+	return nil
+}
+
+// saveShares replaces the rows in NoteShare for n with n.SharedWith.
+func (tx *Tx) saveShares(n *Note) error {
+	_, err := tx.ORM.QueryTable("note_share").Filter("note_id", n.Id).Delete()
+	if err != nil {
+		return err
+	}
+	for _, uid := range n.SharedWith {
+		_, err = tx.ORM.Insert(&NoteShare{Note: n, User: &User{Id: uid}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Returns all people if ids arguement is empty
 func (dbh *DBHandle) GetNotesById(ids []int64) ([]*Note, error) {
 	var p []*Note
-	_, err := dbh.ORM.QueryTable("note").All(&p)
-	return p, err
+	q := dbh.table("note")
+	if len(ids) > 0 {
+		q = q.Filter("id__in", ids)
+	}
+	_, err := q.All(&p)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbh.openNotes(p); err != nil {
+		return nil, err
+	}
+	return p, dbh.loadShares(p)
+}
+
+func (dbh *DBHandle) ListNotes(o ListOptions) ([]*Note, error) {
+	var notes []*Note
+	_, err := o.query(dbh.table("note")).All(&notes)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbh.openNotes(notes); err != nil {
+		return nil, err
+	}
+	return notes, dbh.loadShares(notes)
 }
 
 func (dbh *DBHandle) GetNoteById(id int64) (*Note, error) {
-	p := Note{Id: id}
-	err := dbh.ORM.Read(&p)
+	p := Note{}
+	err := dbh.table("note").Filter("id", id).One(&p)
 	if err != nil {
 		return nil, err
 	}
-	return &p, nil
+	if err := dbh.openText(&p.Text); err != nil {
+		return nil, err
+	}
+	return &p, dbh.loadShares([]*Note{&p})
 }
 
 func (dbh *DBHandle) CreateNote(p *Note) error {
-	_, err := dbh.ORM.Insert(p)
+	if err := dbh.checkPersonScope(p.Person); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		p.Workspace = dbh.workspace
+	}
+	if p.Visibility == "" {
+		p.Visibility = VisibilityWorkspace
+	}
+	p.CreatedAt = now()
+	p.UpdatedAt = p.CreatedAt
+	if p.Date.IsZero() {
+		p.Date = p.CreatedAt
+	}
+	restore, err := dbh.sealText(&p.Text)
+	defer restore()
 	if err != nil {
 		return err
 	}
-	return nil
+	return dbh.WithTx(func(tx *Tx) error {
+		if _, err := tx.ORM.Insert(p); err != nil {
+			return err
+		}
+		return tx.saveShares(p)
+	})
 }
 
 func (dbh *DBHandle) UpdateNote(note *Note) error {
-	if _, err := dbh.ORM.Update(note); err != nil {
+	if err := dbh.checkScope("note", note.Id); err != nil {
 		return err
 	}
-	return nil
+	if err := dbh.checkPersonScope(note.Person); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		note.Workspace = dbh.workspace
+	}
+	restore, err := dbh.sealText(&note.Text)
+	defer restore()
+	if err != nil {
+		return err
+	}
+	version, updated_at := note.Version, note.UpdatedAt
+	err = dbh.WithTx(func(tx *Tx) error {
+		if err := tx.bumpVersion("note", note.Id, version); err != nil {
+			return err
+		}
+		note.Version = version + 1
+		note.UpdatedAt = now()
+		if _, err := tx.ORM.Update(note); err != nil {
+			return err
+		}
+		// The note's attachments follow it to another person.
+		_, err := tx.ORM.QueryTable("attachment").Filter("note_id", note.Id).
+			Update(orm.Params{"person": note.Person.Id})
+		if err != nil {
+			return err
+		}
+		return tx.saveShares(note)
+	})
+	if err != nil {
+		note.Version, note.UpdatedAt = version, updated_at
+	}
+	return err
 }
 
 func (dbh *DBHandle) RemoveNote(note *Note) error {
-	if _, err := dbh.ORM.Delete(note); err != nil {
+	if err := dbh.checkScope("note", note.Id); err != nil {
 		return err
 	}
-	return nil
+	return dbh.WithTx(func(tx *Tx) error {
+		if _, err := tx.ORM.QueryTable("note_share").Filter("note_id", note.Id).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.ORM.QueryTable("attachment").Filter("note_id", note.Id).Delete(); err != nil {
+			return err
+		}
+		_, err := tx.ORM.Delete(note)
+		return err
+	})
 }
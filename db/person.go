@@ -1,10 +1,25 @@
 package db
 
+import "time"
+
 type Person struct {
-	Id    int64   `json:"id"`
-	Name  string  `orm:"size(255);unique" json:"name"`
-	Notes []*Note `orm:"reverse(many)" json:"-"`
-	Todos []*Todo `orm:"reverse(many)" json:"-"`
+	Id   int64  `json:"id"`
+	Name string `orm:"size(255)" json:"name"`
+	// Optional, used to recognise people in imported calendars
+	Email     string     `orm:"size(255)" json:"email"`
+	Workspace *Workspace `orm:"rel(fk);null" json:"-"`
+	Notes     []*Note    `orm:"reverse(many)" json:"-"`
+	Todos     []*Todo    `orm:"reverse(many)" json:"-"`
+	// Bumped by every update
+	Version int64 `orm:"default(0)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+// Names only have to be unique within a workspace.
+func (p *Person) TableUnique() [][]string {
+	return [][]string{{"Workspace", "Name"}}
 }
 
 func (p *Person) LoadRelated(dbh *DBHandle) error {
@@ -22,13 +37,23 @@ func (p *Person) LoadRelated(dbh *DBHandle) error {
 // Returns all people if ids arguement is empty
 func (dbh *DBHandle) GetPeopleById(ids []int64) ([]*Person, error) {
 	var p []*Person
-	_, err := dbh.ORM.QueryTable("person").All(&p)
+	q := dbh.table("person")
+	if len(ids) > 0 {
+		q = q.Filter("id__in", ids)
+	}
+	_, err := q.All(&p)
+	return p, err
+}
+
+func (dbh *DBHandle) ListPeople(o ListOptions) ([]*Person, error) {
+	var p []*Person
+	_, err := o.query(dbh.table("person")).All(&p)
 	return p, err
 }
 
 func (dbh *DBHandle) GetPersonById(id int64) (*Person, error) {
-	p := Person{Id: id}
-	err := dbh.ORM.Read(&p)
+	p := Person{}
+	err := dbh.table("person").Filter("id", id).One(&p)
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +61,11 @@ func (dbh *DBHandle) GetPersonById(id int64) (*Person, error) {
 }
 
 func (dbh *DBHandle) CreatePerson(p *Person) error {
+	if dbh.workspace != nil {
+		p.Workspace = dbh.workspace
+	}
+	p.CreatedAt = now()
+	p.UpdatedAt = p.CreatedAt
 	_, err := dbh.ORM.Insert(p)
 	if err != nil {
 		return err
@@ -43,4 +73,123 @@ func (dbh *DBHandle) CreatePerson(p *Person) error {
 	return nil
 }
 
-func (dbh *DBHandle) UpdatePerson(*Person) error { return nil }
+func (dbh *DBHandle) UpdatePerson(p *Person) error {
+	if err := dbh.checkScope("person", p.Id); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		p.Workspace = dbh.workspace
+	}
+	version, updated_at := p.Version, p.UpdatedAt
+	err := dbh.WithTx(func(tx *Tx) error {
+		if err := tx.bumpVersion("person", p.Id, version); err != nil {
+			return err
+		}
+		p.Version = version + 1
+		p.UpdatedAt = now()
+		_, err := tx.ORM.Update(p)
+		return err
+	})
+	if err != nil {
+		p.Version, p.UpdatedAt = version, updated_at
+	}
+	return err
+}
+
+func (dbh *DBHandle) LoadPersonRelations(p *Person) error {
+	return dbh.LoadPeopleRelations([]*Person{p}, true, true)
+}
+
+// relationBatch is the most ids put in one IN query, well under the limit
+// sqlite puts on the number of query parameters.
+const relationBatch = 500
+
+// idBatches splits ids into slices of at most relationBatch ids.
+func idBatches(ids []int64) [][]int64 {
+	var batches [][]int64
+	for len(ids) > relationBatch {
+		batches = append(batches, ids[:relationBatch])
+		ids = ids[relationBatch:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+// LoadPeopleRelations loads the notes and todos of people with one query
+// per batch of people instead of one per person.
+func (dbh *DBHandle) LoadPeopleRelations(people []*Person, notes bool, todos bool) error {
+	by_id := make(map[int64]*Person, len(people))
+	ids := make([]int64, len(people))
+	for i, p := range people {
+		by_id[p.Id] = p
+		ids[i] = p.Id
+		if notes {
+			p.Notes = []*Note{}
+		}
+		if todos {
+			p.Todos = []*Todo{}
+		}
+	}
+
+	for _, batch := range idBatches(ids) {
+		if notes {
+			var ns []*Note
+			_, err := dbh.ORM.QueryTable("note").Filter("person_id__in", batch).OrderBy("id").Limit(-1).All(&ns)
+			if err != nil {
+				return err
+			}
+			if err := dbh.openNotes(ns); err != nil {
+				return err
+			}
+			if err := dbh.loadShares(ns); err != nil {
+				return err
+			}
+			for _, n := range ns {
+				p := by_id[n.Person.Id]
+				p.Notes = append(p.Notes, n)
+			}
+		}
+		if todos {
+			var ts []*Todo
+			_, err := dbh.ORM.QueryTable("todo").Filter("person_id__in", batch).OrderBy("id").Limit(-1).All(&ts)
+			if err != nil {
+				return err
+			}
+			if err := dbh.openTodos(ts); err != nil {
+				return err
+			}
+			for _, t := range ts {
+				p := by_id[t.Person.Id]
+				p.Todos = append(p.Todos, t)
+			}
+		}
+	}
+	return nil
+}
+
+// RemovePerson deletes a person along with all of their notes and todos.
+func (dbh *DBHandle) RemovePerson(p *Person) error {
+	if err := dbh.checkScope("person", p.Id); err != nil {
+		return err
+	}
+	return dbh.WithTx(func(tx *Tx) error {
+		if _, err := tx.ORM.QueryTable("note_share").Filter("note__person__id", p.Id).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.ORM.QueryTable("attachment").Filter("person_id", p.Id).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.ORM.QueryTable("note").Filter("person_id", p.Id).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.ORM.QueryTable("todo").Filter("person_id", p.Id).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.ORM.Delete(p); err != nil {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoadPeopleRelations(t *testing.T) {
+	dbh := setupTestDB(t)
+	u := &User{Name: "sharer", Token: "sharertoken"}
+	if err := dbh.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// More people than fit in one batch.
+	var people []*Person
+	for i := 0; i < relationBatch+2; i++ {
+		p := &Person{Name: fmt.Sprintf("person%d", i)}
+		if err := dbh.CreatePerson(p); err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, p)
+		if i%2 == 0 {
+			continue
+		}
+		n := &Note{Person: p, Text: p.Name, Date: time.Now(), SharedWith: []int64{u.Id}}
+		if err := dbh.CreateNote(n); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbh.CreateTodo(&Todo{Person: p, Text: p.Name, Date: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dbh.LoadPeopleRelations(people, true, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range people {
+		if p.Todos != nil {
+			t.Fatalf("Expected %s's todos not to be loaded, got %v", p.Name, p.Todos)
+		}
+		if i%2 == 0 {
+			if p.Notes == nil || len(p.Notes) != 0 {
+				t.Fatalf("Expected %s to have no notes, got %v", p.Name, p.Notes)
+			}
+			continue
+		}
+		if len(p.Notes) != 1 || p.Notes[0].Text != p.Name {
+			t.Fatalf("Expected %s to have their own note, got %v", p.Name, p.Notes)
+		}
+		if len(p.Notes[0].SharedWith) != 1 || p.Notes[0].SharedWith[0] != u.Id {
+			t.Fatalf("Expected %s's note to be shared, got %v", p.Name, p.Notes[0].SharedWith)
+		}
+	}
+
+	if err := dbh.LoadPeopleRelations(people, false, true); err != nil {
+		t.Fatal(err)
+	}
+	last := people[len(people)-1]
+	if len(last.Todos) != 1 || last.Todos[0].Text != last.Name {
+		t.Fatalf("Expected %s to have their own todo, got %v", last.Name, last.Todos)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// runWithLocalPostgres starts a throwaway Postgres cluster with the initdb
+// and pg_ctl binaries found in $PATH (or in $POINTYHAIR_TEST_PG_BIN) and
+// re-runs this test binary against it, returning its exit code.  If no
+// binaries are available the Postgres run is skipped and ran is false.
+func runWithLocalPostgres() (code int, ran bool) {
+	bin := os.Getenv("POINTYHAIR_TEST_PG_BIN")
+	initdb, err := exec.LookPath(filepath.Join(bin, "initdb"))
+	if err != nil {
+		glog.Info("initdb not found, skipping Postgres tests")
+		return 0, false
+	}
+	pgctl, err := exec.LookPath(filepath.Join(bin, "pg_ctl"))
+	if err != nil {
+		glog.Info("pg_ctl not found, skipping Postgres tests")
+		return 0, false
+	}
+
+	dir, err := ioutil.TempDir("", "pointyhair-pg")
+	if err != nil {
+		glog.Errorf("Error creating Postgres data dir: %s", err)
+		return 1, true
+	}
+	defer os.RemoveAll(dir)
+
+	port, err := freePort()
+	if err != nil {
+		glog.Errorf("Error finding a free port: %s", err)
+		return 1, true
+	}
+
+	out, err := exec.Command(initdb, "-D", dir, "-U", "postgres", "-A", "trust").CombinedOutput()
+	if err != nil {
+		glog.Errorf("Error running initdb: %s\n%s", err, out)
+		return 1, true
+	}
+	opts := fmt.Sprintf("-p %d -k %s -h 127.0.0.1", port, dir)
+	out, err = exec.Command(pgctl, "-D", dir, "-o", opts, "-w", "start").CombinedOutput()
+	if err != nil {
+		glog.Errorf("Error starting Postgres: %s\n%s", err, out)
+		return 1, true
+	}
+	defer exec.Command(pgctl, "-D", dir, "-m", "immediate", "stop").Run()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", testDSNEnv, port))
+	if err := cmd.Run(); err != nil {
+		return 1, true
+	}
+	return 0, true
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// ErrNotFound is returned by Store implementations when the requested row
+// doesn't exist.
+var ErrNotFound = orm.ErrNoRows
+
+// ErrConflict is returned by Store implementations when updating a person,
+// note or todo that was changed by someone else since it was read.
+var ErrConflict = errors.New("db: changed since it was read")
+
+type PeopleStore interface {
+	// Returns all people if ids is empty
+	GetPeopleById(ids []int64) ([]*Person, error)
+	ListPeople(o ListOptions) ([]*Person, error)
+	GetPersonById(id int64) (*Person, error)
+	CreatePerson(p *Person) error
+	UpdatePerson(p *Person) error
+	RemovePerson(p *Person) error
+	// Fills in p.Notes and p.Todos
+	LoadPersonRelations(p *Person) error
+	// Fills in the Notes and/or Todos of all of people at once
+	LoadPeopleRelations(people []*Person, notes bool, todos bool) error
+}
+
+type NoteStore interface {
+	// Returns all notes if ids is empty
+	GetNotesById(ids []int64) ([]*Note, error)
+	ListNotes(o ListOptions) ([]*Note, error)
+	GetNoteById(id int64) (*Note, error)
+	CreateNote(n *Note) error
+	UpdateNote(n *Note) error
+	RemoveNote(n *Note) error
+}
+
+type TodoStore interface {
+	GetTodoById(id int64) (*Todo, error)
+	GetTodos() ([]*Todo, error)
+	GetTodosByIds(ids []int64) ([]*Todo, error)
+	ListTodos(o ListOptions) ([]*Todo, error)
+	CreateTodo(t *Todo) error
+	UpdateTodo(t *Todo) error
+	RemoveTodo(t *Todo) error
+	// Returns the copies of t created
+	AddTodoToAllPeople(t *Todo) ([]*Todo, error)
+}
+
+type WorkspaceStore interface {
+	CreateUser(u *User) error
+	GetUserById(id int64) (*User, error)
+	GetUserByName(name string) (*User, error)
+	GetUserByToken(token string) (*User, error)
+	GetUserByCalendarToken(token string) (*User, error)
+	SetCalendarToken(u *User) error
+	GetUserByInboxToken(token string) (*User, error)
+	SetInboxToken(u *User) error
+	GetUsers() ([]*User, error)
+	SetDigest(u *User) error
+	CreateWorkspace(ws *Workspace, owner *User) error
+	GetWorkspaceById(id int64) (*Workspace, error)
+	GetMemberships(u *User) ([]*Membership, error)
+	GetMembership(ws *Workspace, u *User) (*Membership, error)
+	SetMember(ws *Workspace, u *User, role string) error
+	SetManager(ws *Workspace, u *User, manager *User) error
+	RemoveMember(ws *Workspace, u *User) error
+	// Returns a Store that only sees, and creates, people, notes and todos
+	// in ws
+	InWorkspace(ws *Workspace) Store
+}
+
+type AttachmentStore interface {
+	// Stores data as a's content
+	CreateAttachment(a *Attachment, data []byte) error
+	GetAttachmentById(id int64) (*Attachment, error)
+	// Including those on the person's notes
+	GetAttachments(p *Person) ([]*Attachment, error)
+	GetNoteAttachments(n *Note) ([]*Attachment, error)
+	GetAttachmentData(a *Attachment) ([]byte, error)
+	RemoveAttachment(a *Attachment) error
+	// Removes the content of removed attachments, and of removed notes' and
+	// people's, stored before the given time
+	RemoveOrphanedBlobs(before time.Time) (int, error)
+}
+
+type NoteTemplateStore interface {
+	CreateNoteTemplate(t *NoteTemplate) error
+	// By name
+	GetNoteTemplates() ([]*NoteTemplate, error)
+	GetNoteTemplateById(id int64) (*NoteTemplate, error)
+	UpdateNoteTemplate(t *NoteTemplate) error
+	RemoveNoteTemplate(t *NoteTemplate) error
+}
+
+type WebhookStore interface {
+	CreateWebhook(w *Webhook) error
+	GetWebhooks() ([]*Webhook, error)
+	GetWebhookById(id int64) (*Webhook, error)
+	// Also removes the webhook's deliveries
+	RemoveWebhook(w *Webhook) error
+	CreateDelivery(d *WebhookDelivery) error
+	UpdateDelivery(d *WebhookDelivery) error
+	// Pending deliveries due by t in every workspace, with their webhooks
+	GetDueDeliveries(t time.Time, limit int) ([]*WebhookDelivery, error)
+	// The last limit deliveries to w, newest first
+	GetDeliveries(w *Webhook, limit int) ([]*WebhookDelivery, error)
+}
+
+// Store is everything the api package needs from the database.
+type Store interface {
+	PeopleStore
+	NoteStore
+	TodoStore
+	WorkspaceStore
+	WebhookStore
+	AttachmentStore
+	NoteTemplateStore
+	// InTx runs f with a Store that does everything in one transaction,
+	// which is committed if f returns nil and rolled back otherwise
+	InTx(f func(s Store) error) error
+}
+
+var _ Store = (*DBHandle)(nil)
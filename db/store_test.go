@@ -0,0 +1,236 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+// The tests here run against every Store implementation.
+
+func TestUpdateConflicts(t *testing.T) {
+	stores := map[string]db.Store{"sqlite3": db.SetupTestDB(t), "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			p := &db.Person{Name: "versioned"}
+			if err := store.CreatePerson(p); err != nil {
+				t.Fatal(err)
+			}
+			n := &db.Note{Person: p, Text: "first", Date: time.Now()}
+			if err := store.CreateNote(n); err != nil {
+				t.Fatal(err)
+			}
+			todo := &db.Todo{Person: p, Text: "first", Date: time.Now()}
+			if err := store.CreateTodo(todo); err != nil {
+				t.Fatal(err)
+			}
+
+			// Two copies read at the same version, as if by two users.
+			p2, _ := store.GetPersonById(p.Id)
+			n2, _ := store.GetNoteById(n.Id)
+			todo2, _ := store.GetTodoById(todo.Id)
+
+			if err := store.UpdatePerson(p); err != nil || p.Version != 1 {
+				t.Fatalf("Expected the person at version 1, got %d, %v", p.Version, err)
+			}
+			if err := store.UpdateNote(n); err != nil || n.Version != 1 {
+				t.Fatalf("Expected the note at version 1, got %d, %v", n.Version, err)
+			}
+			if err := store.UpdateTodo(todo); err != nil || todo.Version != 1 {
+				t.Fatalf("Expected the todo at version 1, got %d, %v", todo.Version, err)
+			}
+
+			n2.Text = "clobbered"
+			if err := store.UpdatePerson(p2); err != db.ErrConflict {
+				t.Errorf("Expected a conflict updating a stale person, got %v", err)
+			}
+			if err := store.UpdateNote(n2); err != db.ErrConflict {
+				t.Errorf("Expected a conflict updating a stale note, got %v", err)
+			}
+			if err := store.UpdateTodo(todo2); err != db.ErrConflict {
+				t.Errorf("Expected a conflict updating a stale todo, got %v", err)
+			}
+			if n2.Version != 0 {
+				t.Errorf("Expected a failed update to leave the version alone, got %d", n2.Version)
+			}
+			got, err := store.GetNoteById(n.Id)
+			if err != nil || got.Text != "first" || got.Version != 1 {
+				t.Errorf("Expected the note not to be clobbered, got %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	stores := map[string]db.Store{"sqlite3": db.SetupTestDB(t), "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now().Add(-time.Second)
+			p := &db.Person{Name: "stamped"}
+			if err := store.CreatePerson(p); err != nil {
+				t.Fatal(err)
+			}
+			n := &db.Note{Person: p, Text: "undated"}
+			if err := store.CreateNote(n); err != nil {
+				t.Fatal(err)
+			}
+			todo := &db.Todo{Person: p, Text: "undated"}
+			if err := store.CreateTodo(todo); err != nil {
+				t.Fatal(err)
+			}
+			if p.CreatedAt.Before(start) || !p.UpdatedAt.Equal(p.CreatedAt) {
+				t.Errorf("Expected the person to be stamped, got %+v", p)
+			}
+			if !n.Date.Equal(n.CreatedAt) || !todo.Date.Equal(todo.CreatedAt) || n.CreatedAt.Before(start) {
+				t.Errorf("Expected undated notes and todos to be dated when created, got %v and %v", n.Date, todo.Date)
+			}
+
+			created := n.CreatedAt
+			n.Text = "changed"
+			if err := store.UpdateNote(n); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.GetNoteById(n.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.CreatedAt.Equal(created) || !got.UpdatedAt.Equal(n.UpdatedAt) || got.UpdatedAt.Before(created) {
+				t.Errorf("Expected the update to be stamped and the creation time kept, got %+v", got)
+			}
+
+			u := &db.User{Name: "stamped"}
+			if err := store.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+			ws := &db.Workspace{Name: "stamped"}
+			if err := store.CreateWorkspace(ws, u); err != nil {
+				t.Fatal(err)
+			}
+			m, err := store.GetMembership(ws, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.CreatedAt.IsZero() || ws.CreatedAt.IsZero() || m.CreatedAt.IsZero() || m.UpdatedAt.IsZero() {
+				t.Errorf("Expected users, workspaces and memberships to be stamped, got %+v, %+v and %+v", u, ws, m)
+			}
+		})
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	stores := map[string]db.Store{"sqlite3": db.SetupTestDB(t), "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			p := &db.Person{Name: "listed"}
+			if err := store.CreatePerson(p); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			// When the first note was created and the last one updated
+			var created, updated time.Time
+			for _, day := range []int{1, 3, 2} {
+				n := &db.Note{Person: p, Text: "listed", Date: time.Date(2020, 1, day, 0, 0, 0, 0, time.UTC)}
+				if err := store.CreateNote(n); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, n.Id)
+				if created.IsZero() {
+					created = n.CreatedAt
+				}
+				updated = n.UpdatedAt
+			}
+
+			tests := []struct {
+				o        db.ListOptions
+				expected []int64
+			}{
+				{db.ListOptions{}, ids},
+				{db.ListOptions{OrderBy: []string{"date"}}, []int64{ids[0], ids[2], ids[1]}},
+				{db.ListOptions{OrderBy: []string{"-date"}}, []int64{ids[1], ids[2], ids[0]}},
+				{db.ListOptions{OrderBy: []string{"-id"}}, []int64{ids[2], ids[1], ids[0]}},
+				{db.ListOptions{Ids: []int64{ids[2], ids[0]}}, []int64{ids[0], ids[2]}},
+				{db.ListOptions{CreatedAfter: created.Add(-time.Hour)}, ids},
+				{db.ListOptions{CreatedBefore: created}, nil},
+				{db.ListOptions{CreatedAfter: created.Add(time.Hour)}, nil},
+				{db.ListOptions{CreatedBefore: updated.Add(time.Second)}, ids},
+				{db.ListOptions{UpdatedAfter: updated}, nil},
+				{db.ListOptions{UpdatedBefore: updated.Add(time.Hour), OrderBy: []string{"-date"}}, []int64{ids[1], ids[2], ids[0]}},
+			}
+			for _, test := range tests {
+				notes, err := store.ListNotes(test.o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []int64{}
+				for _, n := range notes {
+					if n.Text != "listed" {
+						t.Errorf("Expected the notes' text, got %q", n.Text)
+					}
+					got = append(got, n.Id)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+					t.Errorf("Expected notes %v for %+v, got %v", test.expected, test.o, got)
+				}
+			}
+
+			people, err := store.ListPeople(db.ListOptions{CreatedBefore: created.Add(time.Hour), OrderBy: []string{"-created_at"}})
+			if err != nil || len(people) != 1 {
+				t.Errorf("Expected the person to be listed, got %+v, %v", people, err)
+			}
+			todos, err := store.ListTodos(db.ListOptions{UpdatedAfter: created.Add(time.Hour)})
+			if err != nil || len(todos) != 0 {
+				t.Errorf("Expected no todos, got %+v, %v", todos, err)
+			}
+		})
+	}
+}
+
+func TestInTx(t *testing.T) {
+	stores := map[string]db.Store{"sqlite3": db.SetupTestDB(t), "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			p := &db.Person{Name: "in_tx"}
+			if err := store.CreatePerson(p); err != nil {
+				t.Fatal(err)
+			}
+			kept := &db.Todo{Person: p, Text: "kept", Date: time.Now()}
+			if err := store.CreateTodo(kept); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := errors.New("boom")
+			err := store.InTx(func(tx db.Store) error {
+				if err := tx.CreateTodo(&db.Todo{Person: p, Text: "rolled back", Date: time.Now()}); err != nil {
+					return err
+				}
+				kept.Done = true
+				if err := tx.UpdateTodo(kept); err != nil {
+					return err
+				}
+				return expected
+			})
+			if err != expected {
+				t.Fatalf("Expected InTx to return %v, got %v", expected, err)
+			}
+			todos, err := store.GetTodos()
+			if err != nil || len(todos) != 1 || todos[0].Done || todos[0].Version != 0 {
+				t.Fatalf("Expected everything done in the transaction to be rolled back, got %+v, %v", todos, err)
+			}
+
+			err = store.InTx(func(tx db.Store) error {
+				return tx.CreateTodo(&db.Todo{Person: p, Text: "committed", Date: time.Now()})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			todos, err = store.GetTodos()
+			if err != nil || len(todos) != 2 {
+				t.Errorf("Expected the committed todo to be kept, got %+v, %v", todos, err)
+			}
+		})
+	}
+}
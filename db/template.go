@@ -0,0 +1,81 @@
+package db
+
+import "time"
+
+// NoteTemplate is the skeleton of a kind of conversation, like a 1:1 or a
+// career conversation, that notes can be started from.  Templates are
+// shared by everyone in their workspace.  The placeholders Text can have
+// are filled in by the api package.
+type NoteTemplate struct {
+	Id        int64      `json:"id"`
+	Workspace *Workspace `orm:"rel(fk);null" json:"-"`
+	Author    *User      `orm:"rel(fk);null" json:"-"`
+	Name      string     `orm:"size(255)" json:"name"`
+	Text      string     `orm:"type(text)" json:"text"`
+	// Given to notes made from the template, unless they're given their
+	// own.  Visibility may be empty for the notes' default.
+	Category     string `json:"category"`
+	Visibility   string `orm:"size(16)" json:"visibility"`
+	Confidential bool   `json:"confidential"`
+	// Bumped by every update
+	Version int64 `orm:"default(0)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+func (dbh *DBHandle) CreateNoteTemplate(t *NoteTemplate) error {
+	if dbh.workspace != nil {
+		t.Workspace = dbh.workspace
+	}
+	t.CreatedAt = now()
+	t.UpdatedAt = t.CreatedAt
+	_, err := dbh.ORM.Insert(t)
+	return err
+}
+
+// GetNoteTemplates returns all the templates, by name.
+func (dbh *DBHandle) GetNoteTemplates() ([]*NoteTemplate, error) {
+	var ts []*NoteTemplate
+	_, err := dbh.table("note_template").OrderBy("name", "id").Limit(-1).All(&ts)
+	return ts, err
+}
+
+func (dbh *DBHandle) GetNoteTemplateById(id int64) (*NoteTemplate, error) {
+	t := NoteTemplate{}
+	if err := dbh.table("note_template").Filter("id", id).One(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (dbh *DBHandle) UpdateNoteTemplate(t *NoteTemplate) error {
+	if err := dbh.checkScope("note_template", t.Id); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		t.Workspace = dbh.workspace
+	}
+	version, updated_at := t.Version, t.UpdatedAt
+	err := dbh.WithTx(func(tx *Tx) error {
+		if err := tx.bumpVersion("note_template", t.Id, version); err != nil {
+			return err
+		}
+		t.Version = version + 1
+		t.UpdatedAt = now()
+		_, err := tx.ORM.Update(t)
+		return err
+	})
+	if err != nil {
+		t.Version, t.UpdatedAt = version, updated_at
+	}
+	return err
+}
+
+func (dbh *DBHandle) RemoveNoteTemplate(t *NoteTemplate) error {
+	if err := dbh.checkScope("note_template", t.Id); err != nil {
+		return err
+	}
+	_, err := dbh.ORM.Delete(&NoteTemplate{Id: t.Id})
+	return err
+}
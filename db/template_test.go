@@ -0,0 +1,65 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func TestNoteTemplates(t *testing.T) {
+	dbh := db.SetupTestDB(t)
+	stores := map[string]db.Store{"sqlite3": dbh, "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			u := &db.User{Name: "templates"}
+			if err := store.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+			ws := &db.Workspace{Name: "templates"}
+			if err := store.CreateWorkspace(ws, u); err != nil {
+				t.Fatal(err)
+			}
+			scoped := store.InWorkspace(ws)
+			one_on_one := &db.NoteTemplate{Author: u, Name: "1:1", Text: "{{person.name}}", Category: db.CategoryOneOnOne}
+			career := &db.NoteTemplate{Author: u, Name: "Career", Text: "Goals", Confidential: true}
+			for _, tmpl := range []*db.NoteTemplate{career, one_on_one} {
+				if err := scoped.CreateNoteTemplate(tmpl); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ts, err := scoped.GetNoteTemplates(); err != nil || len(ts) != 2 || ts[0].Id != one_on_one.Id || ts[0].Author.Id != u.Id {
+				t.Errorf("Expected the templates by name, got %+v, %v", ts, err)
+			}
+			other := store.InWorkspace(&db.Workspace{Id: ws.Id + 100})
+			if _, err := other.GetNoteTemplateById(career.Id); err != db.ErrNotFound {
+				t.Errorf("Expected the template to be hidden from other workspaces, got %v", err)
+			}
+			if err := other.RemoveNoteTemplate(career); err != db.ErrNotFound {
+				t.Errorf("Expected other workspaces not to remove the template, got %v", err)
+			}
+
+			stale, err := scoped.GetNoteTemplateById(career.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			career.Text = "Goals and growth"
+			if err := scoped.UpdateNoteTemplate(career); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := scoped.GetNoteTemplateById(career.Id); err != nil || got.Text != "Goals and growth" || !got.Confidential {
+				t.Errorf("Expected the template to be changed, got %+v, %v", got, err)
+			}
+			if err := scoped.UpdateNoteTemplate(stale); err != db.ErrConflict {
+				t.Errorf("Expected a conflict updating a stale template, got %v", err)
+			}
+
+			if err := scoped.RemoveNoteTemplate(career); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := scoped.GetNoteTemplateById(career.Id); err != db.ErrNotFound {
+				t.Errorf("Expected the template to be removed, got %v", err)
+			}
+		})
+	}
+}
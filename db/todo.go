@@ -4,35 +4,81 @@ import "time"
 
 // Proably a better way of dealing with this.
 type Todo struct {
-	Id       int64     `json:"id"`
-	Date     time.Time `json:"date"`
-	Person   *Person   `orm:"rel(fk)"  json:"-"`
-	Text     string    `orm:"type(text)" json:"text"`
-	Category string    `json:"category"`
+	Id        int64      `json:"id"`
+	Date      time.Time  `json:"date"`
+	Person    *Person    `orm:"rel(fk)"  json:"-"`
+	Text      string     `orm:"type(text)" json:"text"`
+	Category  string     `json:"category"`
+	Done      bool       `orm:"default(false)" json:"done"`
+	Workspace *Workspace `orm:"rel(fk);null" json:"-"`
+	// Bumped by every update
+	Version int64 `orm:"default(0)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+// stampTodo sets the timestamps of a new todo, and its date if it has none.
+func stampTodo(t *Todo) {
+	t.CreatedAt = now()
+	t.UpdatedAt = t.CreatedAt
+	if t.Date.IsZero() {
+		t.Date = t.CreatedAt
+	}
 }
 
 func (dbh *DBHandle) GetTodoById(id int64) (*Todo, error) {
-	t := Todo{Id: id}
-	err := dbh.ORM.Read(&t)
+	t := Todo{}
+	err := dbh.table("todo").Filter("id", id).One(&t)
 	if err != nil {
 		return nil, err
 	}
+	if err := dbh.openText(&t.Text); err != nil {
+		return nil, err
+	}
 	return &t, nil
 }
 
 func (dbh *DBHandle) GetTodos() ([]*Todo, error) {
 	var todos []*Todo
-	_, err := dbh.ORM.QueryTable("todo").All(&todos)
-	return todos, err
+	_, err := dbh.table("todo").All(&todos)
+	if err != nil {
+		return nil, err
+	}
+	return todos, dbh.openTodos(todos)
 }
 
 func (dbh *DBHandle) GetTodosByIds(ids []int64) ([]*Todo, error) {
 	var todos []*Todo
-	_, err := dbh.ORM.QueryTable("todo").Filter("id__in", ids).All(&todos)
-	return todos, err
+	_, err := dbh.table("todo").Filter("id__in", ids).All(&todos)
+	if err != nil {
+		return nil, err
+	}
+	return todos, dbh.openTodos(todos)
+}
+
+func (dbh *DBHandle) ListTodos(o ListOptions) ([]*Todo, error) {
+	var todos []*Todo
+	_, err := o.query(dbh.table("todo")).All(&todos)
+	if err != nil {
+		return nil, err
+	}
+	return todos, dbh.openTodos(todos)
 }
 
 func (dbh *DBHandle) CreateTodo(t *Todo) error {
+	if err := dbh.checkPersonScope(t.Person); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		t.Workspace = dbh.workspace
+	}
+	restore, err := dbh.sealText(&t.Text)
+	defer restore()
+	if err != nil {
+		return err
+	}
+	stampTodo(t)
 	if _, err := dbh.ORM.Insert(t); err != nil {
 		return err
 	}
@@ -40,31 +86,82 @@ func (dbh *DBHandle) CreateTodo(t *Todo) error {
 }
 
 func (dbh *DBHandle) UpdateTodo(t *Todo) error {
-	if _, err := dbh.ORM.Update(&t); err != nil {
+	if err := dbh.checkScope("todo", t.Id); err != nil {
 		return err
 	}
-	return nil
+	if err := dbh.checkPersonScope(t.Person); err != nil {
+		return err
+	}
+	if dbh.workspace != nil {
+		t.Workspace = dbh.workspace
+	}
+	restore, err := dbh.sealText(&t.Text)
+	defer restore()
+	if err != nil {
+		return err
+	}
+	version, updated_at := t.Version, t.UpdatedAt
+	err = dbh.WithTx(func(tx *Tx) error {
+		if err := tx.bumpVersion("todo", t.Id, version); err != nil {
+			return err
+		}
+		t.Version = version + 1
+		t.UpdatedAt = now()
+		_, err := tx.ORM.Update(t)
+		return err
+	})
+	if err != nil {
+		t.Version, t.UpdatedAt = version, updated_at
+	}
+	return err
 }
 
 func (dbh *DBHandle) RemoveTodo(t *Todo) error {
+	if err := dbh.checkScope("todo", t.Id); err != nil {
+		return err
+	}
 	if _, err := dbh.ORM.Delete(t); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbh *DBHandle) AddTodoToAllPeople(t *Todo) error {
-	var people []*Person
-	_, err := dbh.ORM.QueryTable("person").All(&people)
-	if err != nil {
-		return err
-	}
-	for _, p := range people {
-		t.Person = p
-		err = dbh.CreateTodo(t)
+// AddTodoToAllPeople creates a copy of t for every person and returns the
+// copies.  Either everyone gets the todo or nobody does.
+func (dbh *DBHandle) AddTodoToAllPeople(t *Todo) ([]*Todo, error) {
+	stampTodo(t)
+	var todos []*Todo
+	err := dbh.WithTx(func(tx *Tx) error {
+		var people []*Person
+		q := tx.ORM.QueryTable("person")
+		if dbh.workspace != nil {
+			q = q.Filter("workspace_id", dbh.workspace.Id)
+		}
+		_, err := q.All(&people)
 		if err != nil {
 			return err
 		}
+		for _, p := range people {
+			pt := *t
+			pt.Id = 0
+			pt.Person = p
+			pt.Workspace = dbh.workspace
+			// Every copy gets its own data key.
+			restore, err := dbh.sealText(&pt.Text)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ORM.Insert(&pt)
+			restore()
+			if err != nil {
+				return err
+			}
+			todos = append(todos, &pt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return todos, nil
 }
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/golang/glog"
+)
+
+// Tx is handed to the function passed to WithTx.  Everything done through
+// its ORM happens inside a single transaction.
+type Tx struct {
+	ORM orm.Ormer
+}
+
+// bumpVersion moves the row in table with the given id on from version,
+// returning ErrConflict if it isn't at version any more.  Updating the
+// version first locks the row for the rest of the transaction.
+func (tx *Tx) bumpVersion(table string, id int64, version int64) error {
+	num, err := tx.ORM.QueryTable(table).Filter("id", id).Filter("version", version).Update(orm.Params{
+		"version": version + 1,
+	})
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// WithTx runs f inside a transaction.  The transaction is committed if f
+// returns nil and rolled back if f returns an error or panics (the panic is
+// re-raised after the rollback).
+//
+// Every transaction gets an Ormer of its own, so what other requests do
+// through the handle at the same time stays out of it.  On a handle InTx
+// handed out, f joins that transaction instead and committing or rolling
+// back is left to InTx.
+//
+// f must not call WithTx itself, use the Tx it was given instead.
+func (dbh *DBHandle) WithTx(f func(tx *Tx) error) (err error) {
+	if dbh.tx != nil {
+		return f(dbh.tx)
+	}
+
+	o := orm.NewOrm()
+	if err := o.Using(dbh.Alias); err != nil {
+		return err
+	}
+	if err := o.Begin(); err != nil {
+		return err
+	}
+	tx := &Tx{ORM: o}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if rerr := o.Rollback(); rerr != nil {
+				glog.Errorf("Error rolling back transaction: %s", rerr)
+			}
+			panic(r)
+		}
+	}()
+
+	err = f(tx)
+	if err != nil {
+		if rerr := o.Rollback(); rerr != nil {
+			return fmt.Errorf("%s (rollback also failed: %s)", err, rerr)
+		}
+		return err
+	}
+
+	return o.Commit()
+}
+
+// InTx runs f with a copy of the handle whose ORM is inside the transaction
+// WithTx starts, so the Store methods f calls all join it.
+func (dbh *DBHandle) InTx(f func(s Store) error) error {
+	return dbh.WithTx(func(tx *Tx) error {
+		d := *dbh
+		d.ORM = tx.ORM
+		d.tx = tx
+		return f(&d)
+	})
+}
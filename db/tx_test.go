@@ -0,0 +1,199 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countTodos(t *testing.T, dbh *DBHandle, text string) int64 {
+	c, err := dbh.ORM.QueryTable("todo").Filter("text", text).Count()
+	if err != nil {
+		t.Fatalf("Error counting todos: %s", err)
+	}
+	return c
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "tx_error"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := errors.New("boom")
+	err := dbh.WithTx(func(tx *Tx) error {
+		todo := Todo{Person: p, Text: "tx_error todo", Date: time.Now()}
+		if _, err := tx.ORM.Insert(&todo); err != nil {
+			return err
+		}
+		return expected
+	})
+	if err != expected {
+		t.Fatalf("Expected WithTx to return %v, got %v", expected, err)
+	}
+
+	if c := countTodos(t, dbh, "tx_error todo"); c != 0 {
+		t.Fatalf("Expected todo insert to be rolled back, found %d", c)
+	}
+}
+
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "tx_panic"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("Expected WithTx to re-raise the panic")
+			}
+		}()
+		dbh.WithTx(func(tx *Tx) error {
+			todo := Todo{Person: p, Text: "tx_panic todo", Date: time.Now()}
+			if _, err := tx.ORM.Insert(&todo); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+
+	if c := countTodos(t, dbh, "tx_panic todo"); c != 0 {
+		t.Fatalf("Expected todo insert to be rolled back, found %d", c)
+	}
+
+	// The handle has to be usable again after the panic.
+	if err := dbh.WithTx(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatalf("Error starting a new transaction: %s", err)
+	}
+}
+
+func TestWithTxCommits(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "tx_commit"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dbh.WithTx(func(tx *Tx) error {
+		todo := Todo{Person: p, Text: "tx_commit todo", Date: time.Now()}
+		_, err := tx.ORM.Insert(&todo)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := countTodos(t, dbh, "tx_commit todo"); c != 1 {
+		t.Fatalf("Expected 1 committed todo, found %d", c)
+	}
+}
+
+func TestWithTxIsolated(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "tx_isolated"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := dbh.WithTx(func(tx *Tx) error {
+			for i := 0; i < 10; i++ {
+				todo := Todo{Person: p, Text: "tx_isolated rolled back", Date: time.Now()}
+				if _, err := tx.ORM.Insert(&todo); err != nil {
+					return err
+				}
+				if i == 0 {
+					close(started)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return errors.New("boom")
+		})
+		if err == nil || err.Error() != "boom" {
+			t.Errorf("Expected the transaction to fail, got %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-started
+		for i := 0; i < 10; i++ {
+			todo := &Todo{Person: p, Text: fmt.Sprintf("tx_isolated kept %d", i), Date: time.Now()}
+			if err := dbh.CreateTodo(todo); err != nil {
+				t.Errorf("Error creating a todo: %s", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if c := countTodos(t, dbh, "tx_isolated rolled back"); c != 0 {
+		t.Errorf("Expected the transaction's todos to be rolled back, found %d", c)
+	}
+	c, err := dbh.ORM.QueryTable("todo").Filter("text__startswith", "tx_isolated kept").Count()
+	if err != nil || c != 10 {
+		t.Errorf("Expected the todos created outside the transaction to be kept, found %d, %v", c, err)
+	}
+}
+
+func TestAddTodoToAllPeople(t *testing.T) {
+	dbh := setupTestDB(t)
+	if err := dbh.CreatePerson(&Person{Name: "all_people"}); err != nil {
+		t.Fatal(err)
+	}
+	people, err := dbh.GetPeopleById([]int64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	todos, err := dbh.AddTodoToAllPeople(&Todo{Text: "everyone todo", Date: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != len(people) || todos[0].Id == 0 || todos[0].Text != "everyone todo" {
+		t.Fatalf("Expected the %d created todos back, got %+v", len(people), todos)
+	}
+
+	if c := countTodos(t, dbh, "everyone todo"); c != int64(len(people)) {
+		t.Fatalf("Expected %d todos, found %d", len(people), c)
+	}
+}
+
+func TestRemovePerson(t *testing.T) {
+	dbh := setupTestDB(t)
+	p := &Person{Name: "remove_me"}
+	if err := dbh.CreatePerson(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbh.CreateNote(&Note{Person: p, Text: "remove_me note", Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbh.CreateTodo(&Todo{Person: p, Text: "remove_me todo", Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbh.RemovePerson(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbh.GetPersonById(p.Id); err == nil {
+		t.Fatal("Expected person to be deleted")
+	}
+	if c := countTodos(t, dbh, "remove_me todo"); c != 0 {
+		t.Fatalf("Expected person's todos to be deleted, found %d", c)
+	}
+	c, err := dbh.ORM.QueryTable("note").Filter("person_id", p.Id).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != 0 {
+		t.Fatalf("Expected person's notes to be deleted, found %d", c)
+	}
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// Statuses of a WebhookDelivery.
+const (
+	// Waiting for its next attempt
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// Gave up after too many attempts
+	DeliveryFailed = "failed"
+)
+
+// Webhook is a url a user wants told about changes in a workspace.
+type Webhook struct {
+	Id        int64      `json:"id"`
+	Workspace *Workspace `orm:"rel(fk)" json:"-"`
+	Owner     *User      `orm:"rel(fk)" json:"-"`
+	URL       string     `orm:"column(url);size(2048)" json:"url"`
+	// Key of the HMAC deliveries are signed with
+	Secret string `orm:"size(128)" json:"-"`
+	// Comma separated events to deliver, like "note.created" or "todo.*".
+	// Empty for all of them.
+	Events string `orm:"size(1024)" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+// Wants returns true if event, like "note.created", passes w's filter.
+func (w *Webhook) Wants(event string) bool {
+	if w.Events == "" {
+		return true
+	}
+	kind := strings.SplitN(event, ".", 2)[0]
+	for _, e := range strings.Split(w.Events, ",") {
+		if e == "*" || e == event || e == kind+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event queued to be sent to a webhook, and how
+// sending it has gone so far.
+type WebhookDelivery struct {
+	Id      int64    `json:"id"`
+	Webhook *Webhook `orm:"rel(fk)" json:"-"`
+	Event   string   `orm:"size(32)" json:"event"`
+	// The body to send.  Encrypted like note text as it has notes in it.
+	Payload  string `orm:"type(text)" json:"-"`
+	Status   string `orm:"size(16);index" json:"status"`
+	Attempts int    `orm:"default(0)" json:"attempts"`
+	// When to try next while pending
+	NextAttempt time.Time `orm:"type(datetime);null;index" json:"next_attempt"`
+	// Of the last attempt.  ResponseCode is 0 if there was no response.
+	ResponseCode int    `orm:"default(0)" json:"response_code"`
+	LastError    string `orm:"type(text)" json:"last_error"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+func (dbh *DBHandle) CreateWebhook(w *Webhook) error {
+	if dbh.workspace != nil {
+		w.Workspace = dbh.workspace
+	}
+	w.CreatedAt = now()
+	w.UpdatedAt = w.CreatedAt
+	_, err := dbh.ORM.Insert(w)
+	return err
+}
+
+func (dbh *DBHandle) GetWebhooks() ([]*Webhook, error) {
+	var hooks []*Webhook
+	_, err := dbh.table("webhook").OrderBy("id").Limit(-1).All(&hooks)
+	return hooks, err
+}
+
+func (dbh *DBHandle) GetWebhookById(id int64) (*Webhook, error) {
+	w := Webhook{}
+	if err := dbh.table("webhook").Filter("id", id).One(&w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// RemoveWebhook removes w and its deliveries.
+func (dbh *DBHandle) RemoveWebhook(w *Webhook) error {
+	if err := dbh.checkScope("webhook", w.Id); err != nil {
+		return err
+	}
+	return dbh.WithTx(func(tx *Tx) error {
+		if _, err := tx.ORM.QueryTable("webhook_delivery").Filter("webhook_id", w.Id).Delete(); err != nil {
+			return err
+		}
+		_, err := tx.ORM.Delete(w)
+		return err
+	})
+}
+
+func (dbh *DBHandle) CreateDelivery(d *WebhookDelivery) error {
+	if err := dbh.checkScope("webhook", d.Webhook.Id); err != nil {
+		return err
+	}
+	restore, err := dbh.sealText(&d.Payload)
+	defer restore()
+	if err != nil {
+		return err
+	}
+	d.NextAttempt = d.NextAttempt.Truncate(time.Second)
+	d.CreatedAt = now()
+	d.UpdatedAt = d.CreatedAt
+	_, err = dbh.ORM.Insert(d)
+	return err
+}
+
+// UpdateDelivery saves how the last attempt at d went.  The payload is
+// never changed.
+func (dbh *DBHandle) UpdateDelivery(d *WebhookDelivery) error {
+	// Stored to the second, and compared as stored.
+	d.NextAttempt = d.NextAttempt.Truncate(time.Second)
+	d.UpdatedAt = now()
+	_, err := dbh.ORM.Update(d, "Status", "Attempts", "NextAttempt", "ResponseCode", "LastError", "UpdatedAt")
+	return err
+}
+
+// GetDueDeliveries returns up to limit pending deliveries, in every
+// workspace, due at or before t, with their webhooks, oldest first.
+func (dbh *DBHandle) GetDueDeliveries(t time.Time, limit int) ([]*WebhookDelivery, error) {
+	// Times are stored with their zone after them, which sorts them after
+	// the same second given without one, so look for anything before the
+	// next second instead.
+	var ds []*WebhookDelivery
+	_, err := dbh.ORM.QueryTable("webhook_delivery").Filter("status", DeliveryPending).
+		Filter("next_attempt__lt", t.Truncate(time.Second).Add(time.Second)).RelatedSel("Webhook").OrderBy("next_attempt", "id").Limit(limit).All(&ds)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range ds {
+		if err := dbh.openText(&d.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+// GetDeliveries returns the last limit deliveries to w, newest first.
+func (dbh *DBHandle) GetDeliveries(w *Webhook, limit int) ([]*WebhookDelivery, error) {
+	if err := dbh.checkScope("webhook", w.Id); err != nil {
+		return nil, err
+	}
+	var ds []*WebhookDelivery
+	_, err := dbh.ORM.QueryTable("webhook_delivery").Filter("webhook_id", w.Id).
+		OrderBy("-id").Limit(limit).All(&ds)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range ds {
+		if err := dbh.openText(&d.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
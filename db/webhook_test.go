@@ -0,0 +1,106 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		events string
+		event  string
+		wants  bool
+	}{
+		{"", "note.created", true},
+		{"*", "todo.deleted", true},
+		{"note.created,todo.*", "note.created", true},
+		{"note.created,todo.*", "todo.updated", true},
+		{"note.created,todo.*", "note.updated", false},
+		{"person.deleted", "person.created", false},
+	}
+	for _, test := range tests {
+		w := &db.Webhook{Events: test.events}
+		if w.Wants(test.event) != test.wants {
+			t.Errorf("Expected %q wanting %s to be %v", test.events, test.event, test.wants)
+		}
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	dbh := db.SetupTestDB(t)
+	c, _ := db.NewTestCipher(t)
+	dbh.SetCipher(c)
+	stores := map[string]db.Store{"sqlite3": dbh, "fake": dbtest.NewFakeStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			u := &db.User{Name: "webhooks"}
+			if err := store.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+			ws := &db.Workspace{Name: "webhooks"}
+			if err := store.CreateWorkspace(ws, u); err != nil {
+				t.Fatal(err)
+			}
+			scoped := store.InWorkspace(ws)
+			w := &db.Webhook{Owner: u, URL: "https://example.com/hook", Secret: "s3cret"}
+			if err := scoped.CreateWebhook(w); err != nil {
+				t.Fatal(err)
+			}
+			other := store.InWorkspace(&db.Workspace{Id: ws.Id + 100})
+			if _, err := other.GetWebhookById(w.Id); err != db.ErrNotFound {
+				t.Errorf("Expected the webhook to be hidden from other workspaces, got %v", err)
+			}
+
+			now := time.Now().Truncate(time.Second)
+			due := &db.WebhookDelivery{Webhook: w, Event: "note.created", Payload: `{"note": "secret"}`,
+				Status: db.DeliveryPending, NextAttempt: now.Add(-time.Minute)}
+			later := &db.WebhookDelivery{Webhook: w, Event: "note.updated", Payload: "{}",
+				Status: db.DeliveryPending, NextAttempt: now.Add(time.Hour)}
+			for _, d := range []*db.WebhookDelivery{due, later} {
+				if err := scoped.CreateDelivery(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if store == dbh {
+				var raw string
+				if err := dbh.ORM.Raw("SELECT payload FROM webhook_delivery WHERE id = ?", due.Id).QueryRow(&raw); err != nil || !db.IsEncrypted(raw) {
+					t.Errorf("Expected the payload to be encrypted in the database, got %q, %v", raw, err)
+				}
+			}
+
+			ds, err := store.GetDueDeliveries(now, 10)
+			if err != nil || len(ds) != 1 || ds[0].Id != due.Id {
+				t.Fatalf("Expected only the due delivery, got %+v, %v", ds, err)
+			}
+			if ds[0].Payload != due.Payload || ds[0].Webhook.URL != w.URL || ds[0].Webhook.Secret != w.Secret {
+				t.Errorf("Expected the delivery with its payload and webhook, got %+v", ds[0])
+			}
+
+			ds[0].Status = db.DeliveryDelivered
+			ds[0].Attempts = 1
+			ds[0].ResponseCode = 204
+			if err := store.UpdateDelivery(ds[0]); err != nil {
+				t.Fatal(err)
+			}
+			ds, err = store.GetDueDeliveries(now.Add(2*time.Hour), 10)
+			if err != nil || len(ds) != 1 || ds[0].Id != later.Id {
+				t.Errorf("Expected delivered deliveries not to be due again, got %+v, %v", ds, err)
+			}
+
+			log, err := scoped.GetDeliveries(w, 10)
+			if err != nil || len(log) != 2 || log[0].Id != later.Id || log[1].Status != db.DeliveryDelivered || log[1].ResponseCode != 204 {
+				t.Errorf("Expected the log newest first, got %+v, %v", log, err)
+			}
+
+			if err := scoped.RemoveWebhook(w); err != nil {
+				t.Fatal(err)
+			}
+			if ds, err := store.GetDueDeliveries(now.Add(2*time.Hour), 10); err != nil || len(ds) != 0 {
+				t.Errorf("Expected the webhook's deliveries to be removed with it, got %+v, %v", ds, err)
+			}
+		})
+	}
+}
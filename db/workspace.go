@@ -0,0 +1,338 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// Membership roles, from most to least privileged.  HR partners can read
+// people and CategoryHR notes and nothing else.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+	RoleHR     = "hr"
+)
+
+// How often users are sent a digest email.
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+	DigestOff    = "off"
+)
+
+func ValidDigestSchedule(schedule string) bool {
+	return schedule == DigestDaily || schedule == DigestWeekly || schedule == DigestOff
+}
+
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleEditor || role == RoleViewer || role == RoleHR
+}
+
+// Workspace scopes people, notes and todos.  Every request to the api is
+// made in exactly one workspace.
+type Workspace struct {
+	Id   int64  `json:"id"`
+	Name string `orm:"size(255)" json:"name"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"created_at"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"updated_at"`
+}
+
+// User is someone who can log in to the api, as opposed to a Person who is
+// someone being managed.
+type User struct {
+	Id    int64  `json:"id"`
+	Name  string `orm:"size(255);unique" json:"name"`
+	Token string `orm:"size(64);unique" json:"-"`
+	// Only lets its holder read the user's calendar feed.  Empty until the
+	// user asks for the feed.
+	CalendarToken string `orm:"size(64);index" json:"-"`
+	// Mail sent to an address starting with this becomes notes by the user.
+	// Empty until the user asks for an address.
+	InboxToken string `orm:"size(64);index" json:"-"`
+	// Where digests are sent.  Users without one don't get any.
+	Email string `orm:"size(255)" json:"-"`
+	// DigestDaily, DigestWeekly or DigestOff.  Empty is daily.
+	DigestSchedule string `orm:"size(16)" json:"-"`
+	// When the last digest was sent
+	DigestSentAt time.Time `orm:"type(datetime);null" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"-"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"-"`
+}
+
+type Membership struct {
+	Id        int64      `json:"id"`
+	Workspace *Workspace `orm:"rel(fk)" json:"-"`
+	User      *User      `orm:"rel(fk)" json:"-"`
+	Role      string     `orm:"size(16)" json:"role"`
+	// Who User reports to in this workspace, if anyone
+	Manager *User `orm:"rel(fk);null" json:"-"`
+	// Set by the db package when the row is created and updated
+	CreatedAt time.Time `orm:"type(datetime);null" json:"-"`
+	UpdatedAt time.Time `orm:"type(datetime);null" json:"-"`
+}
+
+func (m *Membership) TableUnique() [][]string {
+	return [][]string{{"Workspace", "User"}}
+}
+
+// CanWrite returns true if the member may create, change and delete things
+// in the workspace.
+func (m *Membership) CanWrite() bool {
+	return m.Role == RoleOwner || m.Role == RoleEditor
+}
+
+func NewToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// InWorkspace returns a copy of the handle that only sees, and creates, rows
+// in ws.
+func (dbh *DBHandle) InWorkspace(ws *Workspace) Store {
+	d := *dbh
+	d.workspace = ws
+	return &d
+}
+
+// table returns a QuerySeter for the named table limited to the handle's
+// workspace, if it has one.
+func (dbh *DBHandle) table(name string) orm.QuerySeter {
+	q := dbh.ORM.QueryTable(name)
+	if dbh.workspace != nil {
+		q = q.Filter("workspace_id", dbh.workspace.Id)
+	}
+	return q
+}
+
+// checkScope returns ErrNotFound if the row with the given id isn't visible
+// from the handle's workspace.
+func (dbh *DBHandle) checkScope(table string, id int64) error {
+	if dbh.workspace == nil {
+		return nil
+	}
+	if !dbh.table(table).Filter("id", id).Exist() {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkPersonScope returns ErrNotFound if p isn't visible from the handle's
+// workspace.
+func (dbh *DBHandle) checkPersonScope(p *Person) error {
+	if p == nil {
+		return nil
+	}
+	return dbh.checkScope("person", p.Id)
+}
+
+func (dbh *DBHandle) CreateUser(u *User) error {
+	if u.Token == "" {
+		token, err := NewToken()
+		if err != nil {
+			return err
+		}
+		u.Token = token
+	}
+	u.CreatedAt = now()
+	u.UpdatedAt = u.CreatedAt
+	_, err := dbh.ORM.Insert(u)
+	return err
+}
+
+func (dbh *DBHandle) GetUserById(id int64) (*User, error) {
+	u := User{Id: id}
+	err := dbh.ORM.Read(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (dbh *DBHandle) GetUserByName(name string) (*User, error) {
+	u := User{Name: name}
+	err := dbh.ORM.Read(&u, "Name")
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (dbh *DBHandle) GetUserByToken(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	u := User{Token: token}
+	err := dbh.ORM.Read(&u, "Token")
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (dbh *DBHandle) GetUserByCalendarToken(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	u := User{CalendarToken: token}
+	err := dbh.ORM.Read(&u, "CalendarToken")
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetCalendarToken saves u.CalendarToken.  Setting it to "" turns the
+// user's feed off.
+func (dbh *DBHandle) SetCalendarToken(u *User) error {
+	u.UpdatedAt = now()
+	_, err := dbh.ORM.Update(u, "CalendarToken", "UpdatedAt")
+	return err
+}
+
+func (dbh *DBHandle) GetUserByInboxToken(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	u := User{InboxToken: token}
+	err := dbh.ORM.Read(&u, "InboxToken")
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetInboxToken saves u.InboxToken.  Setting it to "" stops mail being
+// taken in for the user.
+func (dbh *DBHandle) SetInboxToken(u *User) error {
+	u.UpdatedAt = now()
+	_, err := dbh.ORM.Update(u, "InboxToken", "UpdatedAt")
+	return err
+}
+
+// Digest returns how often u is sent a digest.
+func (u *User) Digest() string {
+	if u.DigestSchedule == "" {
+		return DigestDaily
+	}
+	return u.DigestSchedule
+}
+
+func (dbh *DBHandle) GetUsers() ([]*User, error) {
+	var users []*User
+	_, err := dbh.ORM.QueryTable("user").OrderBy("id").Limit(-1).All(&users)
+	return users, err
+}
+
+// SetDigest saves u.Email, u.DigestSchedule and u.DigestSentAt.
+func (dbh *DBHandle) SetDigest(u *User) error {
+	u.UpdatedAt = now()
+	_, err := dbh.ORM.Update(u, "Email", "DigestSchedule", "DigestSentAt", "UpdatedAt")
+	return err
+}
+
+// CreateWorkspace creates ws with owner as its owner.
+func (dbh *DBHandle) CreateWorkspace(ws *Workspace, owner *User) error {
+	ws.CreatedAt = now()
+	ws.UpdatedAt = ws.CreatedAt
+	return dbh.WithTx(func(tx *Tx) error {
+		if _, err := tx.ORM.Insert(ws); err != nil {
+			return err
+		}
+		m := Membership{Workspace: ws, User: owner, Role: RoleOwner, CreatedAt: ws.CreatedAt, UpdatedAt: ws.CreatedAt}
+		_, err := tx.ORM.Insert(&m)
+		return err
+	})
+}
+
+func (dbh *DBHandle) GetWorkspaceById(id int64) (*Workspace, error) {
+	ws := Workspace{Id: id}
+	err := dbh.ORM.Read(&ws)
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// GetMemberships returns all of u's memberships with their workspaces
+// loaded.
+func (dbh *DBHandle) GetMemberships(u *User) ([]*Membership, error) {
+	var ms []*Membership
+	_, err := dbh.ORM.QueryTable("membership").Filter("user_id", u.Id).
+		OrderBy("workspace_id").RelatedSel("Workspace").All(&ms)
+	return ms, err
+}
+
+func (dbh *DBHandle) GetMembership(ws *Workspace, u *User) (*Membership, error) {
+	m := Membership{}
+	err := dbh.ORM.QueryTable("membership").Filter("workspace_id", ws.Id).
+		Filter("user_id", u.Id).RelatedSel().One(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMember adds u to ws with the given role, or changes their role if they
+// are already a member.
+func (dbh *DBHandle) SetMember(ws *Workspace, u *User, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("Unknown role: %s", role)
+	}
+	m, err := dbh.GetMembership(ws, u)
+	if err == ErrNotFound {
+		created := now()
+		_, err = dbh.ORM.Insert(&Membership{Workspace: ws, User: u, Role: role, CreatedAt: created, UpdatedAt: created})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	m.Role = role
+	m.UpdatedAt = now()
+	_, err = dbh.ORM.Update(m, "Role", "UpdatedAt")
+	return err
+}
+
+// SetManager records that u reports to manager in ws.  A nil manager means u
+// doesn't report to anyone.
+func (dbh *DBHandle) SetManager(ws *Workspace, u *User, manager *User) error {
+	m, err := dbh.GetMembership(ws, u)
+	if err != nil {
+		return err
+	}
+	m.Manager = manager
+	m.UpdatedAt = now()
+	_, err = dbh.ORM.Update(m, "Manager", "UpdatedAt")
+	return err
+}
+
+func (dbh *DBHandle) RemoveMember(ws *Workspace, u *User) error {
+	_, err := dbh.ORM.QueryTable("membership").Filter("workspace_id", ws.Id).
+		Filter("user_id", u.Id).Delete()
+	return err
+}
+
+// AdoptUnscoped moves every person, note and todo that isn't in a workspace
+// (i.e. everything created before workspaces existed) into ws.
+func (dbh *DBHandle) AdoptUnscoped(ws *Workspace) error {
+	return dbh.WithTx(func(tx *Tx) error {
+		for _, table := range []string{"person", "note", "todo"} {
+			_, err := tx.ORM.QueryTable(table).Filter("workspace__isnull", true).
+				Update(orm.Params{"workspace": ws.Id})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,318 @@
+// Package ical reads and writes the parts of iCalendar (RFC 5545) that
+// pointyhair's calendar feed and imports need: components, properties with
+// parameters, text escaping and date-times.  It doesn't know what any
+// component or property means.
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	timeFormat = "20060102T150405Z"
+	// Local and floating times have no Z
+	localTimeFormat = "20060102T150405"
+	dateFormat      = "20060102"
+	// Lines longer than this many octets are folded
+	maxLine = 75
+)
+
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Component is a BEGIN/END block, like VCALENDAR or VTODO, and everything
+// in it.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []*Component
+}
+
+func NewComponent(name string) *Component {
+	return &Component{Name: name}
+}
+
+// Add adds a property with the given raw value, which must already be
+// escaped if it's text.
+func (c *Component) Add(name string, value string) {
+	c.Properties = append(c.Properties, Property{Name: name, Value: value})
+}
+
+// AddText adds a TEXT property, escaping value.
+func (c *Component) AddText(name string, text string) {
+	c.Add(name, EscapeText(text))
+}
+
+// AddTime adds a DATE-TIME property in UTC.
+func (c *Component) AddTime(name string, t time.Time) {
+	c.Add(name, t.UTC().Format(timeFormat))
+}
+
+// AddComponent adds sub as a child of c.
+func (c *Component) AddComponent(sub *Component) {
+	c.Components = append(c.Components, sub)
+}
+
+// Get returns the first property called name.
+func (c *Component) Get(name string) (Property, bool) {
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Text returns the unescaped value of the first TEXT property called
+// name, or "" if there isn't one.
+func (c *Component) Text(name string) string {
+	p, _ := c.Get(name)
+	return UnescapeText(p.Value)
+}
+
+// Time returns the time of the first property called name.
+func (c *Component) Time(name string) (time.Time, error) {
+	p, ok := c.Get(name)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no %s", name)
+	}
+	return p.Time()
+}
+
+// All returns every component called name under c, at any depth.
+func (c *Component) All(name string) []*Component {
+	var found []*Component
+	for _, sub := range c.Components {
+		if sub.Name == name {
+			found = append(found, sub)
+		}
+		found = append(found, sub.All(name)...)
+	}
+	return found
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func EscapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func UnescapeText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Time parses the property's value as a DATE-TIME, in UTC, in the zone
+// named by its TZID parameter or, if floating, in time.Local, or as a
+// DATE if its VALUE parameter says so or it has no time.
+func (p Property) Time() (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == len(dateFormat) {
+		return time.ParseInLocation(dateFormat, p.Value, time.Local)
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		return time.Parse(timeFormat, p.Value)
+	}
+	loc := time.Local
+	if tzid := p.Params["TZID"]; tzid != "" {
+		var err error
+		loc, err = time.LoadLocation(strings.TrimPrefix(tzid, "/"))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown TZID %s", tzid)
+		}
+	}
+	return time.ParseInLocation(localTimeFormat, p.Value, loc)
+}
+
+func quoteParam(v string) string {
+	if strings.ContainsAny(v, ":;,") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// writeLine writes a content line, folded so no line is longer than
+// maxLine octets without splitting a UTF-8 sequence.
+func writeLine(w *bufio.Writer, line string) {
+	limit := maxLine
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts towards the next line's length
+		limit = maxLine - 1
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+func (c *Component) encode(w *bufio.Writer) {
+	writeLine(w, "BEGIN:"+c.Name)
+	for _, p := range c.Properties {
+		line := p.Name
+		names := make([]string, 0, len(p.Params))
+		for name := range p.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line += ";" + name + "=" + quoteParam(p.Params[name])
+		}
+		writeLine(w, line+":"+p.Value)
+	}
+	for _, sub := range c.Components {
+		sub.encode(w)
+	}
+	writeLine(w, "END:"+c.Name)
+}
+
+// Encode writes c, and everything in it, to w.
+func (c *Component) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	c.encode(bw)
+	return bw.Flush()
+}
+
+// unfold returns the content lines of r with folded lines joined back up.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseLine splits a content line into a property.  Names and parameter
+// names are case insensitive so they're upper cased.
+func parseLine(line string) (Property, error) {
+	p := Property{}
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return p, fmt.Errorf("no value in %q", line)
+	}
+	p.Value = line[colon+1:]
+	parts := splitUnquoted(line[:colon], ';')
+	p.Name = strings.ToUpper(parts[0])
+	if p.Name == "" {
+		return p, fmt.Errorf("no name in %q", line)
+	}
+	for _, param := range parts[1:] {
+		eq := strings.Index(param, "=")
+		if eq < 0 {
+			return p, fmt.Errorf("invalid parameter %q", param)
+		}
+		if p.Params == nil {
+			p.Params = map[string]string{}
+		}
+		p.Params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], `"`)
+	}
+	return p, nil
+}
+
+func splitUnquoted(s string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == sep && !quoted {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Parse reads the single top level component, usually a VCALENDAR, in r.
+func Parse(r io.Reader) (*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var stack []*Component
+	var top *Component
+	for n, line := range lines {
+		p, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+		switch p.Name {
+		case "BEGIN":
+			if top != nil {
+				return nil, fmt.Errorf("line %d: more than one top level component", n+1)
+			}
+			c := NewComponent(strings.ToUpper(p.Value))
+			if len(stack) > 0 {
+				stack[len(stack)-1].AddComponent(c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", n+1, p.Value)
+			}
+			if len(stack) == 1 {
+				top = stack[0]
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: %s outside of a component", n+1, p.Name)
+			}
+			c := stack[len(stack)-1]
+			c.Properties = append(c.Properties, p)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("no END:%s", stack[len(stack)-1].Name)
+	}
+	if top == nil {
+		return nil, errors.New("no component found")
+	}
+	return top, nil
+}
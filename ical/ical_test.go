@@ -0,0 +1,87 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cal := NewComponent("VCALENDAR")
+	cal.Add("VERSION", "2.0")
+	todo := NewComponent("VTODO")
+	text := "Ask about the budget; bring numbers, charts\nand a \\ backslash. " + strings.Repeat("ünïcødé ", 20)
+	todo.AddText("SUMMARY", text)
+	due := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	todo.AddTime("DUE", due)
+	todo.Properties = append(todo.Properties, Property{Name: "X-NAME", Params: map[string]string{"CN": "Doe, Jane"}, Value: "x"})
+	cal.AddComponent(todo)
+
+	var b bytes.Buffer
+	if err := cal.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLine {
+			t.Errorf("Expected lines of at most %d octets, got %q", maxLine, line)
+		}
+	}
+
+	parsed, err := Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	todos := parsed.All("VTODO")
+	if parsed.Name != "VCALENDAR" || len(todos) != 1 {
+		t.Fatalf("Expected a calendar with a todo, got %+v", parsed)
+	}
+	if got := todos[0].Text("SUMMARY"); got != text {
+		t.Errorf("Expected the summary %q back, got %q", text, got)
+	}
+	if got, err := todos[0].Time("DUE"); err != nil || !got.Equal(due) {
+		t.Errorf("Expected due %s, got %s, %v", due, got, err)
+	}
+	if p, _ := todos[0].Get("X-NAME"); p.Params["CN"] != "Doe, Jane" {
+		t.Errorf("Expected a quoted parameter back, got %+v", p)
+	}
+}
+
+func TestParseTimes(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone database")
+	}
+	tests := []struct {
+		line     string
+		expected time.Time
+	}{
+		{"DTSTART:20200102T030405Z", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"DTSTART;TZID=America/New_York:20200102T030405", time.Date(2020, 1, 2, 3, 4, 5, 0, ny)},
+		{"DTSTART;VALUE=DATE:20200102", time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		c, err := Parse(strings.NewReader("BEGIN:VEVENT\r\n" + test.line + "\r\nEND:VEVENT\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Time("DTSTART")
+		if err != nil || !got.Equal(test.expected) {
+			t.Errorf("Expected %s from %s, got %s, %v", test.expected, test.line, got, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"BEGIN:VCALENDAR\r\n",
+		"BEGIN:VCALENDAR\r\nEND:VEVENT\r\n",
+		"SUMMARY:loose\r\n",
+		"BEGIN:VCALENDAR\r\nnocolon\r\nEND:VCALENDAR\r\n",
+	} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
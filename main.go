@@ -2,18 +2,259 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/blob"
 	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/smtpd"
 )
 
+var dbPath = flag.String("db", "test.sql",
+	"Path to the sqlite3 database file or a postgres:// connection URL")
+var addUser = flag.String("add-user", "",
+	"Create a user with this name and a workspace for them, print their API token and exit")
+var keyFile = flag.String("key-file", "",
+	"Encrypt note and todo text and attached files with the base64 encoded key in this file.  "+
+		"The key can also be given in $"+keyEnv)
+var attachmentDir = flag.String("attachment-dir", "attachments",
+	"Directory to keep the content of attached files in")
+
+var smtpAddr = flag.String("smtp-addr", "",
+	"host:port of the SMTP server to send digest emails through.  No digests are sent without one.")
+var smtpUser = flag.String("smtp-user", "",
+	"User to authenticate to the SMTP server as, with the password in $"+smtpPasswordEnv)
+var mailFrom = flag.String("mail-from", "pointyhair@localhost", "Address digests are sent from")
+var digestHour = flag.Int("digest-hour", 7, "Hour of the day, in local time, digests are sent from")
+var digestWeekday = flag.String("digest-weekday", "Monday", "Day weekly digests are sent on")
+var mailListen = flag.String("mail-listen", "",
+	"host:port to take in email forwarded to users' inbox addresses on, like :25.  Not done without one.")
+
+// Environment variable the encryption key can be given in instead of
+// -key-file.
+const keyEnv = "POINTYHAIR_ENCRYPTION_KEY"
+
+// Environment variable the SMTP password is given in.
+const smtpPasswordEnv = "POINTYHAIR_SMTP_PASSWORD"
+
 func main() {
-	dbh, err := db.NewDBHandle("test.sql", true)
+	flag.Set("logtostderr", "true")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n%s\nFlags:\n", os.Args[0], cliUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "people", "note", "todo":
+		err := runCLI(flag.Args(), os.Stdin, os.Stdout)
+		if err == errUsage {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pointyhair: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	case "tui":
+		if err := runTUI(); err != nil {
+			fmt.Fprintf(os.Stderr, "pointyhair: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	case "", "serve", "rotate-key", "send-digests":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dbh, key, err := openDB(true)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	flag.Set("logtostderr", "true")
 
+	if flag.Arg(0) == "rotate-key" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = rotateKey(dbh, key, flag.Arg(1))
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var digester *api.Digester
+	if *smtpAddr != "" {
+		digester, err = newDigester(dbh)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if flag.Arg(0) == "send-digests" {
+		if digester == nil {
+			glog.Fatal("send-digests needs -smtp-addr")
+		}
+		sent, err := digester.SendDue()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		fmt.Printf("Sent %d digests\n", sent)
+		return
+	}
+
+	if *addUser != "" {
+		err = createUser(dbh, *addUser)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	blobs, err := blob.NewDir(*attachmentDir)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	dbh.SetBlobs(blobs)
+
+	if digester != nil {
+		go digester.Run()
+	}
+	if *mailListen != "" {
+		go serveMail(dbh)
+	}
 	api.RunWebUi(dbh)
 }
+
+// openDB opens -db, decrypting with the key from loadKey if there is one,
+// and returns it with the key.
+func openDB(verbose bool) (*db.DBHandle, []byte, error) {
+	dbh, err := db.NewDBHandle(*dbPath, verbose)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := loadKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if key != nil {
+		c, err := db.NewCipher(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		dbh.SetCipher(c)
+	}
+	return dbh, key, nil
+}
+
+// newDigester returns a Digester sending through the SMTP server given by
+// the flags.
+func newDigester(dbh *db.DBHandle) (*api.Digester, error) {
+	weekday := -1
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), *digestWeekday) {
+			weekday = int(d)
+		}
+	}
+	if weekday < 0 {
+		return nil, fmt.Errorf("Unknown -digest-weekday %s", *digestWeekday)
+	}
+	if *digestHour < 0 || *digestHour > 23 {
+		return nil, fmt.Errorf("-digest-hour must be from 0 to 23, not %d", *digestHour)
+	}
+	return api.NewDigester(dbh, api.DigestOptions{
+		SMTPAddr:     *smtpAddr,
+		SMTPUsername: *smtpUser,
+		SMTPPassword: os.Getenv(smtpPasswordEnv),
+		From:         *mailFrom,
+		Hour:         *digestHour,
+		Weekday:      time.Weekday(weekday),
+	}), nil
+}
+
+// serveMail takes in email on -mail-listen, forever.
+func serveMail(dbh *db.DBHandle) {
+	hostname, _ := os.Hostname()
+	s := &smtpd.Server{
+		Addr:     *mailListen,
+		Hostname: hostname,
+		Handler:  api.NewMailIngester(dbh).Deliver,
+	}
+	glog.Fatal(s.ListenAndServe())
+}
+
+// createUser creates a user who owns a new workspace.  The first workspace
+// created also gets everything from before workspaces existed.
+func createUser(dbh *db.DBHandle, name string) error {
+	existing, err := dbh.ORM.QueryTable("workspace").Count()
+	if err != nil {
+		return err
+	}
+
+	u := db.User{Name: name}
+	err = dbh.CreateUser(&u)
+	if err != nil {
+		return err
+	}
+	ws := db.Workspace{Name: name + "'s workspace"}
+	err = dbh.CreateWorkspace(&ws, &u)
+	if err != nil {
+		return err
+	}
+	if existing == 0 {
+		err = dbh.AdoptUnscoped(&ws)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Created user %s in workspace %d with API token %s\n", u.Name, ws.Id, u.Token)
+	return nil
+}
+
+// loadKey returns the encryption key from -key-file or the environment, or
+// nil if encryption isn't turned on.
+func loadKey() ([]byte, error) {
+	if *keyFile != "" {
+		return db.LoadKeyFile(*keyFile)
+	}
+	if env := os.Getenv(keyEnv); env != "" {
+		return db.ParseKey(env)
+	}
+	return nil, nil
+}
+
+// rotateKey re-encrypts everything with the key in new_key_file.  old_key is
+// the key currently in use, if any; text that isn't encrypted yet gets
+// encrypted, so this is also how encryption is turned on for an existing
+// database.
+func rotateKey(dbh *db.DBHandle, old_key []byte, new_key_file string) error {
+	new_key, err := db.LoadKeyFile(new_key_file)
+	if err != nil {
+		return err
+	}
+	var old_keys [][]byte
+	if old_key != nil {
+		old_keys = append(old_keys, old_key)
+	}
+	c, err := db.NewCipher(new_key, old_keys...)
+	if err != nil {
+		return err
+	}
+	count, err := dbh.RotateKey(c)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Re-encrypted %d notes and todos with the key in %s; use it from now on\n", count, new_key_file)
+	return nil
+}
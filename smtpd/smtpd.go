@@ -0,0 +1,257 @@
+// Package smtpd is a small SMTP (RFC 5321) server for receiving mail.  It
+// speaks just enough of the protocol for mail servers and clients to
+// deliver to it: no TLS, authentication or relaying.  Every message is
+// handed to a Handler along with its envelope.
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// Messages bigger than this are refused unless Server.MaxSize says
+	// otherwise
+	defaultMaxSize = 25 << 20
+	defaultTimeout = 5 * time.Minute
+	maxRecipients  = 100
+)
+
+// Handler is called with each message received, once it has all been read,
+// with its lines ending in \n.  Returning an *Error replies with its code
+// and message, and any other error with a temporary failure so the sender
+// tries again later.
+type Handler func(from string, to []string, data []byte) error
+
+// Error is a reply to a message that couldn't be delivered.  Codes from 500
+// up tell the sender not to try again.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+type Server struct {
+	// host:port to listen on
+	Addr string
+	// Name the server greets clients with
+	Hostname string
+	Handler  Handler
+	// Largest message accepted, in bytes
+	MaxSize int64
+	// How long a client may take to send a command or a message
+	Timeout time.Duration
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it's closed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return defaultMaxSize
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultTimeout
+}
+
+// session is the state of one connection.
+type session struct {
+	s    *Server
+	conn net.Conn
+	r    *textproto.Reader
+	w    *bufio.Writer
+	// Envelope of the message being sent, if any
+	helo string
+	from *string
+	to   []string
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	sess.w.Flush()
+}
+
+func (sess *session) reset() {
+	sess.from = nil
+	sess.to = nil
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{
+		s:    s,
+		conn: conn,
+		r:    textproto.NewReader(bufio.NewReader(conn)),
+		w:    bufio.NewWriter(conn),
+	}
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	sess.reply(220, "%s ESMTP pointyhair", hostname)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout()))
+		line, err := sess.r.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess.helo = arg
+			sess.reset()
+			sess.reply(250, "%s", hostname)
+		case "EHLO":
+			sess.helo = arg
+			sess.reset()
+			fmt.Fprintf(sess.w, "250-%s\r\n250-8BITMIME\r\n250-SIZE %d\r\n250 PIPELINING\r\n", hostname, s.maxSize())
+			sess.w.Flush()
+		case "MAIL":
+			sess.mail(arg)
+		case "RCPT":
+			sess.rcpt(arg)
+		case "DATA":
+			if !sess.data() {
+				return
+			}
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "OK")
+		case "NOOP":
+			sess.reply(250, "OK")
+		case "VRFY":
+			sess.reply(252, "Send some mail and see")
+		case "QUIT":
+			sess.reply(221, "Bye")
+			return
+		default:
+			sess.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// path returns the address in a MAIL FROM or RCPT TO argument, like
+// "FROM:<a@example.com> SIZE=100".
+func path(arg string, prefix string) (string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", errors.New("Syntax error")
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", errors.New("Syntax error")
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", errors.New("Syntax error")
+	}
+	return arg[1:end], nil
+}
+
+func (sess *session) mail(arg string) {
+	if sess.helo == "" {
+		sess.reply(503, "Say hello first")
+		return
+	}
+	if sess.from != nil {
+		sess.reply(503, "Already have a sender")
+		return
+	}
+	from, err := path(arg, "FROM:")
+	if err != nil {
+		sess.reply(501, "%s", err)
+		return
+	}
+	sess.from = &from
+	sess.reply(250, "OK")
+}
+
+func (sess *session) rcpt(arg string) {
+	if sess.from == nil {
+		sess.reply(503, "Need a sender first")
+		return
+	}
+	to, err := path(arg, "TO:")
+	if err != nil || to == "" {
+		sess.reply(501, "Syntax error")
+		return
+	}
+	if len(sess.to) >= maxRecipients {
+		sess.reply(452, "Too many recipients")
+		return
+	}
+	sess.to = append(sess.to, to)
+	sess.reply(250, "OK")
+}
+
+// data reads a message and hands it to the handler.  It returns false if
+// the connection should be closed.
+func (sess *session) data() bool {
+	if len(sess.to) == 0 {
+		sess.reply(503, "Need recipients first")
+		return true
+	}
+	sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+	sess.conn.SetReadDeadline(time.Now().Add(sess.s.timeout()))
+	r := sess.r.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(r, sess.s.maxSize()+1))
+	if err != nil {
+		return false
+	}
+	if int64(len(data)) > sess.s.maxSize() {
+		// Read the rest so the client hears why
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return false
+		}
+		sess.reply(552, "Message too big")
+		sess.reset()
+		return true
+	}
+	from, to := *sess.from, sess.to
+	sess.reset()
+	if err := sess.s.Handler(from, to, data); err != nil {
+		if e, ok := err.(*Error); ok {
+			sess.reply(e.Code, "%s", e.Message)
+		} else {
+			sess.reply(451, "%s", err)
+		}
+		return true
+	}
+	sess.reply(250, "OK")
+	return true
+}
@@ -0,0 +1,88 @@
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	var mu sync.Mutex
+	var got []received
+	s := &Server{
+		Hostname: "mail.example.com",
+		MaxSize:  1024,
+		Handler: func(from string, to []string, data []byte) error {
+			if to[0] == "nobody@example.com" {
+				return &Error{550, "No such user"}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, received{from, to, string(data)})
+			return nil
+		},
+	}
+	addr := startServer(t, s)
+
+	msg := "Subject: Hi\r\n\r\nHello\r\n.leading dot\r\n"
+	err := smtp.SendMail(addr, nil, "me@example.com", []string{"a@example.com", "b@example.com"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].from != "me@example.com" || strings.Join(got[0].to, ",") != "a@example.com,b@example.com" {
+		t.Fatalf("Expected the message with its envelope, got %+v", got)
+	}
+	if got[0].data != strings.Replace(msg, "\r\n", "\n", -1) {
+		t.Errorf("Expected the message as sent, got %q", got[0].data)
+	}
+
+	err = smtp.SendMail(addr, nil, "me@example.com", []string{"nobody@example.com"}, []byte(msg))
+	if err == nil || !strings.Contains(err.Error(), "550") || !strings.Contains(err.Error(), "No such user") {
+		t.Errorf("Expected the handler's error, got %v", err)
+	}
+	err = smtp.SendMail(addr, nil, "me@example.com", []string{"a@example.com"}, []byte(strings.Repeat("x", 2000)))
+	if err == nil || !strings.Contains(err.Error(), "552") {
+		t.Errorf("Expected messages over MaxSize to be refused, got %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Expected refused messages not to be handled, got %d", len(got))
+	}
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		arg      string
+		expected string
+		ok       bool
+	}{
+		{"FROM:<a@example.com>", "a@example.com", true},
+		{"from: <a@example.com> SIZE=100", "a@example.com", true},
+		{"FROM:<>", "", true},
+		{"FROM:a@example.com", "", false},
+		{"TO:<a@example.com>", "", false},
+	}
+	for _, test := range tests {
+		p, err := path(test.arg, "FROM:")
+		if (err == nil) != test.ok || p != test.expected {
+			t.Errorf("Expected %q to give %q (ok %v), got %q, %v", test.arg, test.expected, test.ok, p, err)
+		}
+	}
+}
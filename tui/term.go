@@ -0,0 +1,179 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/db"
+)
+
+// Escape sequences sent by the keys HandleKey knows, in normal and
+// application cursor mode.
+var escapes = map[string]string{
+	"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+	"\x1bOA": "up", "\x1bOB": "down", "\x1bOC": "right", "\x1bOD": "left",
+}
+
+// decodeKeys returns the keys typed in b, as HandleKey takes them.
+func decodeKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		if b[0] == 0x1b && len(b) >= 3 {
+			if key, ok := escapes[string(b[:3])]; ok {
+				keys = append(keys, key)
+				b = b[3:]
+				continue
+			}
+			if b[1] == '[' {
+				// Skip the rest of the sequence, up to its final byte.
+				end := bytes.IndexFunc(b[2:], func(r rune) bool { return r >= 0x40 && r <= 0x7e })
+				if end >= 0 {
+					b = b[end+3:]
+					continue
+				}
+			}
+		}
+		switch b[0] {
+		case 0x1b:
+			keys = append(keys, "esc")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case '\t':
+			keys = append(keys, "tab")
+		case 0x7f, 0x08:
+			keys = append(keys, "backspace")
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		case 0x15:
+			keys = append(keys, "ctrl-u")
+		default:
+			r, size := utf8.DecodeRune(b)
+			if r >= ' ' && r != utf8.RuneError {
+				keys = append(keys, string(r))
+			}
+			b = b[size:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// stty runs stty on the terminal.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminal puts the terminal in raw mode on the alternate screen until
+// restore is called.
+type terminal struct {
+	state string
+}
+
+func openTerminal() (*terminal, error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("Not a terminal: %s", err)
+	}
+	t := &terminal{state: state}
+	return t, t.raw()
+}
+
+func (t *terminal) raw() error {
+	if _, err := stty("raw", "-echo"); err != nil {
+		return err
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	return nil
+}
+
+func (t *terminal) restore() {
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	stty(t.state)
+}
+
+// size returns the terminal's width and height.
+func (t *terminal) size() (int, int) {
+	out, err := stty("size")
+	var rows, cols int
+	if err != nil {
+		return 80, 24
+	}
+	if _, err := fmt.Sscan(out, &rows, &cols); err != nil {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+// draw writes lines over the screen.
+func draw(w io.Writer, lines []string) {
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	w.Write(b.Bytes())
+}
+
+// Run runs the ui on the terminal as u, in the workspace with the given id
+// or their only one if it's 0, until they quit.  edit asks for a note's
+// text in an editor; e does nothing without one.
+func Run(store db.Store, u *db.User, ws_id int64, edit func() (string, error)) error {
+	scoped, policy, err := api.OpenWorkspace(store, u, ws_id)
+	if err != nil {
+		return err
+	}
+	a, err := New(scoped, policy)
+	if err != nil {
+		return err
+	}
+	t, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer t.restore()
+
+	buf := make([]byte, 256)
+	for {
+		draw(os.Stdout, a.View(t.size()))
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return err
+		}
+		for _, key := range decodeKeys(buf[:n]) {
+			switch a.HandleKey(key) {
+			case ActionQuit:
+				return nil
+			case ActionEdit:
+				if edit == nil {
+					a.status = "No editor"
+					continue
+				}
+				t.restore()
+				text, err := edit()
+				if err := t.raw(); err != nil {
+					return err
+				}
+				if err != nil {
+					a.status = err.Error()
+					continue
+				}
+				a.AddNote(text)
+			}
+		}
+	}
+}
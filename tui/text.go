@@ -0,0 +1,53 @@
+package tui
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// fit pads or cuts s to exactly width characters.
+func fit(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n <= width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	if width < 1 {
+		return ""
+	}
+	return string([]rune(s)[:width-1]) + "…"
+}
+
+// wrap breaks text into lines no wider than width, between words where it
+// can.
+func wrap(text string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(strings.TrimSpace(text), "\n") {
+		line := []rune{}
+		for _, word := range strings.Fields(para) {
+			w := []rune(word)
+			if len(line) > 0 && len(line)+1+len(w) > width {
+				lines = append(lines, string(line))
+				line = line[:0]
+			}
+			for len(w) > width {
+				lines = append(lines, string(w[:width]))
+				w = w[width:]
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			line = append(line, w...)
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// firstLine returns the first line of text.
+func firstLine(text string) string {
+	return strings.SplitN(strings.TrimSpace(text), "\n", 2)[0]
+}
+
+func bold(s string) string      { return "\x1b[1m" + s + "\x1b[0m" }
+func underline(s string) string { return "\x1b[4m" + s + "\x1b[0m" }
+func reverse(s string) string   { return "\x1b[7m" + s + "\x1b[0m" }
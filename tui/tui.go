@@ -0,0 +1,500 @@
+// Package tui is a terminal ui for looking over people before 1:1s: the
+// people in a workspace, the selected person's recent notes and their open
+// todos side by side, with keys to add a note, complete a todo and search.
+//
+// It works on a db.Store directly, through api.OpenWorkspace so the user
+// sees and changes the same things they could over http.
+package tui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/db"
+)
+
+// Number of notes kept for the selected person
+const recentNotes = 20
+
+const help = "j/k move  tab todos  n note  e editor  x done  / search  r reload  q quit"
+
+type mode int
+
+const (
+	modeNormal mode = iota
+	modeSearch
+	modeNote
+)
+
+type pane int
+
+const (
+	panePeople pane = iota
+	paneTodos
+)
+
+// Action is what HandleKey wants done outside the App.
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionQuit
+	// Ask for a note's text in an editor, then give it to AddNote
+	ActionEdit
+)
+
+// App is the state of the ui, drawn by View and changed by HandleKey.
+type App struct {
+	store  db.Store
+	policy *api.Policy
+
+	// Everyone in the workspace, by name, with their notes and todos
+	people []*db.Person
+	// The people matching query, or everyone
+	shown    []*db.Person
+	selected int
+	focus    pane
+	todo     int
+
+	mode  mode
+	input string
+	query string
+	// Shown in place of the help until the next key
+	status string
+	now    func() time.Time
+}
+
+// New returns an App for the workspace store is scoped to, as the user
+// policy is for.
+func New(store db.Store, policy *api.Policy) (*App, error) {
+	a := &App{store: store, policy: policy, now: time.Now}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads everyone from the store again, keeping the selected person
+// selected.
+func (a *App) load() error {
+	people, err := a.store.GetPeopleById(nil)
+	if err != nil {
+		return err
+	}
+	err = a.store.LoadPeopleRelations(people, true, a.policy.CanReadTodos())
+	if err != nil {
+		return err
+	}
+	sort.Slice(people, func(i, j int) bool { return strings.ToLower(people[i].Name) < strings.ToLower(people[j].Name) })
+	for _, p := range people {
+		p.Notes = a.policy.FilterListed(p.Notes, true)
+		sort.Slice(p.Notes, func(i, j int) bool { return p.Notes[i].Date.After(p.Notes[j].Date) })
+		open := []*db.Todo{}
+		for _, t := range p.Todos {
+			if !t.Done {
+				open = append(open, t)
+			}
+		}
+		sort.Slice(open, func(i, j int) bool { return open[i].Date.Before(open[j].Date) })
+		p.Todos = open
+	}
+	todo := a.todo
+	a.people = people
+	a.filter()
+	a.todo = todo
+	a.clampTodo()
+	return nil
+}
+
+// matches returns true if p's name or email, or the text of one of their
+// notes or todos, contains query.
+func matches(p *db.Person, query string) bool {
+	contains := func(s string) bool { return strings.Contains(strings.ToLower(s), query) }
+	if contains(p.Name) || contains(p.Email) {
+		return true
+	}
+	for _, n := range p.Notes {
+		if contains(n.Text) {
+			return true
+		}
+	}
+	for _, t := range p.Todos {
+		if contains(t.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter sets shown to the people matching the query, keeping the
+// selected person selected if they match and otherwise selecting the first.
+func (a *App) filter() {
+	selected := a.person()
+	a.shown = a.people
+	if a.query != "" {
+		a.shown = []*db.Person{}
+		for _, p := range a.people {
+			if matches(p, strings.ToLower(a.query)) {
+				a.shown = append(a.shown, p)
+			}
+		}
+	}
+	a.selected, a.todo = 0, 0
+	for i, p := range a.shown {
+		if selected != nil && p.Id == selected.Id {
+			a.selected = i
+		}
+	}
+}
+
+// person returns the selected person, or nil if nobody is shown.
+func (a *App) person() *db.Person {
+	if a.selected < len(a.shown) {
+		return a.shown[a.selected]
+	}
+	return nil
+}
+
+// notes returns the selected person's recent notes, only those matching
+// the query if any do.
+func (a *App) notes() []*db.Note {
+	p := a.person()
+	if p == nil {
+		return nil
+	}
+	notes := p.Notes
+	if a.query != "" {
+		var matching []*db.Note
+		for _, n := range notes {
+			if strings.Contains(strings.ToLower(n.Text), strings.ToLower(a.query)) {
+				matching = append(matching, n)
+			}
+		}
+		if len(matching) > 0 {
+			notes = matching
+		}
+	}
+	if len(notes) > recentNotes {
+		notes = notes[:recentNotes]
+	}
+	return notes
+}
+
+func (a *App) todos() []*db.Todo {
+	if p := a.person(); p != nil {
+		return p.Todos
+	}
+	return nil
+}
+
+func (a *App) clampTodo() {
+	if a.todo >= len(a.todos()) {
+		a.todo = len(a.todos()) - 1
+	}
+	if a.todo < 0 {
+		a.todo = 0
+	}
+}
+
+// HandleKey changes the App for the key pressed: a single character, or
+// one of up, down, left, right, tab, enter, esc, backspace, ctrl-c and
+// ctrl-u.
+func (a *App) HandleKey(key string) Action {
+	a.status = ""
+	switch a.mode {
+	case modeSearch, modeNote:
+		return a.handleInput(key)
+	}
+	switch key {
+	case "q", "ctrl-c":
+		return ActionQuit
+	case "j", "down":
+		a.move(1)
+	case "k", "up":
+		a.move(-1)
+	case "tab":
+		if a.focus == panePeople {
+			a.focus = paneTodos
+		} else {
+			a.focus = panePeople
+		}
+	case "l", "right":
+		a.focus = paneTodos
+	case "h", "left":
+		a.focus = panePeople
+	case "/":
+		a.mode, a.input, a.focus = modeSearch, a.query, panePeople
+	case "esc":
+		if a.query != "" {
+			a.query = ""
+			a.filter()
+		}
+	case "n", "e":
+		if a.person() == nil {
+			a.status = "Nobody selected"
+		} else if !a.policy.CanWrite() {
+			a.status = "Viewers can't add notes"
+		} else if key == "e" {
+			return ActionEdit
+		} else {
+			a.mode, a.input = modeNote, ""
+		}
+	case "x", " ":
+		a.completeTodo()
+	case "r":
+		if err := a.load(); err != nil {
+			a.status = err.Error()
+		}
+	}
+	return ActionNone
+}
+
+func (a *App) handleInput(key string) Action {
+	switch key {
+	case "ctrl-c", "esc":
+		if a.mode == modeSearch {
+			a.query = ""
+			a.filter()
+		}
+		a.mode = modeNormal
+		return ActionNone
+	case "enter":
+		mode := a.mode
+		a.mode = modeNormal
+		if mode == modeNote {
+			a.AddNote(a.input)
+		} else if len(a.shown) == 0 {
+			a.status = fmt.Sprintf("Nothing matches %q", a.query)
+		}
+		return ActionNone
+	case "backspace":
+		if r := []rune(a.input); len(r) > 0 {
+			a.input = string(r[:len(r)-1])
+		}
+	case "ctrl-u":
+		a.input = ""
+	default:
+		if len([]rune(key)) != 1 {
+			return ActionNone
+		}
+		a.input += key
+	}
+	if a.mode == modeSearch {
+		a.query = a.input
+		a.filter()
+	}
+	return ActionNone
+}
+
+func (a *App) move(by int) {
+	if a.focus == paneTodos {
+		a.todo += by
+		a.clampTodo()
+		return
+	}
+	a.selected += by
+	if a.selected >= len(a.shown) {
+		a.selected = len(a.shown) - 1
+	}
+	if a.selected < 0 {
+		a.selected = 0
+	}
+	a.todo = 0
+}
+
+// AddNote adds a note about the selected person, by the user, dated now.
+// Empty text is ignored.
+func (a *App) AddNote(text string) {
+	text = strings.TrimSpace(text)
+	p := a.person()
+	if text == "" || p == nil {
+		a.status = "Empty note, nothing saved"
+		return
+	}
+	n := &db.Note{
+		Person: p,
+		Author: a.policy.User,
+		Text:   text,
+		Date:   a.now().Truncate(time.Second),
+	}
+	if err := a.store.CreateNote(n); err != nil {
+		a.status = fmt.Sprintf("Error saving the note: %s", err)
+		return
+	}
+	if err := a.load(); err != nil {
+		a.status = err.Error()
+		return
+	}
+	a.status = fmt.Sprintf("Added a note about %s", p.Name)
+}
+
+// completeTodo marks the todo under the cursor done.
+func (a *App) completeTodo() {
+	todos := a.todos()
+	if a.focus != paneTodos || len(todos) == 0 {
+		a.status = "Pick a todo with tab first"
+		return
+	}
+	if !a.policy.CanWrite() {
+		a.status = "Viewers can't complete todos"
+		return
+	}
+	t := todos[a.todo]
+	t.Done = true
+	err := a.store.UpdateTodo(t)
+	if err == db.ErrConflict {
+		a.status = "Someone else changed it, try again"
+	} else if err != nil {
+		a.status = fmt.Sprintf("Error completing the todo: %s", err)
+	} else {
+		a.status = fmt.Sprintf("Done: %s", firstLine(t.Text))
+	}
+	if err := a.load(); err != nil {
+		a.status = err.Error()
+	}
+}
+
+// View returns the lines of the screen, width wide and height high,
+// styled with ANSI escapes.
+func (a *App) View(width int, height int) []string {
+	if width < 20 || height < 4 {
+		return []string{"Too small"}
+	}
+	header := "pointyhair"
+	if ws := a.policy.Membership.Workspace; ws != nil && ws.Name != "" {
+		header += " · " + ws.Name
+	}
+	if a.query != "" {
+		header += fmt.Sprintf(" · %d matching %q", len(a.shown), a.query)
+	}
+
+	rows := height - 3
+	people_width := width / 4
+	if people_width > 28 {
+		people_width = 28
+	}
+	rest := width - people_width - 6
+	notes_width := rest * 3 / 5
+	todos_width := rest - notes_width
+	people := a.peopleColumn(people_width, rows)
+	notes := a.notesColumn(notes_width, rows)
+	todos := a.todosColumn(todos_width, rows)
+
+	lines := []string{bold(fit(header, width))}
+	lines = append(lines, underline(fit("People", people_width))+" │ "+
+		underline(fit("Notes", notes_width))+" │ "+underline(fit("Open todos", todos_width)))
+	for i := 0; i < rows; i++ {
+		lines = append(lines, people[i]+" │ "+notes[i]+" │ "+todos[i])
+	}
+
+	var footer string
+	switch {
+	case a.mode == modeSearch:
+		footer = "Search: " + a.input + "▏"
+	case a.mode == modeNote:
+		footer = fmt.Sprintf("Note about %s: %s▏", a.person().Name, a.input)
+	case a.status != "":
+		footer = a.status
+	default:
+		footer = help
+	}
+	return append(lines, fit(footer, width))
+}
+
+// scroll returns the first of count lines to show in rows so cursor is
+// in view.
+func scroll(cursor int, rows int) int {
+	if cursor < rows {
+		return 0
+	}
+	return cursor - rows + 1
+}
+
+func (a *App) peopleColumn(width int, rows int) []string {
+	lines := make([]string, rows)
+	first := scroll(a.selected, rows)
+	for i := range lines {
+		lines[i] = fit("", width)
+		if first+i >= len(a.shown) {
+			continue
+		}
+		p := a.shown[first+i]
+		name := p.Name
+		if len(p.Todos) > 0 {
+			name = fmt.Sprintf("%s (%d)", p.Name, len(p.Todos))
+		}
+		line := fit(name, width)
+		if first+i == a.selected {
+			if a.focus == panePeople {
+				line = reverse(line)
+			} else {
+				line = bold(line)
+			}
+		}
+		lines[i] = line
+	}
+	return lines
+}
+
+func (a *App) notesColumn(width int, rows int) []string {
+	var text []string
+	for _, n := range a.notes() {
+		title := n.Date.Local().Format("Mon 2 Jan 2006")
+		if n.Category != "" {
+			title += " · " + n.Category
+		}
+		if n.Confidential {
+			title += " · confidential"
+		}
+		text = append(text, bold(fit(title, width)))
+		for _, line := range wrap(n.Text, width) {
+			text = append(text, fit(line, width))
+		}
+		text = append(text, fit("", width))
+	}
+	if a.person() != nil && len(text) == 0 {
+		text = append(text, fit("No notes yet", width))
+	}
+	return column(text, width, rows)
+}
+
+func (a *App) todosColumn(width int, rows int) []string {
+	todos := a.todos()
+	now := a.now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	var text []string
+	first := scroll(a.todo, rows)
+	for i, t := range todos {
+		if i < first {
+			continue
+		}
+		mark := " "
+		if t.Date.Before(today) {
+			mark = "!"
+		}
+		line := fit(fmt.Sprintf("%s%s %s", mark, t.Date.Local().Format("Jan 2"), firstLine(t.Text)), width)
+		if i == a.todo && a.focus == paneTodos {
+			line = reverse(line)
+		}
+		text = append(text, line)
+	}
+	if !a.policy.CanReadTodos() {
+		text = []string{fit("Not shown to HR", width)}
+	}
+	return column(text, width, rows)
+}
+
+// column returns the first rows of lines, padded with blank lines to
+// rows.
+func column(lines []string, width int, rows int) []string {
+	if len(lines) > rows {
+		return lines[:rows]
+	}
+	for len(lines) < rows {
+		lines = append(lines, fit("", width))
+	}
+	return lines
+}
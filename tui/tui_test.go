@@ -0,0 +1,153 @@
+package tui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hobeone/pointyhair/api"
+	"github.com/hobeone/pointyhair/db"
+	"github.com/hobeone/pointyhair/db/dbtest"
+)
+
+func failOnError(t testing.TB, err error) {
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+}
+
+func typeKeys(a *App, keys ...string) {
+	for _, k := range keys {
+		a.HandleKey(k)
+	}
+}
+
+func screen(a *App) string {
+	return strings.Join(a.View(120, 20), "\n")
+}
+
+func TestApp(t *testing.T) {
+	store := dbtest.NewFakeStore()
+	owner := &db.User{Name: "owner"}
+	failOnError(t, store.CreateUser(owner))
+	other := &db.User{Name: "other"}
+	failOnError(t, store.CreateUser(other))
+	ws := &db.Workspace{Name: "Team"}
+	failOnError(t, store.CreateWorkspace(ws, owner))
+	failOnError(t, store.SetMember(ws, other, db.RoleViewer))
+	scoped := store.InWorkspace(ws)
+
+	alice := &db.Person{Name: "Alice"}
+	bob := &db.Person{Name: "Bob"}
+	failOnError(t, scoped.CreatePerson(bob))
+	failOnError(t, scoped.CreatePerson(alice))
+	now := time.Now()
+	for _, n := range []*db.Note{
+		{Person: alice, Author: owner, Text: "Talked about the offer", Date: now.AddDate(0, 0, -7)},
+		{Person: alice, Author: other, Text: "Private thoughts", Date: now, Visibility: db.VisibilityPrivate},
+		{Person: bob, Author: owner, Text: "Wants to learn Go", Date: now},
+	} {
+		failOnError(t, scoped.CreateNote(n))
+	}
+	overdue := &db.Todo{Person: alice, Text: "Send the offer", Date: now.AddDate(0, 0, -2)}
+	for _, todo := range []*db.Todo{overdue, {Person: alice, Text: "Already done", Date: now, Done: true}} {
+		failOnError(t, scoped.CreateTodo(todo))
+	}
+	hook := &db.Webhook{Owner: owner, URL: "https://example.com/hook", Events: "note.created"}
+	failOnError(t, scoped.CreateWebhook(hook))
+
+	opened, policy, err := api.OpenWorkspace(store, owner, 0)
+	failOnError(t, err)
+	a, err := New(opened, policy)
+	failOnError(t, err)
+
+	s := screen(a)
+	if !strings.Contains(s, "Team") || strings.Index(s, "Alice") > strings.Index(s, "Bob") {
+		t.Errorf("Expected the workspace's people by name, got\n%s", s)
+	}
+	if !strings.Contains(s, "Talked about the offer") || strings.Contains(s, "Private") {
+		t.Errorf("Expected only the notes the user can read, got\n%s", s)
+	}
+	if !strings.Contains(s, "!"+overdue.Date.Format("Jan 2")+" Send the offer") || strings.Contains(s, "Already done") {
+		t.Errorf("Expected the open todo, marked overdue, got\n%s", s)
+	}
+	for _, line := range a.View(120, 20) {
+		if line != "" && !strings.Contains(line, "\x1b") && len([]rune(line)) != 120 {
+			t.Errorf("Expected every line to be the screen's width, got %q", line)
+		}
+	}
+
+	typeKeys(a, "n", "H", "i", "x", "backspace", "enter")
+	if err := store.LoadPersonRelations(alice); err != nil || len(alice.Notes) != 3 {
+		t.Fatalf("Expected the note to be added, got %+v, %v", alice.Notes, err)
+	}
+	if !strings.Contains(screen(a), "Added a note about Alice") || !strings.Contains(screen(a), "Hi") {
+		t.Errorf("Expected the new note to be shown, got\n%s", screen(a))
+	}
+	if deliveries, err := store.GetDeliveries(hook, 10); err != nil || len(deliveries) != 1 {
+		t.Errorf("Expected the new note to be sent to the webhook, got %+v, %v", deliveries, err)
+	}
+
+	typeKeys(a, "x")
+	if a.status != "Pick a todo with tab first" {
+		t.Errorf("Expected to need to pick a todo, got %q", a.status)
+	}
+	typeKeys(a, "tab", "x")
+	done, err := store.GetTodoById(overdue.Id)
+	if err != nil || !done.Done {
+		t.Fatalf("Expected the todo to be done, got %+v, %v", done, err)
+	}
+	if s := screen(a); strings.Contains(s, "Send the offer") && !strings.Contains(s, "Done: Send the offer") {
+		t.Errorf("Expected the todo to be gone, got\n%s", s)
+	}
+
+	typeKeys(a, "/", "l", "e", "a", "r", "n")
+	if len(a.shown) != 1 || a.person().Id != bob.Id {
+		t.Errorf("Expected only Bob to match, got %+v", a.shown)
+	}
+	typeKeys(a, "enter")
+	if !strings.Contains(screen(a), `1 matching "learn"`) {
+		t.Errorf("Expected the search to be kept, got\n%s", screen(a))
+	}
+	typeKeys(a, "esc")
+	if len(a.shown) != 2 || a.person().Id != bob.Id {
+		t.Errorf("Expected everyone back with Bob still selected, got %+v", a.shown)
+	}
+	if a.HandleKey("q") != ActionQuit || a.HandleKey("e") != ActionEdit {
+		t.Errorf("Expected q to quit and e to edit")
+	}
+
+	opened, policy, err = api.OpenWorkspace(store, other, ws.Id)
+	failOnError(t, err)
+	viewer, err := New(opened, policy)
+	failOnError(t, err)
+	if typeKeys(viewer, "n"); viewer.mode != modeNormal || viewer.status != "Viewers can't add notes" {
+		t.Errorf("Expected viewers not to add notes, got %q", viewer.status)
+	}
+	if !strings.Contains(screen(viewer), "Private thoughts") {
+		t.Errorf("Expected authors to see their private notes, got\n%s", screen(viewer))
+	}
+	if _, _, err := api.OpenWorkspace(store, other, ws.Id+1); err == nil {
+		t.Errorf("Expected an error for a workspace the user isn't in")
+	}
+}
+
+func TestDecodeKeys(t *testing.T) {
+	keys := decodeKeys([]byte("j\x1b[A\x1bOB\x1b\r\t\x7f\x03\x1b[3~é/"))
+	expected := []string{"j", "up", "down", "esc", "enter", "tab", "backspace", "ctrl-c", "é", "/"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	lines := wrap("Agenda\n- [ ] send the offer letter\nsupercalifragilistic", 10)
+	expected := []string{"Agenda", "- [ ] send", "the offer", "letter", "supercalif", "ragilistic"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+	if got := fit("Alice Smith", 6); got != "Alice…" {
+		t.Errorf("Expected the name to be cut short, got %q", got)
+	}
+}